@@ -0,0 +1,419 @@
+// admin.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// adminCommands lists commands available only to admins
+var adminCommands = map[string]bool{
+	"stats":      true,
+	"user":       true,
+	"grant":      true,
+	"revoke":     true,
+	"refund":     true,
+	"resetlimit": true,
+	"broadcast":  true,
+	"usage":      true,
+
+	"addcoach":    true,
+	"removecoach": true,
+	"assign":      true,
+	"unassign":    true,
+}
+
+// AuditEntry is a single record in the admin audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	AdminID  int64     `json:"admin_id"`
+	Action   string    `json:"action"`
+	TargetID int64     `json:"target_id,omitempty"`
+	Success  bool      `json:"success"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// AuditLogger writes admin actions to an append-only JSON lines file
+type AuditLogger struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewAuditLogger creates an audit logger writing to the given file
+func NewAuditLogger(path string) *AuditLogger {
+	return &AuditLogger{path: path}
+}
+
+// Record appends an entry to the audit log
+func (a *AuditLogger) Record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	slog.Info("Admin action",
+		"audit", true,
+		"admin_id", entry.AdminID,
+		"action", entry.Action,
+		"target_id", entry.TargetID,
+		"success", entry.Success,
+		"details", entry.Details)
+
+	if a == nil || a.path == "" {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := appendJSONLine(a.path, entry); err != nil {
+		slog.Error("Error writing audit log", "path", a.path, "error", err)
+	}
+}
+
+// appendJSONLine appends a value as one JSON line to a file
+func appendJSONLine(path string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// parseAdminIDs parses a comma-separated list of Telegram user IDs
+func parseAdminIDs(value string) ([]int64, error) {
+	var ids []int64
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin user ID %q: %v", part, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// isAdmin checks if the user is configured as an admin
+func (b *Bot) isAdmin(userID int64) bool {
+	return b.admins[userID]
+}
+
+// handleAdminCommand processes commands available only to admins
+func (b *Bot) handleAdminCommand(ctx context.Context, message *tgbotapi.Message) {
+	adminID := message.From.ID
+	chatID := message.Chat.ID
+	command := message.Command()
+
+	if !b.isAdmin(adminID) {
+		slog.Warn("Non-admin tried to use admin command", "user_id", adminID, "command", command)
+		b.audit.Record(AuditEntry{AdminID: adminID, Action: command, Success: false, Details: "not an admin"})
+		b.sendText(chatID, "Unknown command. Use /help for assistance.")
+		return
+	}
+
+	if command == "broadcast" {
+		b.startBroadcast(message)
+		return
+	}
+
+	if command == "stats" {
+		b.sendText(chatID, b.formatStats())
+		b.audit.Record(AuditEntry{AdminID: adminID, Action: command, Success: true})
+		return
+	}
+
+	if command == "usage" {
+		report, err := b.formatUsageReport(strings.TrimSpace(message.CommandArguments()))
+		if err != nil {
+			report = fmt.Sprintf("❌ /usage failed: %v", err)
+		}
+		b.sendText(chatID, report)
+		b.audit.Record(AuditEntry{AdminID: adminID, Action: command, Success: err == nil})
+		return
+	}
+
+	if command == "addcoach" || command == "removecoach" || command == "assign" || command == "unassign" {
+		ids, ok := parseCoachCommandArgs(command, message.CommandArguments())
+		if !ok {
+			b.sendText(chatID, coachCommandUsage(command))
+			return
+		}
+		response, err := b.runCoachAdminCommand(adminID, command, ids)
+		entry := AuditEntry{AdminID: adminID, Action: command, TargetID: ids[0], Success: err == nil}
+		if len(ids) > 1 {
+			entry.Details = fmt.Sprintf("coach %d", ids[1])
+		}
+		if err != nil {
+			entry.Details = err.Error()
+			response = fmt.Sprintf("❌ /%s failed: %v", command, err)
+		}
+		b.audit.Record(entry)
+		b.sendText(chatID, response)
+		return
+	}
+
+	targetID, err := strconv.ParseInt(strings.TrimSpace(message.CommandArguments()), 10, 64)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("Usage: /%s <telegram user id>", command))
+		return
+	}
+
+	// The action reads and changes the target's session, so it runs in the
+	// target's queue and replies from there
+	report := func(response string, err error) {
+		entry := AuditEntry{AdminID: adminID, Action: command, TargetID: targetID, Success: err == nil}
+		if err != nil {
+			entry.Details = err.Error()
+			response = fmt.Sprintf("❌ /%s %d failed: %v", command, targetID, err)
+		}
+		b.audit.Record(entry)
+		b.sendText(chatID, response)
+	}
+	queueCtx, cancel := context.WithTimeout(ctx, dispatchWait)
+	defer cancel()
+	err = b.runForUser(queueCtx, targetID, loggerFrom(ctx), func(context.Context) {
+		report(b.runAdminAction(adminID, command, targetID))
+	})
+	if err != nil {
+		report("", err)
+	}
+}
+
+// runAdminAction performs an admin action on the target user's session. It
+// runs in the target's queue.
+func (b *Bot) runAdminAction(adminID int64, command string, targetID int64) (string, error) {
+	session, exists := b.findSession(targetID)
+	if !exists {
+		return b.runStoredUserAction(adminID, command, targetID)
+	}
+
+	switch command {
+	case "user":
+		return b.formatUserInfo(session), nil
+
+	case "grant":
+		if session.State == StateComplete {
+			return "", fmt.Errorf("user already has access")
+		}
+		session.SetPaymentCompleted(fmt.Sprintf("%s%d_%d", adminGrantPrefix, adminID, time.Now().Unix()))
+		b.saveSession(targetID, session)
+		b.sendText(targetID, "🎁 You have been granted access to the personalized workout program! Use /plan to get it.")
+		return fmt.Sprintf("✅ Access granted to user %d", targetID), nil
+
+	case "revoke":
+		if session.State != StateComplete {
+			return "", fmt.Errorf("user has no access to revoke")
+		}
+		session.RevokePayment()
+		b.saveSession(targetID, session)
+		return fmt.Sprintf("✅ Access revoked for user %d", targetID), nil
+
+	case "refund":
+		if session.State != StateComplete || session.Data.PaymentID == "" {
+			return "", fmt.Errorf("user has no completed payment")
+		}
+		refundID, err := b.refundPayment(targetID, session.Data.PaymentID)
+		if err != nil {
+			return "", err
+		}
+		session.RevokePayment()
+		b.saveSession(targetID, session)
+		b.sendText(targetID, "💸 Your payment has been refunded. Use /start if you want to create a program again.")
+		return fmt.Sprintf("✅ Refund %s created for user %d, access revoked", refundID, targetID), nil
+
+	case "resetlimit":
+		session.MessageCount = 0
+		if b.limiter != nil {
+			b.limiter.Reset(targetID)
+		}
+		b.saveSession(targetID, session)
+		return fmt.Sprintf("✅ Message limit reset for user %d", targetID), nil
+	}
+
+	return "", fmt.Errorf("unknown admin command: %s", command)
+}
+
+// runStoredUserAction performs an admin action on a user without a session,
+// e.g. after a restart, using their persisted payment record. It runs in the
+// target's queue.
+func (b *Bot) runStoredUserAction(adminID int64, command string, targetID int64) (string, error) {
+	paid, found, err := firstPayment(b.store, targetID)
+	if err != nil {
+		return "", fmt.Errorf("reading the payment record: %w", err)
+	}
+
+	switch command {
+	case "user":
+		return b.formatStoredUserInfo(targetID, paid, found), nil
+
+	case "grant":
+		// Access without the questionnaire answers gives the user no plan
+		return "", fmt.Errorf("user %d has no session since the last restart; ask them to send /start and fill in the questionnaire, then grant access", targetID)
+
+	case "revoke":
+		// Sessions aren't persisted, so access ended with the restart
+		return fmt.Sprintf("✅ User %d has no session since the last restart, so they have no access to revoke", targetID), nil
+
+	case "refund":
+		if !found || paid.Refunded {
+			return "", fmt.Errorf("user %d has no session since the last restart and no recorded payment to refund", targetID)
+		}
+		refundID, err := b.refundPayment(targetID, paid.LastPayment())
+		if err != nil {
+			return "", err
+		}
+		b.sendText(targetID, "💸 Your payment has been refunded. Use /start if you want to create a program again.")
+		return fmt.Sprintf("✅ Refund %s created for user %d, who has no session since the last restart and so no access", refundID, targetID), nil
+
+	case "resetlimit":
+		if b.limiter != nil {
+			b.limiter.Reset(targetID)
+		}
+		return fmt.Sprintf("✅ Rate limits reset for user %d, who has no session since the last restart and so no message count", targetID), nil
+	}
+
+	return "", fmt.Errorf("unknown admin command: %s", command)
+}
+
+// refundPayment refunds a Stripe payment of the user and records the refund
+func (b *Bot) refundPayment(userID int64, paymentID string) (string, error) {
+	if !stripePayment(paymentID) {
+		return "", fmt.Errorf("access was not paid through Stripe (%s), there is no payment to refund; use /revoke instead", paymentID)
+	}
+	refundID, err := b.payments.Refund(paymentID)
+	if err != nil {
+		return "", err
+	}
+
+	b.paymentMutex.Lock()
+	defer b.paymentMutex.Unlock()
+	if err := recordRefund(b.store, userID, paymentID); err != nil {
+		slog.Error("Error recording refund", "user_id", userID, "refund_id", refundID, "error", err)
+	}
+	return refundID, nil
+}
+
+// formatStats returns aggregated statistics about user sessions
+func (b *Bot) formatStats() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var questionnaire, payment, complete, blocked, messages int
+	for _, session := range b.snapshots {
+		if session.BlockedBot {
+			blocked++
+		}
+		switch {
+		case session.State == StateComplete:
+			complete++
+		case session.State == StatePayment:
+			payment++
+		case session.State > StateInitial:
+			questionnaire++
+		}
+		messages += session.MessageCount
+	}
+
+	return fmt.Sprintf("📈 *Bot statistics*\n\n"+
+		"• Total users: %d\n"+
+		"• Filling the questionnaire: %d\n"+
+		"• Waiting for payment: %d\n"+
+		"• Paid: %d\n"+
+		"• Blocked the bot: %d\n"+
+		"• Messages in current sessions: %d",
+		len(b.snapshots), questionnaire, payment, complete, blocked, messages)
+}
+
+// formatUserInfo returns a description of the user's session for admins
+func (b *Bot) formatUserInfo(session *UserSession) string {
+	paymentID := session.Data.PaymentID
+	if paymentID == "" {
+		paymentID = "none"
+	}
+
+	return fmt.Sprintf("👤 User %d\n\n"+
+		"• State: %s\n"+
+		"• Session created: %s\n"+
+		"• Messages: %d\n"+
+		"• Payment: %s\n"+
+		"• OpenAI usage: %s\n"+
+		"• Last plan: %s\n"+
+		"• Referral: %s\n\n%s",
+		session.UserID, session.State, session.CreatedAt.Format(time.RFC3339),
+		session.MessageCount, paymentID, b.formatUsageLine(session.UserID), b.formatLastPlan(session.UserID),
+		b.formatReferralLine(session.UserID), session.Data.FormatUserDataBeautifully())
+}
+
+// formatStoredUserInfo describes a user without a session from their persisted records
+func (b *Bot) formatStoredUserInfo(userID int64, paid PaidUser, found bool) string {
+	payment := "none"
+	if found {
+		payment = fmt.Sprintf("%s on %s", paid.LastPayment(), paid.LastPaidAt.Format(time.RFC3339))
+		if paid.LastPaidAt.IsZero() {
+			payment = fmt.Sprintf("%s on %s", paid.FirstSessionID, paid.FirstPaidAt.Format(time.RFC3339))
+		}
+		if paid.Refunded {
+			payment += ", refunded"
+		}
+	}
+
+	return fmt.Sprintf("👤 User %d\n\n"+
+		"• Session: none since the last restart\n"+
+		"• Payment: %s\n"+
+		"• OpenAI usage: %s\n"+
+		"• Last plan: %s\n"+
+		"• Referral: %s",
+		userID, payment, b.formatUsageLine(userID), b.formatLastPlan(userID), b.formatReferralLine(userID))
+}
+
+// formatLastPlan describes the user's latest plan and the prompt that produced it
+func (b *Bot) formatLastPlan(userID int64) string {
+	plan, ok := b.lastPlan(userID)
+	if !ok {
+		return "none"
+	}
+	source := plan.PromptVersion
+	if plan.Fallback {
+		source = "offline generator"
+	}
+	return fmt.Sprintf("%s (%s)", plan.CreatedAt.Format(time.RFC3339), source)
+}
+
+// sortedAdminIDs returns admin IDs in ascending order for logging
+func (b *Bot) sortedAdminIDs() []int64 {
+	ids := make([]int64, 0, len(b.admins))
+	for id := range b.admins {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// sendText sends a plain text message and logs errors
+func (b *Bot) sendText(chatID int64, text string) {
+	_, err := b.api.Send(tgbotapi.NewMessage(chatID, text))
+	if err != nil {
+		slog.Error("Error sending message", "chat_id", chatID, "error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// forgetSession drops the user's session as a restart does, keeping the store
+func forgetSession(h *Harness, userID int64) {
+	h.Bot.mutex.Lock()
+	defer h.Bot.mutex.Unlock()
+	delete(h.Bot.sessions, userID)
+	delete(h.Bot.snapshots, userID)
+}
+
+// adminCommand sends an admin command and waits for the reply containing expect
+func adminCommand(h *Harness, command, expect string) error {
+	if err := h.Send(harnessAdminID, command); err != nil {
+		return err
+	}
+	_, err := h.Expect(harnessAdminID, expect, e2eWait)
+	return err
+}
+
+func TestAdminActionsWithoutSession(t *testing.T) {
+	h := NewHarness(t, e2eResponses...)
+	const user = 160
+	if err := completeQuestionnaire(h, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+		t.Fatal(err)
+	}
+	forgetSession(h, user)
+
+	steps := []struct{ command, expect string }{
+		{"/user %d", "Session: none since the last restart"},
+		{"/grant %d", "ask them to send /start"},
+		{"/revoke %d", "no access to revoke"},
+		{"/resetlimit %d", "Rate limits reset"},
+		{"/refund %d", "Refund re_test_1 created"},
+		{"/user %d", "refunded"},
+		{"/refund %d", "no recorded payment to refund"}, // Not refunded twice
+	}
+	for _, step := range steps {
+		command := fmt.Sprintf(step.command, user)
+		if err := adminCommand(h, command, step.expect); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	if _, err := h.Expect(user, "Your payment has been refunded", e2eWait); err != nil {
+		t.Fatal(err)
+	}
+	if refunds := h.Stripe.Refunds(); len(refunds) != 1 || !strings.HasPrefix(refunds[0], "pi_") {
+		t.Errorf("refunds = %v, want one", refunds)
+	}
+	if _, exists := h.Bot.sessionSnapshot(user); exists {
+		t.Error("admin commands created a session")
+	}
+}
+
+func TestAdminRefundIsRecorded(t *testing.T) {
+	h := NewHarness(t, e2eResponses...)
+	const user = 161
+	if err := completeQuestionnaire(h, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refund with a session is remembered after a restart
+	if err := adminCommand(h, fmt.Sprintf("/refund %d", user), "Refund re_test_1 created"); err != nil {
+		t.Fatal(err)
+	}
+	forgetSession(h, user)
+	// Another command first, as repeating a command at once is ignored
+	if err := adminCommand(h, fmt.Sprintf("/user %d", user), "refunded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := adminCommand(h, fmt.Sprintf("/refund %d", user), "no recorded payment to refund"); err != nil {
+		t.Fatal(err)
+	}
+	if refunds := h.Stripe.Refunds(); len(refunds) != 1 {
+		t.Errorf("refunds = %v, want one", refunds)
+	}
+
+	// A user who never wrote has nothing to show
+	if err := adminCommand(h, "/user 162", "Payment: none"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,9 +2,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,72 +16,186 @@ import (
 
 // Global variable for tracking processed updates
 var processedUpdates = make(map[int]bool)
-var processedMutex sync.RWMutex
+var processedMutex sync.Mutex
 
 // Bot represents a telegram bot
 type Bot struct {
-	api          *tgbotapi.BotAPI
-	openAIClient *OpenAIClient
-	sessions     map[int64]*UserSession
-	mutex        sync.RWMutex
+	api       *tgbotapi.BotAPI
+	providers map[UsageFeature]LLMProvider
+	// Live sessions, only touched by jobs in the user's dispatcher queue
+	sessions map[int64]*UserSession
+	// Copies of the sessions for everything else, published by the user's jobs
+	snapshots map[int64]UserSession
+	mutex     sync.RWMutex
 	// For tracking the last /start command for each user
 	lastStartTime map[int64]time.Time
+	// Telegram user IDs allowed to use admin commands
+	admins  map[int64]bool
+	audit   *AuditLogger
+	limiter *RateLimiter
+	usage   *UsageTracker
+	prompts *PromptStore
+	store   Store
+	// Medical red-flag screening of questions and answers
+	safety    *SafetyScreener
+	incidents *IncidentLogger
+	// Per-user ordered processing of updates
+	dispatcher *Dispatcher
+	// In-flight work, waited for on shutdown
+	life     *lifecycle
+	config   *Config
+	payments *Payments
+	// Serializes claims of checkout sessions in the payments bucket
+	paymentMutex sync.Mutex
+	// Bot API client, tracking the last successful poll for readiness
+	telegram *pollRecorder
+	// Speech-to-text for voice messages, nil if disabled
+	transcriber Transcriber
+	referrals   *ReferralProgram
 }
 
-// NewBot creates a new telegram bot
-func NewBot(token string, openAIClient *OpenAIClient) (*Bot, error) {
-	api, err := tgbotapi.NewBotAPI(token)
+// BotDeps are the services a Bot is built from
+type BotDeps struct {
+	Providers   map[UsageFeature]LLMProvider
+	Prompts     *PromptStore
+	Audit       *AuditLogger
+	Limiter     *RateLimiter
+	Usage       *UsageTracker
+	Store       Store
+	Safety      *SafetyScreener
+	Incidents   *IncidentLogger
+	Dispatcher  *Dispatcher
+	Payments    *Payments // Created from the config if nil
+	Transcriber Transcriber
+	Referrals   *ReferralProgram // Created from the config and store if nil
+}
+
+// NewBot creates a new telegram bot talking to the Bot API at config.TelegramAPIEndpoint
+func NewBot(config *Config, deps BotDeps) (*Bot, error) {
+	telegram := &pollRecorder{next: &http.Client{}}
+	api, err := tgbotapi.NewBotAPIWithClient(config.TelegramToken, config.TelegramAPIEndpoint, telegram)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Authorized bot: %s", api.Self.UserName)
+	slog.Info("Authorized bot", "username", api.Self.UserName)
+
+	payments := deps.Payments
+	if payments == nil {
+		payments = NewPayments(config, nil)
+	}
 
-	// Initialize Stripe
-	InitStripe()
+	referrals := deps.Referrals
+	if referrals == nil {
+		referrals = NewReferralProgram(deps.Store, config.Referrals)
+	}
+
+	admins := make(map[int64]bool)
+	for _, id := range config.AdminIDs {
+		admins[id] = true
+	}
 
-	return &Bot{
+	bot := &Bot{
 		api:           api,
-		openAIClient:  openAIClient,
+		providers:     deps.Providers,
 		sessions:      make(map[int64]*UserSession),
+		snapshots:     make(map[int64]UserSession),
 		mutex:         sync.RWMutex{},
 		lastStartTime: make(map[int64]time.Time),
-	}, nil
+		admins:        admins,
+		audit:         deps.Audit,
+		limiter:       deps.Limiter,
+		usage:         deps.Usage,
+		prompts:       deps.Prompts,
+		store:         deps.Store,
+		safety:        deps.Safety,
+		incidents:     deps.Incidents,
+		dispatcher:    deps.Dispatcher,
+		life:          newLifecycle(),
+		config:        config,
+		payments:      payments,
+		telegram:      telegram,
+		transcriber:   deps.Transcriber,
+		referrals:     referrals,
+	}
+	slog.Info("Admin users configured", "admin_ids", bot.sortedAdminIDs())
+
+	return bot, nil
 }
 
-// Start begins processing messages
+// Start receives updates by long polling
 func (b *Bot) Start() {
+	// Telegram refuses getUpdates while a webhook is registered
+	if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		slog.Error("Error removing Telegram webhook", "error", err)
+	}
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
+	b.life.polling.Store(true)
 	updates := b.api.GetUpdatesChan(u)
 
-	log.Printf("Bot started listening for messages")
+	slog.Info("Bot started listening for messages", "mode", UpdateModePolling)
 	for update := range updates {
-		// Check for duplicate updates
-		processedMutex.RLock()
-		_, exists := processedUpdates[update.UpdateID]
-		processedMutex.RUnlock()
-
-		if exists {
-			log.Printf("Skipping duplicate update ID: %d", update.UpdateID)
-			continue
-		}
+		// A full queue stops polling until there is room again. Updates refused
+		// during shutdown aren't confirmed and come again after a restart.
+		_ = b.dispatchUpdate(context.Background(), update)
+	}
+}
 
-		// Mark update as processed
-		processedMutex.Lock()
-		processedUpdates[update.UpdateID] = true
-		processedMutex.Unlock()
+// dispatchUpdate queues an update for its handler, skipping duplicates. It
+// waits for room in the queue until ctx is done and fails during shutdown.
+func (b *Bot) dispatchUpdate(ctx context.Context, update tgbotapi.Update) error {
+	// Check for duplicate updates and mark the update as processed in one
+	// step, webhook requests arrive concurrently
+	processedMutex.Lock()
+	_, exists := processedUpdates[update.UpdateID]
+	processedUpdates[update.UpdateID] = true
+	count := len(processedUpdates)
+	processedMutex.Unlock()
+
+	if exists {
+		slog.Debug("Skipping duplicate update", "update_id", update.UpdateID)
+		return nil
+	}
+
+	// Clean old updates every 100 messages
+	if count > 100 {
+		go b.cleanOldUpdates()
+	}
 
-		// Clean old updates every 100 messages
-		if len(processedUpdates) > 100 {
-			go b.cleanOldUpdates()
+	// Every update gets a logger tagged with its ID for correlation
+	logger := slog.With("update_id", update.UpdateID)
+
+	var userID int64
+	var handle func(ctx context.Context)
+	switch {
+	case update.Message != nil:
+		userID = update.Message.Chat.ID
+		if update.Message.From != nil {
+			userID = update.Message.From.ID
 		}
+		handle = func(ctx context.Context) { b.handleMessage(ctx, update.Message) }
+	case update.CallbackQuery != nil:
+		userID = update.CallbackQuery.From.ID
+		handle = func(ctx context.Context) { b.handleCallback(ctx, update.CallbackQuery) }
+	default:
+		return nil
+	}
 
-		if update.Message != nil {
-			go b.handleMessage(update.Message)
-		} else if update.CallbackQuery != nil {
-			go b.handleCallback(update.CallbackQuery)
+	// Each user's updates run in order, so handlers never share a session
+	if err := b.runForUser(ctx, userID, logger, handle); err != nil {
+		processedMutex.Lock()
+		delete(processedUpdates, update.UpdateID)
+		processedMutex.Unlock()
+		logger.Warn("Refusing update", "user_id", userID, "reason", err)
+		return err
+	}
+	for {
+		last := b.life.lastUpdateID.Load()
+		if int64(update.UpdateID) <= last || b.life.lastUpdateID.CompareAndSwap(last, int64(update.UpdateID)) {
+			return nil
 		}
 	}
 }
@@ -93,33 +208,88 @@ func (b *Bot) cleanOldUpdates() {
 	// Keep only the last 50 updates
 	if len(processedUpdates) > 50 {
 		processedUpdates = make(map[int]bool)
-		log.Printf("Processed updates cache cleared")
+		slog.Debug("Processed updates cache cleared")
 	}
 }
 
-// getSession returns the user's session
+// runForUser queues f after the user's pending updates, so it never runs
+// concurrently with the user's handlers, and publishes the user's session
+// when f is done. Anything changing a session goes through it. It fails if
+// the queue stays full until ctx is done or the bot is shutting down.
+func (b *Bot) runForUser(ctx context.Context, userID int64, logger *slog.Logger, f func(ctx context.Context)) error {
+	if !b.life.begin() {
+		return ErrShuttingDown
+	}
+	err := b.dispatcher.Submit(ctx, userID, func() {
+		defer b.life.end()
+		defer b.publishSession(userID)
+		f(withLogger(b.life.ctx, logger))
+	})
+	if err != nil {
+		b.life.end()
+	}
+	return err
+}
+
+// getSession returns the user's session. Only jobs run by runForUser for the
+// user may call it.
 func (b *Bot) getSession(userID int64) *UserSession {
-	b.mutex.RLock()
-	session, exists := b.sessions[userID]
-	b.mutex.RUnlock()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
+	session, exists := b.sessions[userID]
 	if !exists {
 		session = NewUserSession(userID)
-		b.mutex.Lock()
 		b.sessions[userID] = session
-		b.mutex.Unlock()
-		log.Printf("Created new session for user %d", userID)
+		slog.Info("Created new session", "user_id", userID)
 	}
-
 	return session
 }
 
+// findSession returns the user's session without creating a new one. Only
+// jobs run by runForUser for the user may call it.
+func (b *Bot) findSession(userID int64) (*UserSession, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	session, exists := b.sessions[userID]
+	return session, exists
+}
+
 // saveSession saves the user's session
 func (b *Bot) saveSession(userID int64, session *UserSession) {
 	b.mutex.Lock()
 	b.sessions[userID] = session
+	b.snapshots[userID] = copySession(session)
 	b.mutex.Unlock()
-	log.Printf("Saved session for user %d in state %d", userID, session.State)
+	slog.Debug("Saved session", "user_id", userID, "state", session.State.String())
+}
+
+// publishSession copies the user's session for readers outside the user's jobs
+func (b *Bot) publishSession(userID int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if session, exists := b.sessions[userID]; exists {
+		b.snapshots[userID] = copySession(session)
+	}
+}
+
+// sessionSnapshot returns a copy of the user's session as of the end of their
+// last job. It is safe to call from anywhere.
+func (b *Bot) sessionSnapshot(userID int64) (UserSession, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	session, exists := b.snapshots[userID]
+	return session, exists
+}
+
+// copySession copies a session so the copy shares nothing with it
+func copySession(session *UserSession) UserSession {
+	snapshot := *session
+	if session.CheckIn != nil {
+		draft := *session.CheckIn
+		snapshot.CheckIn = &draft
+	}
+	return snapshot
 }
 
 // sendMessageWithKeyboard sends a message with a keyboard
@@ -137,41 +307,64 @@ func (b *Bot) sendMessageWithKeyboard(chatID int64, text string, keyboard *tgbot
 	return sentMsg.MessageID, nil
 }
 
-func (b *Bot) handleCallback(callback *tgbotapi.CallbackQuery) {
+// callbackAction is the prefix of callback data, e.g. "dia" of "dia:yes". Only
+// the prefix is logged because the values contain the user's answers.
+func callbackAction(data string) string {
+	action, _, _ := strings.Cut(data, ":")
+	return action
+}
+
+func (b *Bot) handleCallback(ctx context.Context, callback *tgbotapi.CallbackQuery) {
 	userID := callback.From.ID
 	chatID := callback.Message.Chat.ID
 
-	log.Printf("Received callback from %s (%d): %s", callback.From.UserName, userID, callback.Data)
+	logger := loggerFrom(ctx).With("user_id", userID)
+	ctx = withLogger(ctx, logger)
+	logger.Info("Received callback", "action", callbackAction(callback.Data))
+	updatesTotal.WithLabelValues("callback_query").Inc()
 
 	// First, respond to the callback to remove the loading clock
 	b.api.Request(tgbotapi.NewCallback(callback.ID, ""))
 
+	// Broadcast confirmation buttons do not belong to the user's dialog
+	if strings.HasPrefix(callback.Data, CallbackBroadcast) {
+		b.handleBroadcastCallback(callback)
+		return
+	}
+
 	// Get user session
 	session := b.getSession(userID)
 
 	// Check for duplicate callback
 	if session.CheckDuplicateCallback(callback.Data) {
-		log.Printf("Skipping duplicate callback: %s from user %d", callback.Data, userID)
+		logger.Info("Skipping duplicate callback", "action", callbackAction(callback.Data))
 		return
 	}
 
-	// Special handling for "pay" button
+	// Check rate limits (admins are not limited)
+	feature := FeatureQuestionnaire
 	if callback.Data == "pay" {
-		// Create payment link
-		paymentURL, err := CreatePayment(userID)
-		if err != nil {
-			log.Printf("Error creating payment link: %v", err)
-			errorMsg := fmt.Sprintf("An error occurred while creating payment: %v", err)
-			b.api.Send(tgbotapi.NewMessage(chatID, errorMsg))
-			return
-		}
+		feature = FeaturePayments
+	}
+	if !b.checkRateLimit(ctx, chatID, session, feature) {
+		return
+	}
 
-		// Send the link to the user
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("To make a payment, follow this link: %s", paymentURL))
-		_, err = b.api.Send(msg)
-		if err != nil {
-			log.Printf("Error sending payment link: %v", err)
-		}
+	// Weekly check-in answers don't change the questionnaire state
+	if strings.HasPrefix(callback.Data, CallbackCheckIn) {
+		b.handleCheckInCallback(ctx, callback, session)
+		return
+	}
+
+	// Exercise suggestions open the library entry
+	if strings.HasPrefix(callback.Data, CallbackExercise) {
+		b.sendExerciseByID(chatID, strings.TrimPrefix(callback.Data, CallbackExercise))
+		return
+	}
+
+	// Special handling for "pay" button
+	if callback.Data == "pay" {
+		b.sendPaymentLink(ctx, chatID, userID)
 		return
 	}
 
@@ -179,28 +372,15 @@ func (b *Bot) handleCallback(callback *tgbotapi.CallbackQuery) {
 	choiceText := getUserFriendlyChoice(callback.Data)
 
 	// Process button click
+	previousState := session.State
 	response, err := session.ProcessButtonCallback(callback.Data)
+	observeTransition(previousState, session.State)
 	if err != nil {
-		log.Printf("Error processing callback: %v", err)
+		logger.Error("Error processing callback", "error", err)
 		b.api.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("An error occurred. Please try again. (%v)", err)))
 		return
 	}
 
-	// If this is the /pay command, process it separately
-	if response == "/pay" {
-		paymentLink, err := CreatePayment(userID)
-		if err != nil {
-			errorMsg := fmt.Sprintf("An error occurred while creating payment: %v", err)
-			b.api.Send(tgbotapi.NewMessage(chatID, errorMsg))
-			return
-		}
-
-		payMsg := fmt.Sprintf("To make a payment, follow this link: %s", paymentLink)
-		b.api.Send(tgbotapi.NewMessage(chatID, payMsg))
-		b.saveSession(userID, session)
-		return
-	}
-
 	// Remove the old keyboard from the previous message
 	if callback.Message != nil {
 		editMsg := tgbotapi.NewEditMessageText(
@@ -213,15 +393,15 @@ func (b *Bot) handleCallback(callback *tgbotapi.CallbackQuery) {
 		}
 		_, err := b.api.Send(editMsg)
 		if err != nil {
-			log.Printf("Error editing message: %v", err)
+			logger.Error("Error editing message", "error", err)
 		}
 	}
 
 	// Send the next question with a keyboard
-	keyboard := session.GetKeyboardForState()
+	keyboard := b.keyboardForState(session)
 	messageID, err := b.sendMessageWithKeyboard(chatID, response, keyboard)
 	if err != nil {
-		log.Printf("Error sending message with keyboard: %v", err)
+		logger.Error("Error sending message with keyboard", "error", err)
 	} else {
 		session.LastMessageID = messageID
 	}
@@ -242,12 +422,18 @@ func getUserFriendlyChoice(data string) string {
 	if data[:4] == "sex:" {
 		prefix = CallbackSex
 		value = data[4:]
+	} else if data[:4] == "unt:" {
+		prefix = CallbackUnits
+		value = data[4:]
 	} else if data[:4] == "dia:" {
 		prefix = CallbackDiabetes
 		value = data[4:]
 	} else if data[:4] == "lvl:" {
 		prefix = CallbackLevel
 		value = data[4:]
+	} else if data[:4] == "act:" {
+		prefix = CallbackActivity
+		value = data[4:]
 	} else if data[:4] == "gol:" {
 		prefix = CallbackGoal
 		value = data[4:]
@@ -265,6 +451,12 @@ func getUserFriendlyChoice(data string) string {
 			"female": "Female",
 		}[value]
 
+	case CallbackUnits:
+		return map[string]string{
+			"metric":   "Metric (cm, kg)",
+			"imperial": "Imperial (ft/in, lb)",
+		}[value]
+
 	case CallbackDiabetes:
 		return map[string]string{
 			"yes": "Yes",
@@ -278,6 +470,15 @@ func getUserFriendlyChoice(data string) string {
 			"advanced":     "Advanced",
 		}[value]
 
+	case CallbackActivity:
+		return map[string]string{
+			"sedentary":   "Sedentary",
+			"light":       "Lightly active",
+			"moderate":    "Moderately active",
+			"active":      "Very active",
+			"very_active": "Extremely active",
+		}[value]
+
 	case CallbackGoal:
 		return map[string]string{
 			"weight_loss": "Weight Loss",
@@ -300,6 +501,60 @@ func getUserFriendlyChoice(data string) string {
 	return data
 }
 
+// rateFeatureForMessage returns the rate-limited feature a message belongs to
+func rateFeatureForMessage(session *UserSession, message *tgbotapi.Message) RateFeature {
+	switch {
+	case message.IsCommand() && message.Command() == "pay":
+		return FeaturePayments
+	case len(message.Photo) > 0:
+		return FeaturePhoto
+	case !message.IsCommand() && session.State == StateComplete:
+		return FeatureQA
+	default:
+		return FeatureQuestionnaire
+	}
+}
+
+// checkRateLimit takes a token from the user's limit and notifies the user if none is left
+func (b *Bot) checkRateLimit(ctx context.Context, chatID int64, session *UserSession, feature RateFeature) bool {
+	if b.isAdmin(session.UserID) || b.limiter == nil {
+		return true
+	}
+
+	tier := tierForSession(session)
+	allowed, wait := b.limiter.Allow(session.UserID, tier, feature)
+	if allowed {
+		return true
+	}
+
+	// Credits earned by inviting friends answer questions beyond the limit
+	if feature == FeatureQA && b.referrals.UseCredit(session.UserID) {
+		referralEventsTotal.WithLabelValues("credit_used").Inc()
+		loggerFrom(ctx).Info("Used referral credit beyond rate limit", "tier", tier)
+		return true
+	}
+
+	loggerFrom(ctx).Info("Rate limit exceeded", "feature", feature, "tier", tier, "retry_in", wait)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("You are sending requests too often. Please try again in %s.", formatWait(wait)))
+	if _, err := b.api.Send(msg); err != nil {
+		loggerFrom(ctx).Error("Error sending limit message", "error", err)
+	}
+	return false
+}
+
+// checkUsageQuota checks the user's monthly OpenAI quota and notifies the user if it is used up
+func (b *Bot) checkUsageQuota(ctx context.Context, chatID, userID int64) bool {
+	if b.isAdmin(userID) || b.usage.WithinQuota(userID) {
+		return true
+	}
+
+	loggerFrom(ctx).Info("Monthly usage quota exceeded", "user_id", userID)
+	b.sendText(chatID, fmt.Sprintf("You have used up your monthly limit of AI answers. "+
+		"It renews on %s. Your workout program stays available in this chat in the meantime.",
+		b.usage.QuotaResetDate().Format("January 2")))
+	return false
+}
+
 // checkStartCommand checks if the /start command can be processed
 func (b *Bot) checkStartCommand(userID int64) bool {
 	b.mutex.Lock()
@@ -318,22 +573,44 @@ func (b *Bot) checkStartCommand(userID int64) bool {
 }
 
 // handleMessage processes incoming messages
-func (b *Bot) handleMessage(message *tgbotapi.Message) {
+func (b *Bot) handleMessage(ctx context.Context, message *tgbotapi.Message) {
 	userID := message.From.ID
 	chatID := message.Chat.ID
 
-	log.Printf("Received message from %s (%d): %s", message.From.UserName, userID, message.Text)
+	logger := loggerFrom(ctx).With("user_id", userID)
+	ctx = withLogger(ctx, logger)
+	logger.Info("Received message", "command", message.Command(), "text_length", len(message.Text))
+	observeMessage(message)
 
 	// Get user session
 	session := b.getSession(userID)
 
-	// Check message limit
-	if !session.IncrementMessageCount() {
-		msg := tgbotapi.NewMessage(chatID, "You have reached the message limit. Please try again later.")
-		_, err := b.api.Send(msg)
-		if err != nil {
-			log.Printf("Error sending limit message: %v", err)
+	// A message from the user means they have unblocked the bot
+	session.BlockedBot = false
+
+	// Check rate limits (admins are not limited)
+	session.IncrementMessageCount()
+	if !b.checkRateLimit(ctx, chatID, session, rateFeatureForMessage(session, message)) {
+		return
+	}
+
+	// Voice messages continue as the text they contain
+	if message.Voice != nil {
+		text, ok := b.transcribeVoice(ctx, message)
+		if !ok {
+			return
 		}
+		message.Text = text
+	}
+
+	// A coach's reply to a forwarded question goes back to the client
+	if !message.IsCommand() && b.relayCoachReply(message) {
+		return
+	}
+
+	// Meal photos are checked against the user's targets
+	if len(message.Photo) > 0 {
+		b.handlePhoto(ctx, message, session)
 		return
 	}
 
@@ -341,7 +618,19 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 	if message.IsCommand() {
 		// Check for duplicate command
 		if session.CheckDuplicateCommand(message.Text) {
-			log.Printf("Skipping duplicate command: %s from user %d", message.Text, userID)
+			logger.Info("Skipping duplicate command", "command", message.Command())
+			return
+		}
+
+		// Admin commands are checked for permissions separately
+		if adminCommands[message.Command()] {
+			b.handleAdminCommand(ctx, message)
+			return
+		}
+
+		// Plans link their exercises as /ex_<id>
+		if id, ok := strings.CutPrefix(message.Command(), exerciseCommandPrefix); ok {
+			b.sendExerciseByID(chatID, id)
 			return
 		}
 
@@ -349,21 +638,27 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 		case "start":
 			// Additional check for duplicate /start
 			if !b.checkStartCommand(userID) {
-				log.Printf("Skipping duplicate command /start from user %d", userID)
+				logger.Info("Skipping duplicate /start command")
 				return
 			}
 
-			// Create a new session
+			// Invite links start the bot with /start ref_<code>
+			b.attributeReferral(chatID, session, message.CommandArguments())
+
+			// Create a new session, keeping the unit preference
+			units := session.Data.Units
 			session = NewUserSession(userID)
+			session.Data.Units = units
 			b.saveSession(userID, session)
 
 			// Start dialog
 			response, _ := session.ProcessInput("")
-			keyboard := session.GetKeyboardForState() // Get keyboard for current state
+			observeTransition(StateInitial, session.State)
+			keyboard := b.keyboardForState(session) // Get keyboard for current state
 
 			messageID, err := b.sendMessageWithKeyboard(chatID, response, keyboard)
 			if err != nil {
-				log.Printf("Error sending message: %v", err)
+				logger.Error("Error sending message", "error", err)
 			} else {
 				session.LastMessageID = messageID
 				b.saveSession(userID, session)
@@ -371,10 +666,42 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 			return
 
 		case "help":
-			msg := tgbotapi.NewMessage(chatID, "I will help create a personalized workout program based on your data. Use /start to begin.")
+			msg := tgbotapi.NewMessage(chatID, "I will help create a personalized workout program based on your data. Use /start to begin.\n\nOnce your program is ready, send me a photo of your meal to check it against your calorie targets. You can also ask your questions with voice messages. If you have a personal coach, use /coach followed by your question to ask them.\n\nEach week, use /log to record your workouts and /checkin to get your next week's program. Use /exercise followed by a name, e.g. /exercise glute bridge, to learn how to do an exercise.\n\nUse /invite to get a link for friends and earn rewards.\n\nUse /units to switch between metric and imperial units.")
 			_, err := b.api.Send(msg)
 			if err != nil {
-				log.Printf("Error sending message: %v", err)
+				logger.Error("Error sending message", "error", err)
+			}
+			return
+
+		case "checkin":
+			b.startCheckIn(ctx, chatID, session)
+			return
+
+		case "log":
+			b.logWorkout(message, session)
+			return
+
+		case "invite":
+			b.sendInvite(chatID, userID)
+			return
+
+		case "exercise":
+			b.lookupExercise(chatID, message.CommandArguments())
+			return
+
+		case "coach":
+			b.askCoach(message)
+			return
+
+		case "clients":
+			b.sendClientRoster(message)
+			return
+
+		case "units":
+			text := fmt.Sprintf("Current units: %s. Choose your preferred units:", session.Data.UnitsLabel())
+			_, err := b.sendMessageWithKeyboard(chatID, text, unitsKeyboard())
+			if err != nil {
+				logger.Error("Error sending message", "error", err)
 			}
 			return
 
@@ -383,39 +710,35 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 				msg := tgbotapi.NewMessage(chatID, "Please first fill in your information using the /start command")
 				_, err := b.api.Send(msg)
 				if err != nil {
-					log.Printf("Error sending message: %v", err)
+					logger.Error("Error sending message", "error", err)
 				}
 				return
 			}
 
-			response, err := session.ProcessInput("/pay")
-			msg := tgbotapi.NewMessage(chatID, response)
-			_, err = b.api.Send(msg)
-			if err != nil {
-				log.Printf("Error sending message: %v", err)
-			}
+			b.sendPaymentLink(ctx, chatID, userID)
 			return
 
 		case "complete_payment":
-			// Debug command for manual payment completion
-			if os.Getenv("ENABLE_DEBUG_COMMANDS") == "true" {
+			// Debug command for manual payment completion, available only to admins
+			if b.config.DebugCommands && b.isAdmin(userID) {
 				if session.State != StatePayment {
 					msg := tgbotapi.NewMessage(chatID, "This command only works if you are at the payment stage")
 					_, err := b.api.Send(msg)
 					if err != nil {
-						log.Printf("Error sending message: %v", err)
+						logger.Error("Error sending message", "error", err)
 					}
 					return
 				}
 
 				// Emulate successful payment
 				sessionID := ManuallyCompletePayment(userID)
-				err := b.ProcessPaymentWebhook(sessionID)
+				b.audit.Record(AuditEntry{AdminID: userID, Action: "complete_payment", TargetID: userID, Success: true, Details: sessionID})
+				err := b.ProcessPaymentWebhook(ctx, sessionID)
 				if err != nil {
 					msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Error emulating payment: %v", err))
 					_, err := b.api.Send(msg)
 					if err != nil {
-						log.Printf("Error sending message: %v", err)
+						logger.Error("Error sending message", "error", err)
 					}
 				}
 				return
@@ -425,7 +748,7 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 			msg := tgbotapi.NewMessage(chatID, "Unknown command. Use /help for assistance.")
 			_, err := b.api.Send(msg)
 			if err != nil {
-				log.Printf("Error sending message: %v", err)
+				logger.Error("Error sending message", "error", err)
 			}
 			return
 
@@ -434,7 +757,7 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 				msg := tgbotapi.NewMessage(chatID, "Please first fill in your information and pay for the service using the /start command")
 				_, err := b.api.Send(msg)
 				if err != nil {
-					log.Printf("Error sending message: %v", err)
+					logger.Error("Error sending message", "error", err)
 				}
 				return
 			}
@@ -443,47 +766,60 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 			msg := tgbotapi.NewMessage(chatID, "Generating your personalized workout program...")
 			_, err := b.api.Send(msg)
 			if err != nil {
-				log.Printf("Error sending message: %v", err)
+				logger.Error("Error sending message", "error", err)
 			}
 
 			// Generate and send workout plan
-			err = b.sendTrainingPlan(chatID, session)
+			err = b.sendTrainingPlan(ctx, chatID, session)
 			if err != nil {
-				log.Printf("Error sending workout plan: %v", err)
+				logger.Error("Error sending workout plan", "error", err)
 				errorMsg := tgbotapi.NewMessage(chatID, "An error occurred while generating the workout program. Please try again later.")
 				_, _ = b.api.Send(errorMsg)
 			}
 			return
 		}
 	} else {
+		// Admins preparing a broadcast send its text as a regular message
+		if b.isAdmin(userID) && b.handleBroadcastText(message) {
+			return
+		}
+
 		// For non-commands, check for duplication only if in completed state
 		if session.State == StateComplete && session.CheckDuplicateCommand(message.Text) {
-			log.Printf("Skipping duplicate message from user %d", userID)
+			logger.Info("Skipping duplicate message")
 			return
 		}
 	}
 
 	// Process regular messages through the session
+	previousState := session.State
 	response, err := session.ProcessInput(message.Text)
+	observeTransition(previousState, session.State)
 	if err != nil {
-		log.Printf("Error processing input: %v", err)
+		logger.Error("Error processing input", "error", err)
 	}
 
 	// If this is a completed session and the message is not a command, generate GPT response
 	if session.State == StateComplete && !message.IsCommand() {
+		// Red flags get an urgent-care message instead of training advice
+		if b.screenInput(chatID, userID, message.Text) {
+			return
+		}
+
+		if !b.checkUsageQuota(ctx, chatID, userID) {
+			return
+		}
+
 		chatAction := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
 		_, err := b.api.Request(chatAction)
 		if err != nil {
-			log.Printf("Error sending 'typing' status: %v", err)
+			logger.Error("Error sending 'typing' status", "error", err)
 		}
 
-		// Form request with user data
-		userDataPrompt := fmt.Sprintf("User data:\n%s\n\nUser message: %s",
-			session.Data.String(), message.Text)
-
-		gptResponse, err := b.openAIClient.GetCompletion(userDataPrompt)
+		// Answer with the Q&A prompt built from user data
+		answer, err := b.complete(ctx, UsageQA, session, message.Text, nil)
 		if err != nil {
-			log.Printf("Error getting response from OpenAI: %v", err)
+			logger.Error("Error getting response from OpenAI", "error", err)
 
 			errorMessage := "An error occurred while communicating with OpenAI."
 			if strings.Contains(err.Error(), "429") {
@@ -495,21 +831,22 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 			return
 		}
 
-		msg := tgbotapi.NewMessage(chatID, gptResponse)
+		logger.Debug("Answered question", "prompt_version", answer.PromptVersion, "fallback", answer.Fallback)
+		msg := tgbotapi.NewMessage(chatID, answer.Text)
 		_, err = b.api.Send(msg)
 		if err != nil {
-			log.Printf("Error sending response: %v", err)
+			logger.Error("Error sending response", "error", err)
 		}
 		return
 	}
 
 	// Get keyboard for current state
-	keyboard := session.GetKeyboardForState()
+	keyboard := b.keyboardForState(session)
 
 	// Send message with keyboard
 	messageID, err := b.sendMessageWithKeyboard(chatID, response, keyboard)
 	if err != nil {
-		log.Printf("Error sending message with keyboard: %v", err)
+		logger.Error("Error sending message with keyboard", "error", err)
 	} else {
 		session.LastMessageID = messageID
 	}
@@ -519,49 +856,51 @@ func (b *Bot) handleMessage(message *tgbotapi.Message) {
 }
 
 // sendTrainingPlan generates and sends a workout plan
-func (b *Bot) sendTrainingPlan(chatID int64, session *UserSession) error {
+func (b *Bot) sendTrainingPlan(ctx context.Context, chatID int64, session *UserSession) error {
+	logger := loggerFrom(ctx).With("chat_id", chatID)
+
+	if !b.checkUsageQuota(ctx, chatID, session.UserID) {
+		return nil
+	}
+
 	// Send "typing" status
 	chatAction := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
 	_, err := b.api.Request(chatAction)
 	if err != nil {
-		log.Printf("Error sending 'typing' status: %v", err)
+		logger.Error("Error sending 'typing' status", "error", err)
 	}
 
-	// Generate personalized workout plan
-	userDataJSON := session.Data.String()
-	log.Printf("Preparing GPT request for chat %d with data: %s", chatID, userDataJSON)
-
-	prompt := fmt.Sprintf(`Create a detailed personalized workout program for 1 week calculating body index based on the following user data. And give a minimum of 5 workouts plus an additional minimum of 3 ab workouts. Also give some motivation sentence for user.:
-%s
-
-The program should include:
-1. Weekly workout plan with days, workout types, and duration
-2. Detailed description of each workout with exercises, sets, and repetitions
-3. Nutrition recommendations
-4. Progress tracking recommendations
-5. Additional tips considering the user's personal data
-
-Consider the presence of diabetes and adapt the program accordingly.`, userDataJSON)
-
-	log.Printf("Sending request to OpenAI for chat %d", chatID)
+	logger.Info("Sending workout plan request to OpenAI")
 
 	// Get response from GPT
-	trainingPlan, err := b.openAIClient.GetCompletion(prompt)
+	trainingPlan, err := b.complete(withLogger(ctx, logger), UsagePlan, session, "", nil)
 	if err != nil {
-		log.Printf("Error getting response from OpenAI: %v", err)
+		logger.Error("Error getting response from OpenAI", "error", err)
 		return err
 	}
 
-	log.Printf("Received response from OpenAI for chat %d (length: %d characters)", chatID, len(trainingPlan))
+	logger.Info("Received workout plan", "plan_length", len(trainingPlan.Text),
+		"prompt_version", trainingPlan.PromptVersion, "fallback", trainingPlan.Fallback)
+	record := PlanRecord{
+		UserID:        session.UserID,
+		CreatedAt:     time.Now(),
+		PromptVersion: trainingPlan.PromptVersion,
+		SystemVersion: trainingPlan.SystemVersion,
+		Fallback:      trainingPlan.Fallback,
+		Plan:          trainingPlan.Text,
+		Exercises:     planExercises(trainingPlan.Text),
+	}
+	b.savePlan(record)
 
 	// Send workout plan to user
-	planMsg := tgbotapi.NewMessage(chatID, trainingPlan)
+	planMsg := tgbotapi.NewMessage(chatID, trainingPlan.Text)
 	_, err = b.api.Send(planMsg)
 	if err != nil {
-		log.Printf("Error sending workout plan: %v", err)
+		logger.Error("Error sending workout plan", "error", err)
 		return err
 	}
-	log.Printf("Workout plan successfully sent for chat %d", chatID)
+	logger.Info("Workout plan successfully sent")
+	b.sendExerciseGuides(chatID, record.Exercises)
 
 	// Add buttons for further interaction
 	followupMsg := tgbotapi.NewMessage(
@@ -583,66 +922,155 @@ Consider the presence of diabetes and adapt the program accordingly.`, userDataJ
 
 	_, err = b.api.Send(followupMsg)
 	if err != nil {
-		log.Printf("Error sending final message: %v", err)
+		logger.Error("Error sending final message", "error", err)
 	} else {
-		log.Printf("Final message successfully sent for chat %d", chatID)
+		logger.Debug("Final message successfully sent")
 	}
 
 	return nil
 }
 
-// ProcessPaymentWebhook processes webhook from Stripe
-func (b *Bot) ProcessPaymentWebhook(sessionID string) error {
-	log.Printf("Processing webhook from Stripe for session: %s", sessionID)
+// sendPaymentLink creates a checkout session and sends its link
+func (b *Bot) sendPaymentLink(ctx context.Context, chatID, userID int64) {
+	logger := loggerFrom(ctx)
+	paymentURL, err := b.payments.Create(userID, b.referrals.Account(userID).DiscountPercent)
+	if err != nil {
+		logger.Error("Error creating payment link", "error", err)
+		errorMsg := fmt.Sprintf("An error occurred while creating payment: %v", err)
+		b.api.Send(tgbotapi.NewMessage(chatID, errorMsg))
+		return
+	}
 
-	success, userIDStr, err := VerifyPayment(sessionID)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("To make a payment, follow this link: %s", paymentURL))
+	if _, err := b.api.Send(msg); err != nil {
+		logger.Error("Error sending payment link", "error", err)
+	}
+}
+
+// keyboardForState returns the session's keyboard, with a checkout link at the payment stage
+func (b *Bot) keyboardForState(session *UserSession) *tgbotapi.InlineKeyboardMarkup {
+	keyboard := session.GetKeyboardForState()
+	if session.State != StatePayment {
+		return keyboard
+	}
+
+	paymentURL, err := b.payments.Create(session.UserID, b.referrals.Account(session.UserID).DiscountPercent)
 	if err != nil {
-		log.Printf("Error verifying payment: %v", err)
+		// The pay button tries again when pressed
+		slog.Error("Error creating payment link", "user_id", session.UserID, "error", err)
+		return keyboard
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonURL("💳 Go to Payment", paymentURL),
+		),
+	)
+	return &markup
+}
+
+// ProcessPaymentWebhook processes webhook from Stripe. It verifies the payment
+// and returns, the plan is generated in the background. Each checkout session
+// is processed once, so retried webhooks don't send the plan again.
+func (b *Bot) ProcessPaymentWebhook(ctx context.Context, sessionID string) error {
+	logger := loggerFrom(ctx).With("session_id", sessionID)
+	logger.Info("Processing payment for checkout session")
+
+	success, userIDStr, err := b.payments.Verify(sessionID)
+	if err != nil {
+		logger.Error("Error verifying payment", "error", err)
 		return err
 	}
 
 	if !success {
-		log.Printf("Payment not completed for session: %s", sessionID)
+		logger.Warn("Payment not completed")
 		return fmt.Errorf("payment not completed")
 	}
 
 	// Convert user ID from string to int64
 	userID, err := strconv.ParseInt(userIDStr, 10, 64)
 	if err != nil {
-		log.Printf("Error converting user ID '%s': %v", userIDStr, err)
+		logger.Error("Error converting user ID", "client_reference_id", userIDStr, "error", err)
 		return err
 	}
 
-	log.Printf("Payment successfully confirmed for user: %d", userID)
+	logger = logger.With("user_id", userID)
+	logger.Info("Payment successfully confirmed")
+
+	claimed, err := b.claimPayment(sessionID, userID)
+	if err != nil {
+		logger.Error("Error recording payment", "error", err)
+		return err
+	}
+	if !claimed {
+		logger.Info("Payment already processed")
+		return nil
+	}
+	checkoutSessionsTotal.WithLabelValues("paid").Inc()
+
+	// The plan is generated in the user's queue, after the updates before the payment
+	queueCtx, cancel := context.WithTimeout(ctx, dispatchWait)
+	defer cancel()
+	err = b.runForUser(queueCtx, userID, logger, func(ctx context.Context) {
+		b.completePayment(ctx, userID, sessionID)
+	})
+	if err != nil {
+		// Let Stripe's retry process the payment later
+		if err := b.store.Delete(paymentsBucket, sessionID); err != nil {
+			logger.Error("Error releasing payment", "error", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// claimPayment records a checkout session as processed and the user as a
+// paying customer. It reports false if the session was processed already.
+func (b *Bot) claimPayment(sessionID string, userID int64) (bool, error) {
+	b.paymentMutex.Lock()
+	defer b.paymentMutex.Unlock()
+
+	var record PaymentRecord
+	found, err := b.store.Get(paymentsBucket, sessionID, &record)
+	if err != nil || found {
+		return false, err
+	}
+	record = PaymentRecord{UserID: userID, ProcessedAt: time.Now()}
+	if err := b.store.Put(paymentsBucket, sessionID, record); err != nil {
+		return false, err
+	}
+	return true, recordPaidUser(b.store, userID, sessionID)
+}
+
+// completePayment unlocks the plan for a paid checkout session and sends it
+func (b *Bot) completePayment(ctx context.Context, userID int64, sessionID string) {
+	logger := loggerFrom(ctx)
 
 	// Get user session
 	session := b.getSession(userID)
 
 	// Update session status
+	observeTransition(session.State, StateComplete)
 	session.SetPaymentCompleted(sessionID)
 	b.saveSession(userID, session) // Save session after update!
-	log.Printf("User %d session status updated as paid", userID)
+	logger.Info("Session status updated as paid")
 
 	// Send notification to user about successful payment
 	msg := tgbotapi.NewMessage(userID, "🎉 Payment successfully completed! Generating your personalized workout program...")
-	_, err = b.api.Send(msg)
+	_, err := b.api.Send(msg)
 	if err != nil {
-		log.Printf("Error sending message: %v", err)
+		logger.Error("Error sending message", "error", err)
 	} else {
-		log.Printf("Sent successful payment notification to user %d", userID)
+		logger.Debug("Sent successful payment notification")
 	}
 
-	// Add a small delay before sending workout plan
-	time.Sleep(2 * time.Second)
-
 	// Send workout plan
-	err = b.sendTrainingPlan(userID, session)
+	err = b.sendTrainingPlan(ctx, userID, session)
 	if err != nil {
-		log.Printf("Error sending workout plan: %v", err)
+		logger.Error("Error sending workout plan", "error", err)
 		// Send error message to user
 		errorMsg := tgbotapi.NewMessage(userID, "An error occurred while generating the workout plan. Please use the /plan command to get the plan.")
 		_, _ = b.api.Send(errorMsg)
 	}
 
-	return nil
+	b.rewardReferral(userID, sessionID)
 }
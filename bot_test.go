@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionAccessFromOtherGoroutines hammers one user's session from every
+// goroutine that reads or changes it besides the user's own updates. Run it
+// with -race.
+func TestSessionAccessFromOtherGoroutines(t *testing.T) {
+	h := NewHarness(t, e2eResponses...)
+	const user = 600
+	if err := completeQuestionnaire(h, user); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, err := requestCheckout(h, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	repeat := func(times int, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < times; i++ {
+				if err := f(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	repeat(20, func() error { return h.Send(user, "How much protein should I eat?") })
+	repeat(1, func() error {
+		status, err := h.CompleteCheckout(sessionID) // Stripe webhook
+		if err == nil && status != 200 {
+			err = fmt.Errorf("payment webhook answered %d", status)
+		}
+		return err
+	})
+	repeat(10, func() error { return h.Send(harnessAdminID, fmt.Sprintf("/user %d", user)) })
+	repeat(10, func() error { return h.Send(harnessAdminID, fmt.Sprintf("/resetlimit %d", user)) })
+	repeat(10, func() error { h.Bot.markBlocked(context.Background(), user); return nil }) // Broadcast
+	repeat(10, func() error { h.Bot.sendCheckInReminders(time.Now(), 0); return nil })
+	repeat(10, func() error {
+		h.Bot.formatStats()
+		h.Bot.broadcastAudience(BroadcastFilter{})
+		return nil
+	})
+	wg.Wait()
+
+	// Messages from the user clear the flag, so set it after all of them
+	h.Bot.markBlocked(context.Background(), user)
+	ctx, cancel := context.WithTimeout(context.Background(), e2eWait)
+	defer cancel()
+	if err := h.Bot.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	session, ok := h.Bot.sessionSnapshot(user)
+	if !ok || session.State != StateComplete || !session.BlockedBot {
+		t.Fatalf("session lost a change: %+v", session)
+	}
+}
@@ -0,0 +1,155 @@
+// breaker.go
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Requests pass, failures are counted
+	CircuitOpen                         // Requests are rejected until the cooldown ends
+	CircuitHalfOpen                     // A single probe request decides whether to close
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCircuitOpen is returned while the breaker rejects requests
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerConfig configures when a circuit breaker opens and for how long
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit
+	FailureThreshold int
+	// Cooldown is how long the circuit stays open before a probe is allowed
+	Cooldown time.Duration
+}
+
+// defaultBreakerConfig is used unless overridden by LLM_BREAKER_* variables
+var defaultBreakerConfig = BreakerConfig{FailureThreshold: 5, Cooldown: 30 * time.Second}
+
+// CircuitBreaker stops calling a failing dependency and probes it after a cooldown
+type CircuitBreaker struct {
+	name     string
+	config   BreakerConfig
+	mutex    sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(name string, config BreakerConfig) *CircuitBreaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultBreakerConfig.FailureThreshold
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = defaultBreakerConfig.Cooldown
+	}
+
+	b := &CircuitBreaker{name: name, config: config, now: time.Now}
+	circuitStateGauge.WithLabelValues(name).Set(float64(CircuitClosed))
+	return b
+}
+
+// Allow reports whether a request may be sent. Every allowed request must be
+// followed by a call to Success, Failure or Release.
+func (b *CircuitBreaker) Allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.config.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		// Only one probe at a time, everyone else keeps using the fallback
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Success records a successful request and closes the circuit
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != CircuitClosed {
+		b.setState(CircuitClosed)
+	}
+}
+
+// Failure records a failed request and opens the circuit when the threshold is reached
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.probing = false
+	switch {
+	case b.state == CircuitHalfOpen:
+		b.open()
+	case b.state == CircuitClosed && b.failures >= b.config.FailureThreshold:
+		b.open()
+	}
+}
+
+// Release ends a request that says nothing about the dependency, e.g. one
+// canceled by the caller. The state and failure count stay as they are.
+func (b *CircuitBreaker) Release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+// open starts a new cooldown, the mutex must be held
+func (b *CircuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(CircuitOpen)
+}
+
+// setState changes the state and records it, the mutex must be held
+func (b *CircuitBreaker) setState(state CircuitState) {
+	slog.Info("Circuit breaker state changed", "breaker", b.name, "from", b.state, "to", state, "failures", b.failures)
+	b.state = state
+	circuitStateGauge.WithLabelValues(b.name).Set(float64(state))
+	circuitTransitionsTotal.WithLabelValues(b.name, state.String()).Inc()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBreaker returns a breaker with a clock the test moves forward
+func testBreaker(threshold int) (*CircuitBreaker, *time.Time) {
+	now := time.Now()
+	b := NewCircuitBreaker("test", BreakerConfig{FailureThreshold: threshold, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	b, now := testBreaker(2)
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("closed breaker rejected request %d: %v", i+1, err)
+		}
+		b.Failure()
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state after 2 failures = %s, want open", b.State())
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("open breaker allowed a request during the cooldown")
+	}
+
+	*now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("breaker rejected the probe after the cooldown: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("breaker allowed a second concurrent probe")
+	}
+	b.Failure()
+	if b.State() != CircuitOpen {
+		t.Fatalf("state after a failed probe = %s, want open", b.State())
+	}
+
+	*now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Success()
+	if b.State() != CircuitClosed {
+		t.Fatalf("state after a successful probe = %s, want closed", b.State())
+	}
+}
+
+func TestCircuitBreakerReleaseIsNeutral(t *testing.T) {
+	b, now := testBreaker(1)
+	b.Allow()
+	b.Failure()
+
+	*now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("state after a released probe = %s, want half_open", b.State())
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("released probe blocked the next one: %v", err)
+	}
+}
+
+func TestOpenAIClientCanceledProbeKeepsCircuitOpen(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": "ok"}}},
+		})
+	}))
+	defer server.Close()
+
+	client := NewOpenAIClient(LLMConfig{
+		Feature: UsageQA,
+		BaseURL: server.URL,
+		APIKey:  "test",
+		Breaker: BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute},
+	})
+	now := time.Now()
+	client.breaker.now = func() time.Time { return now }
+
+	if _, _, err := client.GetCompletion(context.Background(), "system", "question"); !errors.Is(err, ErrLLMUnavailable) {
+		t.Fatalf("failing API returned %v, want ErrLLMUnavailable", err)
+	}
+	if client.CircuitState() != CircuitOpen {
+		t.Fatalf("state after a failure = %s, want open", client.CircuitState())
+	}
+
+	// A probe canceled by the caller must not close the circuit
+	now = now.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := client.GetCompletion(ctx, "system", "question"); err == nil {
+		t.Fatal("canceled request succeeded")
+	}
+	if client.CircuitState() != CircuitHalfOpen {
+		t.Fatalf("state after a canceled probe = %s, want half_open", client.CircuitState())
+	}
+
+	failing.Store(false)
+	if _, _, err := client.GetCompletion(context.Background(), "system", "question"); err != nil {
+		t.Fatalf("recovered API returned %v", err)
+	}
+	if client.CircuitState() != CircuitClosed {
+		t.Fatalf("state after a successful probe = %s, want closed", client.CircuitState())
+	}
+}
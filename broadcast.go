@@ -0,0 +1,423 @@
+// broadcast.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CallbackBroadcast - prefix for broadcast confirmation buttons
+const CallbackBroadcast = "bc:"
+
+// Telegram rate limits for bulk messages
+const (
+	broadcastGlobalRate   = 25              // messages per second across all chats (Telegram allows ~30)
+	broadcastMaxRetries   = 3               // retries for one message after 429 or network errors
+	broadcastProgressStep = 25              // update progress after this many messages
+	broadcastProgressTime = 5 * time.Second // or after this much time
+)
+
+// BroadcastFilter selects the audience of a broadcast
+type BroadcastFilter struct {
+	State *UserState
+	Goal  string
+	Paid  *bool
+}
+
+// Matches checks if a session belongs to the audience
+func (f BroadcastFilter) Matches(session UserSession) bool {
+	if session.BlockedBot {
+		return false
+	}
+	if f.State != nil && session.State != *f.State {
+		return false
+	}
+	if f.Goal != "" && session.Data.FitnessGoal != f.Goal {
+		return false
+	}
+	if f.Paid != nil && (session.State == StateComplete) != *f.Paid {
+		return false
+	}
+	return true
+}
+
+// String returns a readable description of the filter
+func (f BroadcastFilter) String() string {
+	var parts []string
+	if f.State != nil {
+		parts = append(parts, "state="+f.State.String())
+	}
+	if f.Goal != "" {
+		parts = append(parts, "goal="+f.Goal)
+	}
+	if f.Paid != nil {
+		parts = append(parts, fmt.Sprintf("paid=%t", *f.Paid))
+	}
+	if len(parts) == 0 {
+		return "all users"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseBroadcastFilter parses arguments like "state=payment goal=weight_loss paid=no"
+func parseBroadcastFilter(args string) (BroadcastFilter, error) {
+	var filter BroadcastFilter
+
+	for _, arg := range strings.Fields(args) {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return filter, fmt.Errorf("invalid filter %q, expected key=value", arg)
+		}
+
+		switch strings.ToLower(key) {
+		case "state":
+			state, found := parseUserState(value)
+			if !found {
+				return filter, fmt.Errorf("unknown state %q", value)
+			}
+			filter.State = &state
+		case "goal":
+			goal, ok := goalValues[value]
+			if !ok {
+				return filter, fmt.Errorf("unknown goal %q", value)
+			}
+			filter.Goal = goal
+		case "paid":
+			switch strings.ToLower(value) {
+			case "yes", "true":
+				paid := true
+				filter.Paid = &paid
+			case "no", "false":
+				paid := false
+				filter.Paid = &paid
+			default:
+				return filter, fmt.Errorf("paid must be yes or no")
+			}
+		default:
+			return filter, fmt.Errorf("unknown filter %q", key)
+		}
+	}
+
+	return filter, nil
+}
+
+// BroadcastDraft is a broadcast prepared by an admin and awaiting confirmation
+type BroadcastDraft struct {
+	AdminID int64
+	Filter  BroadcastFilter
+	Text    string
+	Sending bool
+}
+
+// BroadcastStats contains delivery statistics of a broadcast
+type BroadcastStats struct {
+	Total     int
+	Delivered int
+	Blocked   int
+	Failed    int
+	// Recipients left out because the bot shut down
+	Skipped int
+}
+
+// broadcastSender sends messages at the global rate limit. A broadcast sends
+// one message per chat, so the per-chat limit never applies.
+type broadcastSender struct {
+	bot    *Bot
+	ticker *time.Ticker
+}
+
+// newBroadcastSender creates a sender limited to broadcastGlobalRate messages per second
+func newBroadcastSender(bot *Bot) *broadcastSender {
+	return &broadcastSender{
+		bot:    bot,
+		ticker: time.NewTicker(time.Second / broadcastGlobalRate),
+	}
+}
+
+// Stop releases the sender's ticker
+func (s *broadcastSender) Stop() {
+	s.ticker.Stop()
+}
+
+// Send delivers one message, waiting for the rate limit and honoring
+// retry_after. It gives up with the context's error when ctx is done.
+func (s *broadcastSender) Send(ctx context.Context, chatID int64, text string) error {
+	var err error
+	for attempt := 0; attempt <= broadcastMaxRetries; attempt++ {
+		select {
+		case <-s.ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		_, err = s.bot.api.Send(tgbotapi.NewMessage(chatID, text))
+		if err == nil {
+			return nil
+		}
+
+		var tgErr *tgbotapi.Error
+		if !errors.As(err, &tgErr) {
+			// Network error, retry after a short pause
+			if err := sleepContext(ctx, time.Duration(attempt+1)*time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if tgErr.Code == 429 || tgErr.RetryAfter > 0 {
+			retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+			if retryAfter == 0 {
+				retryAfter = time.Second
+			}
+			slog.Warn("Broadcast rate limited", "chat_id", chatID, "retry_after", retryAfter)
+			if err := sleepContext(ctx, retryAfter); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Other API errors (blocked, chat not found) will not succeed on retry
+		return err
+	}
+	return err
+}
+
+// isBlockedError checks if Telegram reports that the user blocked the bot
+func isBlockedError(err error) bool {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		return false
+	}
+	if tgErr.Code == 403 {
+		return true
+	}
+	message := strings.ToLower(tgErr.Message)
+	return strings.Contains(message, "bot was blocked") ||
+		strings.Contains(message, "user is deactivated") ||
+		strings.Contains(message, "chat not found")
+}
+
+// broadcastDrafts stores drafts of admins preparing a broadcast
+var (
+	broadcastDrafts = make(map[int64]*BroadcastDraft)
+	broadcastMutex  sync.Mutex
+)
+
+// startBroadcast begins preparing a broadcast: /broadcast [state=..] [goal=..] [paid=yes|no]
+func (b *Bot) startBroadcast(message *tgbotapi.Message) {
+	adminID := message.From.ID
+	chatID := message.Chat.ID
+	args := strings.TrimSpace(message.CommandArguments())
+
+	if args == "cancel" {
+		broadcastMutex.Lock()
+		draft := broadcastDrafts[adminID]
+		if draft != nil && !draft.Sending {
+			delete(broadcastDrafts, adminID)
+		}
+		broadcastMutex.Unlock()
+		b.sendText(chatID, "Broadcast draft cancelled.")
+		return
+	}
+
+	filter, err := parseBroadcastFilter(args)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v\n\nUsage: /broadcast [state=<state>] [goal=weight_loss|muscle_gain|maintenance|endurance] [paid=yes|no]", err))
+		return
+	}
+
+	broadcastMutex.Lock()
+	if draft := broadcastDrafts[adminID]; draft != nil && draft.Sending {
+		broadcastMutex.Unlock()
+		b.sendText(chatID, "A broadcast is already being sent. Please wait until it finishes.")
+		return
+	}
+	broadcastDrafts[adminID] = &BroadcastDraft{AdminID: adminID, Filter: filter}
+	broadcastMutex.Unlock()
+
+	b.sendText(chatID, fmt.Sprintf("📣 Broadcast to %s (%d users).\n\nSend the message text now, or /broadcast cancel to abort.",
+		filter, len(b.broadcastAudience(filter))))
+}
+
+// handleBroadcastText stores the draft text and shows a preview with confirmation buttons.
+// It returns false if the admin has no draft waiting for text.
+func (b *Bot) handleBroadcastText(message *tgbotapi.Message) bool {
+	adminID := message.From.ID
+
+	broadcastMutex.Lock()
+	draft := broadcastDrafts[adminID]
+	if draft == nil || draft.Sending || message.Text == "" {
+		broadcastMutex.Unlock()
+		return false
+	}
+	draft.Text = message.Text
+	filter := draft.Filter
+	broadcastMutex.Unlock()
+
+	// Preview exactly what recipients will see
+	b.sendText(message.Chat.ID, draft.Text)
+
+	audience := len(b.broadcastAudience(filter))
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Send", CallbackBroadcast+"confirm"),
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Cancel", CallbackBroadcast+"cancel"),
+		),
+	)
+	_, err := b.sendMessageWithKeyboard(message.Chat.ID,
+		fmt.Sprintf("⬆️ Preview. Send this message to %d users (%s)?", audience, filter), &keyboard)
+	if err != nil {
+		slog.Error("Error sending broadcast preview", "error", err)
+	}
+	return true
+}
+
+// handleBroadcastCallback processes the confirmation buttons of a broadcast preview
+func (b *Bot) handleBroadcastCallback(callback *tgbotapi.CallbackQuery) {
+	adminID := callback.From.ID
+	chatID := callback.Message.Chat.ID
+	action := strings.TrimPrefix(callback.Data, CallbackBroadcast)
+
+	if !b.isAdmin(adminID) {
+		return
+	}
+
+	broadcastMutex.Lock()
+	draft := broadcastDrafts[adminID]
+	if draft == nil || draft.Text == "" || draft.Sending {
+		broadcastMutex.Unlock()
+		b.sendText(chatID, "No broadcast is waiting for confirmation.")
+		return
+	}
+	if action != "confirm" {
+		delete(broadcastDrafts, adminID)
+		broadcastMutex.Unlock()
+		b.editText(chatID, callback.Message.MessageID, "Broadcast cancelled.")
+		return
+	}
+	draft.Sending = true
+	broadcastMutex.Unlock()
+
+	b.audit.Record(AuditEntry{AdminID: adminID, Action: "broadcast", Success: true, Details: draft.Filter.String()})
+	b.spawn("broadcast", func(ctx context.Context) {
+		ctx, cancel := b.untilShutdown(ctx)
+		defer cancel()
+		b.runBroadcast(ctx, draft, chatID, callback.Message.MessageID)
+	})
+}
+
+// runBroadcast sends the draft to its audience and reports progress to the admin.
+// When ctx is done it stops and reports how far it got.
+func (b *Bot) runBroadcast(ctx context.Context, draft *BroadcastDraft, chatID int64, progressMessageID int) {
+	defer func() {
+		broadcastMutex.Lock()
+		delete(broadcastDrafts, draft.AdminID)
+		broadcastMutex.Unlock()
+	}()
+
+	recipients := b.broadcastAudience(draft.Filter)
+	stats := BroadcastStats{Total: len(recipients)}
+	slog.Info("Starting broadcast", "admin_id", draft.AdminID, "recipients", stats.Total, "filter", draft.Filter.String())
+
+	sender := newBroadcastSender(b)
+	defer sender.Stop()
+
+	lastProgress := time.Now()
+	for i, userID := range recipients {
+		err := sender.Send(ctx, userID, draft.Text)
+		switch {
+		case err == nil:
+			stats.Delivered++
+		case ctx.Err() != nil:
+			stats.Skipped = stats.Total - i
+		case isBlockedError(err):
+			stats.Blocked++
+			b.markBlocked(ctx, userID)
+		default:
+			stats.Failed++
+			slog.Error("Error sending broadcast", "user_id", userID, "error", err)
+		}
+		if stats.Skipped > 0 {
+			break
+		}
+
+		sent := i + 1
+		if sent%broadcastProgressStep == 0 || time.Since(lastProgress) > broadcastProgressTime {
+			b.editText(chatID, progressMessageID, fmt.Sprintf("📤 Sending broadcast: %d/%d", sent, stats.Total))
+			lastProgress = time.Now()
+		}
+	}
+
+	slog.Info("Broadcast finished",
+		"admin_id", draft.AdminID,
+		"recipients", stats.Total,
+		"delivered", stats.Delivered,
+		"blocked", stats.Blocked,
+		"failed", stats.Failed,
+		"skipped", stats.Skipped)
+	b.editText(chatID, progressMessageID, broadcastReport(draft.Filter, stats))
+}
+
+// broadcastReport describes the outcome of a broadcast for the admin
+func broadcastReport(filter BroadcastFilter, stats BroadcastStats) string {
+	title := "✅ Broadcast finished"
+	if stats.Skipped > 0 {
+		title = "⏹ Broadcast stopped by a bot shutdown"
+	}
+	report := fmt.Sprintf("%s (%s)\n\n"+
+		"• Recipients: %d\n"+
+		"• Delivered: %d\n"+
+		"• Blocked the bot: %d\n"+
+		"• Failed: %d",
+		title, filter, stats.Total, stats.Delivered, stats.Blocked, stats.Failed)
+	if stats.Skipped > 0 {
+		report += fmt.Sprintf("\n• Not sent: %d", stats.Skipped)
+	}
+	return report
+}
+
+// broadcastAudience returns IDs of users matching the filter
+func (b *Bot) broadcastAudience(filter BroadcastFilter) []int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var ids []int64
+	for userID, session := range b.snapshots {
+		if filter.Matches(session) {
+			ids = append(ids, userID)
+		}
+	}
+	return ids
+}
+
+// markBlocked marks that the user has blocked the bot. The change is queued
+// after the user's pending updates.
+func (b *Bot) markBlocked(ctx context.Context, userID int64) {
+	err := b.runForUser(ctx, userID, slog.Default(), func(context.Context) {
+		if session, exists := b.findSession(userID); exists {
+			session.BlockedBot = true
+			slog.Info("User has blocked the bot", "user_id", userID)
+		}
+	})
+	if err != nil {
+		slog.Error("Error marking user as blocked", "user_id", userID, "error", err)
+	}
+}
+
+// editText replaces the text of a sent message and removes its keyboard
+func (b *Bot) editText(chatID int64, messageID int, text string) {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	edit.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	}
+	if _, err := b.api.Send(edit); err != nil {
+		slog.Error("Error editing message", "chat_id", chatID, "error", err)
+	}
+}
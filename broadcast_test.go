@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroadcastStopsOnShutdown(t *testing.T) {
+	h := NewHarness(t)
+
+	// The admin's session makes it 100 recipients
+	for userID := int64(500); userID < 599; userID++ {
+		h.Bot.saveSession(userID, NewUserSession(userID))
+	}
+
+	if err := h.Send(harnessAdminID, "/broadcast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Expect(harnessAdminID, "Send the message text now", e2eWait); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Send(harnessAdminID, "New programs are out"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Expect(harnessAdminID, "Preview", e2eWait); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Press(harnessAdminID, CallbackBroadcast+"confirm"); err != nil {
+		t.Fatal(err)
+	}
+
+	// At the global rate the broadcast takes 4 seconds, shutdown must not wait for it
+	time.Sleep(300 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Bot.Drain(ctx); err != nil {
+		t.Fatalf("drain waited for the broadcast: %v", err)
+	}
+
+	var report string
+	for _, message := range h.Telegram.Sent() {
+		if message.ChatID == harnessAdminID && message.Method == "editMessageText" {
+			report = message.Text
+		}
+	}
+	if !strings.Contains(report, "Broadcast stopped") || !strings.Contains(report, "Recipients: 100") || !strings.Contains(report, "Not sent:") {
+		t.Fatalf("unexpected report of a stopped broadcast:\n%s", report)
+	}
+
+	delivered := 0
+	for _, message := range h.Telegram.Sent() {
+		if message.Text == "New programs are out" && message.ChatID >= 500 {
+			delivered++
+		}
+	}
+	if delivered == 0 || delivered > 15 {
+		t.Fatalf("%d messages delivered in 300ms, expected about %d per second", delivered, broadcastGlobalRate)
+	}
+}
@@ -0,0 +1,549 @@
+// checkin.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"RestApiServer/Tg-bot/workout"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Store buckets of weekly check-ins
+const (
+	checkInsBucket         = "checkins"          // CheckInRecord by user and time
+	latestCheckInsBucket   = "latest_checkins"   // Key of the latest CheckInRecord by user ID, empty if none
+	workoutLogsBucket      = "workout_logs"      // WorkoutLog by user and time
+	userWorkoutLogsBucket  = "user_workout_logs" // Keys of a user's WorkoutLogs by user ID, oldest first
+	checkInRemindersBucket = "checkin_reminders" // CheckInReminder by user ID
+)
+
+// CallbackCheckIn starts the data of check-in buttons, e.g. chk:pain:none
+const CallbackCheckIn = "chk:"
+
+// checkInReminderTick is how often users due for a check-in are looked for
+const checkInReminderTick = time.Hour
+
+// Limits of the workout log passed to the model
+const (
+	maxPromptWorkouts = 20
+	maxWorkoutLogText = 200
+)
+
+// sharpPainAdvice answers a check-in that reports joint or sharp pain
+const sharpPainAdvice = "⚠️ Joint or sharp pain is a reason to see a doctor or physiotherapist before training hard again. Skip any exercise that hurts."
+
+// checkInQuestion is one question of the check-in with its answers
+type checkInQuestion struct {
+	Field   string
+	Text    string
+	Options [][2]string // Value and label
+}
+
+// checkInQuestions are asked in order, each answered with a button
+var checkInQuestions = []checkInQuestion{
+	{Field: "adherence", Text: "📝 Weekly check-in (1/5)\n\nHow many of this week's planned workouts did you do?", Options: [][2]string{
+		{string(workout.AdherenceAll), "All of them"}, {string(workout.AdherenceMost), "Most"},
+		{string(workout.AdherenceHalf), "About half"}, {string(workout.AdherenceLow), "Few or none"},
+	}},
+	{Field: "difficulty", Text: "📝 Weekly check-in (2/5)\n\nHow hard did the workouts feel?", Options: [][2]string{
+		{string(workout.DifficultyEasy), "Too easy"}, {string(workout.DifficultyRight), "Just right"},
+		{string(workout.DifficultyHard), "Hard"}, {string(workout.DifficultyTooHard), "Too hard"},
+	}},
+	{Field: "energy", Text: "📝 Weekly check-in (3/5)\n\nHow was your energy this week?", Options: [][2]string{
+		{string(workout.EnergyLow), "Low"}, {string(workout.EnergyNormal), "Normal"}, {string(workout.EnergyHigh), "High"},
+	}},
+	{Field: "weight", Text: "📝 Weekly check-in (4/5)\n\nHow did your weight change?", Options: [][2]string{
+		{string(workout.WeightDown), "Went down"}, {string(workout.WeightSame), "About the same"}, {string(workout.WeightUp), "Went up"},
+	}},
+	{Field: "pain", Text: "📝 Weekly check-in (5/5)\n\nDid you feel any pain during or after workouts?", Options: [][2]string{
+		{string(workout.PainNone), "No pain"}, {string(workout.PainMild), "Muscle soreness"}, {string(workout.PainSharp), "Joint or sharp pain"},
+	}},
+}
+
+// CheckInDraft is a check-in being answered
+type CheckInDraft struct {
+	Step    int
+	Answers workout.CheckIn
+}
+
+// CheckInRecord is a completed check-in with the progression it led to
+type CheckInRecord struct {
+	UserID      int64               `json:"user_id"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Answers     workout.CheckIn     `json:"answers"`
+	Progression workout.Progression `json:"progression"`
+}
+
+// WorkoutLog is a workout the user reported with /log
+type WorkoutLog struct {
+	UserID int64     `json:"user_id"`
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"`
+}
+
+// CheckInReminder remembers the plan a user was last reminded about
+type CheckInReminder struct {
+	PlanCreatedAt time.Time `json:"plan_created_at"`
+	SentAt        time.Time `json:"sent_at"`
+}
+
+// startCheckIn asks the first check-in question
+func (b *Bot) startCheckIn(ctx context.Context, chatID int64, session *UserSession) {
+	if session.State != StateComplete {
+		b.sendText(chatID, "Weekly check-ins start once your program is ready. Use /start to begin.")
+		return
+	}
+	if _, ok := b.lastPlan(session.UserID); !ok {
+		b.sendText(chatID, "You don't have a program to check in on yet. Use /plan to get it.")
+		return
+	}
+	// Don't ask five questions when the next week can't be planned
+	if !b.checkUsageQuota(ctx, chatID, session.UserID) {
+		return
+	}
+
+	session.CheckIn = &CheckInDraft{}
+	b.saveSession(session.UserID, session)
+	checkInsTotal.WithLabelValues("started").Inc()
+	b.askCheckInQuestion(chatID, session)
+}
+
+// askCheckInQuestion sends the current question of the check-in with its answers
+func (b *Bot) askCheckInQuestion(chatID int64, session *UserSession) {
+	question := checkInQuestions[session.CheckIn.Step]
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, option := range question.Options {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(option[1], CallbackCheckIn+question.Field+":"+option[0]))
+	}
+
+	// Two answers per row keep the labels readable
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < len(buttons); i += 2 {
+		rows = append(rows, buttons[i:min(i+2, len(buttons))])
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := b.sendMessageWithKeyboard(chatID, question.Text, &keyboard); err != nil {
+		slog.Error("Error sending check-in question", "user_id", session.UserID, "error", err)
+	}
+}
+
+// handleCheckInCallback records an answer and asks the next question, or
+// plans the next week after the last one
+func (b *Bot) handleCheckInCallback(ctx context.Context, callback *tgbotapi.CallbackQuery, session *UserSession) {
+	chatID := callback.Message.Chat.ID
+	data := strings.TrimPrefix(callback.Data, CallbackCheckIn)
+	if data == "start" {
+		b.startCheckIn(ctx, chatID, session)
+		return
+	}
+
+	field, value, _ := strings.Cut(data, ":")
+	draft := session.CheckIn
+	if draft == nil || checkInQuestions[draft.Step].Field != field {
+		b.sendText(chatID, "This check-in question has expired. Use /checkin to start a new check-in.")
+		return
+	}
+
+	question := checkInQuestions[draft.Step]
+	label := ""
+	for _, option := range question.Options {
+		if option[0] == value {
+			label = option[1]
+		}
+	}
+	if label == "" {
+		loggerFrom(ctx).Warn("Unknown check-in answer", "field", field, "value", value)
+		return
+	}
+
+	switch field {
+	case "adherence":
+		draft.Answers.Adherence = workout.Adherence(value)
+	case "difficulty":
+		draft.Answers.Difficulty = workout.Difficulty(value)
+	case "energy":
+		draft.Answers.Energy = workout.Energy(value)
+	case "weight":
+		draft.Answers.Weight = workout.WeightTrend(value)
+	case "pain":
+		draft.Answers.Pain = workout.Pain(value)
+	}
+
+	// Show the answer in place of the buttons
+	edit := tgbotapi.NewEditMessageText(chatID, callback.Message.MessageID, callback.Message.Text+"\n\n✅ Selected: "+label)
+	edit.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+	if _, err := b.api.Send(edit); err != nil {
+		loggerFrom(ctx).Error("Error editing message", "error", err)
+	}
+
+	draft.Step++
+	if draft.Step < len(checkInQuestions) {
+		b.saveSession(session.UserID, session)
+		b.askCheckInQuestion(chatID, session)
+		return
+	}
+
+	session.CheckIn = nil
+	b.saveSession(session.UserID, session)
+	b.completeCheckIn(ctx, chatID, session, draft.Answers)
+}
+
+// completeCheckIn applies the progression rules to the answers and sends the
+// next week's plan. The check-in is saved only with the plan it led to, so a
+// week that wasn't planned doesn't advance the progression.
+func (b *Bot) completeCheckIn(ctx context.Context, chatID int64, session *UserSession, answers workout.CheckIn) {
+	logger := loggerFrom(ctx)
+	userID := session.UserID
+
+	previousPlan, ok := b.lastPlan(userID)
+	if !ok {
+		b.sendText(chatID, "You don't have a program to check in on yet. Use /plan to get it.")
+		return
+	}
+	if !b.checkUsageQuota(ctx, chatID, userID) {
+		if answers.Pain == workout.PainSharp {
+			b.sendText(chatID, sharpPainAdvice)
+		}
+		return
+	}
+	workouts := b.workoutLogs(userID, previousPlan.CreatedAt)
+	answers.LoggedWorkouts = len(workouts)
+
+	previous := workout.Progression{Week: 1}
+	if last, ok := b.lastCheckIn(userID); ok {
+		previous = last.Progression
+	}
+	progression := workout.Decide(answers, session.Data.WorkoutProfile().Goal, previous)
+
+	if _, err := b.api.Request(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)); err != nil {
+		logger.Error("Error sending 'typing' status", "error", err)
+	}
+
+	data := NewPromptData(&session.Data, "")
+	data.Week = progression.Week
+	data.PreviousPlan = previousPlan.Plan
+	data.CheckIn = formatCheckInAnswers(answers)
+	data.Workouts = formatWorkoutLogs(workouts)
+	data.Progression = progression.Instructions()
+	plan, err := b.completeWith(ctx, UsageCheckIn, session, data, nil, func() string {
+		return fallbackCheckInPlan(session.Data, progression)
+	})
+	if err != nil {
+		logger.Error("Error planning next week", "error", err)
+		b.sendText(chatID, "An error occurred while planning your next week. Please try /checkin again later.")
+		return
+	}
+
+	now := time.Now()
+	planRecord := PlanRecord{
+		UserID:        userID,
+		CreatedAt:     now,
+		PromptVersion: plan.PromptVersion,
+		SystemVersion: plan.SystemVersion,
+		Fallback:      plan.Fallback,
+		Week:          progression.Week,
+		Plan:          plan.Text,
+		Exercises:     planExercises(plan.Text),
+	}
+	b.savePlan(planRecord)
+
+	b.saveCheckIn(CheckInRecord{UserID: userID, CreatedAt: now, Answers: answers, Progression: progression})
+	checkInsTotal.WithLabelValues(string(progression.Adjustment)).Inc()
+	logger.Info("Check-in completed", "week", progression.Week, "adjustment", progression.Adjustment,
+		"load", progression.Load, "logged_workouts", answers.LoggedWorkouts)
+
+	summary := fmt.Sprintf("📊 Thanks! Next up is week %d: %s, because %s.",
+		progression.Week, adjustmentLabel(progression.Adjustment), strings.Join(progression.Reasons, ", "))
+	if answers.Pain == workout.PainSharp {
+		summary += "\n\n" + sharpPainAdvice
+	}
+	b.sendText(chatID, summary)
+	b.sendText(chatID, plan.Text)
+	b.sendExerciseGuides(chatID, planRecord.Exercises)
+}
+
+// logWorkout records a workout the user did
+func (b *Bot) logWorkout(message *tgbotapi.Message, session *UserSession) {
+	chatID := message.Chat.ID
+	if session.State != StateComplete {
+		b.sendText(chatID, "You can log workouts once your program is ready. Use /start to begin.")
+		return
+	}
+	text := strings.TrimSpace(message.CommandArguments())
+	if text == "" {
+		b.sendText(chatID, "Send what you did after the command, e.g. /log Day 1: goblet squats 3x10 with 12 kg, felt easy")
+		return
+	}
+	if runes := []rune(text); len(runes) > maxWorkoutLogText {
+		text = string(runes[:maxWorkoutLogText])
+	}
+
+	if err := b.saveWorkoutLog(WorkoutLog{UserID: session.UserID, Time: time.Now(), Text: text}); err != nil {
+		slog.Error("Error saving workout log", "user_id", session.UserID, "error", err)
+		b.sendText(chatID, "Your workout couldn't be saved. Please try again later.")
+		return
+	}
+
+	// Pain mentioned in the log gets the same urgent-care advice as questions
+	if b.screenInput(chatID, session.UserID, text) {
+		return
+	}
+
+	count := 1
+	if plan, ok := b.lastPlan(session.UserID); ok {
+		count = len(b.workoutLogs(session.UserID, plan.CreatedAt))
+	}
+	b.sendText(chatID, fmt.Sprintf("✅ Workout logged. Workouts logged for this program week: %d. Use /checkin at the end of the week to get your next week.", count))
+}
+
+// saveWorkoutLog stores a workout log and adds it to the user's logs
+func (b *Bot) saveWorkoutLog(entry WorkoutLog) error {
+	keys, err := b.workoutLogKeys(entry.UserID)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%d:%d", entry.UserID, entry.Time.UnixNano())
+	if err := b.store.Put(workoutLogsBucket, key, entry); err != nil {
+		return err
+	}
+	if err := b.store.Put(userWorkoutLogsBucket, strconv.FormatInt(entry.UserID, 10), append(keys, key)); err != nil {
+		slog.Error("Error indexing workout log", "user_id", entry.UserID, "error", err)
+	}
+	return nil
+}
+
+// workoutLogKeys returns the keys of the user's workout logs, oldest first.
+// Logs saved before the user_workout_logs index existed are found by
+// scanning the bucket once.
+func (b *Bot) workoutLogKeys(userID int64) ([]string, error) {
+	var keys []string
+	found, err := b.store.Get(userWorkoutLogsBucket, strconv.FormatInt(userID, 10), &keys)
+	if err != nil || found {
+		return keys, err
+	}
+
+	if keys, err = b.scanUserKeys(workoutLogsBucket, userID); err != nil {
+		return nil, err
+	}
+	if err := b.store.Put(userWorkoutLogsBucket, strconv.FormatInt(userID, 10), keys); err != nil {
+		slog.Error("Error indexing workout logs", "user_id", userID, "error", err)
+	}
+	return keys, nil
+}
+
+// workoutLogs returns the user's workouts logged after since, oldest first
+func (b *Bot) workoutLogs(userID int64, since time.Time) []WorkoutLog {
+	keys, err := b.workoutLogKeys(userID)
+	if err != nil {
+		slog.Error("Error listing workout logs", "user_id", userID, "error", err)
+		return nil
+	}
+
+	var logs []WorkoutLog
+	for _, key := range keys {
+		// Keys end with the log time, so older logs aren't read
+		if keyTime(key).Before(since) {
+			continue
+		}
+		var entry WorkoutLog
+		if ok, err := b.store.Get(workoutLogsBucket, key, &entry); err != nil || !ok {
+			continue
+		}
+		if entry.Time.After(since) {
+			logs = append(logs, entry)
+		}
+	}
+	return logs
+}
+
+// saveCheckIn stores a completed check-in and makes it the user's latest one
+func (b *Bot) saveCheckIn(record CheckInRecord) {
+	key := fmt.Sprintf("%d:%d", record.UserID, record.CreatedAt.UnixNano())
+	if err := b.store.Put(checkInsBucket, key, record); err != nil {
+		slog.Error("Error saving check-in", "user_id", record.UserID, "error", err)
+		return
+	}
+	if err := b.store.Put(latestCheckInsBucket, strconv.FormatInt(record.UserID, 10), key); err != nil {
+		slog.Error("Error indexing check-in", "user_id", record.UserID, "error", err)
+	}
+}
+
+// lastCheckIn returns the user's most recent check-in
+func (b *Bot) lastCheckIn(userID int64) (*CheckInRecord, bool) {
+	var key string
+	found, err := b.store.Get(latestCheckInsBucket, strconv.FormatInt(userID, 10), &key)
+	if err != nil {
+		return nil, false
+	}
+	if !found {
+		// Check-ins saved before the latest_checkins index existed
+		keys, err := b.scanUserKeys(checkInsBucket, userID)
+		if err != nil {
+			return nil, false
+		}
+		if len(keys) > 0 {
+			key = keys[len(keys)-1]
+		}
+		if err := b.store.Put(latestCheckInsBucket, strconv.FormatInt(userID, 10), key); err != nil {
+			slog.Error("Error indexing check-in", "user_id", userID, "error", err)
+		}
+	}
+	if key == "" {
+		return nil, false
+	}
+
+	var record CheckInRecord
+	if ok, err := b.store.Get(checkInsBucket, key, &record); err != nil || !ok {
+		return nil, false
+	}
+	return &record, true
+}
+
+// scanUserKeys returns the keys of the user's records in a bucket keyed by
+// user and time, oldest first. It reads every key of the bucket, so it only
+// builds the per-user indexes of records saved before they existed.
+func (b *Bot) scanUserKeys(bucket string, userID int64) ([]string, error) {
+	keys, err := b.store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("%d:", userID)
+	var userKeys []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			userKeys = append(userKeys, key)
+		}
+	}
+	sort.Slice(userKeys, func(i, j int) bool { return keyTime(userKeys[i]).Before(keyTime(userKeys[j])) })
+	return userKeys, nil
+}
+
+// keyTime returns the time at the end of a user:unix-nanoseconds key
+func keyTime(key string) time.Time {
+	_, nanos, _ := strings.Cut(key, ":")
+	n, _ := strconv.ParseInt(nanos, 10, 64)
+	return time.Unix(0, n)
+}
+
+// RemindCheckIns asks users for a check-in once their latest plan is interval old
+func (b *Bot) RemindCheckIns(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(checkInReminderTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				b.sendCheckInReminders(now, interval)
+			case <-b.life.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sendCheckInReminders reminds every paying user whose plan is due for a check-in, once per plan
+func (b *Bot) sendCheckInReminders(now time.Time, interval time.Duration) {
+	b.mutex.RLock()
+	var due []UserSession
+	for _, session := range b.snapshots {
+		if session.State == StateComplete && !session.BlockedBot && session.CheckIn == nil {
+			due = append(due, session)
+		}
+	}
+	b.mutex.RUnlock()
+
+	for _, session := range due {
+		b.life.mutex.Lock()
+		stopping := b.life.stopping
+		b.life.mutex.Unlock()
+		if stopping {
+			return
+		}
+
+		plan, ok := b.lastPlan(session.UserID)
+		if !ok || now.Sub(plan.CreatedAt) < interval {
+			continue
+		}
+		key := strconv.FormatInt(session.UserID, 10)
+		var reminder CheckInReminder
+		if _, err := b.store.Get(checkInRemindersBucket, key, &reminder); err != nil || reminder.PlanCreatedAt.Equal(plan.CreatedAt) {
+			continue
+		}
+
+		msg := tgbotapi.NewMessage(session.UserID, "📅 A week of your program is done! Answer five quick questions and I'll build your next week from how it went.")
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📝 Start check-in", CallbackCheckIn+"start"),
+		))
+		if _, err := b.api.Send(msg); err != nil {
+			slog.Error("Error sending check-in reminder", "user_id", session.UserID, "error", err)
+			continue
+		}
+		checkInsTotal.WithLabelValues("reminded").Inc()
+
+		reminder = CheckInReminder{PlanCreatedAt: plan.CreatedAt, SentAt: now}
+		if err := b.store.Put(checkInRemindersBucket, key, reminder); err != nil {
+			slog.Error("Error saving check-in reminder", "user_id", session.UserID, "error", err)
+		}
+	}
+}
+
+// adjustmentLabel describes an adjustment to the user
+func adjustmentLabel(adjustment workout.Adjustment) string {
+	switch adjustment {
+	case workout.AdjustDeload:
+		return "a lighter recovery week"
+	case workout.AdjustRepeat:
+		return "the same load again"
+	default:
+		return "a step up in load"
+	}
+}
+
+// formatCheckInAnswers lists the answers for the model
+func formatCheckInAnswers(answers workout.CheckIn) string {
+	labels := map[string]string{
+		"adherence":  string(answers.Adherence),
+		"difficulty": string(answers.Difficulty),
+		"energy":     string(answers.Energy),
+		"weight":     string(answers.Weight),
+		"pain":       string(answers.Pain),
+	}
+	var sb strings.Builder
+	for _, question := range checkInQuestions {
+		value := labels[question.Field]
+		for _, option := range question.Options {
+			if option[0] == value {
+				value = option[1]
+			}
+		}
+		// The question text without the "Weekly check-in (n/5)" heading
+		_, text, _ := strings.Cut(question.Text, "\n\n")
+		fmt.Fprintf(&sb, "- %s %s\n", text, value)
+	}
+	fmt.Fprintf(&sb, "- Workouts logged in the bot: %d", answers.LoggedWorkouts)
+	return sb.String()
+}
+
+// formatWorkoutLogs lists logged workouts for the model
+func formatWorkoutLogs(logs []WorkoutLog) string {
+	if len(logs) == 0 {
+		return "none"
+	}
+	if len(logs) > maxPromptWorkouts {
+		logs = logs[len(logs)-maxPromptWorkouts:]
+	}
+	var sb strings.Builder
+	for _, entry := range logs {
+		fmt.Fprintf(&sb, "- %s: %s\n", entry.Time.Format("Mon 2006-01-02"), entry.Text)
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"RestApiServer/Tg-bot/workout"
+)
+
+// scanCountingStore counts how often whole buckets are listed
+type scanCountingStore struct {
+	Store
+	scans atomic.Int64
+}
+
+func (s *scanCountingStore) Keys(bucket string) ([]string, error) {
+	s.scans.Add(1)
+	return s.Store.Keys(bucket)
+}
+
+func TestCheckInRemindersUseLatestPlanIndex(t *testing.T) {
+	h := NewHarness(t)
+	store := &scanCountingStore{Store: h.store}
+	h.Bot.store = store
+
+	now := time.Now()
+	weekAgo := now.Add(-9 * 24 * time.Hour)
+	const users = 20
+	for userID := int64(700); userID < 700+users; userID++ {
+		session := NewUserSession(userID)
+		session.State = StateComplete
+		h.Bot.saveSession(userID, session)
+		for week := 0; week < 3; week++ {
+			h.Bot.savePlan(PlanRecord{UserID: userID, CreatedAt: weekAgo.Add(time.Duration(week) * time.Hour), Plan: fmt.Sprintf("week %d", week)})
+		}
+	}
+
+	// A plan saved before the index existed is found by one scan
+	const legacyUser = 800
+	session := NewUserSession(legacyUser)
+	session.State = StateComplete
+	h.Bot.saveSession(legacyUser, session)
+	if err := h.store.Put(plansBucket, fmt.Sprintf("%d:%d", legacyUser, weekAgo.UnixNano()), PlanRecord{UserID: legacyUser, CreatedAt: weekAgo}); err != nil {
+		t.Fatal(err)
+	}
+
+	for tick := 0; tick < 3; tick++ {
+		h.Bot.sendCheckInReminders(now, 7*24*time.Hour)
+	}
+	if scans := store.scans.Load(); scans != 1 {
+		t.Errorf("plans were scanned %d times, want once for the legacy user", scans)
+	}
+
+	reminded := make(map[int64]int)
+	for _, message := range h.Telegram.Sent() {
+		if strings.Contains(message.Text, "A week of your program is done") {
+			reminded[message.ChatID]++
+		}
+	}
+	if len(reminded) != users+1 {
+		t.Errorf("%d users reminded, want %d", len(reminded), users+1)
+	}
+	for userID, count := range reminded {
+		if count != 1 {
+			t.Errorf("user %d reminded %d times, want once per plan", userID, count)
+		}
+	}
+
+	plan, ok := h.Bot.lastPlan(700)
+	if !ok || plan.Plan != "week 2" {
+		t.Errorf("lastPlan = %+v, want the newest plan", plan)
+	}
+}
+
+func TestCheckInOverQuotaKeepsProgression(t *testing.T) {
+	h := NewHarness(t, e2eResponses...)
+	h.Bot.usage.quota = UsageQuota{Tokens: 1_000_000}
+	const user = 130
+	if err := completeQuestionnaire(h, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The quota runs out while the user answers the questions
+	answers := []string{"start", "adherence:all", "difficulty:right", "energy:normal", "weight:same"}
+	for i, answer := range answers {
+		if err := h.Press(user, CallbackCheckIn+answer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.Expect(user, fmt.Sprintf("(%d/5)", i+1), e2eWait); err != nil {
+			t.Fatalf("after %s: %v", answer, err)
+		}
+	}
+	h.Bot.usage.Record(user, UsageQA, Usage{Model: "gpt-4o", PromptTokens: 1_000_000})
+	if err := h.Press(user, CallbackCheckIn+"pain:sharp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Expect(user, "used up your monthly limit", e2eWait); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Expect(user, "Joint or sharp pain", e2eWait); err != nil {
+		t.Fatal(err)
+	}
+
+	if checkIn, ok := h.Bot.lastCheckIn(user); ok {
+		t.Errorf("check-in without a plan was saved: %+v", checkIn)
+	}
+	if plan, ok := h.Bot.lastPlan(user); !ok || plan.Week != 0 {
+		t.Errorf("latest plan changed: %+v", plan)
+	}
+	for _, message := range h.Telegram.Sent() {
+		if message.ChatID == user && strings.Contains(message.Text, "Next up is week") {
+			t.Errorf("user was told about a week that wasn't planned: %q", message.Text)
+		}
+	}
+
+	// A new check-in isn't started while the quota is used up
+	if err := h.Send(user, "/checkin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Expect(user, "used up your monthly limit", e2eWait); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := h.Bot.sessionSnapshot(user); session.CheckIn != nil {
+		t.Errorf("check-in started over quota: %+v", session.CheckIn)
+	}
+}
+
+func TestCheckInsAndWorkoutLogsUseUserIndexes(t *testing.T) {
+	h := NewHarness(t)
+	store := &scanCountingStore{Store: h.store}
+	h.Bot.store = store
+
+	// Records saved before the indexes existed, with other users' records around them
+	planTime := time.Now().Add(-7 * 24 * time.Hour)
+	const legacyUser = 140
+	for userID := int64(140); userID < 150; userID++ {
+		for day := 0; day < 3; day++ {
+			at := planTime.Add(time.Duration(day-1) * 24 * time.Hour)
+			if err := h.store.Put(workoutLogsBucket, fmt.Sprintf("%d:%d", userID, at.UnixNano()), WorkoutLog{UserID: userID, Time: at, Text: fmt.Sprintf("day %d", day)}); err != nil {
+				t.Fatal(err)
+			}
+			record := CheckInRecord{UserID: userID, CreatedAt: at, Progression: workout.Progression{Week: day + 2}}
+			if err := h.store.Put(checkInsBucket, fmt.Sprintf("%d:%d", userID, at.UnixNano()), record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if logs := h.Bot.workoutLogs(legacyUser, planTime); len(logs) != 1 || logs[0].Text != "day 2" {
+			t.Fatalf("workoutLogs = %+v, want the log after the plan", logs)
+		}
+		if checkIn, ok := h.Bot.lastCheckIn(legacyUser); !ok || checkIn.Progression.Week != 4 {
+			t.Fatalf("lastCheckIn = %+v, want the latest", checkIn)
+		}
+	}
+	if scans := store.scans.Load(); scans != 2 {
+		t.Errorf("buckets were scanned %d times, want once each", scans)
+	}
+
+	// New records are indexed as they are saved
+	const newUser = 150
+	if err := h.Bot.saveWorkoutLog(WorkoutLog{UserID: newUser, Time: time.Now(), Text: "squats"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Bot.saveWorkoutLog(WorkoutLog{UserID: legacyUser, Time: time.Now(), Text: "lunges"}); err != nil {
+		t.Fatal(err)
+	}
+	h.Bot.saveCheckIn(CheckInRecord{UserID: legacyUser, CreatedAt: time.Now(), Progression: workout.Progression{Week: 5}})
+	store.scans.Store(0)
+
+	if logs := h.Bot.workoutLogs(legacyUser, planTime); len(logs) != 2 || logs[1].Text != "lunges" {
+		t.Errorf("workoutLogs = %+v, want the old and new logs", logs)
+	}
+	if logs := h.Bot.workoutLogs(newUser, planTime); len(logs) != 1 {
+		t.Errorf("workoutLogs = %+v, want the new log", logs)
+	}
+	if checkIn, ok := h.Bot.lastCheckIn(legacyUser); !ok || checkIn.Progression.Week != 5 {
+		t.Errorf("lastCheckIn = %+v, want the new check-in", checkIn)
+	}
+	if scans := store.scans.Load(); scans != 0 {
+		t.Errorf("buckets were scanned %d times for indexed users", scans)
+	}
+}
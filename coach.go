@@ -0,0 +1,350 @@
+// coach.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Store buckets of coach mode
+const (
+	coachesBucket      = "coaches"       // CoachRecord by coach ID
+	coachClientsBucket = "coach_clients" // CoachLink by client ID
+	coachRelayBucket   = "coach_relay"   // RelayRecord by coach ID and message ID
+)
+
+// coachPlanPreview is how much of the latest plan the roster shows
+const coachPlanPreview = 300
+
+// CoachRecord is a trainer who reviews clients
+type CoachRecord struct {
+	ID      int64     `json:"id"`
+	AddedBy int64     `json:"added_by"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// CoachLink assigns a client to a coach
+type CoachLink struct {
+	ClientID   int64     `json:"client_id"`
+	CoachID    int64     `json:"coach_id"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// RelayRecord remembers which client a question forwarded to a coach came from,
+// so the coach's reply to it can be relayed back
+type RelayRecord struct {
+	ClientID int64     `json:"client_id"`
+	Question string    `json:"question"`
+	AskedAt  time.Time `json:"asked_at"`
+}
+
+// isCoach checks if the user has a coach account
+func (b *Bot) isCoach(userID int64) bool {
+	var coach CoachRecord
+	ok, err := b.store.Get(coachesBucket, strconv.FormatInt(userID, 10), &coach)
+	if err != nil {
+		slog.Error("Error reading coach", "user_id", userID, "error", err)
+	}
+	return ok
+}
+
+// coachOf returns the coach assigned to the client
+func (b *Bot) coachOf(clientID int64) (int64, bool) {
+	var link CoachLink
+	ok, err := b.store.Get(coachClientsBucket, strconv.FormatInt(clientID, 10), &link)
+	if err != nil {
+		slog.Error("Error reading coach link", "client_id", clientID, "error", err)
+	}
+	return link.CoachID, ok
+}
+
+// clientsOf returns the clients assigned to the coach in ascending order
+func (b *Bot) clientsOf(coachID int64) ([]CoachLink, error) {
+	keys, err := b.store.Keys(coachClientsBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []CoachLink
+	for _, key := range keys {
+		var link CoachLink
+		if ok, err := b.store.Get(coachClientsBucket, key, &link); err != nil || !ok {
+			continue
+		}
+		if link.CoachID == coachID {
+			clients = append(clients, link)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+	return clients, nil
+}
+
+// coachCommandUsage returns the usage of a coach admin command
+func coachCommandUsage(command string) string {
+	if command == "assign" {
+		return "Usage: /assign <client id> <coach id>"
+	}
+	return fmt.Sprintf("Usage: /%s <telegram user id>", command)
+}
+
+// parseCoachCommandArgs parses the user IDs of a coach admin command
+func parseCoachCommandArgs(command, args string) ([]int64, bool) {
+	want := 1
+	if command == "assign" {
+		want = 2
+	}
+	fields := strings.Fields(args)
+	if len(fields) != want {
+		return nil, false
+	}
+	ids := make([]int64, 0, want)
+	for _, field := range fields {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// runCoachAdminCommand creates and removes coaches and assigns clients to them.
+// Unlike other admin actions, the users involved don't need a session.
+func (b *Bot) runCoachAdminCommand(adminID int64, command string, ids []int64) (string, error) {
+	targetID := ids[0]
+	key := strconv.FormatInt(targetID, 10)
+
+	switch command {
+	case "addcoach":
+		if b.isCoach(targetID) {
+			return "", errors.New("user is already a coach")
+		}
+		coach := CoachRecord{ID: targetID, AddedBy: adminID, AddedAt: time.Now()}
+		if err := b.store.Put(coachesBucket, key, coach); err != nil {
+			return "", err
+		}
+		b.sendText(targetID, "🏋️ You are now a coach. Use /clients to see your clients and reply to their forwarded questions to answer them.")
+		return fmt.Sprintf("✅ User %d is now a coach", targetID), nil
+
+	case "removecoach":
+		if !b.isCoach(targetID) {
+			return "", errors.New("user is not a coach")
+		}
+		clients, err := b.clientsOf(targetID)
+		if err != nil {
+			return "", err
+		}
+		if len(clients) > 0 {
+			return "", fmt.Errorf("coach still has %d clients, /unassign them first", len(clients))
+		}
+		if err := b.store.Delete(coachesBucket, key); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("✅ User %d is no longer a coach", targetID), nil
+
+	case "assign":
+		coachID := ids[1]
+		if !b.isCoach(coachID) {
+			return "", fmt.Errorf("user %d is not a coach", coachID)
+		}
+		if coachID == targetID {
+			return "", errors.New("a coach can't be their own client")
+		}
+		link := CoachLink{ClientID: targetID, CoachID: coachID, AssignedAt: time.Now()}
+		if err := b.store.Put(coachClientsBucket, key, link); err != nil {
+			return "", err
+		}
+		b.sendText(targetID, "🏋️ A personal coach now reviews your progress. Send /coach followed by your question to ask them.")
+		b.sendText(coachID, fmt.Sprintf("👤 User %d is now your client. Use /clients to see their data.", targetID))
+		return fmt.Sprintf("✅ User %d assigned to coach %d", targetID, coachID), nil
+
+	case "unassign":
+		if _, ok := b.coachOf(targetID); !ok {
+			return "", errors.New("user has no coach")
+		}
+		if err := b.store.Delete(coachClientsBucket, key); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("✅ User %d no longer has a coach", targetID), nil
+	}
+
+	return "", fmt.Errorf("unknown coach command: %s", command)
+}
+
+// askCoach forwards a client's question to their coach
+func (b *Bot) askCoach(message *tgbotapi.Message) {
+	clientID := message.From.ID
+	chatID := message.Chat.ID
+	logger := slog.With("user_id", clientID)
+
+	coachID, ok := b.coachOf(clientID)
+	if !ok {
+		b.sendText(chatID, "You don't have a personal coach. Ask your questions here and the AI assistant will answer them.")
+		return
+	}
+	question := strings.TrimSpace(message.CommandArguments())
+	if question == "" {
+		b.sendText(chatID, "Send your question after the command, e.g. /coach Is my squat depth OK?")
+		return
+	}
+
+	// The coach should know about red flags, the client gets urgent-care advice right away
+	header := fmt.Sprintf("❓ Question from client %s (%d):", clientName(message.From), clientID)
+	if finding := b.safety.Screen(question, ScopeInput); finding != nil {
+		b.incidents.Record(SafetyIncident{
+			UserID:   clientID,
+			Scope:    ScopeInput,
+			RuleID:   finding.RuleID,
+			Category: finding.Category,
+			Match:    finding.Match,
+		})
+		b.sendText(chatID, finding.Message())
+		header = fmt.Sprintf("⚠️ Possible medical red flag (%s)\n%s", finding.Category, header)
+	}
+
+	sent, err := b.api.Send(tgbotapi.NewMessage(coachID, header+"\n\n"+question+"\n\nReply to this message to answer."))
+	if err != nil {
+		logger.Error("Error forwarding question to coach", "coach_id", coachID, "error", err)
+		coachMessagesTotal.WithLabelValues("question", "failed").Inc()
+		b.sendText(chatID, "Your coach can't be reached right now. Please try again later.")
+		return
+	}
+
+	relay := RelayRecord{ClientID: clientID, Question: question, AskedAt: time.Now()}
+	if err := b.store.Put(coachRelayBucket, relayKey(coachID, sent.MessageID), relay); err != nil {
+		logger.Error("Error saving coach relay", "coach_id", coachID, "error", err)
+	}
+	coachMessagesTotal.WithLabelValues("question", "relayed").Inc()
+	logger.Info("Forwarded question to coach", "coach_id", coachID, "question_length", len(question))
+	b.sendText(chatID, "✅ Your question was sent to your coach. Their answer will appear here.")
+}
+
+// relayCoachReply sends a coach's reply to a forwarded question back to the
+// client. It reports false if the message isn't such a reply.
+func (b *Bot) relayCoachReply(message *tgbotapi.Message) bool {
+	coachID := message.From.ID
+	if message.ReplyToMessage == nil || message.Text == "" || !b.isCoach(coachID) {
+		return false
+	}
+
+	var relay RelayRecord
+	ok, err := b.store.Get(coachRelayBucket, relayKey(coachID, message.ReplyToMessage.MessageID), &relay)
+	if err != nil || !ok {
+		return false
+	}
+
+	// The client must still belong to this coach
+	if current, ok := b.coachOf(relay.ClientID); !ok || current != coachID {
+		b.sendText(message.Chat.ID, fmt.Sprintf("User %d is no longer your client, the reply was not sent.", relay.ClientID))
+		return true
+	}
+
+	if _, err := b.api.Send(tgbotapi.NewMessage(relay.ClientID, "💬 Your coach replied:\n\n"+message.Text)); err != nil {
+		slog.Error("Error relaying coach reply", "coach_id", coachID, "client_id", relay.ClientID, "error", err)
+		coachMessagesTotal.WithLabelValues("reply", "failed").Inc()
+		b.sendText(message.Chat.ID, "The reply could not be delivered, the client may have blocked the bot.")
+		return true
+	}
+	coachMessagesTotal.WithLabelValues("reply", "relayed").Inc()
+	slog.Info("Relayed coach reply", "coach_id", coachID, "client_id", relay.ClientID, "reply_length", len(message.Text))
+	b.sendText(message.Chat.ID, fmt.Sprintf("✅ Reply sent to client %d", relay.ClientID))
+	return true
+}
+
+// sendClientRoster lists a coach's clients. Coaches see their own clients,
+// admins may name a coach with /clients <coach id>.
+func (b *Bot) sendClientRoster(message *tgbotapi.Message) {
+	userID := message.From.ID
+	chatID := message.Chat.ID
+
+	coachID := userID
+	if args := strings.TrimSpace(message.CommandArguments()); args != "" && b.isAdmin(userID) {
+		id, err := strconv.ParseInt(args, 10, 64)
+		if err != nil {
+			b.sendText(chatID, "Usage: /clients <coach id>")
+			return
+		}
+		coachID = id
+	}
+	if !b.isCoach(coachID) {
+		if b.isAdmin(userID) && coachID != userID {
+			b.sendText(chatID, fmt.Sprintf("User %d is not a coach.", coachID))
+			return
+		}
+		slog.Warn("Non-coach tried to list clients", "user_id", userID)
+		b.sendText(chatID, "Unknown command. Use /help for assistance.")
+		return
+	}
+
+	clients, err := b.clientsOf(coachID)
+	if err != nil {
+		slog.Error("Error listing clients", "coach_id", coachID, "error", err)
+		b.sendText(chatID, "The client list is unavailable right now. Please try again later.")
+		return
+	}
+	if len(clients) == 0 {
+		b.sendText(chatID, "👥 No clients are assigned yet.")
+		return
+	}
+
+	b.sendText(chatID, fmt.Sprintf("👥 %d clients", len(clients)))
+	for _, link := range clients {
+		b.sendText(chatID, b.formatClient(link))
+	}
+}
+
+// formatClient describes a client for their coach
+func (b *Bot) formatClient(link CoachLink) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "👤 Client %d (since %s)\n\n", link.ClientID, link.AssignedAt.Format("2006-01-02"))
+
+	session, ok := b.sessionSnapshot(link.ClientID)
+	if !ok {
+		sb.WriteString("No activity since the bot was restarted.")
+		return sb.String()
+	}
+
+	lastActivity := "never"
+	if !session.LastActivity.IsZero() {
+		lastActivity = session.LastActivity.Format("2006-01-02 15:04")
+	}
+	fmt.Fprintf(&sb, "• State: %s\n• Last message: %s\n• Messages: %d\n• AI usage: %s\n\n%s",
+		session.State, lastActivity, session.MessageCount, b.formatUsageLine(link.ClientID),
+		session.Data.FormatUserDataBeautifully())
+
+	plan, ok := b.lastPlan(link.ClientID)
+	if !ok {
+		sb.WriteString("\n\n📋 No plan yet")
+		return sb.String()
+	}
+	text := plan.Plan
+	if runes := []rune(text); len(runes) > coachPlanPreview {
+		text = string(runes[:coachPlanPreview]) + "…"
+	}
+	fmt.Fprintf(&sb, "\n\n📋 Latest plan (%s):\n%s", b.formatLastPlan(link.ClientID), text)
+	return sb.String()
+}
+
+// relayKey identifies a forwarded question by the coach's chat and message
+func relayKey(coachID int64, messageID int) string {
+	return fmt.Sprintf("%d:%d", coachID, messageID)
+}
+
+// clientName returns how a client is shown to their coach
+func clientName(user *tgbotapi.User) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if user.UserName != "" {
+		name += " @" + user.UserName
+	}
+	if name == "" {
+		return "without a name"
+	}
+	return name
+}
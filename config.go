@@ -3,53 +3,468 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
 // Config contains application configuration
 type Config struct {
 	TelegramToken string
-	OpenAIToken   string
+	// Bot API endpoint, for a local Bot API server or a test double
+	TelegramAPIEndpoint string
+	UpdateMode          string
+	BaseURL             string // Public URL for payment redirects and the Telegram webhook
+	WebhookSecret       string
+	Port                string
+	ShutdownTimeout     time.Duration
+	// Concurrent update handlers and updates waiting for one
+	DispatchWorkers   int
+	DispatchQueueSize int
+
+	AdminIDs      []int64
+	AuditLogPath  string
+	DebugCommands bool
+	LogLevel      string
+	LogFormat     string
+	StorePath     string
+	RateLimits    map[RateTier]map[RateFeature]RateLimit
+
+	StripeSecretKey     string
+	StripeWebhookSecret string
+	StripeTestMode      bool
+	StripeAPIURL        string
+	Referrals           ReferralRewards
+
+	LLM           map[UsageFeature]LLMConfig
+	ModelPrices   map[string]ModelPrice
+	UsageQuota    UsageQuota
+	PromptsDir    string
+	PromptsReload time.Duration
+	UserDataJSON  bool // Send user data to the model as JSON
+	Speech        STTConfig
+	SafetyRules   string
+	SafetyLogPath string
+
+	// Weekly check-ins, offered when the latest plan is CheckInInterval old
+	CheckInReminders bool
+	CheckInInterval  time.Duration
+}
+
+// setting documents a configuration value and its default
+type setting struct {
+	Name    string
+	Default string
+	Help    string
+}
+
+// settings lists every configuration value. Each is read from the environment
+// (including .env), then from the CONFIG_FILE, then falls back to the default.
+var settings = []setting{
+	{"TELEGRAM_TOKEN", "", "bot token from @BotFather (required)"},
+	{"TELEGRAM_API_ENDPOINT", tgbotapi.APIEndpoint, "Bot API endpoint with %s for token and method"},
+	{"BOT_UPDATE_MODE", UpdateModePolling, "how to receive updates: polling or webhook"},
+	{"BOT_WEBHOOK_BASE_URL", "", "public URL for payment redirects and the webhook (default http://localhost:PORT)"},
+	{"BOT_WEBHOOK_SECRET", "", "secret token Telegram sends with webhook requests (random if empty)"},
+	{"PORT", "4242", "HTTP server port"},
+	{"SHUTDOWN_TIMEOUT", "25s", "time to finish in-flight work on SIGTERM"},
+	{"DISPATCH_WORKERS", "32", "updates handled at the same time"},
+	{"DISPATCH_QUEUE_SIZE", "1000", "updates queued before intake slows down"},
+
+	{"ADMIN_USER_IDS", "", "comma-separated Telegram user IDs allowed to use admin commands"},
+	{"ADMIN_AUDIT_LOG", "admin_audit.log", "append-only log of admin actions"},
+	{"ENABLE_DEBUG_COMMANDS", "false", "allow admins to use /complete_payment"},
+	{"LOG_LEVEL", "info", "debug, info, warn or error"},
+	{"LOG_FORMAT", "text", "text or json"},
+	{"STORE_PATH", "data/store.json", "file with rate limits, usage and plans"},
+	{"RATE_LIMITS", "", `overrides of the default rate limits, e.g. "paid.qa=50/1h,free.qa=10/24h"`},
+
+	{"STRIPE_SECRET_KEY", "", "Stripe API key"},
+	{"STRIPE_WEBHOOK_SECRET", "", "signing secret of the Stripe webhook (signatures unchecked if empty)"},
+	{"STRIPE_TEST_MODE", "false", "treat every checkout as paid and accept unsigned webhooks"},
+	{"STRIPE_API_URL", "", "Stripe API URL, e.g. of stripe-mock (default api.stripe.com)"},
+	{"REFERRAL_REFERRER_CREDITS", "10", "extra Q&A answers for a user whose invited friend pays"},
+	{"REFERRAL_REFERRED_CREDITS", "5", "extra Q&A answers for an invited user who pays"},
+	{"REFERRAL_DISCOUNT_PERCENT", "20", "discount on the inviting user's next checkout, 0-90"},
+
+	{"LLM_PROVIDER", ProviderOpenAI, "openai, compatible or scripted"},
+	{"OPENAI_TOKEN", "", "OpenAI API key, required for the openai provider"},
+	{"OPENAI_MODEL", "", "model name (default gpt-3.5-turbo, required for compatible)"},
+	{"OPENAI_BASE_URL", "", "API URL of an OpenAI-compatible server"},
+	{"LLM_SCRIPT", "", "JSON file with responses of the scripted provider"},
+	{"LLM_MAX_RETRIES", strconv.Itoa(defaultRetryPolicy.MaxRetries), "retries of transient LLM errors"},
+	{"LLM_RETRY_BASE_DELAY", defaultRetryPolicy.BaseDelay.String(), "first retry delay, doubled on each retry"},
+	{"LLM_RETRY_MAX_DELAY", defaultRetryPolicy.MaxDelay.String(), "longest retry delay"},
+	{"LLM_BREAKER_FAILURES", strconv.Itoa(defaultBreakerConfig.FailureThreshold), "failures in a row that open the circuit breaker"},
+	{"LLM_BREAKER_COOLDOWN", defaultBreakerConfig.Cooldown.String(), "time before an open circuit is tried again"},
+	{"USE_OPENAI_FALLBACK", "false", "always answer with the offline generator"},
+	{"OPENAI_PRICING", "", `model prices in USD per million tokens, e.g. "gpt-4o=2.5/10"`},
+	{"USAGE_MONTHLY_TOKENS", "0", "monthly token quota per user, 0 for unlimited"},
+	{"USAGE_MONTHLY_COST_USD", "0", "monthly cost quota per user, 0 for unlimited"},
+	{"PROMPTS_DIR", "prompts", "directory with prompt templates"},
+	{"PROMPTS_RELOAD_INTERVAL", "30s", "how often prompt files are checked for changes"},
+	{"USE_JSON_FORMAT", "false", "send user data to the model as JSON"},
+	{"CHECKIN_REMINDERS", "true", "remind users to check in when their plan is CHECKIN_INTERVAL old"},
+	{"CHECKIN_INTERVAL", "168h", "age of the latest plan that makes a check-in due"},
+	{"STT_PROVIDER", "", "speech-to-text for voice messages: openai, whispercpp, scripted or none (default openai if OPENAI_TOKEN is set)"},
+	{"STT_MODEL", "", "transcription model (default whisper-1)"},
+	{"STT_BASE_URL", "", "URL of a whisper.cpp server or an OpenAI-compatible transcription API"},
+	{"STT_API_KEY", "", "transcription API key (default OPENAI_TOKEN)"},
+	{"STT_LANGUAGE", "", "language of voice messages, e.g. en (detected if empty)"},
+	{"SAFETY_RULES", "", "JSON file with medical red-flag rules (built-in if empty)"},
+	{"SAFETY_INCIDENT_LOG", "safety_incidents.log", "append-only log of red flags found"},
+}
+
+// llmFeatureSettings override the LLM_* settings for one feature as LLM_<FEATURE>_<NAME>
+var llmFeatureSettings = []string{
+	"PROVIDER", "MODEL", "BASE_URL", "API_KEY", "SCRIPT", "MAX_RETRIES",
+	"RETRY_BASE_DELAY", "RETRY_MAX_DELAY", "BREAKER_FAILURES", "BREAKER_COOLDOWN",
+}
+
+// knownSettings returns all settings, including the per-feature LLM ones
+func knownSettings() []setting {
+	all := append([]setting(nil), settings...)
+	for _, feature := range llmFeatures {
+		for _, name := range llmFeatureSettings {
+			all = append(all, setting{
+				Name: llmSettingName(feature, name),
+				Help: fmt.Sprintf("%s for the %s feature (default from the LLM_*/OPENAI_* setting)", strings.ToLower(name), feature),
+			})
+		}
+	}
+	return all
+}
+
+// llmSettingName returns the per-feature name of an LLM setting
+func llmSettingName(feature UsageFeature, name string) string {
+	return "LLM_" + strings.ToUpper(string(feature)) + "_" + name
+}
+
+// configSource looks up settings in the environment, then the config file, then the defaults
+type configSource struct {
+	file     map[string]string
+	defaults map[string]string
+}
+
+// newConfigSource reads the config file at path, which may be empty
+func newConfigSource(path string) (*configSource, error) {
+	src := &configSource{file: map[string]string{}, defaults: map[string]string{}}
+	known := make(map[string]bool)
+	for _, s := range knownSettings() {
+		known[s.Name] = true
+		src.defaults[s.Name] = s.Default
+	}
+
+	if path == "" {
+		return src, nil
+	}
+	values, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown setting %s in %s", name, path)
+		}
+		src.file[name] = value
+	}
+	return src, nil
+}
+
+// lookup returns a setting and where it came from: env, file or default
+func (s *configSource) lookup(name string) (string, string) {
+	if value := os.Getenv(name); value != "" {
+		return value, "env"
+	}
+	if value, ok := s.file[name]; ok {
+		return value, "file"
+	}
+	return s.defaults[name], "default"
+}
+
+// str returns a setting as text
+func (s *configSource) str(name string) string {
+	value, _ := s.lookup(name)
+	return value
 }
 
-// LoadConfig loads configuration from environment variables or .env file
+// boolean parses a true/false setting
+func (s *configSource) boolean(name string) (bool, error) {
+	value := s.str(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expected true or false", name, value)
+	}
+	return b, nil
+}
+
+// integer parses a non-negative integer setting
+func (s *configSource) integer(name string) (int, error) {
+	return envInt(name, s.str(name), 0)
+}
+
+// duration parses a positive duration setting
+func (s *configSource) duration(name string) (time.Duration, error) {
+	return envDuration(name, s.str(name), 0)
+}
+
+// LoadConfig loads configuration from environment variables, the .env file
+// and the YAML or TOML file named by CONFIG_FILE
 func LoadConfig() (*Config, error) {
 	// Load from .env file
 	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: Failed to load .env file: %v", err)
+		slog.Warn("Failed to load .env file", "error", err)
 		// Continue - environment variables may already be set
 	}
 
-	telegramToken := os.Getenv("TELEGRAM_TOKEN")
-	if telegramToken == "" {
-		return nil, errors.New("TELEGRAM_TOKEN not set")
+	src, err := newConfigSource(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
 	}
+	return loadConfig(src)
+}
 
-	openAIToken := os.Getenv("OPENAI_TOKEN")
-	if openAIToken == "" {
-		return nil, errors.New("OPENAI_TOKEN not set")
+// loadConfig builds the config from a source and reports all invalid settings at once
+func loadConfig(src *configSource) (*Config, error) {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	// For local development - optionally use webhook secret
-	stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	if stripeWebhookSecret == "" {
-		log.Printf("WARNING: STRIPE_WEBHOOK_SECRET not set, webhook signatures will not be verified")
+	config := &Config{
+		TelegramToken:       src.str("TELEGRAM_TOKEN"),
+		TelegramAPIEndpoint: src.str("TELEGRAM_API_ENDPOINT"),
+		UpdateMode:          src.str("BOT_UPDATE_MODE"),
+		BaseURL:             strings.TrimSuffix(src.str("BOT_WEBHOOK_BASE_URL"), "/"),
+		WebhookSecret:       src.str("BOT_WEBHOOK_SECRET"),
+		Port:                src.str("PORT"),
+		AuditLogPath:        src.str("ADMIN_AUDIT_LOG"),
+		LogLevel:            src.str("LOG_LEVEL"),
+		LogFormat:           src.str("LOG_FORMAT"),
+		StorePath:           src.str("STORE_PATH"),
+		StripeSecretKey:     src.str("STRIPE_SECRET_KEY"),
+		StripeWebhookSecret: src.str("STRIPE_WEBHOOK_SECRET"),
+		StripeAPIURL:        src.str("STRIPE_API_URL"),
+		PromptsDir:          src.str("PROMPTS_DIR"),
+		SafetyRules:         src.str("SAFETY_RULES"),
+		SafetyLogPath:       src.str("SAFETY_INCIDENT_LOG"),
 	}
 
-	// Print port for debugging
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "4242"
-		log.Printf("Using default port: %s", port)
-	} else {
-		log.Printf("Using specified port: %s", port)
+	if config.TelegramToken == "" {
+		check(errors.New("TELEGRAM_TOKEN not set"))
+	}
+	if strings.Count(config.TelegramAPIEndpoint, "%s") != 2 {
+		check(fmt.Errorf("TELEGRAM_API_ENDPOINT must contain two %%s for token and method, got %q", config.TelegramAPIEndpoint))
+	}
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		check(fmt.Errorf("invalid PORT %q", config.Port))
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = "http://localhost:" + config.Port
+	}
+
+	// Telegram updates by long polling or by webhook on BOT_WEBHOOK_BASE_URL
+	switch config.UpdateMode {
+	case UpdateModePolling:
+	case UpdateModeWebhook:
+		if !strings.HasPrefix(config.BaseURL, "https://") {
+			check(fmt.Errorf("BOT_WEBHOOK_BASE_URL must be an https URL in webhook mode, got %q", config.BaseURL))
+		}
+		if config.WebhookSecret == "" {
+			// Telegram is re-registered on every start, so a random secret works
+			config.WebhookSecret = newCorrelationID() + newCorrelationID()
+		} else if !telegramSecretPattern.MatchString(config.WebhookSecret) {
+			check(errors.New("BOT_WEBHOOK_SECRET may only contain A-Z, a-z, 0-9, _ and -"))
+		}
+	default:
+		check(fmt.Errorf("invalid BOT_UPDATE_MODE %q, expected %s or %s", config.UpdateMode, UpdateModePolling, UpdateModeWebhook))
+	}
+
+	var err error
+	config.ShutdownTimeout, err = src.duration("SHUTDOWN_TIMEOUT")
+	check(err)
+
+	// Update processing; each user's updates are always handled one at a time
+	config.DispatchWorkers, err = src.integer("DISPATCH_WORKERS")
+	check(err)
+	config.DispatchQueueSize, err = src.integer("DISPATCH_QUEUE_SIZE")
+	check(err)
+	if config.DispatchWorkers < 1 || config.DispatchQueueSize < config.DispatchWorkers {
+		check(fmt.Errorf("DISPATCH_WORKERS must be positive and DISPATCH_QUEUE_SIZE at least DISPATCH_WORKERS, got %d and %d", config.DispatchWorkers, config.DispatchQueueSize))
+	}
+
+	// Telegram user IDs allowed to use admin commands
+	config.AdminIDs, err = parseAdminIDs(src.str("ADMIN_USER_IDS"))
+	check(err)
+	config.DebugCommands, err = src.boolean("ENABLE_DEBUG_COMMANDS")
+	check(err)
+	check(validateLogging(config.LogLevel, config.LogFormat))
+
+	// Per-tier rate limits, e.g. RATE_LIMITS="paid.qa=50/1h,free.qa=10/24h"
+	config.RateLimits, err = parseRateLimits(src.str("RATE_LIMITS"))
+	check(err)
+
+	config.StripeTestMode, err = src.boolean("STRIPE_TEST_MODE")
+	check(err)
+
+	// Rewards granted when an invited user pays
+	config.Referrals.ReferrerCredits, err = src.integer("REFERRAL_REFERRER_CREDITS")
+	check(err)
+	config.Referrals.ReferredCredits, err = src.integer("REFERRAL_REFERRED_CREDITS")
+	check(err)
+	config.Referrals.DiscountPercent, err = src.integer("REFERRAL_DISCOUNT_PERCENT")
+	check(err)
+	if config.Referrals.DiscountPercent > 90 {
+		check(fmt.Errorf("REFERRAL_DISCOUNT_PERCENT must be at most 90, got %d", config.Referrals.DiscountPercent))
 	}
 
-	return &Config{
-		TelegramToken: telegramToken,
-		OpenAIToken:   openAIToken,
-	}, nil
+	// Language model provider for each feature
+	config.LLM = make(map[UsageFeature]LLMConfig)
+	for _, feature := range llmFeatures {
+		cfg, err := loadLLMConfig(src, feature)
+		check(err)
+		config.LLM[feature] = cfg
+	}
+
+	// OpenAI prices in USD per million tokens, e.g. OPENAI_PRICING="gpt-4o=2.5/10"
+	config.ModelPrices, err = parseModelPrices(src.str("OPENAI_PRICING"))
+	check(err)
+
+	// Monthly OpenAI quota per user, unlimited if zero
+	config.UsageQuota.Tokens, err = src.integer("USAGE_MONTHLY_TOKENS")
+	check(err)
+	if value := src.str("USAGE_MONTHLY_COST_USD"); value != "" {
+		config.UsageQuota.CostUSD, err = strconv.ParseFloat(value, 64)
+		if err != nil || config.UsageQuota.CostUSD < 0 {
+			check(fmt.Errorf("invalid USAGE_MONTHLY_COST_USD %q", value))
+		}
+	}
+
+	// Prompt templates, checked for changes every PROMPTS_RELOAD_INTERVAL
+	config.PromptsReload, err = src.duration("PROMPTS_RELOAD_INTERVAL")
+	check(err)
+	config.UserDataJSON, err = src.boolean("USE_JSON_FORMAT")
+	check(err)
+
+	// Weekly check-ins that plan the next week
+	config.CheckInReminders, err = src.boolean("CHECKIN_REMINDERS")
+	check(err)
+	config.CheckInInterval, err = src.duration("CHECKIN_INTERVAL")
+	check(err)
+
+	// Speech-to-text for voice messages
+	config.Speech, err = loadSTTConfig(src)
+	check(err)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if len(config.AdminIDs) == 0 {
+		slog.Warn("ADMIN_USER_IDS not set, admin commands are disabled")
+	}
+	if config.StripeWebhookSecret == "" {
+		slog.Warn("STRIPE_WEBHOOK_SECRET not set, webhook signatures will not be verified")
+	}
+	return config, nil
+}
+
+// loadConfigFile reads settings from a YAML or TOML file. Nested keys are
+// joined with underscores, so llm: {plan: {model: x}} sets LLM_PLAN_MODEL.
+func loadConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var tree map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &tree)
+	case ".toml":
+		err = toml.Unmarshal(content, &tree)
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flattenConfig("", tree, values)
+	return values, nil
+}
+
+// flattenConfig turns nested tables into setting names
+func flattenConfig(prefix string, tree map[string]any, values map[string]string) {
+	for key, value := range tree {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			flattenConfig(name, v, values)
+		case []any:
+			// Lists like admin_user_ids: [1, 2] become comma-separated values
+			parts := make([]string, len(v))
+			for i, item := range v {
+				parts[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(parts, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+// runConfigCommand implements the config command, which prints every setting
+// with its source and validates the configuration:
+//
+//	CONFIG_FILE=config.yaml go run . config
+func runConfigCommand(stdout io.Writer) error {
+	godotenv.Load()
+	src, err := newConfigSource(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return err
+	}
+
+	for _, s := range knownSettings() {
+		value, source := src.lookup(s.Name)
+		if value != "" && isSecretSetting(s.Name) {
+			value = "[REDACTED]"
+		}
+		fmt.Fprintf(stdout, "%-28s %-7s %-36q # %s\n", s.Name, source, value, s.Help)
+	}
+
+	_, err = loadConfig(src)
+	return err
+}
+
+// isSecretSetting reports whether a setting must not be printed
+func isSecretSetting(name string) bool {
+	for _, word := range []string{"TOKEN", "SECRET", "KEY"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
 }
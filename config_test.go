@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"yaml", `
+telegram_token: "123:abc"
+admin_user_ids: [1, 2]
+rate_limits: "paid.qa=50/1h,free.qa=10/24h"
+stripe:
+  webhook_secret: whsec_1
+llm:
+  plan:
+    model: gpt-4o
+openai_pricing: gpt-4o=2.5/10
+`},
+		{"toml", `
+telegram_token = "123:abc"
+admin_user_ids = [1, 2]
+rate_limits = ["paid.qa=50/1h", "free.qa=10/24h"] # A comma in the values
+stripe.webhook_secret = "whsec_1"
+llm = { plan = { model = "gpt-4o" } }
+openai_pricing = """
+gpt-4o=2.5/10"""
+`},
+	}
+	want := map[string]string{
+		"TELEGRAM_TOKEN":        "123:abc",
+		"ADMIN_USER_IDS":        "1,2",
+		"RATE_LIMITS":           "paid.qa=50/1h,free.qa=10/24h",
+		"STRIPE_WEBHOOK_SECRET": "whsec_1",
+		"LLM_PLAN_MODEL":        "gpt-4o",
+		"OPENAI_PRICING":        "gpt-4o=2.5/10",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := loadConfigFile(writeConfigFile(t, "config."+tt.name, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range want {
+				if values[name] != value {
+					t.Errorf("%s = %q, want %q", name, values[name], value)
+				}
+			}
+			if len(values) != len(want) {
+				t.Errorf("got %d settings, want %d: %v", len(values), len(want), values)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		file, content, err string
+	}{
+		{"config.toml", "telegram_token = \"unterminated\n", "parsing config file"},
+		{"config.yaml", "telegram_token: [1", "parsing config file"},
+		{"config.json", "{}", "must be .yaml, .yml or .toml"},
+		{"config.toml", "telegram = { tokn = \"x\" }", "unknown setting TELEGRAM_TOKN"},
+	}
+	for _, tt := range tests {
+		_, err := newConfigSource(writeConfigFile(t, tt.file, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: error %v, want %q", tt.file, tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	setValidConfigEnv(t)
+	src, err := newConfigSource(writeConfigFile(t, "config.toml", `
+port = 8080
+shutdown_timeout = "10s"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PORT", "9090")
+
+	tests := []struct {
+		name, value, source string
+	}{
+		{"PORT", "9090", "env"},               // Set in the environment and the file
+		{"SHUTDOWN_TIMEOUT", "10s", "file"},   // Only set in the file
+		{"DISPATCH_WORKERS", "32", "default"}, // Set nowhere
+	}
+	for _, tt := range tests {
+		if value, source := src.lookup(tt.name); value != tt.value || source != tt.source {
+			t.Errorf("lookup(%s) = %q from %s, want %q from %s", tt.name, value, source, tt.value, tt.source)
+		}
+	}
+
+	config, err := loadConfig(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != "9090" || config.ShutdownTimeout != 10*time.Second || config.DispatchWorkers != 32 {
+		t.Errorf("config has port %s, shutdown timeout %s, %d workers", config.Port, config.ShutdownTimeout, config.DispatchWorkers)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	setValidConfigEnv(t)
+	src, err := newConfigSource("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(src); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		errs []string
+	}{
+		{"missing token", map[string]string{"TELEGRAM_TOKEN": ""}, []string{"TELEGRAM_TOKEN not set"}},
+		{"port", map[string]string{"PORT": "70000"}, []string{`invalid PORT "70000"`}},
+		{"update mode", map[string]string{"BOT_UPDATE_MODE": "push"}, []string{`invalid BOT_UPDATE_MODE "push"`}},
+		{"webhook over http", map[string]string{"BOT_UPDATE_MODE": "webhook", "BOT_WEBHOOK_BASE_URL": "http://bot.example"}, []string{"must be an https URL"}},
+		{"dispatcher", map[string]string{"DISPATCH_WORKERS": "8", "DISPATCH_QUEUE_SIZE": "4"}, []string{"DISPATCH_QUEUE_SIZE at least DISPATCH_WORKERS"}},
+		{"discount", map[string]string{"REFERRAL_DISCOUNT_PERCENT": "95"}, []string{"REFERRAL_DISCOUNT_PERCENT must be at most 90"}},
+		{"log level", map[string]string{"LOG_LEVEL": "loud"}, []string{`invalid LOG_LEVEL "loud"`}},
+		{
+			// All invalid settings are reported at once
+			"several",
+			map[string]string{"TELEGRAM_TOKEN": "", "STRIPE_TEST_MODE": "maybe", "SHUTDOWN_TIMEOUT": "soon"},
+			[]string{"TELEGRAM_TOKEN not set", "STRIPE_TEST_MODE", "SHUTDOWN_TIMEOUT"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValidConfigEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			src, err := newConfigSource("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadConfig(src)
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// writeConfigFile writes a config file to a temporary directory and returns its path
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setValidConfigEnv sets the environment to the smallest valid config for
+// the test. Other settings of the test run's environment are unset.
+func setValidConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, s := range knownSettings() {
+		t.Setenv(s.Name, "")
+	}
+	t.Setenv("TELEGRAM_TOKEN", "123:abc")
+	t.Setenv("LLM_PROVIDER", ProviderScripted)
+}
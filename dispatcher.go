@@ -0,0 +1,88 @@
+// dispatcher.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrDispatcherBusy is returned when the queue stays full until the caller gives up
+var ErrDispatcherBusy = errors.New("too many pending updates")
+
+// Dispatcher runs jobs in order per key (a Telegram user) and in parallel across
+// keys, with at most workers jobs running and queueSize jobs pending at a time
+type Dispatcher struct {
+	workers chan struct{} // Running jobs
+	slots   chan struct{} // Queued and running jobs, full means backpressure
+	mutex   sync.Mutex
+	queues  map[int64][]func()
+}
+
+// NewDispatcher creates a dispatcher with the given limits
+func NewDispatcher(workers, queueSize int) *Dispatcher {
+	return &Dispatcher{
+		workers: make(chan struct{}, workers),
+		slots:   make(chan struct{}, queueSize),
+		queues:  make(map[int64][]func()),
+	}
+}
+
+// Submit queues a job after the key's earlier jobs. If the dispatcher is
+// full it waits for room until ctx is done.
+func (d *Dispatcher) Submit(ctx context.Context, key int64, job func()) error {
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ErrDispatcherBusy
+	}
+	dispatcherQueueDepth.Inc()
+
+	d.mutex.Lock()
+	d.queues[key] = append(d.queues[key], job)
+	first := len(d.queues[key]) == 1
+	d.mutex.Unlock()
+
+	// Only one goroutine runs a key's jobs, which keeps them in order
+	if first {
+		go d.run(key)
+	}
+	return nil
+}
+
+// run executes the key's jobs one by one until its queue is empty
+func (d *Dispatcher) run(key int64) {
+	for {
+		d.mutex.Lock()
+		job := d.queues[key][0]
+		d.mutex.Unlock()
+
+		d.workers <- struct{}{}
+		runRecovered("dispatcher", job)
+		<-d.workers
+		<-d.slots
+		dispatcherQueueDepth.Dec()
+
+		d.mutex.Lock()
+		d.queues[key] = d.queues[key][1:]
+		if len(d.queues[key]) == 0 {
+			delete(d.queues, key)
+			d.mutex.Unlock()
+			return
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// runRecovered runs f and logs a panic instead of crashing the bot
+func runRecovered(name string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			handlerPanicsTotal.WithLabelValues(name).Inc()
+			slog.Error("Recovered from panic", "handler", name, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	f()
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// e2eLogs shows the bot's logs, which only help when a scenario fails:
+//
+//	go test -race -run TestE2E/journey -e2e.logs
+var e2eLogs = flag.Bool("e2e.logs", false, "show the bot's logs in end-to-end scenarios")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	logs, level := io.Discard, "error"
+	if *e2eLogs {
+		logs, level = os.Stderr, "debug"
+	}
+	if err := setupLogging(logs, level, ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// Scenario is an end-to-end check of one user journey against fake Telegram
+// and Stripe servers
+type Scenario struct {
+	Name      string
+	Responses []ScriptedResponse
+	Run       func(h *Harness) error
+}
+
+func TestE2E(t *testing.T) {
+	for _, scenario := range e2eScenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			h := NewHarness(t, scenario.Responses...)
+			if err := scenario.Run(h); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// e2eWait is how long a scenario waits for each reply of the bot
+const e2eWait = 10 * time.Second
+
+// Scripted answers matched against the feature prompts
+var e2eResponses = []ScriptedResponse{
+	{Match: "weekly check-in", Response: "SCRIPTED WEEK: Day 1 - squats 4x10, Day 2 - rest"},
+	{Match: "photo of a meal", Response: "SCRIPTED MEAL: about 650 kcal, protein 45 g, fat 20 g, carbohydrates 70 g. Verdict: good fit"},
+	{Match: "workout program for 1 week", Response: "SCRIPTED PLAN: Day 1 - squats 3x10, Day 2 - rest"},
+	{Match: "protein", Response: "SCRIPTED ANSWER: about 1.6-2.2 g of protein per kg"},
+}
+
+// e2eScenarios are run by TestE2E
+var e2eScenarios = []Scenario{
+	{
+		Name:      "journey",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 101
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+
+			if err := h.Send(user, "How much protein should I eat?"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "SCRIPTED ANSWER", e2eWait); err != nil {
+				return err
+			}
+
+			prompts := h.LLM.Prompts()
+			if len(prompts) != 2 {
+				return fmt.Errorf("expected 2 prompts (plan, question), got %d", len(prompts))
+			}
+			if !strings.Contains(prompts[0], "Age: 32") || !strings.Contains(prompts[1], "How much protein") {
+				return fmt.Errorf("prompts don't contain the user's data and question:\n%s", strings.Join(prompts, "\n---\n"))
+			}
+			record, err := h.Bot.usage.Current(user)
+			if err != nil {
+				return err
+			}
+			if record.Total.Requests != 2 {
+				return fmt.Errorf("expected 2 recorded requests, got %+v", record.Total)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "llm_outage_fallback",
+		Responses: []ScriptedResponse{{Match: "", Error: scriptedUnavailable}},
+		Run: func(h *Harness) error {
+			const user = 102
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "NUTRITION"); err != nil {
+				return err
+			}
+			if err := h.Send(user, "Can I train every day?"); err != nil {
+				return err
+			}
+			_, err := h.Expect(user, "Autonomous mode", e2eWait)
+			return err
+		},
+	},
+	{
+		Name:      "safety_escalation",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 103
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+
+			if err := h.Send(user, "I have chest pain after squats, how much protein should I eat?"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "Chest pain", e2eWait); err != nil {
+				return err
+			}
+			if prompts := h.LLM.Prompts(); len(prompts) != 1 {
+				return fmt.Errorf("flagged question reached the language model, %d prompts", len(prompts))
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "meal_photo",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 105
+			// Enough of a JPEG header for content sniffing
+			photo := append([]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), make([]byte, 2048)...)
+
+			if err := h.SendPhoto(user, "", photo); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "once your program is ready", e2eWait); err != nil {
+				return err
+			}
+
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+			if err := h.SendPhoto(user, "my lunch after training", photo); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "SCRIPTED MEAL", e2eWait); err != nil {
+				return err
+			}
+
+			prompts := h.LLM.Prompts()
+			last := prompts[len(prompts)-1]
+			if !strings.Contains(last, "Daily calorie target") || !strings.Contains(last, "my lunch after training") {
+				return fmt.Errorf("photo prompt lacks the targets or caption:\n%s", last)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "voice_question",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 106
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+
+			if err := h.SendVoice(user, "How much protein should I eat?"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, `I heard: "How much protein should I eat?"`, e2eWait); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "SCRIPTED ANSWER", e2eWait); err != nil {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "coach_relay",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const client, coach = 107, 207
+			if err := completeQuestionnaire(h, client); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, client, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+
+			// Only coaches and admins see a roster
+			if err := h.Send(client, "/clients"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(client, "Unknown command", e2eWait); err != nil {
+				return err
+			}
+
+			for _, command := range []string{fmt.Sprintf("/addcoach %d", coach), fmt.Sprintf("/assign %d %d", client, coach)} {
+				if err := h.Send(harnessAdminID, command); err != nil {
+					return err
+				}
+				if _, err := h.Expect(harnessAdminID, "✅", e2eWait); err != nil {
+					return err
+				}
+			}
+			if _, err := h.Expect(client, "personal coach", e2eWait); err != nil {
+				return err
+			}
+
+			if err := h.Send(client, "/coach Is my squat depth OK?"); err != nil {
+				return err
+			}
+			question, err := h.Expect(coach, "Is my squat depth OK?", e2eWait)
+			if err != nil {
+				return err
+			}
+			if _, err := h.Expect(client, "sent to your coach", e2eWait); err != nil {
+				return err
+			}
+
+			if err := h.Reply(coach, "Go just below parallel.", question); err != nil {
+				return err
+			}
+			if _, err := h.Expect(client, "Your coach replied:\n\nGo just below parallel.", e2eWait); err != nil {
+				return err
+			}
+			if _, err := h.Expect(coach, "Reply sent", e2eWait); err != nil {
+				return err
+			}
+
+			if err := h.Send(coach, "/clients"); err != nil {
+				return err
+			}
+			roster, err := h.Expect(coach, fmt.Sprintf("Client %d", client), e2eWait)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(roster.Text, "SCRIPTED PLAN") {
+				return fmt.Errorf("roster entry lacks the latest plan:\n%s", roster.Text)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "referral",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const referrer, friend = 108, 208
+			if err := h.Send(referrer, "/invite"); err != nil {
+				return err
+			}
+			invite, err := h.Expect(referrer, "https://t.me/fitness_test_bot?start=ref_", e2eWait)
+			if err != nil {
+				return err
+			}
+			start := invite.Text[strings.Index(invite.Text, "start=")+len("start="):]
+			start = "/start " + start[:strings.IndexByte(start, '\n')]
+
+			// Opening one's own link earns nothing
+			if err := completeQuestionnaireFrom(h, referrer, start); err != nil {
+				return err
+			}
+			if _, ok := h.Bot.referrals.Referrer(referrer); ok {
+				return fmt.Errorf("user %d was credited for their own invite link", referrer)
+			}
+
+			if err := completeQuestionnaireFrom(h, friend, start); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, friend, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(friend, "extra answers", e2eWait); err != nil {
+				return err
+			}
+			if _, err := h.Expect(referrer, "A friend you invited has joined", e2eWait); err != nil {
+				return err
+			}
+
+			// The referrer's checkout is discounted
+			sessionID, err := requestCheckout(h, referrer)
+			if err != nil {
+				return err
+			}
+			if amount := h.Stripe.Amount(sessionID); amount != 4000 {
+				return fmt.Errorf("referrer's checkout charges %d, expected the discounted 4000", amount)
+			}
+			if account := h.Bot.referrals.Account(referrer); account.Invited != 1 || account.Converted != 1 {
+				return fmt.Errorf("referrer has %d invited and %d converted, expected 1 and 1", account.Invited, account.Converted)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "weekly_checkin",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 109
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+
+			if err := h.Send(user, "/log Day 1: goblet squats 3x10 with 12 kg"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "Workouts logged for this program week: 1", e2eWait); err != nil {
+				return err
+			}
+
+			// A week later the user is reminded once
+			h.Bot.sendCheckInReminders(time.Now().Add(8*24*time.Hour), 7*24*time.Hour)
+			if _, err := h.Expect(user, "A week of your program is done", e2eWait); err != nil {
+				return err
+			}
+			answers := []string{"start", "adherence:all", "difficulty:right", "energy:normal", "weight:same", "pain:none"}
+			for i, answer := range answers {
+				if err := h.Press(user, CallbackCheckIn+answer); err != nil {
+					return err
+				}
+				expect := fmt.Sprintf("(%d/5)", i+1)
+				if i == len(answers)-1 {
+					expect = "week 2: a step up in load"
+				}
+				if _, err := h.Expect(user, expect, e2eWait); err != nil {
+					return fmt.Errorf("after %s: %w", answer, err)
+				}
+			}
+			if _, err := h.Expect(user, "SCRIPTED WEEK", e2eWait); err != nil {
+				return err
+			}
+
+			checkIn, ok := h.Bot.lastCheckIn(user)
+			if !ok || checkIn.Progression.Load != 1 || checkIn.Answers.LoggedWorkouts != 1 {
+				return fmt.Errorf("unexpected check-in record %+v", checkIn)
+			}
+			if plan, ok := h.Bot.lastPlan(user); !ok || plan.Week != 2 {
+				return fmt.Errorf("latest plan is not week 2: %+v", plan)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "exercise_library",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 110
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+				return err
+			}
+
+			// The plan's "squats" link to the library entry
+			if _, err := h.Expect(user, "Bodyweight squat: /ex_bodyweight_squat", e2eWait); err != nil {
+				return err
+			}
+			if plan, ok := h.Bot.lastPlan(user); !ok || strings.Join(plan.Exercises, ",") != "bodyweight_squat" {
+				return fmt.Errorf("stored plan links unexpected exercises: %+v", plan)
+			}
+			if err := h.Send(user, "/ex_bodyweight_squat"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "Bodyweight squat\nLevel: beginner", e2eWait); err != nil {
+				return err
+			}
+
+			// Misspelled plurals still find the exercise
+			if err := h.Send(user, "/exercise dumbell rows"); err != nil {
+				return err
+			}
+			message, err := h.Expect(user, "One-arm dumbbell row\n", e2eWait)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(message.Text, "How to do it:") || !strings.Contains(message.Text, "in case of:") {
+				return fmt.Errorf("exercise entry lacks steps or contraindications:\n%s", message.Text)
+			}
+
+			// Ambiguous names offer a choice
+			if err := h.Send(user, "/exercise pull"); err != nil {
+				return err
+			}
+			message, err = h.Expect(user, "Which exercise do you mean", e2eWait)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(strings.Join(message.Buttons, " "), CallbackExercise+"pull_up") {
+				return fmt.Errorf("suggestions lack pull-ups: %v", message.Buttons)
+			}
+			if err := h.Press(user, CallbackExercise+"pull_up"); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "Pull-up\nLevel: advanced", e2eWait); err != nil {
+				return err
+			}
+
+			if err := h.Send(user, "/exercise zumba"); err != nil {
+				return err
+			}
+			_, err = h.Expect(user, "I couldn't find \"zumba\"", e2eWait)
+			return err
+		},
+	},
+	{
+		Name:      "forged_payment_webhook",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 104
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			sessionID, err := requestCheckout(h, user)
+			if err != nil {
+				return err
+			}
+
+			// A webhook signed with another secret must not unlock the plan
+			h.webhook.webhookSecret = "whsec_other"
+			status, err := h.CompleteCheckout(sessionID)
+			if err != nil {
+				return err
+			}
+			if status != http.StatusBadRequest {
+				return fmt.Errorf("forged webhook answered %d, expected %d", status, http.StatusBadRequest)
+			}
+			if session, _ := h.Bot.sessionSnapshot(user); session.State != StatePayment {
+				return fmt.Errorf("forged webhook moved the session to %s", session.State)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "duplicate_payment_webhook",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 112
+			if err := completeQuestionnaire(h, user); err != nil {
+				return err
+			}
+			sessionID, err := requestCheckout(h, user)
+			if err != nil {
+				return err
+			}
+
+			// Stripe retries a webhook until it is acknowledged, and the
+			// test-mode success page processes the session again
+			for i := 0; i < 3; i++ {
+				status, err := h.CompleteCheckout(sessionID)
+				if err != nil {
+					return err
+				}
+				if status != http.StatusOK {
+					return fmt.Errorf("payment webhook %d answered %d", i+1, status)
+				}
+			}
+			if err := h.Bot.ProcessPaymentWebhook(context.Background(), sessionID); err != nil {
+				return err
+			}
+			if _, err := h.Expect(user, "SCRIPTED PLAN", e2eWait); err != nil {
+				return err
+			}
+
+			// Wait for any duplicate processing to finish
+			ctx, cancel := context.WithTimeout(context.Background(), e2eWait)
+			defer cancel()
+			if err := h.Bot.Drain(ctx); err != nil {
+				return err
+			}
+			if prompts := h.LLM.Prompts(); len(prompts) != 1 {
+				return fmt.Errorf("the plan was generated %d times", len(prompts))
+			}
+			notifications := 0
+			for _, message := range h.Telegram.Sent() {
+				if message.ChatID == user && strings.Contains(message.Text, "Payment successfully completed") {
+					notifications++
+				}
+			}
+			if notifications != 1 {
+				return fmt.Errorf("the user was notified of the payment %d times", notifications)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "telegram_webhook",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			const user = 111
+
+			// Updates without the secret token are refused and never handled
+			status, err := h.PostUpdate(tgbotapi.Update{Message: textMessage(user, "/help")}, "forged")
+			if err != nil {
+				return err
+			}
+			if status != http.StatusUnauthorized {
+				return fmt.Errorf("update with a forged secret answered %d, expected %d", status, http.StatusUnauthorized)
+			}
+
+			status, err = h.PostUpdate(tgbotapi.Update{Message: textMessage(user, "/start")}, harnessTelegramSecret)
+			if err != nil {
+				return err
+			}
+			if status != http.StatusOK {
+				return fmt.Errorf("update answered %d, expected %d", status, http.StatusOK)
+			}
+			if _, err := h.Expect(user, "Specify your gender", e2eWait); err != nil {
+				return err
+			}
+			for _, message := range h.Telegram.Sent() {
+				if message.ChatID == user && strings.Contains(message.Text, "Use /start to begin") {
+					return fmt.Errorf("the forged update was handled")
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "concurrent_users",
+		Responses: e2eResponses,
+		Run: func(h *Harness) error {
+			// Users going through the journey at the same time don't see each other's data
+			users := []int64{120, 121, 122, 123, 124, 125, 126, 127}
+			errs := make([]error, len(users))
+			var wg sync.WaitGroup
+			for i, user := range users {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := completeQuestionnaire(h, user); err != nil {
+						errs[i] = fmt.Errorf("user %d: %w", user, err)
+						return
+					}
+					if err := payAndReceivePlan(h, user, "SCRIPTED PLAN"); err != nil {
+						errs[i] = fmt.Errorf("user %d: %w", user, err)
+					}
+				}()
+			}
+			wg.Wait()
+			if err := errors.Join(errs...); err != nil {
+				return err
+			}
+
+			for _, user := range users {
+				session, ok := h.Bot.sessionSnapshot(user)
+				if !ok || session.State != StateComplete || session.Data.Age != 32 {
+					return fmt.Errorf("user %d ended with an unexpected session %+v", user, session)
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// completeQuestionnaire answers all questions from /start up to the payment offer
+func completeQuestionnaire(h *Harness, user int64) error {
+	return completeQuestionnaireFrom(h, user, "/start")
+}
+
+// completeQuestionnaireFrom is completeQuestionnaire starting with the given
+// /start command, e.g. of an invite link
+func completeQuestionnaireFrom(h *Harness, user int64, start string) error {
+	steps := []struct {
+		text, press string // Either a message or a button
+		expect      string
+	}{
+		{text: start, expect: "Specify your gender"},
+		{press: CallbackSex + "female", expect: "Specify your age"},
+		{text: "32", expect: "Which units"},
+		{press: CallbackUnits + "metric", expect: "height"},
+		{text: "168", expect: "weight"},
+		{text: "64", expect: "diabetes"},
+		{press: CallbackDiabetes + "no", expect: "fitness level"},
+		{press: CallbackLevel + "intermediate", expect: "How active"},
+		{press: CallbackActivity + "moderate", expect: "main goal"},
+		{press: CallbackGoal + "muscle_gain", expect: "type of workouts"},
+		{press: CallbackType + "strength", expect: "pay"},
+	}
+
+	for _, step := range steps {
+		var err error
+		if step.press != "" {
+			err = h.Press(user, step.press)
+		} else {
+			err = h.Send(user, step.text)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := h.Expect(user, step.expect, e2eWait); err != nil {
+			return fmt.Errorf("after %q: %w", step.text+step.press, err)
+		}
+	}
+	return nil
+}
+
+// requestCheckout presses the pay button and returns the checkout session from the link
+func requestCheckout(h *Harness, user int64) (string, error) {
+	if err := h.Press(user, "pay"); err != nil {
+		return "", err
+	}
+	message, err := h.Expect(user, "https://checkout.stripe.test/pay/", e2eWait)
+	if err != nil {
+		return "", err
+	}
+	return message.Text[strings.LastIndex(message.Text, "/")+1:], nil
+}
+
+// payAndReceivePlan pays through the fake checkout and waits for the plan
+func payAndReceivePlan(h *Harness, user int64, plan string) error {
+	sessionID, err := requestCheckout(h, user)
+	if err != nil {
+		return err
+	}
+
+	status, err := h.CompleteCheckout(sessionID)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("payment webhook answered %d", status)
+	}
+
+	if _, err := h.Expect(user, "Payment successfully completed", e2eWait); err != nil {
+		return err
+	}
+	_, err = h.Expect(user, plan, e2eWait)
+	return err
+}
@@ -0,0 +1,139 @@
+// exercise.go
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"RestApiServer/Tg-bot/workout"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// exerciseCommandPrefix starts the commands linking to library entries, e.g. /ex_goblet_squat
+const exerciseCommandPrefix = "ex_"
+
+// CallbackExercise starts the data of exercise suggestion buttons, e.g. exr:goblet_squat
+const CallbackExercise = "exr:"
+
+// exerciseMediaDir holds the optional images of library exercises
+const exerciseMediaDir = "static/exercises"
+
+// Exercise search tuning
+const (
+	maxExerciseSuggestions = 5
+	// A match at least this good is shown directly if no other match comes close
+	exerciseMatchScore = 0.75
+	exerciseMatchLead  = 0.1
+)
+
+// lookupExercise answers /exercise <name> with the best library entry or suggestions
+func (b *Bot) lookupExercise(chatID int64, query string) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		b.sendText(chatID, "Send the exercise name after the command, e.g. /exercise glute bridge")
+		return
+	}
+
+	matches := workout.Search(query, maxExerciseSuggestions)
+	switch {
+	case len(matches) == 0:
+		exerciseLookupsTotal.WithLabelValues("not_found").Inc()
+		b.sendText(chatID, fmt.Sprintf("I couldn't find %q in the exercise library. Try another name, e.g. /exercise push-up", query))
+
+	case matches[0].Score >= exerciseMatchScore &&
+		(len(matches) == 1 || matches[0].Score-matches[1].Score >= exerciseMatchLead):
+		exerciseLookupsTotal.WithLabelValues("found").Inc()
+		b.sendExercise(chatID, matches[0].Exercise)
+
+	default:
+		exerciseLookupsTotal.WithLabelValues("suggested").Inc()
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for _, match := range matches {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(match.Exercise.Name, CallbackExercise+match.Exercise.ID),
+			))
+		}
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+		if _, err := b.sendMessageWithKeyboard(chatID, fmt.Sprintf("Which exercise do you mean by %q?", query), &keyboard); err != nil {
+			slog.Error("Error sending exercise suggestions", "chat_id", chatID, "error", err)
+		}
+	}
+}
+
+// sendExerciseByID answers /ex_<id> links and suggestion buttons
+func (b *Bot) sendExerciseByID(chatID int64, id string) {
+	exercise, ok := workout.Find(id)
+	if !ok {
+		exerciseLookupsTotal.WithLabelValues("not_found").Inc()
+		b.sendText(chatID, "This exercise is not in the library anymore. Use /exercise followed by its name to search.")
+		return
+	}
+	exerciseLookupsTotal.WithLabelValues("found").Inc()
+	b.sendExercise(chatID, exercise)
+}
+
+// sendExercise sends the library entry, preceded by its image if there is one
+func (b *Bot) sendExercise(chatID int64, exercise workout.Exercise) {
+	if exercise.Media != "" {
+		path := filepath.Join(exerciseMediaDir, exercise.Media)
+		if _, err := os.Stat(path); err != nil {
+			slog.Warn("Exercise image is missing", "exercise", exercise.ID, "path", path)
+		} else {
+			photo := tgbotapi.NewPhoto(chatID, tgbotapi.FilePath(path))
+			photo.Caption = exercise.Name
+			if _, err := b.api.Send(photo); err != nil {
+				slog.Error("Error sending exercise image", "chat_id", chatID, "exercise", exercise.ID, "error", err)
+			}
+		}
+	}
+	b.sendText(chatID, formatExercise(exercise))
+}
+
+// formatExercise describes a library entry to the user
+func formatExercise(e workout.Exercise) string {
+	var sb strings.Builder
+	sb.WriteString(e.Name + "\n")
+	sb.WriteString(fmt.Sprintf("Level: %s · Equipment: %s", e.MinLevel, e.Equipment))
+	if e.LowImpact {
+		sb.WriteString(" · Low impact")
+	}
+	sb.WriteString("\nMuscles: " + e.Muscles + "\n\n")
+	sb.WriteString(e.Description + "\n\nHow to do it:\n")
+	for i, step := range e.Steps {
+		sb.WriteString(fmt.Sprintf("%d. %s\n", i+1, step))
+	}
+	if len(e.Contraindications) > 0 {
+		sb.WriteString("\nSkip it or choose an easier variation in case of:\n")
+		for _, item := range e.Contraindications {
+			sb.WriteString("- " + item + "\n")
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// planExercises returns the IDs of the library exercises named in a plan
+func planExercises(plan string) []string {
+	var ids []string
+	for _, exercise := range workout.Mentions(plan) {
+		ids = append(ids, exercise.ID)
+	}
+	return ids
+}
+
+// sendExerciseGuides links the exercises of a plan to their library entries
+func (b *Bot) sendExerciseGuides(chatID int64, ids []string) {
+	var lines []string
+	for _, id := range ids {
+		if exercise, ok := workout.Find(id); ok {
+			lines = append(lines, fmt.Sprintf("%s: /%s%s", exercise.Name, exerciseCommandPrefix, id))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	b.sendText(chatID, "How to do the exercises of your program:\n"+strings.Join(lines, "\n"))
+}
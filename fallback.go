@@ -0,0 +1,173 @@
+// fallback.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"RestApiServer/Tg-bot/nutrition"
+	"RestApiServer/Tg-bot/workout"
+)
+
+// WorkoutProfile converts user data into a profile for the offline plan generator
+func (u *UserData) WorkoutProfile() workout.Profile {
+	level, err := workout.ParseLevel(u.Level)
+	if err != nil {
+		level = workout.LevelBeginner
+	}
+	goal, _ := nutrition.ParseGoal(u.FitnessGoal)
+
+	return workout.Profile{
+		Level:    level,
+		Goal:     goal,
+		Type:     u.FitnessType,
+		Diabetes: u.Diabetes == "yes",
+		// Equipment isn't part of the questionnaire, so plan for a typical home setup
+		Equipment: []workout.Equipment{workout.EquipmentDumbbells, workout.EquipmentBand},
+	}
+}
+
+// fallbackPlan builds a workout plan without the language model
+func fallbackPlan(data UserData) string {
+	plan := workout.Generate(data.WorkoutProfile()).Format()
+
+	if energy, err := nutrition.Calculate(data.NutritionProfile()); err == nil {
+		plan += fmt.Sprintf("\n\n## NUTRITION\n"+
+			"- Daily calories: about %d kcal (%s)\n"+
+			"- Protein %d g, fat %d g, carbohydrates %d g\n"+
+			"- Water: about %s per day",
+			energy.Calories, energy.GoalNote,
+			energy.Macros.ProteinG, energy.Macros.FatG, energy.Macros.CarbsG,
+			data.FormatVolume(energy.WaterMl))
+	}
+
+	return plan
+}
+
+// fallbackCheckInPlan builds the plan of a later week without the language model
+func fallbackCheckInPlan(data UserData, progression workout.Progression) string {
+	plan := workout.Generate(data.WorkoutProfile()).Apply(progression).Format()
+	return fmt.Sprintf("📅 WEEK %d\n%s\n\n%s", progression.Week, progression.Instructions(), plan)
+}
+
+// fallbackAnswer answers a question without the language model
+func fallbackAnswer(data UserData) string {
+	profile := data.WorkoutProfile()
+	tips := workout.Generate(profile).Tips
+
+	var sb strings.Builder
+	sb.WriteString("🤖 Autonomous mode (AI assistant unavailable):\n\n")
+	sb.WriteString("I can't answer your question in detail right now, but here is what matters most for you:\n\n")
+	for i, tip := range tips {
+		fmt.Fprintf(&sb, "%d. %s\n", i+1, tip)
+	}
+	sb.WriteString("\nPlease ask your question again a bit later.")
+	return sb.String()
+}
+
+// fallbackPhotoAnswer replies to a meal photo without the language model
+func fallbackPhotoAnswer(data UserData) string {
+	var sb strings.Builder
+	sb.WriteString("🤖 Autonomous mode (AI assistant unavailable):\n\n")
+	sb.WriteString("I can't look at your photo right now.")
+	if energy, err := nutrition.Calculate(data.NutritionProfile()); err == nil {
+		// Three main meals make up most of the day
+		fmt.Fprintf(&sb, " As a guide, one of three main meals should have about %d kcal: "+
+			"protein %d g, fat %d g, carbohydrates %d g.",
+			energy.Calories/3, energy.Macros.ProteinG/3, energy.Macros.FatG/3, energy.Macros.CarbsG/3)
+	}
+	sb.WriteString("\n\nPlease send the photo again a bit later.")
+	return sb.String()
+}
+
+// Completion is an answer with the prompts that produced it
+type Completion struct {
+	Text          string
+	PromptVersion string
+	SystemVersion string
+	Fallback      bool
+}
+
+// featurePrompts are the prompt templates used by each feature
+var featurePrompts = map[UsageFeature]string{
+	UsagePlan:    PromptPlan,
+	UsageQA:      PromptQA,
+	UsagePhoto:   PromptPhoto,
+	UsageCheckIn: PromptCheckIn,
+}
+
+// complete renders the feature's prompts, asks its language model and falls
+// back to the offline generator when the model is unavailable or its answer
+// fails the safety check. The image, if any, goes to a vision model.
+func (b *Bot) complete(ctx context.Context, feature UsageFeature, session *UserSession, question string, image *Image) (Completion, error) {
+	return b.completeWith(ctx, feature, session, NewPromptData(&session.Data, question), image, nil)
+}
+
+// completeWith is complete with prepared prompt data and the offline answer
+// to use instead of the feature's default fallback
+func (b *Bot) completeWith(ctx context.Context, feature UsageFeature, session *UserSession, data PromptData, image *Image, fallback func() string) (Completion, error) {
+	if b.config.UserDataJSON {
+		data.UserData = session.Data.JSON()
+	}
+	system, systemVersion, err := b.prompts.Render(PromptSystem, data)
+	if err != nil {
+		return Completion{}, err
+	}
+	prompt, promptVersion, err := b.prompts.Render(featurePrompts[feature], data)
+	if err != nil {
+		return Completion{}, err
+	}
+
+	result := Completion{PromptVersion: promptVersion, SystemVersion: systemVersion}
+	var answer string
+	var usage Usage
+	provider := b.providers[feature]
+	if image == nil {
+		answer, usage, err = provider.GetCompletion(ctx, system, prompt)
+	} else if vision, ok := provider.(VisionProvider); ok {
+		answer, usage, err = vision.GetVisionCompletion(ctx, system, prompt, *image)
+	} else {
+		err = fmt.Errorf("%w: %s provider can't read images", ErrLLMUnavailable, feature)
+	}
+	b.usage.Record(session.UserID, feature, usage)
+	if err != nil && !errors.Is(err, ErrLLMUnavailable) {
+		return result, err
+	}
+	if err == nil {
+		finding := b.safety.Screen(answer, ScopeOutput)
+		if finding == nil {
+			result.Text = answer
+			return result, nil
+		}
+
+		// Never pass unsafe advice on; plans are rebuilt offline instead
+		b.incidents.Record(SafetyIncident{
+			UserID:   session.UserID,
+			Scope:    ScopeOutput,
+			RuleID:   finding.RuleID,
+			Category: finding.Category,
+			Match:    finding.Match,
+		})
+		if feature != UsagePlan && feature != UsageCheckIn {
+			result.Text = finding.Message()
+			return result, nil
+		}
+		err = fmt.Errorf("model output failed safety check %s", finding.RuleID)
+	}
+
+	loggerFrom(ctx).Info("Using offline fallback", "feature", feature, "reason", err)
+	result.Fallback = true
+	switch {
+	case fallback != nil:
+		result.Text = fallback()
+	case feature == UsagePlan:
+		result.Text = fallbackPlan(session.Data)
+	case feature == UsagePhoto:
+		result.Text = fallbackPhotoAnswer(session.Data)
+	default:
+		result.Text = fallbackAnswer(session.Data)
+	}
+	return result, nil
+}
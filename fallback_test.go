@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"RestApiServer/Tg-bot/workout"
+)
+
+func TestFallbackPlanFromIncompleteData(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      UserData
+		nutrition bool
+	}{
+		{"empty", UserData{}, false},
+		{"questionnaire stopped at the weight", UserData{Sex: "Male", Age: 30, Height: 180}, false},
+		{"free-text answers", UserData{Level: "dunno", FitnessGoal: "look good", FitnessType: "dancing", Diabetes: "maybe"}, false},
+		{"complete", UserData{Sex: "Female", Age: 32, Height: 168, Weight: 64, Level: "Intermediate",
+			Activity: "moderate", FitnessGoal: "Weight loss", FitnessType: "Strength", Diabetes: "yes", Units: UnitsImperial}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := fallbackPlan(tt.data)
+			if !strings.Contains(plan, "WEEKLY PLAN") {
+				t.Errorf("no plan:\n%s", plan)
+			}
+			if nutrition := strings.Contains(plan, "## NUTRITION"); nutrition != tt.nutrition {
+				t.Errorf("nutrition section: %v, want %v", nutrition, tt.nutrition)
+			}
+			next := fallbackCheckInPlan(tt.data, workout.Progression{Week: 2, Load: 1, Adjustment: workout.AdjustProgress})
+			if !strings.Contains(next, "WEEK 2") {
+				t.Errorf("no next week:\n%s", next)
+			}
+		})
+	}
+
+	plan := fallbackPlan(UserData{Level: "Intermediate", FitnessGoal: "Weight loss", FitnessType: "Strength", Diabetes: "yes"})
+	for _, want := range []string{"Upper body strength", "12-15", "blood sugar"} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan doesn't reflect the questionnaire, lacks %q:\n%s", want, plan)
+		}
+	}
+}
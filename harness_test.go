@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// SentMessage is a message the bot sent through the fake Telegram API
+type SentMessage struct {
+	Method    string // sendMessage or editMessageText
+	ChatID    int64
+	MessageID int
+	Text      string
+	Buttons   []string // Callback data of the inline keyboard
+}
+
+// FakeTelegram is an in-process Telegram Bot API double that records what the bot sends
+type FakeTelegram struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+	sent   []SentMessage
+	nextID int
+	files  map[string][]byte // Content of uploaded files by file ID
+}
+
+// NewFakeTelegram starts a fake Bot API server
+func NewFakeTelegram() *FakeTelegram {
+	t := &FakeTelegram{nextID: 1000, files: make(map[string][]byte)}
+	t.server = httptest.NewServer(t)
+	return t
+}
+
+// Endpoint returns the API endpoint format for tgbotapi
+func (t *FakeTelegram) Endpoint() string {
+	return t.server.URL + "/bot%s/%s"
+}
+
+// Close stops the server
+func (t *FakeTelegram) Close() {
+	t.server.Close()
+}
+
+// AddFile makes a file available for getFile and download
+func (t *FakeTelegram) AddFile(fileID string, data []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.files[fileID] = data
+}
+
+// Sent returns all messages sent so far
+func (t *FakeTelegram) Sent() []SentMessage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]SentMessage(nil), t.sent...)
+}
+
+func (t *FakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	// Downloads look like /file/bot<token>/files/<file ID>
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		t.mutex.Lock()
+		data, ok := t.files[method]
+		t.mutex.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	var result any = true
+	switch method {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, IsBot: true, FirstName: "Fitness", UserName: "fitness_test_bot"}
+	case "getFile":
+		fileID := r.Form.Get("file_id")
+		t.mutex.Lock()
+		data, ok := t.files[fileID]
+		t.mutex.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"ok": false, "error_code": 400, "description": "Bad Request: invalid file_id"})
+			return
+		}
+		result = tgbotapi.File{FileID: fileID, FileSize: len(data), FilePath: "files/" + fileID}
+	case "sendMessage", "editMessageText":
+		chatID, _ := strconv.ParseInt(r.Form.Get("chat_id"), 10, 64)
+		message := SentMessage{
+			Method:  method,
+			ChatID:  chatID,
+			Text:    r.Form.Get("text"),
+			Buttons: callbackButtons(r.Form.Get("reply_markup")),
+		}
+
+		t.mutex.Lock()
+		if method == "editMessageText" {
+			message.MessageID, _ = strconv.Atoi(r.Form.Get("message_id"))
+		} else {
+			t.nextID++
+			message.MessageID = t.nextID
+		}
+		t.sent = append(t.sent, message)
+		t.mutex.Unlock()
+
+		result = tgbotapi.Message{
+			MessageID: message.MessageID,
+			Chat:      &tgbotapi.Chat{ID: chatID, Type: "private"},
+			Date:      int(time.Now().Unix()),
+			Text:      message.Text,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+// callbackButtons extracts the callback data of an inline keyboard
+func callbackButtons(markup string) []string {
+	var keyboard tgbotapi.InlineKeyboardMarkup
+	if markup == "" || json.Unmarshal([]byte(markup), &keyboard) != nil {
+		return nil
+	}
+	var buttons []string
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData != nil {
+				buttons = append(buttons, *button.CallbackData)
+			}
+		}
+	}
+	return buttons
+}
+
+// FakeStripe is an in-process Stripe API double for checkout sessions and refunds
+type FakeStripe struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	sessions map[string]*stripe.CheckoutSession
+	refunds  []string // Refunded payment intents
+}
+
+// NewFakeStripe starts a fake Stripe server
+func NewFakeStripe() *FakeStripe {
+	s := &FakeStripe{sessions: make(map[string]*stripe.CheckoutSession)}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+// Backend returns a Stripe backend sending requests to the fake
+func (s *FakeStripe) Backend() stripe.Backend {
+	return stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(s.server.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	})
+}
+
+// Close stops the server
+func (s *FakeStripe) Close() {
+	s.server.Close()
+}
+
+// Pay marks a checkout session as paid, as if the user completed the checkout
+func (s *FakeStripe) Pay(sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("no checkout session %s", sessionID)
+	}
+	session.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	session.PaymentIntent = &stripe.PaymentIntent{ID: "pi_" + strings.TrimPrefix(sessionID, "cs_")}
+	return nil
+}
+
+// Refunds returns the payment intents refunded so far
+func (s *FakeStripe) Refunds() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.refunds...)
+}
+
+// Amount returns the amount a checkout session charges
+func (s *FakeStripe) Amount(sessionID string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session, ok := s.sessions[sessionID]; ok {
+		return session.AmountTotal
+	}
+	return 0
+}
+
+func (s *FakeStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result any
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/checkout/sessions":
+		id := fmt.Sprintf("cs_test_%d", len(s.sessions)+1)
+		amount, _ := strconv.ParseInt(r.Form.Get("line_items[0][price_data][unit_amount]"), 10, 64)
+		session := &stripe.CheckoutSession{
+			AmountTotal:       amount,
+			ID:                id,
+			Object:            "checkout.session",
+			URL:               "https://checkout.stripe.test/pay/" + id,
+			ClientReferenceID: r.Form.Get("client_reference_id"),
+			Mode:              stripe.CheckoutSessionModePayment,
+			PaymentStatus:     stripe.CheckoutSessionPaymentStatusUnpaid,
+		}
+		s.sessions[id] = session
+		result = session
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/checkout/sessions/"):
+		session, ok := s.sessions[strings.TrimPrefix(r.URL.Path, "/v1/checkout/sessions/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"type": "invalid_request_error", "message": "No such checkout session"}})
+			return
+		}
+		result = session
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/refunds":
+		s.refunds = append(s.refunds, r.Form.Get("payment_intent"))
+		result = map[string]any{"id": fmt.Sprintf("re_test_%d", len(s.refunds)), "object": "refund", "status": "succeeded"}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Harness runs a Bot against fake Telegram and Stripe servers and a scripted language model
+type Harness struct {
+	Bot      *Bot
+	Telegram *FakeTelegram
+	Stripe   *FakeStripe
+	LLM      *ScriptedLLM
+
+	webhook         *WebhookHandler
+	telegramWebhook *TelegramWebhookHandler
+	store           *FileStore
+	mutex           sync.Mutex
+	seen            map[int64]int // Messages already matched by Expect, per chat
+}
+
+// harnessUpdateID numbers injected updates. The duplicate filter is global,
+// so IDs must stay unique across harnesses.
+var harnessUpdateID atomic.Int64
+
+// harnessWebhookSecret signs the Stripe webhooks posted by the harness
+const harnessWebhookSecret = "whsec_harness"
+
+// harnessTelegramSecret is the secret token of the Telegram webhooks posted by the harness
+const harnessTelegramSecret = "tg-harness-secret"
+
+// harnessAdminID is the admin of the harness bot
+const harnessAdminID = 900
+
+// NewHarness starts a bot with its own fakes and a temporary data directory,
+// stopped when the test ends
+func NewHarness(t testing.TB, responses ...ScriptedResponse) *Harness {
+	t.Helper()
+	h := &Harness{
+		Telegram: NewFakeTelegram(),
+		Stripe:   NewFakeStripe(),
+		LLM:      NewScriptedLLM(responses...),
+		seen:     make(map[int64]int),
+	}
+	t.Cleanup(h.Close)
+
+	var err error
+	if h.store, err = NewFileStore(filepath.Join(t.TempDir(), "store.json"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	prompts, err := NewPromptStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	safety, err := LoadSafetyScreener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		TelegramToken:       "e2e-token",
+		TelegramAPIEndpoint: h.Telegram.Endpoint(),
+		UpdateMode:          UpdateModePolling,
+		BaseURL:             "http://localhost:4242",
+		StripeSecretKey:     "sk_test_harness",
+		StripeWebhookSecret: harnessWebhookSecret,
+		AdminIDs:            []int64{harnessAdminID},
+		Referrals:           ReferralRewards{ReferrerCredits: 10, ReferredCredits: 5, DiscountPercent: 20},
+	}
+	h.Bot, err = NewBot(config, BotDeps{
+		Providers:   map[UsageFeature]LLMProvider{UsagePlan: h.LLM, UsageQA: h.LLM, UsagePhoto: h.LLM, UsageCheckIn: h.LLM},
+		Prompts:     prompts,
+		Audit:       NewAuditLogger(""),
+		Limiter:     NewRateLimiter(defaultRateLimits, h.store),
+		Usage:       NewUsageTracker(h.store, defaultModelPrices, UsageQuota{}),
+		Store:       h.store,
+		Safety:      safety,
+		Incidents:   NewIncidentLogger(""),
+		Dispatcher:  NewDispatcher(8, 100),
+		Payments:    NewPayments(config, h.Stripe.Backend()),
+		Transcriber: ScriptedTranscriber{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.webhook = &WebhookHandler{bot: h.Bot, webhookSecret: config.StripeWebhookSecret}
+	h.telegramWebhook = NewTelegramWebhookHandler(h.Bot, harnessTelegramSecret)
+	return h
+}
+
+// Close waits for the bot to finish and stops the fakes
+func (h *Harness) Close() {
+	if h.Bot != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		h.Bot.Drain(ctx)
+		cancel()
+	}
+	if h.store != nil {
+		h.store.Close()
+	}
+	h.Telegram.Close()
+	h.Stripe.Close()
+}
+
+// update injects an update as if Telegram delivered it
+func (h *Harness) update(update tgbotapi.Update) error {
+	update.UpdateID = int(harnessUpdateID.Add(1))
+	return h.Bot.dispatchUpdate(context.Background(), update)
+}
+
+// Send injects a text message from the user; text starting with / is a command
+func (h *Harness) Send(userID int64, text string) error {
+	return h.Reply(userID, text, SentMessage{})
+}
+
+// Reply injects a text message from the user as a reply to a message of the bot,
+// or a plain message if to is zero
+func (h *Harness) Reply(userID int64, text string, to SentMessage) error {
+	message := textMessage(userID, text)
+	if to.MessageID != 0 {
+		message.ReplyToMessage = &tgbotapi.Message{
+			MessageID: to.MessageID,
+			Chat:      &tgbotapi.Chat{ID: to.ChatID, Type: "private"},
+			Text:      to.Text,
+		}
+	}
+	return h.update(tgbotapi.Update{Message: message})
+}
+
+// textMessage builds a text message from the user; text starting with / is a command
+func textMessage(userID int64, text string) *tgbotapi.Message {
+	message := &tgbotapi.Message{
+		MessageID: int(time.Now().UnixNano() % 1e6),
+		From:      &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(text)
+		if i := strings.IndexByte(text, ' '); i > 0 {
+			length = i
+		}
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return message
+}
+
+// PostUpdate posts an update to the Telegram webhook handler with the secret
+// token, as Telegram does in webhook mode, and returns the response status
+func (h *Harness) PostUpdate(update tgbotapi.Update, secret string) (int, error) {
+	update.UpdateID = int(harnessUpdateID.Add(1))
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return 0, err
+	}
+
+	request := httptest.NewRequest(http.MethodPost, telegramWebhookPath("e2e-token"), bytes.NewReader(payload))
+	request.Header.Set(telegramSecretHeader, secret)
+	recorder := httptest.NewRecorder()
+	h.telegramWebhook.ServeHTTP(recorder, request)
+	return recorder.Code, nil
+}
+
+// SendPhoto injects a photo with a caption from the user
+func (h *Harness) SendPhoto(userID int64, caption string, data []byte) error {
+	fileID := fmt.Sprintf("photo_%d_%d", userID, harnessUpdateID.Load()+1)
+	h.Telegram.AddFile(fileID, data)
+	return h.update(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: int(time.Now().UnixNano() % 1e6),
+		From:      &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Date:      int(time.Now().Unix()),
+		Caption:   caption,
+		Photo:     []tgbotapi.PhotoSize{{FileID: fileID, Width: 1280, Height: 960, FileSize: len(data)}},
+	}})
+}
+
+// SendVoice injects a voice message; the scripted transcriber recognizes the transcript
+func (h *Harness) SendVoice(userID int64, transcript string) error {
+	fileID := fmt.Sprintf("voice_%d_%d", userID, harnessUpdateID.Load()+1)
+	h.Telegram.AddFile(fileID, []byte(transcript))
+	return h.update(tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: int(time.Now().UnixNano() % 1e6),
+		From:      &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Date:      int(time.Now().Unix()),
+		Voice:     &tgbotapi.Voice{FileID: fileID, Duration: 3, MimeType: "audio/ogg", FileSize: len(transcript)},
+	}})
+}
+
+// Press injects a tap on an inline keyboard button of the bot's last message to the user
+func (h *Harness) Press(userID int64, data string) error {
+	var last SentMessage
+	for _, message := range h.Telegram.Sent() {
+		if message.ChatID == userID && message.Method == "sendMessage" {
+			last = message
+		}
+	}
+	return h.update(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   fmt.Sprintf("cb_%d_%s", userID, data),
+		From: &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Message: &tgbotapi.Message{
+			MessageID: last.MessageID,
+			Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+			Text:      last.Text,
+		},
+		Data: data,
+	}})
+}
+
+// Expect waits for the next message to the user containing text and returns it.
+// Messages before it are skipped, so later calls only see newer messages.
+func (h *Harness) Expect(userID int64, text string, timeout time.Duration) (SentMessage, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		h.mutex.Lock()
+		seen := h.seen[userID]
+		h.mutex.Unlock()
+
+		count := 0
+		for _, message := range h.Telegram.Sent() {
+			if message.ChatID != userID || message.Method != "sendMessage" {
+				continue
+			}
+			count++
+			if count > seen && strings.Contains(message.Text, text) {
+				h.mutex.Lock()
+				h.seen[userID] = count
+				h.mutex.Unlock()
+				return message, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return SentMessage{}, fmt.Errorf("no message to %d containing %q within %s, got:\n%s", userID, text, timeout, h.transcript(userID, seen))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// transcript lists the user's messages after the first skip ones, for failure reports
+func (h *Harness) transcript(userID int64, skip int) string {
+	var sb strings.Builder
+	count := 0
+	for _, message := range h.Telegram.Sent() {
+		if message.ChatID != userID || message.Method != "sendMessage" {
+			continue
+		}
+		count++
+		if count > skip {
+			text := message.Text
+			if len(text) > 120 {
+				text = text[:120] + "…"
+			}
+			fmt.Fprintf(&sb, "  %d. %q %v\n", count, text, message.Buttons)
+		}
+	}
+	if sb.Len() == 0 {
+		return "  (nothing)\n"
+	}
+	return sb.String()
+}
+
+// CompleteCheckout pays the checkout session and posts Stripe's signed
+// checkout.session.completed webhook, returning the response status
+func (h *Harness) CompleteCheckout(sessionID string) (int, error) {
+	if err := h.Stripe.Pay(sessionID); err != nil {
+		return 0, err
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"id":     "evt_" + sessionID,
+		"object": "event",
+		"type":   "checkout.session.completed",
+		"data":   map[string]any{"object": map[string]any{"id": sessionID, "object": "checkout.session"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, harnessWebhookSecret))
+
+	request := httptest.NewRequest(http.MethodPost, "/webhook/stripe", strings.NewReader(string(payload)))
+	request.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	recorder := httptest.NewRecorder()
+	h.webhook.ServeHTTP(recorder, request)
+	return recorder.Code, nil
+}
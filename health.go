@@ -0,0 +1,179 @@
+// health.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Results of a readiness check
+const (
+	CheckOK       = "ok"
+	CheckDegraded = "degraded" // Working with reduced quality, still ready
+	CheckFailed   = "failed"
+)
+
+// pollStaleAfter is how long polling may go without a successful getUpdates.
+// Long polls return every 60 seconds even without updates.
+const pollStaleAfter = 3 * time.Minute
+
+// HealthCheck is the result of checking one dependency
+type HealthCheck struct {
+	Status      string     `json:"status"`
+	Detail      string     `json:"detail,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// Readiness is the body of /readyz
+type Readiness struct {
+	Status string                 `json:"status"`
+	Time   time.Time              `json:"time"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// pollRecorder is the Bot API HTTP client, noting when getUpdates last succeeded
+type pollRecorder struct {
+	next     tgbotapi.HTTPClient
+	lastPoll atomic.Int64 // Unix nanoseconds
+}
+
+func (p *pollRecorder) Do(req *http.Request) (*http.Response, error) {
+	resp, err := p.next.Do(req)
+	if err == nil && resp.StatusCode == http.StatusOK && strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		p.lastPoll.Store(time.Now().UnixNano())
+	}
+	return resp, err
+}
+
+// LastPoll returns when getUpdates last succeeded, zero if it never did
+func (p *pollRecorder) LastPoll() time.Time {
+	if n := p.lastPoll.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// circuitReporter is implemented by LLM providers with a circuit breaker
+type circuitReporter interface {
+	CircuitState() CircuitState
+}
+
+// Readiness checks the bot's dependencies. An open LLM circuit only degrades
+// the bot, since questions are then answered by the offline fallback.
+func (b *Bot) Readiness() Readiness {
+	checks := map[string]HealthCheck{
+		"telegram": b.checkTelegram(),
+		"store":    checkResult(b.store.Ping()),
+		"stripe":   checkResult(checkStripeConfig(b.config)),
+	}
+	for feature, provider := range b.providers {
+		check := HealthCheck{Status: CheckOK, Detail: "no circuit breaker"}
+		if reporter, ok := provider.(circuitReporter); ok {
+			state := reporter.CircuitState()
+			check.Detail = "circuit " + state.String()
+			if state != CircuitClosed {
+				check.Status = CheckDegraded
+			}
+		}
+		checks["llm_"+string(feature)] = check
+	}
+
+	b.life.mutex.Lock()
+	stopping := b.life.stopping
+	b.life.mutex.Unlock()
+	if stopping {
+		checks["intake"] = HealthCheck{Status: CheckFailed, Detail: "shutting down"}
+	}
+
+	status := CheckOK
+	for _, check := range checks {
+		if check.Status == CheckFailed {
+			status = CheckFailed
+			break
+		}
+		if check.Status == CheckDegraded {
+			status = CheckDegraded
+		}
+	}
+	return Readiness{Status: status, Time: time.Now(), Checks: checks}
+}
+
+// checkTelegram reports whether updates are still being received
+func (b *Bot) checkTelegram() HealthCheck {
+	if b.config.UpdateMode == UpdateModeWebhook {
+		return HealthCheck{Status: CheckOK, Detail: "updates are pushed to the webhook"}
+	}
+
+	last := b.telegram.LastPoll()
+	if last.IsZero() {
+		return HealthCheck{Status: CheckFailed, Detail: "no successful getUpdates yet"}
+	}
+	check := HealthCheck{Status: CheckOK, LastSuccess: &last}
+	if age := time.Since(last); age > pollStaleAfter {
+		check.Status = CheckFailed
+		check.Detail = fmt.Sprintf("no successful getUpdates for %s", age.Round(time.Second))
+	}
+	return check
+}
+
+// checkStripeConfig checks that payments can be created and confirmed
+func checkStripeConfig(config *Config) error {
+	var errs []error
+	key := config.StripeSecretKey
+	if key == "" {
+		errs = append(errs, errors.New("STRIPE_SECRET_KEY not set"))
+	} else if !strings.HasPrefix(key, "sk_") && !strings.HasPrefix(key, "rk_") {
+		errs = append(errs, errors.New("STRIPE_SECRET_KEY is not a secret or restricted key"))
+	}
+	if config.StripeWebhookSecret == "" && !config.StripeTestMode {
+		errs = append(errs, errors.New("STRIPE_WEBHOOK_SECRET not set outside test mode"))
+	}
+	return errors.Join(errs...)
+}
+
+// checkResult turns an error into a check
+func checkResult(err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: CheckFailed, Detail: err.Error()}
+	}
+	return HealthCheck{Status: CheckOK}
+}
+
+// healthzHandler reports that the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": CheckOK})
+}
+
+// readyzHandler reports the bot's dependencies, with 503 if one has failed
+func readyzHandler(bot *Bot) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := bot.Readiness()
+		if readiness.Status == CheckFailed {
+			var failed []string
+			for name, check := range readiness.Checks {
+				if check.Status == CheckFailed {
+					failed = append(failed, name)
+				}
+			}
+			sort.Strings(failed)
+			slog.Warn("Not ready", "failed_checks", failed)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if readiness.Status == CheckFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
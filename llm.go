@@ -0,0 +1,262 @@
+// llm.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LLMProvider generates answers to prompts with a language model
+type LLMProvider interface {
+	// GetCompletion returns the answer to the prompt with its token usage
+	GetCompletion(ctx context.Context, system, prompt string) (string, Usage, error)
+}
+
+// Image is a picture sent to a vision model
+type Image struct {
+	Data     []byte
+	MIMEType string
+}
+
+// VisionProvider is an LLMProvider that can also look at images
+type VisionProvider interface {
+	LLMProvider
+	// GetVisionCompletion returns the answer to the prompt about the image
+	GetVisionCompletion(ctx context.Context, system, prompt string, image Image) (string, Usage, error)
+}
+
+// defaultVisionModel describes meal photos unless LLM_PHOTO_MODEL is set,
+// as the text model may not accept images
+const defaultVisionModel = "gpt-4o-mini"
+
+// ErrLLMUnavailable is returned when the model can't be reached and the
+// caller should answer with the offline fallback instead
+var ErrLLMUnavailable = errors.New("language model unavailable")
+
+// Supported LLM providers
+const (
+	ProviderOpenAI     = "openai"     // api.openai.com
+	ProviderCompatible = "compatible" // any OpenAI-compatible server (Ollama, vLLM, llama.cpp)
+	ProviderScripted   = "scripted"   // deterministic fake for tests and demos
+)
+
+// LLMConfig selects the provider used for one feature
+type LLMConfig struct {
+	Feature    UsageFeature
+	Provider   string
+	Model      string
+	BaseURL    string
+	APIKey     string
+	ScriptPath string
+	Retry      RetryPolicy
+	Breaker    BreakerConfig
+	// Answer offline without asking the model
+	ForceFallback bool
+}
+
+// loadLLMConfig reads the provider settings of a feature from LLM_<FEATURE>_* settings,
+// falling back to LLM_PROVIDER, OPENAI_MODEL, OPENAI_BASE_URL, OPENAI_TOKEN and LLM_*
+func loadLLMConfig(src *configSource, feature UsageFeature) (LLMConfig, error) {
+	prefix := "LLM_" + strings.ToUpper(string(feature)) + "_"
+	get := func(name, fallback string) string {
+		if value := src.str(prefix + name); value != "" {
+			return value
+		}
+		return src.str(fallback)
+	}
+
+	cfg := LLMConfig{
+		Feature:    feature,
+		Provider:   strings.ToLower(get("PROVIDER", "LLM_PROVIDER")),
+		Model:      get("MODEL", "OPENAI_MODEL"),
+		BaseURL:    get("BASE_URL", "OPENAI_BASE_URL"),
+		APIKey:     get("API_KEY", "OPENAI_TOKEN"),
+		ScriptPath: get("SCRIPT", "LLM_SCRIPT"),
+	}
+	if cfg.Provider == "" {
+		cfg.Provider = ProviderOpenAI
+	}
+	if feature == UsagePhoto && cfg.Provider == ProviderOpenAI {
+		cfg.Model = src.str(prefix + "MODEL")
+		if cfg.Model == "" {
+			cfg.Model = defaultVisionModel
+		}
+	}
+
+	var err error
+	if cfg.ForceFallback, err = src.boolean("USE_OPENAI_FALLBACK"); err != nil {
+		return cfg, err
+	}
+
+	cfg.Retry = defaultRetryPolicy
+	if cfg.Retry.MaxRetries, err = envInt(prefix+"MAX_RETRIES", get("MAX_RETRIES", "LLM_MAX_RETRIES"), cfg.Retry.MaxRetries); err != nil {
+		return cfg, err
+	}
+	if cfg.Retry.BaseDelay, err = envDuration(prefix+"RETRY_BASE_DELAY", get("RETRY_BASE_DELAY", "LLM_RETRY_BASE_DELAY"), cfg.Retry.BaseDelay); err != nil {
+		return cfg, err
+	}
+	if cfg.Retry.MaxDelay, err = envDuration(prefix+"RETRY_MAX_DELAY", get("RETRY_MAX_DELAY", "LLM_RETRY_MAX_DELAY"), cfg.Retry.MaxDelay); err != nil {
+		return cfg, err
+	}
+
+	cfg.Breaker = defaultBreakerConfig
+	if cfg.Breaker.FailureThreshold, err = envInt(prefix+"BREAKER_FAILURES", get("BREAKER_FAILURES", "LLM_BREAKER_FAILURES"), cfg.Breaker.FailureThreshold); err != nil {
+		return cfg, err
+	}
+	if cfg.Breaker.Cooldown, err = envDuration(prefix+"BREAKER_COOLDOWN", get("BREAKER_COOLDOWN", "LLM_BREAKER_COOLDOWN"), cfg.Breaker.Cooldown); err != nil {
+		return cfg, err
+	}
+
+	switch cfg.Provider {
+	case ProviderOpenAI:
+		if cfg.APIKey == "" {
+			return cfg, fmt.Errorf("OPENAI_TOKEN not set for %s", feature)
+		}
+	case ProviderCompatible:
+		if cfg.BaseURL == "" {
+			return cfg, fmt.Errorf("%sBASE_URL or OPENAI_BASE_URL required for compatible provider", prefix)
+		}
+		if cfg.Model == "" {
+			return cfg, fmt.Errorf("%sMODEL or OPENAI_MODEL required for compatible provider", prefix)
+		}
+	case ProviderScripted:
+	default:
+		return cfg, fmt.Errorf("unknown LLM provider %q for %s", cfg.Provider, feature)
+	}
+
+	return cfg, nil
+}
+
+// NewLLMProvider creates the provider described by the config
+func NewLLMProvider(cfg LLMConfig) (LLMProvider, error) {
+	switch cfg.Provider {
+	case ProviderOpenAI:
+		cfg.BaseURL = ""
+		return NewOpenAIClient(cfg), nil
+	case ProviderCompatible:
+		// Local servers usually ignore the key but the client requires one
+		if cfg.APIKey == "" {
+			cfg.APIKey = "none"
+		}
+		return NewOpenAIClient(cfg), nil
+	case ProviderScripted:
+		if cfg.ScriptPath == "" {
+			return NewScriptedLLM(), nil
+		}
+		return LoadScriptedLLM(cfg.ScriptPath)
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", cfg.Provider)
+	}
+}
+
+// envInt parses an optional non-negative integer setting
+func envInt(name, value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// envDuration parses an optional positive duration setting
+func envDuration(name, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+// ScriptedResponse is returned when the prompt contains Match
+type ScriptedResponse struct {
+	Match    string `json:"match"`
+	Response string `json:"response"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ScriptedLLM is a deterministic LLMProvider returning canned responses
+type ScriptedLLM struct {
+	responses []ScriptedResponse
+	mutex     sync.Mutex
+	prompts   []string
+}
+
+// scriptedDefaultResponse is returned when no scripted response matches
+const scriptedDefaultResponse = "This is a scripted response."
+
+// scriptedUnavailable as Error simulates an outage, so the offline fallback is used
+const scriptedUnavailable = "unavailable"
+
+// NewScriptedLLM creates a fake returning the first response whose Match is found in the prompt
+func NewScriptedLLM(responses ...ScriptedResponse) *ScriptedLLM {
+	return &ScriptedLLM{responses: responses}
+}
+
+// LoadScriptedLLM reads scripted responses from a JSON file
+func LoadScriptedLLM(path string) (*ScriptedLLM, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading LLM script %s: %w", path, err)
+	}
+
+	var responses []ScriptedResponse
+	if err := json.Unmarshal(content, &responses); err != nil {
+		return nil, fmt.Errorf("parsing LLM script %s: %w", path, err)
+	}
+	return NewScriptedLLM(responses...), nil
+}
+
+func (s *ScriptedLLM) GetCompletion(ctx context.Context, system, prompt string) (string, Usage, error) {
+	s.mutex.Lock()
+	s.prompts = append(s.prompts, prompt)
+	s.mutex.Unlock()
+
+	answer := scriptedDefaultResponse
+	for _, r := range s.responses {
+		if strings.Contains(strings.ToLower(prompt), strings.ToLower(r.Match)) {
+			if r.Error == scriptedUnavailable {
+				return "", Usage{}, fmt.Errorf("scripted outage: %w", ErrLLMUnavailable)
+			}
+			if r.Error != "" {
+				return "", Usage{}, fmt.Errorf("scripted error: %s", r.Error)
+			}
+			answer = r.Response
+			break
+		}
+	}
+
+	// Roughly four characters per token, so usage accounting can be exercised
+	usage := Usage{
+		Model:            ProviderScripted,
+		PromptTokens:     len(prompt)/4 + 1,
+		CompletionTokens: len(answer)/4 + 1,
+	}
+	loggerFrom(ctx).Debug("Scripted LLM response", "prompt_length", len(prompt), "response_length", len(answer))
+	return answer, usage, nil
+}
+
+// GetVisionCompletion answers like GetCompletion, so photo handling works offline
+func (s *ScriptedLLM) GetVisionCompletion(ctx context.Context, system, prompt string, image Image) (string, Usage, error) {
+	return s.GetCompletion(ctx, system, prompt)
+}
+
+// Prompts returns all prompts received so far
+func (s *ScriptedLLM) Prompts() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.prompts...)
+}
@@ -0,0 +1,211 @@
+// logging.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces sensitive values in logs
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeys are attributes whose values must never be logged. Keys are
+// matched whole, with dashes as underscores, so that e.g. prompt_tokens and
+// has_signature are still logged.
+var sensitiveKeys = map[string]bool{
+	"token":             true,
+	"bot_token":         true,
+	"telegram_token":    true,
+	"access_token":      true,
+	"refresh_token":     true,
+	"secret":            true,
+	"secret_token":      true,
+	"webhook_secret":    true,
+	"client_secret":     true,
+	"signature":         true,
+	"stripe_signature":  true,
+	"password":          true,
+	"authorization":     true,
+	"api_key":           true,
+	"apikey":            true,
+	"openai_api_key":    true,
+	"stripe_key":        true,
+	"stripe_secret_key": true,
+	"cookie":            true,
+	"set_cookie":        true,
+}
+
+// privateKeys are attributes with user content or health data
+var privateKeys = map[string]bool{
+	"text":      true,
+	"prompt":    true,
+	"answer":    true,
+	"payload":   true,
+	"headers":   true,
+	"body":      true,
+	"user_data": true,
+	"diabetes":  true,
+	"health":    true,
+	"data":      true, // Callback data holds questionnaire answers
+}
+
+// secretPatterns match secrets that may appear inside log messages and errors
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`),                 // OpenAI API keys
+	regexp.MustCompile(`(sk|rk|pk)_(live|test)_[A-Za-z0-9]{8,}`), // Stripe API keys
+	regexp.MustCompile(`whsec_[A-Za-z0-9]+`),                     // Stripe webhook secrets
+	regexp.MustCompile(`\d{6,}:[A-Za-z0-9_\-]{30,}`),             // Telegram bot tokens
+	regexp.MustCompile(`t=\d+,v1=[0-9a-f]+(,v0=[0-9a-f]+)?`),     // Stripe-Signature header
+	regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._\-]+`),          // Authorization headers
+}
+
+// loggerKey is the context key for a request-scoped logger
+type loggerKey struct{}
+
+// setupLogging configures the default slog logger with redaction
+func setupLogging(w io.Writer, level, format string) error {
+	handler, err := newLogHandler(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(&redactingHandler{next: handler}))
+	return nil
+}
+
+// validateLogging checks logging settings without changing the logger
+func validateLogging(level, format string) error {
+	_, err := newLogHandler(io.Discard, level, format)
+	return err
+}
+
+// newLogHandler creates a text or JSON handler for the level
+func newLogHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q: %v", level, err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, AddSource: lvl <= slog.LevelDebug}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q, expected json or text", format)
+	}
+}
+
+// mustSetupLogging configures logging from the environment before the config is loaded
+func mustSetupLogging() {
+	if err := setupLogging(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")); err != nil {
+		setupLogging(os.Stderr, "", "")
+		slog.Warn("Invalid logging settings, using defaults", "error", err)
+	}
+}
+
+// withLogger returns a context carrying the logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger stored in the context or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// newCorrelationID returns a random identifier for tracing a request in logs
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// redactString removes secrets from free text
+func redactString(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, redactedValue)
+	}
+	return s
+}
+
+// isSensitiveKey checks if an attribute key must be redacted
+func isSensitiveKey(key string) bool {
+	key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	return privateKeys[key] || sensitiveKeys[key]
+}
+
+// redactAttr scrubs a single attribute
+func redactAttr(a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redactedValue)
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]any, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = redactAttr(attr)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, redactString(err.Error()))
+		}
+		if s, ok := v.Any().(fmt.Stringer); ok {
+			return slog.String(a.Key, redactString(s.String()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactingHandler scrubs secrets and private data before passing records on
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandlerScrubsPrivateData(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, "info", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(&redactingHandler{next: handler})
+
+	logger.Info("Received callback", "action", callbackAction(CallbackDiabetes+"yes"), "data", CallbackDiabetes+"yes")
+	logger.With("text", "my sugar is 20").Info("Received message",
+		"error", "call failed with sk-abcdefghijklmnopqrstuvwxyz")
+
+	out := buf.String()
+	for _, leaked := range []string{"yes", "sugar", "sk-abcdefghijklmnop"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log output contains %q:\n%s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, "action=dia") {
+		t.Errorf("log output lacks the callback action:\n%s", out)
+	}
+}
+
+func TestCallbackAction(t *testing.T) {
+	tests := map[string]string{
+		"dia:yes":        "dia",
+		"chk:pain:sharp": "chk",
+		"pay":            "pay",
+		"":               "",
+	}
+	for data, want := range tests {
+		if got := callbackAction(data); got != want {
+			t.Errorf("callbackAction(%q) = %q, want %q", data, got, want)
+		}
+	}
+}
+
+func TestIsSensitiveKey(t *testing.T) {
+	tests := map[string]bool{
+		"token":             true,
+		"bot_token":         true,
+		"api_key":           true,
+		"Authorization":     true,
+		"Stripe-Signature":  true,
+		"secret_token":      true,
+		"text":              true,
+		"prompt_tokens":     false,
+		"completion_tokens": false,
+		"has_signature":     false,
+		"key":               false, // Rate limit bucket keys
+		"user_id":           false,
+	}
+	for key, want := range tests {
+		if got := isSensitiveKey(key); got != want {
+			t.Errorf("isSensitiveKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestRedactingHandlerKeepsUsageCounts(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, "debug", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(&redactingHandler{next: handler})
+
+	logger.Info("OpenAI usage", "prompt_tokens", 120, "completion_tokens", 45)
+	logger.Debug("Received webhook", "has_signature", true, "stripe-signature", "t=1,v1=abc")
+
+	out := buf.String()
+	for _, want := range []string{"prompt_tokens=120", "completion_tokens=45", "has_signature=true", "stripe-signature=" + redactedValue} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -2,10 +2,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,62 +23,79 @@ import (
 type WebhookHandler struct {
 	bot           *Bot
 	webhookSecret string
+	// Accept events with invalid signatures, for local testing
+	testMode bool
 }
 
 func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	log.Printf("Received request %s %s", r.Method, r.URL.Path)
+
+	// Tag all logs of this request with a correlation ID
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newCorrelationID()
+	}
+	logger := slog.With("request_id", requestID)
+	ctx := withLogger(r.Context(), logger)
+	logger.Info("Received webhook request", "method", r.Method, "path", r.URL.Path)
+
+	// Record the outcome of every request, including early rejections
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	eventType := "unknown"
+	defer func() {
+		webhookEventsTotal.WithLabelValues(eventType, webhookOutcome(recorder.status)).Inc()
+		webhookDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	const MaxBodyBytes = int64(65536)
 	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
 
 	payload, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading webhook: %v", err)
+		logger.Error("Error reading webhook", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// Output useful information for debugging
-	log.Printf("Received webhook, length: %d bytes, headers: %v", len(payload), r.Header)
+	logger.Debug("Received webhook", "payload_length", len(payload), "has_signature", r.Header.Get("Stripe-Signature") != "")
 
 	// Check webhook signature if secret is set
 	var event stripe.Event
 	if h.webhookSecret != "" {
 		event, err = webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), h.webhookSecret)
 		if err != nil {
-			log.Printf("Error verifying webhook signature: %v", err)
-			// If in local mode, log the received payload
-			if os.Getenv("LOG_WEBHOOK_PAYLOAD") == "true" {
-				log.Printf("Received webhook payload: %s", string(payload))
-			}
+			logger.Error("Error verifying webhook signature", "error", err)
 
 			// If in test mode, continue despite signature error
-			if !strings.Contains(err.Error(), "signature") || os.Getenv("STRIPE_TEST_MODE") != "true" {
+			if !strings.Contains(err.Error(), "signature") || !h.testMode {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
 			// Try to parse the event without signature verification (for testing)
 			if err := json.Unmarshal(payload, &event); err != nil {
-				log.Printf("Error parsing event without signature: %v", err)
+				logger.Error("Error parsing event without signature", "error", err)
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			log.Printf("WARNING: Processing event without signature verification (for testing only)")
+			logger.Warn("Processing event without signature verification (for testing only)")
 		}
 	} else {
 		// If secret is not set, just parse JSON
 		if err := json.Unmarshal(payload, &event); err != nil {
-			log.Printf("Error parsing event: %v", err)
+			logger.Error("Error parsing event", "error", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		log.Printf("WARNING: Webhook Secret not set, signature not verified")
+		logger.Warn("Webhook secret not set, signature not verified")
 	}
 
 	// Log received event
-	log.Printf("Received Stripe event: %s [%s]", event.Type, event.ID)
+	logger = logger.With("event_id", event.ID, "event_type", event.Type)
+	ctx = withLogger(ctx, logger)
+	logger.Info("Received Stripe event")
+	eventType = event.Type
 
 	// Process event
 	switch event.Type {
@@ -84,105 +103,196 @@ func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var session stripe.CheckoutSession
 		err := json.Unmarshal(event.Data.Raw, &session)
 		if err != nil {
-			log.Printf("Error parsing checkout.session.completed event: %v", err)
+			logger.Error("Error parsing checkout.session.completed event", "error", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		log.Printf("Processing successful payment: %s, for user: %s", session.ID, session.ClientReferenceID)
+		logger.Info("Processing successful payment", "session_id", session.ID, "user_id", session.ClientReferenceID)
 
-		err = h.bot.ProcessPaymentWebhook(session.ID)
+		err = h.bot.ProcessPaymentWebhook(ctx, session.ID)
 		if err != nil {
-			log.Printf("Error processing payment: %v", err)
+			logger.Error("Error processing payment", "session_id", session.ID, "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("Successfully processed payment: %s", session.ID)
+		logger.Info("Accepted payment", "session_id", session.ID)
 	case "payment_intent.succeeded":
-		log.Printf("Received payment_intent.succeeded event, but processing happens on checkout.session.completed")
+		logger.Debug("Payment intent succeeded, processing happens on checkout.session.completed")
 	default:
-		log.Printf("Received unprocessed event type: %s", event.Type)
+		logger.Info("Received unprocessed event type")
 	}
 
-	elapsed := time.Since(start)
-	log.Printf("Webhook processing took %s", elapsed)
+	logger.Info("Webhook processed", "duration", time.Since(start))
 	w.WriteHeader(http.StatusOK)
 }
 
 func main() {
-	// Configure logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	log.Printf("Starting application")
+	// Render a prompt for a sample profile without starting the bot
+	if len(os.Args) > 1 && os.Args[1] == "render-prompt" {
+		if err := runRenderPrompt(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "render-prompt:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Print the effective configuration and check it
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCommand(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "config:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Configure logging from the environment until the config is loaded
+	mustSetupLogging()
+	slog.Info("Starting application")
 
 	// Load configuration
 	config, err := LoadConfig()
 	if err != nil {
-		log.Fatalf("Error loading configuration: %v", err)
+		slog.Error("Error loading configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Apply logging settings that may come from the .env file
+	if err := setupLogging(os.Stderr, config.LogLevel, config.LogFormat); err != nil {
+		slog.Error("Error configuring logging", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize language model providers
+	providers := make(map[UsageFeature]LLMProvider)
+	for feature, cfg := range config.LLM {
+		provider, err := NewLLMProvider(cfg)
+		if err != nil {
+			slog.Error("Error initializing LLM provider", "feature", feature, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("LLM provider configured", "feature", feature, "provider", cfg.Provider, "model", cfg.Model, "base_url", cfg.BaseURL)
+		providers[feature] = provider
+	}
+
+	// Open persistent store
+	store, err := NewFileStore(config.StorePath, 30*time.Second)
+	if err != nil {
+		slog.Error("Error opening store", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			slog.Error("Error closing store", "error", err)
+		}
+	}()
+
+	// Load prompt templates and reload them when the files change
+	prompts, err := NewPromptStore(config.PromptsDir)
+	if err != nil {
+		slog.Error("Error loading prompts", "error", err)
+		os.Exit(1)
+	}
+	prompts.Watch(config.PromptsReload)
+	defer prompts.Close()
+
+	safety, err := LoadSafetyScreener(config.SafetyRules)
+	if err != nil {
+		slog.Error("Error loading safety rules", "error", err)
+		os.Exit(1)
 	}
 
-	// Initialize OpenAI client
-	openAIClient := NewOpenAIClient(config.OpenAIToken)
+	slog.Info("Speech-to-text configured", "provider", config.Speech.Provider, "model", config.Speech.Model, "base_url", config.Speech.BaseURL)
+
+	limiter := NewRateLimiter(config.RateLimits, store)
+	usage := NewUsageTracker(store, config.ModelPrices, config.UsageQuota)
 
 	// Initialize and start bot
-	bot, err := NewBot(config.TelegramToken, openAIClient)
+	bot, err := NewBot(config, BotDeps{
+		Providers:   providers,
+		Prompts:     prompts,
+		Audit:       NewAuditLogger(config.AuditLogPath),
+		Limiter:     limiter,
+		Usage:       usage,
+		Store:       store,
+		Safety:      safety,
+		Incidents:   NewIncidentLogger(config.SafetyLogPath),
+		Dispatcher:  NewDispatcher(config.DispatchWorkers, config.DispatchQueueSize),
+		Transcriber: NewTranscriber(config.Speech),
+	})
 	if err != nil {
-		log.Fatalf("Error initializing bot: %v", err)
+		slog.Error("Error initializing bot", "error", err)
+		os.Exit(1)
+	}
+
+	if config.CheckInReminders {
+		bot.RemindCheckIns(config.CheckInInterval)
 	}
 
-	// Start message processing in a separate goroutine
-	go bot.Start()
-	fmt.Println("Bot started...")
+	// Receive Telegram updates by long polling or on the webhook registered below
+	if config.UpdateMode == UpdateModePolling {
+		go bot.Start()
+	} else {
+		http.Handle(telegramWebhookPath(config.TelegramToken), NewTelegramWebhookHandler(bot, config.WebhookSecret))
+	}
+	slog.Info("Bot started")
 
 	// Configure HTTP server for webhooks
 	webhookHandler := &WebhookHandler{
 		bot:           bot,
-		webhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
+		webhookSecret: config.StripeWebhookSecret,
+		testMode:      config.StripeTestMode,
 	}
 
 	// Output additional information for debugging
-	log.Printf("Setting up webhook for Stripe at path /webhook/stripe")
+	slog.Info("Setting up webhook for Stripe", "path", "/webhook/stripe")
 	http.Handle("/webhook/stripe", webhookHandler)
 	http.Handle("/webhook", webhookHandler) // Alternative path for webhook
 
 	// For debugging - simple handler to check server operation
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received ping request")
+		slog.Debug("Received ping request")
 		w.Write([]byte("pong"))
 	})
 
 	// Monitoring
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Server status request")
+		slog.Debug("Server status request")
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "ok",
 			"time":   time.Now().Format(time.RFC3339),
 		})
 	})
+	// Liveness and readiness probes
+	http.HandleFunc("/healthz", healthzHandler)
+	http.Handle("/readyz", readyzHandler(bot))
+	// Prometheus metrics
+	http.Handle("/metrics", metricsHandler())
+
 	// Setup static files
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
 	// Successful payment handler
 	http.HandleFunc("/payment/success", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request to success payment page: %s", r.URL.String())
-
 		// Get session ID from URL
 		sessionID := r.URL.Query().Get("session_id")
-		if sessionID != "" {
-			log.Printf("Payment session ID: %s", sessionID)
+		logger := slog.With("request_id", newCorrelationID(), "session_id", sessionID)
+		logger.Info("Received request to success payment page")
 
+		if sessionID != "" {
 			// Try to process successful payment through webhook,
 			// if user returned via success_url
-			if os.Getenv("STRIPE_TEST_MODE") == "true" {
-				go func() {
-					log.Printf("Test mode: automatic processing of successful payment")
+			if config.StripeTestMode {
+				bot.spawn("payment_success", func(ctx context.Context) {
+					logger.Info("Test mode: automatic processing of successful payment")
 					// Give time for normal webhook processing
 					time.Sleep(2 * time.Second)
 
 					// Process payment if it hasn't been processed yet
-					webhookHandler.bot.ProcessPaymentWebhook(sessionID)
-				}()
+					bot.ProcessPaymentWebhook(withLogger(ctx, logger), sessionID)
+				})
 			}
 		}
 
@@ -192,7 +302,7 @@ func main() {
 
 	// Payment cancellation handler
 	http.HandleFunc("/payment/cancel", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request to cancel payment page")
+		slog.Info("Received request to cancel payment page")
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write([]byte(`
         <html>
@@ -223,22 +333,41 @@ func main() {
 	})
 
 	// Start HTTP server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "4242"
-	}
-
+	server := &http.Server{Addr: ":" + config.Port}
 	go func() {
-		log.Printf("Starting HTTP server on port %s", port)
-		if err := http.ListenAndServe(":"+port, nil); err != nil {
-			log.Printf("Error starting HTTP server: %v", err)
+		slog.Info("Starting HTTP server", "port", config.Port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error starting HTTP server", "error", err)
 		}
 	}()
 
+	// Register the webhook once the server is about to accept Telegram's requests
+	if config.UpdateMode == UpdateModeWebhook {
+		if err := bot.SetWebhook(config.BaseURL, config.WebhookSecret); err != nil {
+			slog.Error("Error registering Telegram webhook", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	// Configure graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	fmt.Println("Shutting down bot...")
+	slog.Info("Shutting down bot", "timeout", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Stop taking updates, finish HTTP requests (Stripe webhooks included),
+	// then wait for handlers still generating plans or processing payments
+	bot.StopIntake()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down HTTP server", "error", err)
+	}
+	if err := bot.Drain(ctx); err != nil {
+		slog.Error("Shutdown deadline reached, cancelled remaining work", "error", err)
+	}
+
+	// The deferred store Close flushes persistent state
+	slog.Info("Bot stopped")
 }
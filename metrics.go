@@ -0,0 +1,268 @@
+// metrics.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes all metric names
+const metricsNamespace = "tgbot"
+
+// knownCommands limits the label values of the command counter
+var knownCommands = map[string]bool{
+	"start": true, "help": true, "pay": true, "plan": true, "get_plan": true,
+	"units": true, "complete_payment": true,
+	"stats": true, "user": true, "grant": true, "revoke": true, "refund": true,
+	"resetlimit": true, "broadcast": true, "usage": true,
+	"checkin": true, "log": true, "invite": true, "coach": true, "clients": true, "addcoach": true, "removecoach": true, "assign": true, "unassign": true,
+	"exercise": true,
+}
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	updatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "updates_total",
+		Help:      "Telegram updates received, by type.",
+	}, []string{"type"})
+
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_total",
+		Help:      "Bot commands received, by command.",
+	}, []string{"command"})
+
+	questionnaireTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "questionnaire_transitions_total",
+		Help:      "Dialog state transitions, by source and target state.",
+	}, []string{"from", "to"})
+
+	openAIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_request_duration_seconds",
+		Help:      "Latency of OpenAI chat completion requests.",
+		Buckets:   []float64{0.5, 1, 2, 5, 10, 15, 20, 30, 45, 60},
+	}, []string{"model", "outcome"})
+
+	openAITokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_tokens_total",
+		Help:      "OpenAI tokens used, by model and token type.",
+	}, []string{"model", "type"})
+
+	openAICostTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_cost_usd_total",
+		Help:      "Estimated OpenAI cost in USD, by model and feature.",
+	}, []string{"model", "feature"})
+
+	openAIErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_errors_total",
+		Help:      "OpenAI request errors, by model and kind.",
+	}, []string{"model", "kind"})
+
+	openAIFallbackTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_fallback_total",
+		Help:      "Responses served by the local fallback, by reason.",
+	}, []string{"reason"})
+
+	openAIRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_retries_total",
+		Help:      "OpenAI request retries, by model and error kind.",
+	}, []string{"model", "kind"})
+
+	circuitStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "Circuit breaker state (0 closed, 1 open, 2 half-open), by breaker.",
+	}, []string{"breaker"})
+
+	circuitTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Circuit breaker state changes, by breaker and new state.",
+	}, []string{"breaker", "state"})
+
+	photoAnalysesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "photo_analyses_total",
+		Help:      "Meal photos analyzed, by outcome (analyzed, fallback, download_failed, failed).",
+	}, []string{"outcome"})
+
+	voiceTranscriptionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "voice_transcriptions_total",
+		Help:      "Voice messages received, by outcome (transcribed, empty, failed, too_long, download_failed, disabled).",
+	}, []string{"outcome"})
+
+	checkInsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkins_total",
+		Help:      "Weekly check-in events (reminded, started) and completed check-ins by adjustment (progress, repeat, deload).",
+	}, []string{"event"})
+
+	exerciseLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "exercise_lookups_total",
+		Help:      "Exercise library lookups by result (found, suggested, not_found).",
+	}, []string{"result"})
+
+	referralEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "referral_events_total",
+		Help:      "Referral program events (attributed, self_referral, unknown_code, not_eligible, rewarded, credit_used).",
+	}, []string{"event"})
+
+	coachMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "coach_messages_total",
+		Help:      "Messages relayed between clients and coaches, by direction (question, reply) and outcome (relayed, failed).",
+	}, []string{"direction", "outcome"})
+
+	safetyIncidentsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "safety_incidents_total",
+		Help:      "Medical red flags found, by source (input, output) and category.",
+	}, []string{"source", "category"})
+
+	dispatcherQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "dispatcher_queue_depth",
+		Help:      "Updates queued or being handled.",
+	})
+
+	handlerPanicsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_panics_total",
+		Help:      "Panics recovered in handlers, by handler.",
+	}, []string{"handler"})
+
+	checkoutSessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkout_sessions_total",
+		Help:      "Stripe checkout sessions, by status (created, paid, failed).",
+	}, []string{"status"})
+
+	webhookEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_events_total",
+		Help:      "Stripe webhook requests, by event type and outcome.",
+	}, []string{"event_type", "outcome"})
+
+	webhookDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_duration_seconds",
+		Help:      "Time spent processing Stripe webhook requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		updatesTotal,
+		commandsTotal,
+		questionnaireTransitionsTotal,
+		openAIRequestDuration,
+		openAITokensTotal,
+		openAICostTotal,
+		openAIErrorsTotal,
+		openAIFallbackTotal,
+		openAIRetriesTotal,
+		circuitStateGauge,
+		circuitTransitionsTotal,
+		photoAnalysesTotal,
+		voiceTranscriptionsTotal,
+		coachMessagesTotal,
+		referralEventsTotal,
+		checkInsTotal,
+		exerciseLookupsTotal,
+		safetyIncidentsTotal,
+		dispatcherQueueDepth,
+		handlerPanicsTotal,
+		checkoutSessionsTotal,
+		webhookEventsTotal,
+		webhookDuration,
+	)
+}
+
+// metricsHandler serves metrics in Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// observeMessage records the type of an incoming message
+func observeMessage(message *tgbotapi.Message) {
+	updateType := "text"
+	switch {
+	case message.IsCommand():
+		updateType = "command"
+		command := message.Command()
+		if strings.HasPrefix(command, exerciseCommandPrefix) {
+			command = "exercise" // Links to library entries
+		}
+		if !knownCommands[command] {
+			command = "unknown"
+		}
+		commandsTotal.WithLabelValues(command).Inc()
+	case message.Photo != nil:
+		updateType = "photo"
+	case message.Voice != nil:
+		updateType = "voice"
+	case message.Text == "":
+		updateType = "other"
+	}
+	updatesTotal.WithLabelValues(updateType).Inc()
+}
+
+// observeTransition records a dialog state change
+func observeTransition(from, to UserState) {
+	if from != to {
+		questionnaireTransitionsTotal.WithLabelValues(from.String(), to.String()).Inc()
+	}
+}
+
+// observeOpenAIRequest records latency and outcome of an OpenAI request
+func observeOpenAIRequest(model string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	openAIRequestDuration.WithLabelValues(model, outcome).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder captures the status code written by an HTTP handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// webhookOutcome converts an HTTP status into an outcome label
+func webhookOutcome(status int) string {
+	switch {
+	case status < 300:
+		return "ok"
+	case status < 500:
+		return "rejected"
+	default:
+		return "error"
+	}
+}
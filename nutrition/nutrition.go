@@ -0,0 +1,313 @@
+// nutrition.go
+package nutrition
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Sex is the biological sex used by the BMR equations
+type Sex string
+
+const (
+	SexMale   Sex = "male"
+	SexFemale Sex = "female"
+)
+
+// ActivityLevel describes how active the user is outside of planned workouts
+type ActivityLevel string
+
+const (
+	ActivitySedentary  ActivityLevel = "sedentary"
+	ActivityLight      ActivityLevel = "light"
+	ActivityModerate   ActivityLevel = "moderate"
+	ActivityActive     ActivityLevel = "active"
+	ActivityVeryActive ActivityLevel = "very_active"
+)
+
+// Goal is the user's main fitness goal
+type Goal string
+
+const (
+	GoalWeightLoss  Goal = "weight loss"
+	GoalMuscleGain  Goal = "muscle gain"
+	GoalMaintenance Goal = "maintenance"
+	GoalEndurance   Goal = "endurance improvement"
+)
+
+// BMI categories (WHO classification for adults)
+const (
+	BMIUnderweight = "underweight"
+	BMINormal      = "normal weight"
+	BMIOverweight  = "overweight"
+	BMIObese       = "obesity"
+)
+
+// Energy per gram of macronutrient, kcal
+const (
+	kcalPerGramProtein = 4
+	kcalPerGramCarbs   = 4
+	kcalPerGramFat     = 9
+)
+
+// activityMultipliers are the standard TDEE multipliers applied to BMR
+var activityMultipliers = map[ActivityLevel]float64{
+	ActivitySedentary:  1.2,
+	ActivityLight:      1.375,
+	ActivityModerate:   1.55,
+	ActivityActive:     1.725,
+	ActivityVeryActive: 1.9,
+}
+
+// goalAdjustment describes how a goal changes calories and macros
+type goalAdjustment struct {
+	calorieFactor float64 // multiplier applied to TDEE
+	proteinPerKg  float64 // g of protein per kg of body weight
+	fatShare      float64 // share of calories from fat
+	description   string
+}
+
+var goalAdjustments = map[Goal]goalAdjustment{
+	GoalWeightLoss:  {calorieFactor: 0.80, proteinPerKg: 2.0, fatShare: 0.25, description: "20% deficit"},
+	GoalMuscleGain:  {calorieFactor: 1.10, proteinPerKg: 1.8, fatShare: 0.25, description: "10% surplus"},
+	GoalMaintenance: {calorieFactor: 1.00, proteinPerKg: 1.6, fatShare: 0.30, description: "maintenance"},
+	GoalEndurance:   {calorieFactor: 1.05, proteinPerKg: 1.4, fatShare: 0.25, description: "5% surplus for training volume"},
+}
+
+// Safety limits for calorie targets
+const (
+	minCaloriesMale   = 1500
+	minCaloriesFemale = 1200
+	minFatPerKg       = 0.6
+)
+
+// Profile contains the data needed for the calculations
+type Profile struct {
+	Sex            Sex
+	Age            int
+	HeightCm       float64
+	WeightKg       float64
+	BodyFatPercent float64 // optional, enables Katch-McArdle when > 0
+	Activity       ActivityLevel
+	Goal           Goal
+}
+
+// Macros contains daily macronutrient targets in grams
+type Macros struct {
+	ProteinG int
+	FatG     int
+	CarbsG   int
+}
+
+// Result contains the outcome of the energy calculation
+type Result struct {
+	BMI            float64
+	BMICategory    string
+	BMR            float64
+	BMRFormula     string
+	TDEE           float64
+	Calories       int
+	GoalNote       string
+	Macros         Macros
+	WaterMl        int
+	MinCalories    int
+	CaloriesCapped bool
+}
+
+// Validate checks that the profile contains plausible values
+func (p Profile) Validate() error {
+	if p.Sex != SexMale && p.Sex != SexFemale {
+		return fmt.Errorf("unsupported sex: %q", p.Sex)
+	}
+	if p.Age < 14 || p.Age > 100 {
+		return fmt.Errorf("age out of range: %d", p.Age)
+	}
+	if p.HeightCm < 100 || p.HeightCm > 250 {
+		return fmt.Errorf("height out of range: %.0f cm", p.HeightCm)
+	}
+	if p.WeightKg < 30 || p.WeightKg > 300 {
+		return fmt.Errorf("weight out of range: %.0f kg", p.WeightKg)
+	}
+	if p.BodyFatPercent < 0 || p.BodyFatPercent >= 70 {
+		return fmt.Errorf("body fat out of range: %.1f%%", p.BodyFatPercent)
+	}
+	return nil
+}
+
+// BMI returns the body mass index
+func BMI(weightKg, heightCm float64) float64 {
+	if heightCm <= 0 {
+		return 0
+	}
+	h := heightCm / 100
+	return weightKg / (h * h)
+}
+
+// ClassifyBMI returns the WHO category for a BMI value
+func ClassifyBMI(bmi float64) string {
+	switch {
+	case bmi < 18.5:
+		return BMIUnderweight
+	case bmi < 25:
+		return BMINormal
+	case bmi < 30:
+		return BMIOverweight
+	default:
+		return BMIObese
+	}
+}
+
+// MifflinStJeor returns BMR in kcal using the Mifflin-St Jeor equation
+func MifflinStJeor(sex Sex, weightKg, heightCm float64, age int) float64 {
+	bmr := 10*weightKg + 6.25*heightCm - 5*float64(age)
+	if sex == SexFemale {
+		return bmr - 161
+	}
+	return bmr + 5
+}
+
+// KatchMcArdle returns BMR in kcal using lean body mass
+func KatchMcArdle(weightKg, bodyFatPercent float64) float64 {
+	leanMass := weightKg * (1 - bodyFatPercent/100)
+	return 370 + 21.6*leanMass
+}
+
+// TDEE returns total daily energy expenditure for an activity level
+func TDEE(bmr float64, activity ActivityLevel) float64 {
+	multiplier, ok := activityMultipliers[activity]
+	if !ok {
+		multiplier = activityMultipliers[ActivityLight]
+	}
+	return bmr * multiplier
+}
+
+// Calculate computes BMI, BMR, TDEE, calorie target and macros for a profile
+func Calculate(p Profile) (Result, error) {
+	if err := p.Validate(); err != nil {
+		return Result{}, err
+	}
+
+	goal := p.Goal
+	adj, ok := goalAdjustments[goal]
+	if !ok {
+		goal = GoalMaintenance
+		adj = goalAdjustments[goal]
+	}
+
+	var res Result
+	res.BMI = BMI(p.WeightKg, p.HeightCm)
+	res.BMICategory = ClassifyBMI(res.BMI)
+
+	if p.BodyFatPercent > 0 {
+		res.BMR = KatchMcArdle(p.WeightKg, p.BodyFatPercent)
+		res.BMRFormula = "Katch-McArdle"
+	} else {
+		res.BMR = MifflinStJeor(p.Sex, p.WeightKg, p.HeightCm, p.Age)
+		res.BMRFormula = "Mifflin-St Jeor"
+	}
+
+	res.TDEE = TDEE(res.BMR, p.Activity)
+	res.GoalNote = adj.description
+
+	res.MinCalories = minCaloriesMale
+	if p.Sex == SexFemale {
+		res.MinCalories = minCaloriesFemale
+	}
+
+	calories := res.TDEE * adj.calorieFactor
+	if calories < float64(res.MinCalories) {
+		calories = float64(res.MinCalories)
+		res.CaloriesCapped = true
+	}
+	res.Calories = roundTo(calories, 10)
+	res.Macros = splitMacros(float64(res.Calories), p.WeightKg, adj)
+	res.WaterMl = roundTo(p.WeightKg*35, 50)
+
+	return res, nil
+}
+
+// splitMacros distributes calories between protein, fat and carbohydrates
+func splitMacros(calories, weightKg float64, adj goalAdjustment) Macros {
+	protein := weightKg * adj.proteinPerKg
+	fat := calories * adj.fatShare / kcalPerGramFat
+	if fat < weightKg*minFatPerKg {
+		fat = weightKg * minFatPerKg
+	}
+
+	carbs := (calories - protein*kcalPerGramProtein - fat*kcalPerGramFat) / kcalPerGramCarbs
+	if carbs < 0 {
+		carbs = 0
+	}
+
+	return Macros{
+		ProteinG: int(math.Round(protein)),
+		FatG:     int(math.Round(fat)),
+		CarbsG:   int(math.Round(carbs)),
+	}
+}
+
+// roundTo rounds a value to the nearest multiple of step
+func roundTo(v float64, step int) int {
+	return int(math.Round(v/float64(step))) * step
+}
+
+// ErrUnknownValue is returned when free-text input cannot be mapped
+var ErrUnknownValue = errors.New("unknown value")
+
+// ParseSex maps user input to a Sex value
+func ParseSex(s string) (Sex, error) {
+	switch normalize(s) {
+	case "male", "m", "man":
+		return SexMale, nil
+	case "female", "f", "woman":
+		return SexFemale, nil
+	}
+	return "", ErrUnknownValue
+}
+
+// ParseGoal maps callback values and free-text input to a Goal. Free text
+// is matched by whole words, so "fatigue" isn't weight loss and "again" isn't muscle gain.
+func ParseGoal(s string) (Goal, error) {
+	words := strings.FieldsFunc(normalize(s), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	has := func(candidates ...string) bool {
+		for _, word := range words {
+			for _, candidate := range candidates {
+				if word == candidate {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("lose", "losing", "loss", "fat"):
+		return GoalWeightLoss, nil
+	case has("muscle", "muscles", "gain", "gaining", "mass"):
+		return GoalMuscleGain, nil
+	case has("endurance", "stamina"):
+		return GoalEndurance, nil
+	case has("maintain", "maintaining", "maintenance", "keep"):
+		return GoalMaintenance, nil
+	}
+	return "", ErrUnknownValue
+}
+
+// ParseActivity maps callback values and free-text input to an ActivityLevel
+func ParseActivity(s string) (ActivityLevel, error) {
+	v := strings.ReplaceAll(normalize(s), " ", "_")
+	if _, ok := activityMultipliers[ActivityLevel(v)]; ok {
+		return ActivityLevel(v), nil
+	}
+	return "", ErrUnknownValue
+}
+
+// normalize lowercases input and replaces underscores with spaces
+func normalize(s string) string {
+	return strings.ToLower(strings.TrimSpace(strings.ReplaceAll(s, "_", " ")))
+}
@@ -0,0 +1,243 @@
+package nutrition
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMifflinStJeor(t *testing.T) {
+	tests := []struct {
+		name     string
+		sex      Sex
+		weightKg float64
+		heightCm float64
+		age      int
+		want     float64
+	}{
+		{"male", SexMale, 80, 180, 30, 1780},
+		{"female", SexFemale, 64, 168, 32, 1369},
+		{"older female", SexFemale, 40, 150, 80, 776.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MifflinStJeor(tt.sex, tt.weightKg, tt.heightCm, tt.age); !approx(got, tt.want) {
+				t.Errorf("MifflinStJeor() = %.2f, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKatchMcArdle(t *testing.T) {
+	tests := []struct {
+		weightKg, bodyFat, want float64
+	}{
+		{80, 20, 1752.4},
+		{70, 0, 1882},
+		{100, 35, 1774},
+	}
+	for _, tt := range tests {
+		if got := KatchMcArdle(tt.weightKg, tt.bodyFat); !approx(got, tt.want) {
+			t.Errorf("KatchMcArdle(%v, %v) = %.2f, want %.2f", tt.weightKg, tt.bodyFat, got, tt.want)
+		}
+	}
+}
+
+func TestTDEE(t *testing.T) {
+	tests := []struct {
+		activity ActivityLevel
+		want     float64
+	}{
+		{ActivitySedentary, 1200},
+		{ActivityLight, 1375},
+		{ActivityModerate, 1550},
+		{ActivityActive, 1725},
+		{ActivityVeryActive, 1900},
+		{"unknown", 1375}, // Falls back to light activity
+	}
+	for _, tt := range tests {
+		if got := TDEE(1000, tt.activity); !approx(got, tt.want) {
+			t.Errorf("TDEE(1000, %q) = %.2f, want %.2f", tt.activity, got, tt.want)
+		}
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  Profile
+		formula  string
+		calories int
+		capped   bool
+		macros   Macros
+		waterMl  int
+	}{
+		{
+			name:     "muscle gain surplus",
+			profile:  Profile{Sex: SexFemale, Age: 32, HeightCm: 168, WeightKg: 64, Activity: ActivityModerate, Goal: GoalMuscleGain},
+			formula:  "Mifflin-St Jeor",
+			calories: 2330,
+			macros:   Macros{ProteinG: 115, FatG: 65, CarbsG: 322},
+			waterMl:  2250,
+		},
+		{
+			name:     "body fat uses Katch-McArdle",
+			profile:  Profile{Sex: SexMale, Age: 30, HeightCm: 180, WeightKg: 80, BodyFatPercent: 20, Activity: ActivitySedentary, Goal: GoalMaintenance},
+			formula:  "Katch-McArdle",
+			calories: 2100,
+			macros:   Macros{ProteinG: 128, FatG: 70, CarbsG: 240},
+			waterMl:  2800,
+		},
+		{
+			name:     "female minimum calories",
+			profile:  Profile{Sex: SexFemale, Age: 80, HeightCm: 150, WeightKg: 40, Activity: ActivitySedentary, Goal: GoalWeightLoss},
+			formula:  "Mifflin-St Jeor",
+			calories: 1200,
+			capped:   true,
+			macros:   Macros{ProteinG: 80, FatG: 33, CarbsG: 145},
+			waterMl:  1400,
+		},
+		{
+			name:     "male minimum calories",
+			profile:  Profile{Sex: SexMale, Age: 90, HeightCm: 150, WeightKg: 40, Activity: ActivitySedentary, Goal: GoalWeightLoss},
+			formula:  "Mifflin-St Jeor",
+			calories: 1500,
+			capped:   true,
+			macros:   Macros{ProteinG: 80, FatG: 42, CarbsG: 201},
+			waterMl:  1400,
+		},
+		{
+			name:     "fat floor for heavy users",
+			profile:  Profile{Sex: SexMale, Age: 60, HeightCm: 170, WeightKg: 150, Activity: ActivitySedentary, Goal: GoalWeightLoss},
+			formula:  "Mifflin-St Jeor",
+			calories: 2180,
+			macros:   Macros{ProteinG: 300, FatG: 90, CarbsG: 43},
+			waterMl:  5250,
+		},
+		{
+			name:     "unknown goal means maintenance",
+			profile:  Profile{Sex: SexMale, Age: 30, HeightCm: 180, WeightKg: 80, Activity: ActivitySedentary, Goal: "other"},
+			formula:  "Mifflin-St Jeor",
+			calories: 2140,
+			macros:   Macros{ProteinG: 128, FatG: 71, CarbsG: 247},
+			waterMl:  2800,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Calculate(tt.profile)
+			if err != nil {
+				t.Fatalf("Calculate() error = %v", err)
+			}
+			if res.BMRFormula != tt.formula || res.Calories != tt.calories || res.CaloriesCapped != tt.capped {
+				t.Errorf("got %s, %d kcal, capped %v; want %s, %d kcal, capped %v",
+					res.BMRFormula, res.Calories, res.CaloriesCapped, tt.formula, tt.calories, tt.capped)
+			}
+			if res.Macros != tt.macros {
+				t.Errorf("macros = %+v, want %+v", res.Macros, tt.macros)
+			}
+			if res.WaterMl != tt.waterMl {
+				t.Errorf("water = %d ml, want %d", res.WaterMl, tt.waterMl)
+			}
+		})
+	}
+}
+
+func TestCalculateRejectsImplausibleProfiles(t *testing.T) {
+	valid := Profile{Sex: SexMale, Age: 30, HeightCm: 180, WeightKg: 80}
+	tests := []struct {
+		name   string
+		modify func(p *Profile)
+	}{
+		{"sex", func(p *Profile) { p.Sex = "" }},
+		{"age", func(p *Profile) { p.Age = 12 }},
+		{"height", func(p *Profile) { p.HeightCm = 300 }},
+		{"weight", func(p *Profile) { p.WeightKg = 20 }},
+		{"body fat", func(p *Profile) { p.BodyFatPercent = 75 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.modify(&p)
+			if _, err := Calculate(p); err == nil {
+				t.Errorf("Calculate(%+v) accepted an implausible profile", p)
+			}
+		})
+	}
+}
+
+func TestParseSex(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Sex
+		err   error
+	}{
+		{"male", SexMale, nil},
+		{" M ", SexMale, nil},
+		{"Woman", SexFemale, nil},
+		{"f", SexFemale, nil},
+		{"other", "", ErrUnknownValue},
+	}
+	for _, tt := range tests {
+		got, err := ParseSex(tt.input)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("ParseSex(%q) = %q, %v; want %q, %v", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseGoal(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Goal
+		err   error
+	}{
+		{"weight_loss", GoalWeightLoss, nil},
+		{"muscle_gain", GoalMuscleGain, nil},
+		{"endurance", GoalEndurance, nil},
+		{"maintenance", GoalMaintenance, nil},
+		{"I want to lose some fat", GoalWeightLoss, nil},
+		{"burn fat", GoalWeightLoss, nil},
+		{"gain mass", GoalMuscleGain, nil},
+		{"Build muscles", GoalMuscleGain, nil},
+		{"more stamina", GoalEndurance, nil},
+		{"keep my shape", GoalMaintenance, nil},
+		{"maintain weight", GoalMaintenance, nil},
+		// Words only containing a keyword don't count
+		{"less fatigue", "", ErrUnknownValue},
+		{"feel good again", "", ErrUnknownValue},
+		{"endurance without fatigue", GoalEndurance, nil},
+		{"", "", ErrUnknownValue},
+	}
+	for _, tt := range tests {
+		got, err := ParseGoal(tt.input)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("ParseGoal(%q) = %q, %v; want %q, %v", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseActivity(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ActivityLevel
+		err   error
+	}{
+		{"sedentary", ActivitySedentary, nil},
+		{"very_active", ActivityVeryActive, nil},
+		{"Very Active", ActivityVeryActive, nil},
+		{" moderate ", ActivityModerate, nil},
+		{"athlete", "", ErrUnknownValue},
+	}
+	for _, tt := range tests {
+		got, err := ParseActivity(tt.input)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("ParseActivity(%q) = %q, %v; want %q, %v", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// approx compares calculated energy values to a hundredth of a kcal
+func approx(got, want float64) bool {
+	return math.Abs(got-want) < 0.01
+}
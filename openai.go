@@ -3,200 +3,224 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
-	"log"
-	"os"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
 
-// OpenAIClient wrapper for working with OpenAI API
+// OpenAIClient is an LLMProvider for the OpenAI API and OpenAI-compatible servers
 type OpenAIClient struct {
 	client      *openai.Client
-	useFallback bool
+	model       string
+	retry       RetryPolicy
+	breaker     *CircuitBreaker
+	useFallback bool // Set by USE_OPENAI_FALLBACK, never changed at runtime
 }
 
-// NewOpenAIClient creates a new OpenAI client
-func NewOpenAIClient(token string) *OpenAIClient {
-	// Check token
-	if len(token) < 20 {
-		log.Println("WARNING: It seems that the OpenAI token is invalid (too short)")
+// Usage describes the tokens consumed by a completion
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// NewOpenAIClient creates a new OpenAI client. An empty BaseURL uses api.openai.com
+// and an empty Model uses the default model.
+func NewOpenAIClient(cfg LLMConfig) *OpenAIClient {
+	config := openai.DefaultConfig(cfg.APIKey)
+	if cfg.BaseURL != "" {
+		config.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	} else if len(cfg.APIKey) < 20 {
+		// Check token
+		slog.Warn("It seems that the OpenAI token is invalid (too short)")
 	}
+	config.HTTPClient = &http.Client{Transport: &retryAfterTransport{next: http.DefaultTransport}}
 
-	client := openai.NewClient(token)
-	log.Printf("OpenAI client initialized with token: %s***", token[:10])
+	model := cfg.Model
+	if model == "" {
+		model = openai.GPT3Dot5Turbo
+	}
 
-	// Check if fallback should be used
-	useFallback := os.Getenv("USE_OPENAI_FALLBACK") == "true"
+	client := openai.NewClientWithConfig(config)
+	slog.Info("OpenAI client initialized", "base_url", config.BaseURL, "model", model)
 
 	return &OpenAIClient{
 		client:      client,
-		useFallback: useFallback,
+		model:       model,
+		retry:       cfg.Retry,
+		breaker:     NewCircuitBreaker("llm_"+string(cfg.Feature), cfg.Breaker),
+		useFallback: cfg.ForceFallback,
 	}
 }
 
-// GetCompletion sends a request to OpenAI and returns the response
-func (c *OpenAIClient) GetCompletion(prompt string) (string, error) {
-	// If fallback mode is enabled, use fallback
-	if c.useFallback {
-		log.Println("Using fallback mode for OpenAI")
-		return c.getFallbackResponse(prompt), nil
-	}
+// CircuitState returns the state of the client's circuit breaker
+func (c *OpenAIClient) CircuitState() CircuitState {
+	return c.breaker.State()
+}
+
+// GetCompletion sends a request to OpenAI and returns the response with its token usage
+func (c *OpenAIClient) GetCompletion(ctx context.Context, system, prompt string) (string, Usage, error) {
+	loggerFrom(ctx).Info("Sending request to OpenAI", "model", c.model, "prompt_length", len(prompt))
 
-	ctx := context.Background()
+	return c.chat(ctx, system, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: prompt,
+	})
+}
+
+// GetVisionCompletion sends the prompt with an image, which the model must support
+func (c *OpenAIClient) GetVisionCompletion(ctx context.Context, system, prompt string, image Image) (string, Usage, error) {
+	loggerFrom(ctx).Info("Sending image request to OpenAI", "model", c.model, "prompt_length", len(prompt), "image_bytes", len(image.Data))
+
+	dataURL := "data:" + image.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(image.Data)
+	return c.chat(ctx, system, openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: prompt},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{
+				URL:    dataURL,
+				Detail: openai.ImageURLDetailLow, // Enough to recognize a meal, at a fraction of the tokens
+			}},
+		},
+	})
+}
 
-	// Create base system prompt for fitness trainer
-	systemPrompt := `You are an experienced fitness trainer and nutritionist. Your task is to provide personalized recommendations 
-based on user data, which will be provided in JSON format at the beginning of the request.
-Consider gender, age, height, weight, diabetes status, fitness level, and user goals.
-Always give practical, science-based advice that can be applied immediately.
-Never give advice that could be dangerous to health.
-Your responses should be personalized, specific, and motivating.`
+// chat sends the user message after the system prompt, with retries and the circuit breaker
+func (c *OpenAIClient) chat(ctx context.Context, system string, message openai.ChatCompletionMessage) (string, Usage, error) {
+	logger := loggerFrom(ctx)
 
-	// Set model
-	model := openai.GPT3Dot5Turbo
-	if os.Getenv("OPENAI_MODEL") != "" {
-		model = os.Getenv("OPENAI_MODEL")
+	// If fallback mode is enabled, use fallback
+	if c.useFallback {
+		logger.Info("Using fallback mode for OpenAI")
+		openAIFallbackTotal.WithLabelValues("fallback_mode").Inc()
+		return "", Usage{}, fmt.Errorf("%w: fallback mode enabled", ErrLLMUnavailable)
 	}
 
-	log.Printf("Sending request to OpenAI (model: %s, request length: %d characters)",
-		model, len(prompt))
+	model := c.model
 
 	req := openai.ChatCompletionRequest{
 		Model: model,
 		Messages: []openai.ChatCompletionMessage{
 			{
 				Role:    openai.ChatMessageRoleSystem,
-				Content: systemPrompt,
-			},
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: prompt,
+				Content: system,
 			},
+			message,
 		},
 		MaxTokens:   2500, // Increased maximum response length
 		Temperature: 0.7,  // Added temperature parameter for more stable responses
 	}
 
-	// Set timeout for request
-	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	// Don't wait for OpenAI while it is known to be down
+	if err := c.breaker.Allow(); err != nil {
+		logger.Warn("OpenAI circuit is open, using fallback")
+		openAIFallbackTotal.WithLabelValues("circuit_open").Inc()
+		return "", Usage{}, fmt.Errorf("%w: %v", ErrLLMUnavailable, err)
+	}
 
-	resp, err := c.client.CreateChatCompletion(timeoutCtx, req)
+	resp, err := c.createWithRetry(ctx, req)
 	if err != nil {
-		log.Printf("OpenAI API error: %v", err)
-
-		// If error is related to limits or timeout, enable fallback mode
-		if strings.Contains(err.Error(), "429") ||
-			strings.Contains(err.Error(), "timeout") ||
-			strings.Contains(err.Error(), "connection") {
-			log.Println("Switching to fallback mode due to API error")
-			c.useFallback = true
-			return c.getFallbackResponse(prompt), nil
+		if ctx.Err() != nil {
+			// The caller gave up, the request tells nothing about the API
+			c.breaker.Release()
+			return "", Usage{}, err
+		}
+		if !isTransientError(err) {
+			// The API is reachable, the request itself was rejected
+			c.breaker.Success()
+			return "", Usage{}, err
 		}
-		return "", err
+
+		c.breaker.Failure()
+		logger.Warn("OpenAI unavailable, using fallback", "error", err)
+		openAIFallbackTotal.WithLabelValues(openAIErrorKind(err)).Inc()
+		return "", Usage{}, fmt.Errorf("%w: %v", ErrLLMUnavailable, err)
+	}
+	c.breaker.Success()
+
+	usage := Usage{
+		Model:            model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
 	}
 
+	openAITokensTotal.WithLabelValues(model, "prompt").Add(float64(resp.Usage.PromptTokens))
+	openAITokensTotal.WithLabelValues(model, "completion").Add(float64(resp.Usage.CompletionTokens))
+
 	if len(resp.Choices) == 0 {
-		log.Println("OpenAI returned empty response")
-		return "", errors.New("no response from OpenAI")
+		logger.Error("OpenAI returned empty response", "model", model)
+		openAIErrorsTotal.WithLabelValues(model, "empty_response").Inc()
+		return "", usage, errors.New("no response from OpenAI")
 	}
 
 	answer := resp.Choices[0].Message.Content
-	log.Printf("Received response from OpenAI (length: %d characters)", len(answer))
-	return answer, nil
+	logger.Info("Received response from OpenAI",
+		"model", model,
+		"response_length", len(answer),
+		"prompt_tokens", resp.Usage.PromptTokens,
+		"completion_tokens", resp.Usage.CompletionTokens)
+	return answer, usage, nil
 }
 
-// getFallbackResponse returns a local response without API call
-func (c *OpenAIClient) getFallbackResponse(prompt string) string {
-	// Check if the request contains keywords for workout plan
-	if strings.Contains(strings.ToLower(prompt), "workout program") ||
-		strings.Contains(strings.ToLower(prompt), "training plan") {
-		return `📋 PERSONALIZED WORKOUT PROGRAM
-
-Based on your data, I've created an optimal workout program for 2 weeks:
-
-## WEEKLY PLAN
-
-**Monday**: Strength training (upper body) - 45 minutes
-**Tuesday**: Cardio - 30 minutes
-**Wednesday**: Rest
-**Thursday**: Strength training (lower body) - 45 minutes
-**Friday**: Cardio + light strength - 40 minutes
-**Saturday**: Active recovery (walking, yoga) - 30 minutes
-**Sunday**: Complete rest
-
-## DETAILED WORKOUTS
-
-### MONDAY (STRENGTH - UPPER BODY)
-1. Warm-up - 5 minutes
-2. Push-ups: 3 sets of 10-12 repetitions
-3. Dumbbell rows: 3×12
-4. Shoulder press: 3×12
-5. Bicep curls: 3×12
-6. Tricep dips: 3×15
-7. Stretching - 5 minutes
-
-### TUESDAY (CARDIO)
-1. Warm-up - 5 minutes
-2. Interval training:
-   - 1 minute fast walking/running
-   - 1 minute regular walking
-   - Repeat 10 times
-3. Cool-down - 5 minutes
-
-### THURSDAY (STRENGTH - LOWER BODY)
-1. Warm-up - 5 minutes
-2. Squats: 3×15
-3. Lunges: 3×12 for each leg
-4. Calf raises: 3×20
-5. Glute bridge: 3×15
-6. Plank: 3×30 seconds
-7. Stretching - 5 minutes
-
-### FRIDAY (CARDIO + LIGHT STRENGTH)
-1. Warm-up - 5 minutes
-2. Cardio - 15 minutes (walking, running, or cycling)
-3. Circuit training (3 rounds):
-   - Squats: 15 repetitions
-   - Knee push-ups: 10 repetitions
-   - Crunches: 15 repetitions
-   - Plank: 30 seconds
-4. Stretching - 5 minutes
-
-## NUTRITION RECOMMENDATIONS
-- Increase protein intake (meat, fish, eggs, cottage cheese)
-- Eat complex carbohydrates (vegetables, grains, legumes)
-- Monitor sugar levels due to diabetes
-- Drink at least 2 liters of water per day
-- Eat frequently and in small portions (4-5 times a day)
-
-## PROGRESS TRACKING
-- Keep a workout journal
-- Take before and after photos
-- Measure body circumferences once a week
-- Regularly monitor weight (1-2 times a week)
-- Pay attention to well-being and energy
-
-## SPECIAL RECOMMENDATIONS
-- Stop training immediately if hypoglycemia symptoms appear
-- Carry fast carbs with you (juice, candy)
-- Check sugar levels before and after workouts
-- Exercise 1-2 hours after eating
-- Increase intensity gradually
-
-This program is designed considering your level and health specifics. Gradually you'll be able to increase workout intensity.`
+// createWithRetry sends the request, retrying transient errors with backoff
+func (c *OpenAIClient) createWithRetry(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	logger := loggerFrom(ctx)
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, retryAfter := withRetryAfter(ctx)
+		// Set timeout for request
+		attemptCtx, cancel := context.WithTimeout(attemptCtx, 30*time.Second)
+
+		start := time.Now()
+		resp, err := c.client.CreateChatCompletion(attemptCtx, req)
+		cancel()
+		observeOpenAIRequest(req.Model, start, err)
+		if err == nil {
+			return resp, nil
+		}
+
+		kind := openAIErrorKind(err)
+		logger.Error("OpenAI API error", "model", req.Model, "attempt", attempt+1, "error", err)
+		openAIErrorsTotal.WithLabelValues(req.Model, kind).Inc()
+
+		if attempt >= c.retry.MaxRetries || !isTransientError(err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		delay := c.retry.Backoff(attempt)
+		if wait := retryAfter.get(); wait > 0 {
+			if wait > c.retry.MaxDelay {
+				logger.Warn("Retry-After exceeds the maximum retry delay, giving up", "retry_after", wait)
+				return resp, err
+			}
+			delay = wait
+		}
+
+		logger.Info("Retrying OpenAI request", "model", req.Model, "attempt", attempt+1, "delay", delay)
+		openAIRetriesTotal.WithLabelValues(req.Model, kind).Inc()
+		if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+			return resp, err
+		}
 	}
+}
 
-	// Fallback for regular questions
-	return "🤖 Autonomous mode (OpenAI unavailable):\n\n" +
-		"I can't connect to OpenAI right now, but here are some general fitness recommendations:\n\n" +
-		"1. Regular workouts (3-5 times a week) are the key to success\n" +
-		"2. Combine cardio and strength training for comprehensive results\n" +
-		"3. Proper nutrition accounts for 70% of success in achieving fitness goals\n" +
-		"4. Monitor recovery and ensure your body gets enough rest\n" +
-		"5. Gradually increase intensity for continuous progress\n\n" +
-		"Ask your question later when the service is available. Request time: " + time.Now().Format("15:04:05")
+// openAIErrorKind classifies an OpenAI error for metrics
+func openAIErrorKind(err error) string {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "429"):
+		return "rate_limit"
+	case strings.Contains(message, "timeout") || strings.Contains(message, "deadline"):
+		return "timeout"
+	case strings.Contains(message, "connection"):
+		return "connection"
+	default:
+		return "api_error"
+	}
 }
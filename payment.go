@@ -3,79 +3,95 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/checkout/session"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
-// InitStripe initializes Stripe API
-func InitStripe() {
-	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
-	if stripeKey == "" {
-		log.Println("WARNING: STRIPE_SECRET_KEY not set, using test key!")
+// PaymentConfig contains payment configuration
+type PaymentConfig struct {
+	ProductName string
+	ProductDesc string
+	PriceAmount int64 // in minimum currency units (cents, kopecks, etc.)
+	Currency    string
+	SuccessURL  string
+	CancelURL   string
+	// Every checkout counts as paid, for local testing
+	TestMode bool
+}
+
+// NewPaymentConfig returns the product offered, redirecting back to baseURL
+func NewPaymentConfig(config *Config) PaymentConfig {
+	return PaymentConfig{
+		ProductName: "Personalized Fitness Program",
+		ProductDesc: "Individual workout program created based on your parameters and goals",
+		PriceAmount: 5000, // 50.00 currency units
+		Currency:    "rub",
+		SuccessURL:  fmt.Sprintf("%s/payment/success?session_id={CHECKOUT_SESSION_ID}", config.BaseURL),
+		CancelURL:   fmt.Sprintf("%s/payment/cancel?session_id={CHECKOUT_SESSION_ID}", config.BaseURL),
+		TestMode:    config.StripeTestMode,
 	}
-	stripe.Key = stripeKey
-	log.Printf("Stripe API initialized with key: %s***", stripeKey[:10])
 }
 
-// PaymentConfig contains payment configuration
-type PaymentConfig struct {
-	ProductName   string
-	ProductDesc   string
-	PriceAmount   int64 // in minimum currency units (cents, kopecks, etc.)
-	Currency      string
-	SuccessURL    string
-	CancelURL     string
-	WebhookSecret string
+// Payments creates and checks Stripe checkout sessions
+type Payments struct {
+	config PaymentConfig
+	api    *client.API
 }
 
-// GetDefaultPaymentConfig returns default configuration
-func GetDefaultPaymentConfig() PaymentConfig {
-	// Define base URL
-	baseURL := os.Getenv("BOT_WEBHOOK_BASE_URL")
-	if baseURL == "" {
-		// For local testing
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "4242"
-		}
-		baseURL = fmt.Sprintf("http://localhost:%s", port)
+// NewPayments creates a Stripe client. A nil backend talks to STRIPE_API_URL,
+// or to api.stripe.com if that isn't set.
+func NewPayments(config *Config, backend stripe.Backend) *Payments {
+	if config.StripeSecretKey == "" {
+		slog.Warn("STRIPE_SECRET_KEY not set, payments will fail")
+	}
+	if backend == nil && config.StripeAPIURL != "" {
+		backend = stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+			URL: stripe.String(config.StripeAPIURL),
+		})
+	}
 
-		// Check Stripe mode
-		if os.Getenv("STRIPE_TEST_MODE") == "true" {
-			log.Println("Working in Stripe test mode, redirect URLs will be ignored")
-		} else {
-			log.Println("WARNING: Set BOT_WEBHOOK_BASE_URL for proper redirect operation!")
+	var backends *stripe.Backends
+	if backend != nil {
+		backends = &stripe.Backends{
+			API:     backend,
+			Connect: stripe.GetBackend(stripe.ConnectBackend),
+			Uploads: stripe.GetBackend(stripe.UploadsBackend),
 		}
 	}
 
-	return PaymentConfig{
-		ProductName:   "Personalized Fitness Program",
-		ProductDesc:   "Individual workout program created based on your parameters and goals",
-		PriceAmount:   5000, // 50.00 currency units
-		Currency:      "rub",
-		SuccessURL:    fmt.Sprintf("%s/payment/success?session_id={CHECKOUT_SESSION_ID}", baseURL),
-		CancelURL:     fmt.Sprintf("%s/payment/cancel?session_id={CHECKOUT_SESSION_ID}", baseURL),
-		WebhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
+	payments := &Payments{
+		config: NewPaymentConfig(config),
+		api:    client.New(config.StripeSecretKey, backends),
+	}
+	if payments.config.TestMode {
+		slog.Info("Working in Stripe test mode, every checkout counts as paid")
 	}
+	slog.Info("Stripe API initialized", "live_mode", strings.HasPrefix(config.StripeSecretKey, "sk_live_"))
+	return payments
 }
 
-// CreatePayment creates a Stripe payment session and returns URL for payment
-func CreatePayment(userID int64) (string, error) {
-	config := GetDefaultPaymentConfig()
+// Create creates a Stripe payment session with a discount in percent and returns URL for payment
+func (p *Payments) Create(userID int64, discountPercent int) (string, error) {
+	config := p.config
+	amount := config.PriceAmount * int64(100-discountPercent) / 100
+	productName := config.ProductName
+	if discountPercent > 0 {
+		productName = fmt.Sprintf("%s (referral discount %d%%)", productName, discountPercent)
+	}
 
 	// Check minimum payment amount
 	if config.PriceAmount < 5000 {
-		log.Printf("WARNING: Payment amount %d may be too small for Stripe", config.PriceAmount)
+		slog.Warn("Payment amount may be too small for Stripe", "amount", config.PriceAmount)
 	}
 
 	// Convert user ID to string and log it
 	userIDStr := strconv.FormatInt(userID, 10)
-	log.Printf("Creating payment for user ID: %s", userIDStr)
+	slog.Info("Creating payment", "user_id", userID, "amount", amount, "discount_percent", discountPercent)
 
 	params := &stripe.CheckoutSessionParams{
 		PaymentMethodTypes: stripe.StringSlice([]string{
@@ -86,10 +102,10 @@ func CreatePayment(userID int64) (string, error) {
 				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
 					Currency: stripe.String(config.Currency),
 					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Name:        stripe.String(config.ProductName),
+						Name:        stripe.String(productName),
 						Description: stripe.String(config.ProductDesc),
 					},
-					UnitAmount: stripe.Int64(config.PriceAmount),
+					UnitAmount: stripe.Int64(amount),
 				},
 				Quantity: stripe.Int64(1),
 			},
@@ -100,55 +116,165 @@ func CreatePayment(userID int64) (string, error) {
 		ClientReferenceID: stripe.String(userIDStr),
 	}
 
-	s, err := session.New(params)
+	s, err := p.api.CheckoutSessions.New(params)
 	if err != nil {
-		log.Printf("Error creating Stripe session: %v", err)
+		slog.Error("Error creating Stripe session", "user_id", userID, "error", err)
+		checkoutSessionsTotal.WithLabelValues("failed").Inc()
 		return "", err
 	}
+	checkoutSessionsTotal.WithLabelValues("created").Inc()
 
-	log.Printf("Created Stripe session %s for user %s with URL: %s", s.ID, userIDStr, s.URL)
+	slog.Info("Created Stripe session", "session_id", s.ID, "user_id", userID)
 	return s.URL, nil
 }
 
-// VerifyPayment checks payment status
-func VerifyPayment(sessionID string) (bool, string, error) {
-	log.Printf("Checking payment status for session: %s", sessionID)
+// Verify checks payment status
+func (p *Payments) Verify(sessionID string) (bool, string, error) {
+	slog.Info("Checking payment status", "session_id", sessionID)
 
 	// Additional parameter check
 	if sessionID == "" {
 		return false, "", fmt.Errorf("empty session ID")
 	}
 
-	s, err := session.Get(sessionID, nil)
+	s, err := p.api.CheckoutSessions.Get(sessionID, nil)
 	if err != nil {
-		log.Printf("Error getting session data %s: %v", sessionID, err)
+		slog.Error("Error getting session data", "session_id", sessionID, "error", err)
 		return false, "", err
 	}
 
-	// Output all session data for debugging
-	log.Printf("Session: %s, Payment status: %s, Client ID: %s, Mode: %s",
-		s.ID, s.PaymentStatus, s.ClientReferenceID, s.Mode)
+	slog.Debug("Checkout session",
+		"session_id", s.ID,
+		"payment_status", s.PaymentStatus,
+		"client_reference_id", s.ClientReferenceID,
+		"mode", s.Mode)
 
 	// For local testing - always consider payment successful
-	if os.Getenv("STRIPE_TEST_MODE") == "true" {
-		log.Printf("TEST MODE: Considering payment successful")
+	if p.config.TestMode {
+		slog.Warn("Test mode: considering payment successful", "session_id", sessionID)
 		return true, s.ClientReferenceID, nil
 	}
 
 	// Check payment status
 	if s.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid {
-		log.Printf("Payment confirmed for session: %s", sessionID)
+		slog.Info("Payment confirmed", "session_id", sessionID)
 		return true, s.ClientReferenceID, nil
 	}
 
-	log.Printf("Payment not confirmed for session: %s (status: %s)", sessionID, s.PaymentStatus)
+	slog.Info("Payment not confirmed", "session_id", sessionID, "payment_status", s.PaymentStatus)
 	return false, s.ClientReferenceID, nil
 }
 
+// Refund refunds the payment made through a checkout session
+func (p *Payments) Refund(sessionID string) (string, error) {
+	slog.Info("Refunding payment", "session_id", sessionID)
+
+	if sessionID == "" {
+		return "", fmt.Errorf("empty session ID")
+	}
+
+	s, err := p.api.CheckoutSessions.Get(sessionID, nil)
+	if err != nil {
+		slog.Error("Error getting session data", "session_id", sessionID, "error", err)
+		return "", err
+	}
+
+	if s.PaymentIntent == nil || s.PaymentIntent.ID == "" {
+		return "", fmt.Errorf("session %s has no payment intent", sessionID)
+	}
+
+	r, err := p.api.Refunds.New(&stripe.RefundParams{
+		PaymentIntent: stripe.String(s.PaymentIntent.ID),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	})
+	if err != nil {
+		slog.Error("Error creating refund", "session_id", sessionID, "error", err)
+		return "", err
+	}
+
+	slog.Info("Created refund", "refund_id", r.ID, "session_id", sessionID, "status", r.Status)
+	return r.ID, nil
+}
+
+// Store buckets of processed payments
+const (
+	paymentsBucket  = "payments"   // PaymentRecord by checkout session ID
+	paidUsersBucket = "paid_users" // PaidUser by user ID
+)
+
+// PaymentRecord marks a checkout session whose payment was processed
+type PaymentRecord struct {
+	UserID      int64     `json:"user_id"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// PaidUser records the payments of a user. Unlike the session it survives
+// restarts, so it decides who counts as an existing customer and which
+// payment admins can refund.
+type PaidUser struct {
+	FirstSessionID string    `json:"first_session_id"`
+	FirstPaidAt    time.Time `json:"first_paid_at"`
+	LastSessionID  string    `json:"last_session_id,omitempty"`
+	LastPaidAt     time.Time `json:"last_paid_at"`
+	Refunded       bool      `json:"refunded,omitempty"` // The last payment was refunded
+}
+
+// LastPayment returns the checkout session of the user's latest payment
+func (p PaidUser) LastPayment() string {
+	if p.LastSessionID != "" {
+		return p.LastSessionID
+	}
+	return p.FirstSessionID // Recorded before later payments were
+}
+
+// recordPaidUser records a payment of the user, keeping their first payment
+func recordPaidUser(store Store, userID int64, sessionID string) error {
+	key := strconv.FormatInt(userID, 10)
+	var paid PaidUser
+	found, err := store.Get(paidUsersBucket, key, &paid)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !found {
+		paid.FirstSessionID, paid.FirstPaidAt = sessionID, now
+	}
+	paid.LastSessionID, paid.LastPaidAt, paid.Refunded = sessionID, now, false
+	return store.Put(paidUsersBucket, key, paid)
+}
+
+// recordRefund marks the user's last payment as refunded if it is the session
+func recordRefund(store Store, userID int64, sessionID string) error {
+	paid, found, err := firstPayment(store, userID)
+	if err != nil || !found || paid.LastPayment() != sessionID {
+		return err
+	}
+	paid.Refunded = true
+	return store.Put(paidUsersBucket, strconv.FormatInt(userID, 10), paid)
+}
+
+// firstPayment returns the payments of the user, if they ever paid
+func firstPayment(store Store, userID int64) (PaidUser, bool, error) {
+	var paid PaidUser
+	found, err := store.Get(paidUsersBucket, strconv.FormatInt(userID, 10), &paid)
+	return paid, found, err
+}
+
+// Payment IDs that don't belong to a Stripe checkout session
+const (
+	adminGrantPrefix    = "admin_grant_"    // Access granted with /grant
+	manualPaymentPrefix = "cs_test_manual_" // Payments completed with /complete_payment
+)
+
+// stripePayment reports whether a payment ID is a real checkout session that can be refunded
+func stripePayment(paymentID string) bool {
+	return !strings.HasPrefix(paymentID, adminGrantPrefix) && !strings.HasPrefix(paymentID, manualPaymentPrefix)
+}
+
 // ManuallyCompletePayment allows manually completing payment for testing
 func ManuallyCompletePayment(userID int64) string {
 	// Generate a fake session ID
-	sessionID := fmt.Sprintf("cs_test_manual_%d_%d", userID, time.Now().Unix())
-	log.Printf("Payment manually completed: %s for user %d", sessionID, userID)
+	sessionID := fmt.Sprintf("%s%d_%d", manualPaymentPrefix, userID, time.Now().Unix())
+	slog.Warn("Payment manually completed", "session_id", sessionID, "user_id", userID)
 	return sessionID
 }
@@ -0,0 +1,86 @@
+// photo.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxPhotoBytes is the largest photo sent to the vision model
+const maxPhotoBytes = 5 << 20
+
+// handlePhoto estimates the macros of a meal photo and judges it against the user's targets
+func (b *Bot) handlePhoto(ctx context.Context, message *tgbotapi.Message, session *UserSession) {
+	logger := loggerFrom(ctx)
+	chatID := message.Chat.ID
+
+	if session.State != StateComplete {
+		b.sendText(chatID, "I can check your meals against your calorie targets once your program is ready. Use /start to begin.")
+		return
+	}
+
+	// The caption is the user's question about the meal
+	if b.screenInput(chatID, session.UserID, message.Caption) {
+		return
+	}
+	if !b.checkUsageQuota(ctx, chatID, session.UserID) {
+		return
+	}
+
+	if _, err := b.api.Request(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)); err != nil {
+		logger.Error("Error sending 'typing' status", "error", err)
+	}
+
+	image, err := b.downloadPhoto(ctx, message.Photo)
+	if err != nil {
+		logger.Error("Error downloading photo", "error", err)
+		photoAnalysesTotal.WithLabelValues("download_failed").Inc()
+		b.sendText(chatID, "I couldn't load your photo. Please try sending it again.")
+		return
+	}
+
+	answer, err := b.complete(ctx, UsagePhoto, session, message.Caption, image)
+	if err != nil {
+		logger.Error("Error analyzing photo", "error", err)
+		photoAnalysesTotal.WithLabelValues("failed").Inc()
+		b.sendText(chatID, "An error occurred while analyzing your photo. Please try again later.")
+		return
+	}
+
+	outcome := "analyzed"
+	if answer.Fallback {
+		outcome = "fallback"
+	}
+	photoAnalysesTotal.WithLabelValues(outcome).Inc()
+	logger.Debug("Analyzed meal photo", "prompt_version", answer.PromptVersion, "fallback", answer.Fallback, "image_bytes", len(image.Data))
+	b.sendText(chatID, answer.Text)
+}
+
+// downloadPhoto fetches the largest size of a photo that isn't too big for the model
+func (b *Bot) downloadPhoto(ctx context.Context, sizes []tgbotapi.PhotoSize) (*Image, error) {
+	// Telegram lists the sizes from smallest to largest
+	var fileID string
+	for _, size := range sizes {
+		if size.FileSize <= maxPhotoBytes {
+			fileID = size.FileID
+		}
+	}
+	if fileID == "" {
+		return nil, fmt.Errorf("all %d photo sizes exceed %d bytes", len(sizes), maxPhotoBytes)
+	}
+
+	data, path, err := b.downloadFile(ctx, fileID, maxPhotoBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, fmt.Errorf("photo %s is %s, not an image", path, mimeType)
+	}
+	return &Image{Data: data, MIMEType: mimeType}, nil
+}
@@ -0,0 +1,388 @@
+// prompts.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Prompt template names
+const (
+	PromptSystem  = "system"
+	PromptPlan    = "plan"
+	PromptQA      = "qa"
+	PromptPhoto   = "photo"
+	PromptCheckIn = "checkin"
+)
+
+// promptNames are the templates every prompt directory must provide
+var promptNames = []string{PromptSystem, PromptPlan, PromptQA, PromptPhoto, PromptCheckIn}
+
+// defaultPrompts are built into the binary and used when a file is missing
+//
+//go:embed prompts/*.tmpl
+var defaultPrompts embed.FS
+
+// promptVersionPattern finds the version declared in a template,
+// e.g. {{- /* version: 3 */ -}}
+var promptVersionPattern = regexp.MustCompile(`version:\s*([\w.\-]+)`)
+
+// PromptData is the input of all prompt templates
+type PromptData struct {
+	User             *UserData
+	UserData         string // User formatted for the model
+	Energy           string // Calculated energy targets
+	UnitsInstruction string
+	Question         string // The user's message, or the caption of a meal photo
+
+	// Weekly check-in
+	Week         int    // Number of the week to plan
+	PreviousPlan string // Plan of the week before
+	CheckIn      string // The user's answers
+	Workouts     string // Workouts logged since the previous plan
+	Progression  string // Progressive overload or deload instructions
+}
+
+// NewPromptData prepares template input from the user's data
+func NewPromptData(data *UserData, question string) PromptData {
+	return PromptData{
+		User:             data,
+		UserData:         data.String(),
+		Energy:           data.EnergySummary(),
+		UnitsInstruction: data.UnitsInstruction(),
+		Question:         question,
+	}
+}
+
+// samplePromptData is used to validate templates and by the render-prompt command
+func samplePromptData() PromptData {
+	data := NewPromptData(&UserData{
+		Sex:         "female",
+		Age:         32,
+		Height:      168,
+		Weight:      64,
+		Units:       UnitsMetric,
+		Diabetes:    "no",
+		Level:       "intermediate",
+		Activity:    "moderate",
+		FitnessGoal: "muscle gain",
+		FitnessType: "strength",
+	}, "How much protein should I eat on rest days?")
+	data.Week = 2
+	data.PreviousPlan = "Monday: goblet squat 3 × 8-10, push-up 3 × 8-10\nWednesday: 25 min brisk walk"
+	data.CheckIn = "- Planned workouts done: most\n- Difficulty: just right"
+	data.Workouts = "- Mon: squats 3x10 with 12 kg"
+	data.Progression = "Apply progressive overload in week 2."
+	return data
+}
+
+// promptTemplate is a parsed template with its version
+type promptTemplate struct {
+	tmpl    *template.Template
+	version string
+	source  string // File path or "builtin"
+	modTime time.Time
+}
+
+// PromptStore loads prompt templates from a directory and reloads them when they change
+type PromptStore struct {
+	dir       string
+	mutex     sync.RWMutex
+	templates map[string]*promptTemplate
+	rejected  map[string]time.Time // Modification time of broken files, to log them once
+	stop      chan struct{}
+}
+
+// NewPromptStore loads all prompts, falling back to the built-in ones for missing files
+func NewPromptStore(dir string) (*PromptStore, error) {
+	s := &PromptStore{
+		dir:       dir,
+		templates: make(map[string]*promptTemplate),
+		rejected:  make(map[string]time.Time),
+		stop:      make(chan struct{}),
+	}
+	for _, name := range promptNames {
+		t, err := s.load(name)
+		if err != nil {
+			return nil, err
+		}
+		s.templates[name] = t
+		slog.Info("Prompt loaded", "prompt", name, "version", t.version, "source", t.source)
+	}
+	return s, nil
+}
+
+// load reads and validates one template
+func (s *PromptStore) load(name string) (*promptTemplate, error) {
+	path := filepath.Join(s.dir, name+".tmpl")
+	source := path
+
+	var content []byte
+	var modTime time.Time
+	info, err := os.Stat(path)
+	if s.dir != "" && err == nil {
+		modTime = info.ModTime()
+		if content, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("reading prompt %s: %w", path, err)
+		}
+	} else {
+		source = "builtin"
+		if content, err = fs.ReadFile(defaultPrompts, "prompts/"+name+".tmpl"); err != nil {
+			return nil, fmt.Errorf("reading built-in prompt %s: %w", name, err)
+		}
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("parsing prompt %s: %w", source, err)
+	}
+
+	// Catch references to unknown fields before the template is used
+	if err := tmpl.Execute(io.Discard, samplePromptData()); err != nil {
+		return nil, fmt.Errorf("validating prompt %s: %w", source, err)
+	}
+
+	return &promptTemplate{
+		tmpl:    tmpl,
+		version: promptVersion(name, content),
+		source:  source,
+		modTime: modTime,
+	}, nil
+}
+
+// promptVersion identifies a template by its declared version and content hash,
+// so edits are visible even if the declared version isn't bumped
+func promptVersion(name string, content []byte) string {
+	declared := "0"
+	if m := promptVersionPattern.FindSubmatch(content); m != nil {
+		declared = string(m[1])
+	}
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("%s.v%s-%s", name, declared, hex.EncodeToString(sum[:4]))
+}
+
+// Render executes a template and returns the prompt with the template version
+func (s *PromptStore) Render(name string, data PromptData) (string, string, error) {
+	s.mutex.RLock()
+	t, ok := s.templates[name]
+	s.mutex.RUnlock()
+	if !ok {
+		return "", "", fmt.Errorf("unknown prompt %q", name)
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", t.version, fmt.Errorf("rendering prompt %s: %w", name, err)
+	}
+	return strings.TrimSpace(buf.String()), t.version, nil
+}
+
+// Reload reloads templates whose files changed. A broken template keeps the
+// previous version in use.
+func (s *PromptStore) Reload() {
+	for _, name := range promptNames {
+		s.mutex.RLock()
+		current := s.templates[name]
+		s.mutex.RUnlock()
+
+		info, err := os.Stat(filepath.Join(s.dir, name+".tmpl"))
+		switch {
+		case err != nil && current.source == "builtin":
+			continue
+		case err == nil && (info.ModTime().Equal(current.modTime) || info.ModTime().Equal(s.rejected[name])):
+			continue
+		}
+
+		t, err := s.load(name)
+		if err != nil {
+			if info != nil {
+				s.rejected[name] = info.ModTime()
+			}
+			slog.Error("Error reloading prompt, keeping previous version", "prompt", name, "version", current.version, "error", err)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.templates[name] = t
+		s.mutex.Unlock()
+		slog.Info("Prompt reloaded", "prompt", name, "version", t.version, "previous_version", current.version, "source", t.source)
+	}
+}
+
+// Watch checks the prompt files for changes every interval until Close
+func (s *PromptStore) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.Reload()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching for changes
+func (s *PromptStore) Close() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+// PlanRecord is a generated plan with the prompts that produced it
+type PlanRecord struct {
+	UserID        int64     `json:"user_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	PromptVersion string    `json:"prompt_version"`
+	SystemVersion string    `json:"system_version,omitempty"`
+	Fallback      bool      `json:"fallback"`
+	Week          int       `json:"week,omitempty"` // Set for plans made after a weekly check-in
+	Plan          string    `json:"plan"`
+	Exercises     []string  `json:"exercises,omitempty"` // IDs of the library exercises in the plan
+}
+
+// Store buckets of generated plans
+const (
+	plansBucket       = "plans"        // PlanRecord by user and creation time
+	latestPlansBucket = "latest_plans" // Key of the latest PlanRecord by user ID, empty if none
+)
+
+// savePlan stores a generated plan, keyed by user and creation time, and
+// makes it the user's latest plan
+func (b *Bot) savePlan(record PlanRecord) {
+	if b.store == nil {
+		return
+	}
+	key := fmt.Sprintf("%d:%d", record.UserID, record.CreatedAt.UnixNano())
+	if err := b.store.Put(plansBucket, key, record); err != nil {
+		slog.Error("Error saving plan", "user_id", record.UserID, "error", err)
+		return
+	}
+	if err := b.store.Put(latestPlansBucket, strconv.FormatInt(record.UserID, 10), key); err != nil {
+		slog.Error("Error indexing plan", "user_id", record.UserID, "error", err)
+	}
+}
+
+// lastPlan returns the most recent plan generated for the user
+func (b *Bot) lastPlan(userID int64) (*PlanRecord, bool) {
+	if b.store == nil {
+		return nil, false
+	}
+	var key string
+	found, err := b.store.Get(latestPlansBucket, strconv.FormatInt(userID, 10), &key)
+	if err != nil {
+		return nil, false
+	}
+	if !found {
+		return b.indexLastPlan(userID)
+	}
+	if key == "" {
+		return nil, false
+	}
+
+	var record PlanRecord
+	if ok, err := b.store.Get(plansBucket, key, &record); err != nil || !ok {
+		return nil, false
+	}
+	return &record, true
+}
+
+// indexLastPlan finds the latest plan of a user whose plans were saved before
+// the latest_plans index existed, and adds it to the index
+func (b *Bot) indexLastPlan(userID int64) (*PlanRecord, bool) {
+	keys, err := b.store.Keys(plansBucket)
+	if err != nil {
+		return nil, false
+	}
+
+	prefix := fmt.Sprintf("%d:", userID)
+	var last *PlanRecord
+	var lastKey string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		var record PlanRecord
+		if ok, err := b.store.Get(plansBucket, key, &record); err != nil || !ok {
+			continue
+		}
+		if last == nil || record.CreatedAt.After(last.CreatedAt) {
+			last, lastKey = &record, key
+		}
+	}
+
+	// An empty key records that the user has no plans, so they aren't scanned again
+	if err := b.store.Put(latestPlansBucket, strconv.FormatInt(userID, 10), lastKey); err != nil {
+		slog.Error("Error indexing plan", "user_id", userID, "error", err)
+	}
+	return last, last != nil
+}
+
+// runRenderPrompt implements the render-prompt command:
+//
+//	go run . render-prompt -name plan -profile profile.json
+func runRenderPrompt(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("render-prompt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", "prompts", "directory with prompt templates")
+	name := flags.String("name", PromptPlan, "prompt to render: system, plan, qa, photo or checkin")
+	profile := flags.String("profile", "", "JSON file with user data (default: built-in sample)")
+	question := flags.String("question", "", "user message for the qa prompt or photo caption")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	data := samplePromptData()
+	if *profile != "" {
+		content, err := os.ReadFile(*profile)
+		if err != nil {
+			return err
+		}
+		var user UserData
+		if err := json.Unmarshal(content, &user); err != nil {
+			return fmt.Errorf("parsing profile %s: %w", *profile, err)
+		}
+		sample := data
+		data = NewPromptData(&user, sample.Question)
+		data.Week, data.PreviousPlan, data.CheckIn = sample.Week, sample.PreviousPlan, sample.CheckIn
+		data.Workouts, data.Progression = sample.Workouts, sample.Progression
+	}
+	if *question != "" {
+		data.Question = *question
+	}
+
+	store, err := NewPromptStore(*dir)
+	if err != nil {
+		return err
+	}
+	prompt, version, err := store.Render(*name, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "# %s\n", version)
+	fmt.Fprintln(stdout, prompt)
+	return nil
+}
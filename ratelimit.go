@@ -0,0 +1,233 @@
+// ratelimit.go
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateFeature is a part of the bot limited separately
+type RateFeature string
+
+const (
+	FeatureQuestionnaire RateFeature = "questionnaire"
+	FeatureQA            RateFeature = "qa"
+	FeaturePayments      RateFeature = "payments"
+	FeaturePhoto         RateFeature = "photo"
+)
+
+// RateTier groups users with the same limits
+type RateTier string
+
+const (
+	TierFree RateTier = "free"
+	TierPaid RateTier = "paid"
+)
+
+// rateLimitBucket is the store bucket for limiter state
+const rateLimitBucket = "ratelimit"
+
+// RateLimit allows Burst requests and refills them evenly over Period
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Burst, l.Period)
+}
+
+// defaultRateLimits are used unless overridden by RATE_LIMITS:
+//
+//	free.questionnaire=60/1h  free.qa=5/24h   free.payments=5/1h  free.photo=3/24h
+//	paid.questionnaire=120/1h paid.qa=30/1h   paid.payments=5/1h  paid.photo=20/24h
+var defaultRateLimits = map[RateTier]map[RateFeature]RateLimit{
+	TierFree: {
+		FeatureQuestionnaire: {Burst: 60, Period: time.Hour},
+		FeatureQA:            {Burst: 5, Period: 24 * time.Hour},
+		FeaturePayments:      {Burst: 5, Period: time.Hour},
+		FeaturePhoto:         {Burst: 3, Period: 24 * time.Hour},
+	},
+	TierPaid: {
+		FeatureQuestionnaire: {Burst: 120, Period: time.Hour},
+		FeatureQA:            {Burst: 30, Period: time.Hour},
+		FeaturePayments:      {Burst: 5, Period: time.Hour},
+		FeaturePhoto:         {Burst: 20, Period: 24 * time.Hour},
+	},
+}
+
+// parseRateLimits parses overrides like "paid.qa=50/1h,free.qa=10/24h" on top of the defaults
+func parseRateLimits(value string) (map[RateTier]map[RateFeature]RateLimit, error) {
+	limits := make(map[RateTier]map[RateFeature]RateLimit)
+	for tier, features := range defaultRateLimits {
+		limits[tier] = make(map[RateFeature]RateLimit)
+		for feature, limit := range features {
+			limits[tier][feature] = limit
+		}
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected tier.feature=count/period", item)
+		}
+		tierName, featureName, ok := strings.Cut(strings.TrimSpace(name), ".")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit name %q, expected tier.feature", name)
+		}
+		tier, feature := RateTier(tierName), RateFeature(featureName)
+		if _, ok := limits[tier]; !ok {
+			return nil, fmt.Errorf("unknown rate limit tier %q", tierName)
+		}
+		if _, ok := limits[tier][feature]; !ok {
+			return nil, fmt.Errorf("unknown rate limit feature %q", featureName)
+		}
+
+		countStr, periodStr, ok := strings.Cut(strings.TrimSpace(spec), "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected count/period", spec)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid rate limit count %q", countStr)
+		}
+		period, err := time.ParseDuration(periodStr)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid rate limit period %q", periodStr)
+		}
+
+		limits[tier][feature] = RateLimit{Burst: count, Period: period}
+	}
+
+	return limits, nil
+}
+
+// tokenBucket is the persisted state of one user's limit
+type tokenBucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// RateLimiter applies token-bucket limits per user and feature
+type RateLimiter struct {
+	limits  map[RateTier]map[RateFeature]RateLimit
+	store   Store
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+// NewRateLimiter creates a limiter persisting its state in the store
+func NewRateLimiter(limits map[RateTier]map[RateFeature]RateLimit, store Store) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		store:   store,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// rateLimitKey builds the key of a user's bucket
+func rateLimitKey(userID int64, feature RateFeature) string {
+	return fmt.Sprintf("%d:%s", userID, feature)
+}
+
+// Allow takes a token from the user's bucket. If none is left, it returns
+// false and the time until the next token is available.
+func (l *RateLimiter) Allow(userID int64, tier RateTier, feature RateFeature) (bool, time.Duration) {
+	limit, ok := l.limits[tier][feature]
+	if !ok {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := rateLimitKey(userID, feature)
+	now := l.now()
+	bucket := l.loadBucket(key, limit, now)
+
+	// Refill tokens for the time passed since the last request
+	refillRate := float64(limit.Burst) / limit.Period.Seconds()
+	bucket.Tokens = math.Min(float64(limit.Burst), bucket.Tokens+now.Sub(bucket.Last).Seconds()*refillRate)
+	bucket.Last = now
+
+	allowed := bucket.Tokens >= 1
+	var wait time.Duration
+	if allowed {
+		bucket.Tokens--
+	} else {
+		wait = time.Duration((1 - bucket.Tokens) / refillRate * float64(time.Second))
+	}
+
+	if l.store != nil {
+		if err := l.store.Put(rateLimitBucket, key, bucket); err != nil {
+			slog.Error("Error saving rate limit state", "user_id", userID, "feature", feature, "error", err)
+		}
+	}
+
+	return allowed, wait
+}
+
+// loadBucket returns the bucket from memory, the store or a new full one
+func (l *RateLimiter) loadBucket(key string, limit RateLimit, now time.Time) *tokenBucket {
+	if bucket, ok := l.buckets[key]; ok {
+		return bucket
+	}
+
+	bucket := &tokenBucket{Tokens: float64(limit.Burst), Last: now}
+	if l.store != nil {
+		if _, err := l.store.Get(rateLimitBucket, key, bucket); err != nil {
+			slog.Error("Error loading rate limit state", "key", key, "error", err)
+			bucket = &tokenBucket{Tokens: float64(limit.Burst), Last: now}
+		}
+	}
+	l.buckets[key] = bucket
+	return bucket
+}
+
+// Reset restores all of the user's limits to full
+func (l *RateLimiter) Reset(userID int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, feature := range []RateFeature{FeatureQuestionnaire, FeatureQA, FeaturePayments, FeaturePhoto} {
+		key := rateLimitKey(userID, feature)
+		delete(l.buckets, key)
+		if l.store != nil {
+			if err := l.store.Delete(rateLimitBucket, key); err != nil {
+				slog.Error("Error deleting rate limit state", "key", key, "error", err)
+			}
+		}
+	}
+}
+
+// tierForSession returns the limit tier of the user
+func tierForSession(session *UserSession) RateTier {
+	if session.State == StateComplete {
+		return TierPaid
+	}
+	return TierFree
+}
+
+// formatWait returns a friendly description of a waiting time
+func formatWait(wait time.Duration) string {
+	switch {
+	case wait < time.Minute:
+		return "a minute"
+	case wait < time.Hour:
+		return fmt.Sprintf("%d minutes", int(math.Ceil(wait.Minutes())))
+	default:
+		return fmt.Sprintf("%d hours", int(math.Ceil(wait.Hours())))
+	}
+}
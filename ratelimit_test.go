@@ -0,0 +1,157 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testLimits are small limits that are easy to count
+var testLimits = map[RateTier]map[RateFeature]RateLimit{
+	TierFree: {
+		FeatureQA:    {Burst: 2, Period: time.Hour},
+		FeaturePhoto: {Burst: 1, Period: 24 * time.Hour},
+	},
+	TierPaid: {
+		FeatureQA:    {Burst: 4, Period: time.Hour},
+		FeaturePhoto: {Burst: 3, Period: 24 * time.Hour},
+	},
+}
+
+// testRateLimiter returns a limiter on the store with the time set by *now
+func testRateLimiter(store Store, now *time.Time) *RateLimiter {
+	limiter := NewRateLimiter(testLimits, store)
+	limiter.now = func() time.Time { return *now }
+	return limiter
+}
+
+// openTestStore opens the file store at path, closed when the test ends
+func openTestStore(t *testing.T, path string) *FileStore {
+	t.Helper()
+	store, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// takeAll takes tokens until the limiter refuses and returns how many it allowed
+func takeAll(l *RateLimiter, userID int64, tier RateTier, feature RateFeature) (int, time.Duration) {
+	for taken := 0; taken < 1000; taken++ {
+		if ok, wait := l.Allow(userID, tier, feature); !ok {
+			return taken, wait
+		}
+	}
+	return 1000, 0
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	limiter := testRateLimiter(nil, &now)
+
+	if taken, wait := takeAll(limiter, 1, TierFree, FeatureQA); taken != 2 || wait != 30*time.Minute {
+		t.Fatalf("took %d tokens, then wait %s; want 2 and 30m", taken, wait)
+	}
+
+	// A token refills every 30 minutes
+	now = now.Add(20 * time.Minute)
+	if ok, wait := limiter.Allow(1, TierFree, FeatureQA); ok || wait != 10*time.Minute {
+		t.Errorf("after 20 minutes: allowed %v, wait %s; want a 10m wait", ok, wait)
+	}
+	now = now.Add(10 * time.Minute)
+	if ok, _ := limiter.Allow(1, TierFree, FeatureQA); !ok {
+		t.Error("token not refilled after 30 minutes")
+	}
+
+	// Refills stop at the burst
+	now = now.Add(24 * time.Hour)
+	if taken, _ := takeAll(limiter, 1, TierFree, FeatureQA); taken != 2 {
+		t.Errorf("took %d tokens after a day, want the burst of 2", taken)
+	}
+}
+
+func TestRateLimiterTiersAndFeatures(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	limiter := testRateLimiter(nil, &now)
+
+	tests := []struct {
+		userID  int64
+		tier    RateTier
+		feature RateFeature
+		want    int
+	}{
+		{1, TierFree, FeatureQA, 2},
+		{1, TierFree, FeaturePhoto, 1}, // Features have separate buckets
+		{2, TierPaid, FeatureQA, 4},    // Users too
+		{2, TierPaid, FeaturePhoto, 3},
+		{3, TierFree, FeaturePayments, 1000}, // Features without a limit aren't limited
+	}
+	for _, tt := range tests {
+		if taken, _ := takeAll(limiter, tt.userID, tt.tier, tt.feature); taken != tt.want {
+			t.Errorf("user %d, %s %s: took %d tokens, want %d", tt.userID, tt.tier, tt.feature, taken, tt.want)
+		}
+	}
+
+	// A user who starts paying refills up to the paid burst
+	now = now.Add(time.Hour)
+	if taken, _ := takeAll(limiter, 1, TierPaid, FeatureQA); taken != 4 {
+		t.Errorf("took %d tokens after paying, want the paid burst of 4", taken)
+	}
+}
+
+func TestRateLimiterPersistsAcrossRestart(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := openTestStore(t, path)
+	limiter := testRateLimiter(store, &now)
+	takeAll(limiter, 1, TierFree, FeatureQA)
+	limiter.Allow(1, TierPaid, FeaturePhoto)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarted bot continues with the saved tokens
+	now = now.Add(30 * time.Minute)
+	limiter = testRateLimiter(openTestStore(t, path), &now)
+	if taken, _ := takeAll(limiter, 1, TierFree, FeatureQA); taken != 1 {
+		t.Errorf("took %d Q&A tokens after the restart, want the 1 refilled", taken)
+	}
+	if taken, _ := takeAll(limiter, 1, TierPaid, FeaturePhoto); taken != 2 {
+		t.Errorf("took %d photo tokens after the restart, want the 2 left", taken)
+	}
+	if taken, _ := takeAll(limiter, 2, TierFree, FeatureQA); taken != 2 {
+		t.Errorf("new user took %d tokens, want the burst of 2", taken)
+	}
+}
+
+func TestRateLimiterReset(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "store.json")
+	store := openTestStore(t, path)
+	limiter := testRateLimiter(store, &now)
+	takeAll(limiter, 1, TierFree, FeatureQA)
+	takeAll(limiter, 1, TierFree, FeaturePhoto)
+	takeAll(limiter, 2, TierFree, FeatureQA)
+
+	limiter.Reset(1)
+	if taken, _ := takeAll(limiter, 1, TierFree, FeatureQA); taken != 2 {
+		t.Errorf("took %d Q&A tokens after reset, want 2", taken)
+	}
+	if taken, _ := takeAll(limiter, 1, TierFree, FeaturePhoto); taken != 1 {
+		t.Errorf("took %d photo tokens after reset, want 1", taken)
+	}
+	if ok, _ := limiter.Allow(2, TierFree, FeatureQA); ok {
+		t.Error("reset of user 1 refilled user 2")
+	}
+
+	// The reset is persisted too
+	limiter.Reset(1)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	limiter = testRateLimiter(openTestStore(t, path), &now)
+	if taken, _ := takeAll(limiter, 1, TierFree, FeatureQA); taken != 2 {
+		t.Errorf("took %d tokens after reset and restart, want 2", taken)
+	}
+}
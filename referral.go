@@ -0,0 +1,377 @@
+// referral.go
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store buckets of the referral program
+const (
+	referralCodesBucket    = "referral_codes"    // ReferralCode by code
+	referralAccountsBucket = "referral_accounts" // ReferralAccount by user ID
+	referralsBucket        = "referrals"         // Referral by referred user ID
+)
+
+// referralPayloadPrefix starts the /start payload of invite links, t.me/<bot>?start=ref_<code>
+const referralPayloadPrefix = "ref_"
+
+// referralCodeAlphabet leaves out characters that are easily confused
+const referralCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+const referralCodeLength = 8
+
+// Reasons an invite link isn't credited to its owner
+var (
+	ErrUnknownReferralCode = errors.New("unknown referral code")
+	ErrSelfReferral        = errors.New("own referral code")
+	ErrMutualReferral      = errors.New("referrer was invited by this user")
+	ErrAlreadyReferred     = errors.New("user was already referred")
+	ErrExistingCustomer    = errors.New("user has already paid")
+)
+
+// ReferralRewards are granted when a referred user pays for the first time
+type ReferralRewards struct {
+	ReferrerCredits int // Extra Q&A answers for the referrer
+	ReferredCredits int // Extra Q&A answers for the new user
+	DiscountPercent int // Off the referrer's next checkout
+}
+
+// ReferralCode maps an invite code to its owner
+type ReferralCode struct {
+	Code      string    `json:"code"`
+	OwnerID   int64     `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReferralAccount is a user's invite code and the rewards they hold
+type ReferralAccount struct {
+	UserID          int64  `json:"user_id"`
+	Code            string `json:"code,omitempty"`
+	Invited         int    `json:"invited"`   // Users who started the bot through the code
+	Converted       int    `json:"converted"` // Invited users who paid
+	Credits         int    `json:"credits"`   // Q&A answers beyond the rate limit
+	DiscountPercent int    `json:"discount_percent,omitempty"`
+}
+
+// Referral attributes a user to the owner of the invite link they started with
+type Referral struct {
+	ReferrerID   int64      `json:"referrer_id"`
+	ReferredID   int64      `json:"referred_id"`
+	Code         string     `json:"code"`
+	AttributedAt time.Time  `json:"attributed_at"`
+	RewardedAt   *time.Time `json:"rewarded_at,omitempty"`
+	SessionID    string     `json:"session_id,omitempty"` // Checkout that earned the rewards
+}
+
+// ReferralProgram hands out invite codes, attributes new users and grants rewards
+type ReferralProgram struct {
+	store   Store
+	rewards ReferralRewards
+	mutex   sync.Mutex
+}
+
+// NewReferralProgram creates a referral program persisting its state in the store
+func NewReferralProgram(store Store, rewards ReferralRewards) *ReferralProgram {
+	return &ReferralProgram{store: store, rewards: rewards}
+}
+
+// Account returns the user's referral account, empty if they have none yet
+func (p *ReferralProgram) Account(userID int64) ReferralAccount {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.account(userID)
+}
+
+func (p *ReferralProgram) account(userID int64) ReferralAccount {
+	account := ReferralAccount{UserID: userID}
+	if _, err := p.store.Get(referralAccountsBucket, strconv.FormatInt(userID, 10), &account); err != nil {
+		slog.Error("Error reading referral account", "user_id", userID, "error", err)
+	}
+	return account
+}
+
+func (p *ReferralProgram) saveAccount(account ReferralAccount) error {
+	return p.store.Put(referralAccountsBucket, strconv.FormatInt(account.UserID, 10), account)
+}
+
+// Code returns the user's invite code, creating one on first use
+func (p *ReferralProgram) Code(userID int64) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	account := p.account(userID)
+	if account.Code != "" {
+		return account.Code, nil
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+		if ok, err := p.store.Get(referralCodesBucket, code, &ReferralCode{}); err != nil || ok {
+			continue
+		}
+
+		if err := p.store.Put(referralCodesBucket, code, ReferralCode{Code: code, OwnerID: userID, CreatedAt: time.Now()}); err != nil {
+			return "", err
+		}
+		account.Code = code
+		if err := p.saveAccount(account); err != nil {
+			return "", err
+		}
+		slog.Info("Created referral code", "user_id", userID)
+		return code, nil
+	}
+	return "", errors.New("no free referral code found")
+}
+
+// Attribute credits the user to the owner of the code. Users can't invite
+// themselves or each other, and only users who never paid can be invited.
+func (p *ReferralProgram) Attribute(userID int64, code string) (*Referral, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var owner ReferralCode
+	ok, err := p.store.Get(referralCodesBucket, strings.ToLower(code), &owner)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUnknownReferralCode
+	}
+	if owner.OwnerID == userID {
+		return nil, ErrSelfReferral
+	}
+
+	key := strconv.FormatInt(userID, 10)
+	if ok, err := p.store.Get(referralsBucket, key, &Referral{}); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, ErrAlreadyReferred
+	}
+	if _, paid, err := firstPayment(p.store, userID); err != nil {
+		return nil, err
+	} else if paid {
+		return nil, ErrExistingCustomer
+	}
+
+	var ownerReferral Referral
+	if ok, err := p.store.Get(referralsBucket, strconv.FormatInt(owner.OwnerID, 10), &ownerReferral); err != nil {
+		return nil, err
+	} else if ok && ownerReferral.ReferrerID == userID {
+		return nil, ErrMutualReferral
+	}
+
+	referral := &Referral{ReferrerID: owner.OwnerID, ReferredID: userID, Code: owner.Code, AttributedAt: time.Now()}
+	if err := p.store.Put(referralsBucket, key, referral); err != nil {
+		return nil, err
+	}
+	account := p.account(owner.OwnerID)
+	account.Invited++
+	if err := p.saveAccount(account); err != nil {
+		slog.Error("Error counting referral", "user_id", owner.OwnerID, "error", err)
+	}
+	return referral, nil
+}
+
+// Referrer returns the attribution of a referred user
+func (p *ReferralProgram) Referrer(userID int64) (*Referral, bool) {
+	var referral Referral
+	ok, err := p.store.Get(referralsBucket, strconv.FormatInt(userID, 10), &referral)
+	if err != nil {
+		slog.Error("Error reading referral", "user_id", userID, "error", err)
+	}
+	return &referral, ok
+}
+
+// CompletePayment uses up the user's discount and, on a referred user's first
+// payment, grants the rewards. It returns the referral if rewards were granted.
+// The payment must already be recorded with recordPaidUser.
+func (p *ReferralProgram) CompletePayment(userID int64, sessionID string) (*Referral, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if account := p.account(userID); account.DiscountPercent > 0 {
+		account.DiscountPercent = 0
+		if err := p.saveAccount(account); err != nil {
+			slog.Error("Error clearing referral discount", "user_id", userID, "error", err)
+		}
+	}
+
+	key := strconv.FormatInt(userID, 10)
+	var referral Referral
+	ok, err := p.store.Get(referralsBucket, key, &referral)
+	if err != nil || !ok || referral.RewardedAt != nil {
+		return nil, err
+	}
+	if referral.ReferrerID == userID {
+		return nil, ErrSelfReferral
+	}
+	paid, found, err := firstPayment(p.store, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !found || paid.FirstSessionID != sessionID {
+		// Only the first payment counts, the user was a customer before
+		return nil, ErrExistingCustomer
+	}
+
+	now := time.Now()
+	referral.RewardedAt = &now
+	referral.SessionID = sessionID
+	if err := p.store.Put(referralsBucket, key, referral); err != nil {
+		return nil, err
+	}
+
+	referrer := p.account(referral.ReferrerID)
+	referrer.Converted++
+	referrer.Credits += p.rewards.ReferrerCredits
+	referrer.DiscountPercent = max(referrer.DiscountPercent, p.rewards.DiscountPercent)
+	if err := p.saveAccount(referrer); err != nil {
+		return nil, err
+	}
+
+	referred := p.account(userID)
+	referred.Credits += p.rewards.ReferredCredits
+	if err := p.saveAccount(referred); err != nil {
+		return nil, err
+	}
+	return &referral, nil
+}
+
+// UseCredit takes one Q&A credit from the user, reporting false if they have none
+func (p *ReferralProgram) UseCredit(userID int64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	account := p.account(userID)
+	if account.Credits <= 0 {
+		return false
+	}
+	account.Credits--
+	if err := p.saveAccount(account); err != nil {
+		slog.Error("Error using referral credit", "user_id", userID, "error", err)
+		return false
+	}
+	return true
+}
+
+// newReferralCode returns a random invite code
+func newReferralCode() (string, error) {
+	buf := make([]byte, referralCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = referralCodeAlphabet[int(b)%len(referralCodeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// attributeReferral handles the payload of /start for invite links
+func (b *Bot) attributeReferral(chatID int64, session *UserSession, payload string) {
+	code, ok := strings.CutPrefix(payload, referralPayloadPrefix)
+	if !ok || code == "" {
+		return
+	}
+	logger := slog.With("user_id", session.UserID)
+
+	referral, err := b.referrals.Attribute(session.UserID, code)
+	switch {
+	case err == nil:
+		referralEventsTotal.WithLabelValues("attributed").Inc()
+		logger.Info("Attributed referral", "referrer_id", referral.ReferrerID)
+	case errors.Is(err, ErrSelfReferral):
+		referralEventsTotal.WithLabelValues("self_referral").Inc()
+		b.sendText(chatID, "This is your own invite link. Share it with friends instead!")
+	case errors.Is(err, ErrUnknownReferralCode):
+		referralEventsTotal.WithLabelValues("unknown_code").Inc()
+		logger.Info("Unknown referral code")
+	case errors.Is(err, ErrMutualReferral), errors.Is(err, ErrAlreadyReferred), errors.Is(err, ErrExistingCustomer):
+		referralEventsTotal.WithLabelValues("not_eligible").Inc()
+		logger.Info("Referral not credited", "reason", err)
+	default:
+		logger.Error("Error attributing referral", "error", err)
+	}
+}
+
+// rewardReferral grants the rewards of a referred user's first payment and tells both users
+func (b *Bot) rewardReferral(userID int64, sessionID string) {
+	referral, err := b.referrals.CompletePayment(userID, sessionID)
+	if errors.Is(err, ErrExistingCustomer) {
+		referralEventsTotal.WithLabelValues("not_eligible").Inc()
+		slog.Info("Referral not rewarded", "user_id", userID, "reason", err)
+		return
+	}
+	if err != nil {
+		slog.Error("Error granting referral rewards", "user_id", userID, "error", err)
+		return
+	}
+	if referral == nil {
+		return
+	}
+	referralEventsTotal.WithLabelValues("rewarded").Inc()
+	slog.Info("Granted referral rewards", "user_id", userID, "referrer_id", referral.ReferrerID, "session_id", sessionID)
+
+	rewards := b.config.Referrals
+	text := "🎉 A friend you invited has joined!"
+	if rewards.ReferrerCredits > 0 {
+		text += fmt.Sprintf("\n• %d extra answers to your questions", rewards.ReferrerCredits)
+	}
+	if rewards.DiscountPercent > 0 {
+		text += fmt.Sprintf("\n• %d%% off your next program", rewards.DiscountPercent)
+	}
+	b.sendText(referral.ReferrerID, text+"\n\nSee your rewards with /invite.")
+	if rewards.ReferredCredits > 0 {
+		b.sendText(userID, fmt.Sprintf("🎁 Thanks for joining through an invite! You get %d extra answers to your questions.", rewards.ReferredCredits))
+	}
+}
+
+// sendInvite shows the user's invite link and rewards
+func (b *Bot) sendInvite(chatID, userID int64) {
+	code, err := b.referrals.Code(userID)
+	if err != nil {
+		slog.Error("Error creating referral code", "user_id", userID, "error", err)
+		b.sendText(chatID, "Your invite link is unavailable right now. Please try again later.")
+		return
+	}
+	account := b.referrals.Account(userID)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🤝 Invite friends with your personal link:\nhttps://t.me/%s?start=%s%s\n\n", b.api.Self.UserName, referralPayloadPrefix, code)
+	rewards := b.config.Referrals
+	if rewards.ReferrerCredits > 0 || rewards.DiscountPercent > 0 {
+		sb.WriteString("When a friend buys their program, you get")
+		var parts []string
+		if rewards.ReferrerCredits > 0 {
+			parts = append(parts, fmt.Sprintf(" %d extra answers to your questions", rewards.ReferrerCredits))
+		}
+		if rewards.DiscountPercent > 0 {
+			parts = append(parts, fmt.Sprintf(" %d%% off your next program", rewards.DiscountPercent))
+		}
+		sb.WriteString(strings.Join(parts, " and") + ".\n\n")
+	}
+	fmt.Fprintf(&sb, "• Friends invited: %d\n• Friends who bought a program: %d\n• Extra answers left: %d", account.Invited, account.Converted, account.Credits)
+	if account.DiscountPercent > 0 {
+		fmt.Fprintf(&sb, "\n• Discount on your next program: %d%%", account.DiscountPercent)
+	}
+	b.sendText(chatID, sb.String())
+}
+
+// formatReferralLine describes the user's referral activity for admins
+func (b *Bot) formatReferralLine(userID int64) string {
+	account := b.referrals.Account(userID)
+	line := fmt.Sprintf("invited %d, converted %d, %d credits", account.Invited, account.Converted, account.Credits)
+	if referral, ok := b.referrals.Referrer(userID); ok {
+		line += fmt.Sprintf(", referred by %d", referral.ReferrerID)
+	}
+	return line
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// testReferralProgram returns a program on an empty store and the invite code of user 1
+func testReferralProgram(t *testing.T) (*ReferralProgram, Store, string) {
+	t.Helper()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "store.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	program := NewReferralProgram(store, ReferralRewards{ReferrerCredits: 10, ReferredCredits: 5, DiscountPercent: 20})
+	code, err := program.Code(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program, store, code
+}
+
+func TestReferralAttribution(t *testing.T) {
+	program, store, code := testReferralProgram(t)
+
+	if _, err := program.Attribute(1, code); !errors.Is(err, ErrSelfReferral) {
+		t.Errorf("own code: error %v, want %v", err, ErrSelfReferral)
+	}
+	if _, err := program.Attribute(2, "nosuchcode"); !errors.Is(err, ErrUnknownReferralCode) {
+		t.Errorf("unknown code: error %v, want %v", err, ErrUnknownReferralCode)
+	}
+
+	// A user who paid before counts as a customer, however their session looks
+	if err := recordPaidUser(store, 3, "cs_earlier"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := program.Attribute(3, code); !errors.Is(err, ErrExistingCustomer) {
+		t.Errorf("paying user: error %v, want %v", err, ErrExistingCustomer)
+	}
+
+	referral, err := program.Attribute(2, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if referral.ReferrerID != 1 || referral.ReferredID != 2 {
+		t.Errorf("referral = %+v, want user 2 invited by 1", referral)
+	}
+	if _, err := program.Attribute(2, code); !errors.Is(err, ErrAlreadyReferred) {
+		t.Errorf("second attribution: error %v, want %v", err, ErrAlreadyReferred)
+	}
+
+	friendCode, err := program.Code(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := program.Attribute(1, friendCode); !errors.Is(err, ErrMutualReferral) {
+		t.Errorf("mutual referral: error %v, want %v", err, ErrMutualReferral)
+	}
+}
+
+func TestReferralRewardOnFirstPaymentOnly(t *testing.T) {
+	program, store, code := testReferralProgram(t)
+	for _, user := range []int64{2, 3} {
+		if _, err := program.Attribute(user, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// User 2 pays for the first time
+	if err := recordPaidUser(store, 2, "cs_first"); err != nil {
+		t.Fatal(err)
+	}
+	referral, err := program.CompletePayment(2, "cs_first")
+	if err != nil || referral == nil {
+		t.Fatalf("first payment: referral %v, error %v; want rewards", referral, err)
+	}
+	if referrer := program.Account(1); referrer.Converted != 1 || referrer.Credits != 10 || referrer.DiscountPercent != 20 {
+		t.Errorf("referrer account = %+v", referrer)
+	}
+	if referred := program.Account(2); referred.Credits != 5 {
+		t.Errorf("referred account = %+v", referred)
+	}
+
+	// User 3 was attributed before their payment was recorded, e.g. by a
+	// session lost in a restart. Their later payment earns nothing.
+	if err := recordPaidUser(store, 3, "cs_earlier"); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordPaidUser(store, 3, "cs_later"); err != nil {
+		t.Fatal(err)
+	}
+	if referral, err := program.CompletePayment(3, "cs_later"); !errors.Is(err, ErrExistingCustomer) || referral != nil {
+		t.Errorf("later payment: referral %v, error %v; want %v", referral, err, ErrExistingCustomer)
+	}
+	if referrer := program.Account(1); referrer.Converted != 1 {
+		t.Errorf("referrer rewarded for an existing customer: %+v", referrer)
+	}
+}
@@ -0,0 +1,139 @@
+// retry.go
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// RetryPolicy configures retries of transient errors
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, doubled for every next one
+	BaseDelay time.Duration
+	// MaxDelay caps the delay; a longer Retry-After gives up instead of waiting
+	MaxDelay time.Duration
+}
+
+// defaultRetryPolicy is used unless overridden by LLM_RETRY_* variables
+var defaultRetryPolicy = RetryPolicy{MaxRetries: 2, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}
+
+// Backoff returns the delay before the given retry (starting at 0) with jitter
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	delay := p.BaseDelay << retry
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	// Equal jitter: half fixed, half random, so clients don't retry in lockstep
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half)
+}
+
+// isTransientError checks if an error is worth retrying
+func isTransientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return isTransientStatus(apiErr.HTTPStatusCode)
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return isTransientStatus(reqErr.HTTPStatusCode)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isTransientStatus checks if an HTTP status means the request may succeed later
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// retryAfterKey is the context key for the Retry-After value of a response
+type retryAfterKey struct{}
+
+// retryAfter holds the Retry-After value of the last response of a request
+type retryAfter struct {
+	mutex sync.Mutex
+	delay time.Duration
+}
+
+func (r *retryAfter) set(delay time.Duration) {
+	r.mutex.Lock()
+	r.delay = delay
+	r.mutex.Unlock()
+}
+
+func (r *retryAfter) get() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.delay
+}
+
+// withRetryAfter returns a context that captures the Retry-After header of responses
+func withRetryAfter(ctx context.Context) (context.Context, *retryAfter) {
+	holder := &retryAfter{}
+	return context.WithValue(ctx, retryAfterKey{}, holder), holder
+}
+
+// retryAfterTransport stores the Retry-After header in the request context,
+// since the OpenAI client does not expose response headers on errors
+type retryAfterTransport struct {
+	next http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if holder, ok := req.Context().Value(retryAfterKey{}).(*retryAfter); ok {
+		holder.set(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// sleepContext waits for the delay unless the context is cancelled first
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
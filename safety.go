@@ -0,0 +1,329 @@
+// safety.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Safety rule scopes
+const (
+	ScopeInput  = "input"  // Messages from users
+	ScopeOutput = "output" // Answers of the language model
+)
+
+// Safety categories with their own urgent-care message
+const (
+	SafetyCardiac       = "cardiac"
+	SafetyNeurological  = "neurological"
+	SafetyBreathing     = "breathing"
+	SafetyHypoglycemia  = "hypoglycemia"
+	SafetyHyperglycemia = "hyperglycemia"
+	SafetyInjury        = "injury"
+	SafetyMentalHealth  = "mental_health"
+	SafetyDangerousTip  = "dangerous_advice"
+)
+
+// safetyMessages are sent instead of training advice
+var safetyMessages = map[string]string{
+	SafetyCardiac: "⚠️ Chest pain, pressure or an irregular heartbeat during or after exercise can be a sign of a heart problem.\n\n" +
+		"Stop exercising now. If the pain is severe, spreads to your arm, jaw or back, or comes with shortness of breath, " +
+		"sweating or nausea, call emergency services (112 / 911) immediately. Otherwise please see a doctor before your next workout.",
+	SafetyNeurological: "⚠️ Fainting, sudden confusion, numbness, slurred speech or a sudden severe headache need urgent medical attention.\n\n" +
+		"Please call emergency services (112 / 911) now. Don't exercise until a doctor has checked you.",
+	SafetyBreathing: "⚠️ Severe shortness of breath, wheezing that doesn't settle with rest or blue lips need urgent medical attention.\n\n" +
+		"Stop exercising and call emergency services (112 / 911) if it doesn't improve within a few minutes of rest.",
+	SafetyHypoglycemia: "⚠️ This blood sugar level is dangerously low.\n\n" +
+		"Stop exercising and take 15-20 g of fast carbohydrates now (juice, glucose tablets, regular soda). Re-check in 15 minutes. " +
+		"If you feel confused or drowsy or the level doesn't rise, call emergency services (112 / 911). Don't train again today without talking to your doctor.",
+	SafetyHyperglycemia: "⚠️ This blood sugar level is dangerously high.\n\n" +
+		"Don't exercise now. Check for ketones if you can, drink water and follow your diabetes plan. If you feel sick, vomit, " +
+		"breathe fast or feel very drowsy, call emergency services (112 / 911). Please contact your doctor today.",
+	SafetyInjury: "⚠️ What you describe may be a serious injury.\n\n" +
+		"Stop training the affected area and have it checked by a doctor. If there is a visible deformity, severe swelling or you can't put weight on it, go to an emergency department.",
+	SafetyMentalHealth: "💙 I'm really sorry you're feeling this way. You don't have to go through it alone.\n\n" +
+		"If you might act on these thoughts, please call emergency services (112 / 911) now or reach out to a local crisis line. " +
+		"Talking to someone you trust or a mental health professional can help.",
+	SafetyDangerousTip: "⚠️ I can't give advice on this. Please discuss it with your doctor before making any changes to your training, diet or medication.",
+}
+
+// SafetyRule flags text matching any of its patterns
+type SafetyRule struct {
+	ID       string   `json:"id"`
+	Category string   `json:"category"`
+	Scope    string   `json:"scope"`
+	Patterns []string `json:"patterns"`
+
+	compiled []*regexp.Regexp
+}
+
+// GlucoseThresholds are the blood sugar limits in mmol/L
+type GlucoseThresholds struct {
+	LowMmol  float64 `json:"low_mmol"`
+	HighMmol float64 `json:"high_mmol"`
+}
+
+// SafetyConfig is the format of the SAFETY_RULES file
+type SafetyConfig struct {
+	Rules   []SafetyRule      `json:"rules"`
+	Glucose GlucoseThresholds `json:"glucose"`
+}
+
+// defaultSafetyConfig is used unless SAFETY_RULES points to a file
+var defaultSafetyConfig = SafetyConfig{
+	Glucose: GlucoseThresholds{LowMmol: 3.9, HighMmol: 16.7},
+	Rules: []SafetyRule{
+		{ID: "chest_pain", Category: SafetyCardiac, Scope: ScopeInput, Patterns: []string{
+			`chest\s+(pain|pressure|tightness|hurts?)`,
+			`pain\s+in\s+(my\s+)?chest`,
+			`heart\s+(is\s+)?(racing|pounding|skipping|fluttering)`,
+			`(irregular|abnormal)\s+heart\s*beat`,
+			`palpitations?`,
+			`pain\s+(spreading|radiating)\s+(to|into|down)\s+(my\s+)?(left\s+)?(arm|jaw|neck|back)`,
+		}},
+		{ID: "fainting", Category: SafetyNeurological, Scope: ScopeInput, Patterns: []string{
+			`faint(ed|ing)?\b`,
+			`passed\s+out`,
+			`blacked\s+out`,
+			`lost\s+consciousness`,
+			`slurred\s+speech`,
+			`(face|arm|leg)\s+(is\s+)?(numb|drooping)`,
+			`(worst|sudden|severe)\s+headache`,
+			`seizure`,
+		}},
+		{ID: "breathing", Category: SafetyBreathing, Scope: ScopeInput, Patterns: []string{
+			`can'?t\s+(catch\s+my\s+)?breath`,
+			`can(not|'t)\s+breathe`,
+			`(struggling|hard|difficult)\s+to\s+breathe`,
+			`blue\s+lips`,
+		}},
+		{ID: "hypoglycemia_symptoms", Category: SafetyHypoglycemia, Scope: ScopeInput, Patterns: []string{
+			`hypo(glycemi[ac])?\b.*(now|right now|after|during)`,
+			`(shaking|shaky|sweating|confused|dizzy).*(sugar|glucose)\s+(is\s+)?(low|dropping|crashing)`,
+		}},
+		{ID: "injury", Category: SafetyInjury, Scope: ScopeInput, Patterns: []string{
+			`heard\s+a\s+(pop|snap)`,
+			`(bone|joint)\s+(is\s+)?(sticking\s+out|deformed)`,
+			`can'?t\s+(put\s+weight|walk|move\s+my)`,
+			`(dark|brown|cola)[\s-]colou?red\s+urine`,
+		}},
+		{ID: "self_harm", Category: SafetyMentalHealth, Scope: ScopeInput, Patterns: []string{
+			`(kill|hurt|harm)\s+myself`,
+			`suicid`,
+			`(want|wish)\s+to\s+die`,
+			`end\s+my\s+life`,
+			`starv(e|ing)\s+myself`,
+		}},
+		{ID: "dangerous_advice", Category: SafetyDangerousTip, Scope: ScopeOutput, Patterns: []string{
+			`(train|push|work)\s+through\s+(the\s+)?(chest\s+)?pain`,
+			`ignore\s+(the\s+)?(chest\s+pain|dizziness|symptoms)`,
+			`(skip|stop|reduce)\s+(taking\s+)?(your\s+)?(insulin|medication|medicine)`,
+			`(eat|consume)\s+(less\s+than|under|below)\s+(500|600|700|800)\s*(kcal|calories)`,
+		}},
+	},
+}
+
+// SafetyFinding describes why a text was flagged
+type SafetyFinding struct {
+	RuleID   string
+	Category string
+	Match    string
+}
+
+// Message returns the urgent-care message for the finding
+func (f *SafetyFinding) Message() string {
+	if message, ok := safetyMessages[f.Category]; ok {
+		return message
+	}
+	return safetyMessages[SafetyDangerousTip]
+}
+
+// Blood sugar readings need glucose context, so "25 g of sugar" or "sugar in
+// 2 bananas" aren't mistaken for readings. The number may not be separated from
+// the context by punctuation, and the word after it is checked by screenGlucose.
+var (
+	// glucoseReadingPattern finds readings like "blood sugar is 2.8", "my sugar was 20",
+	// "glucose level 250" or "a reading of 3.1"
+	glucoseReadingPattern = regexp.MustCompile(`(?i)(blood\s+(?:sugar|glucose)|(?:sugar|glucose)\s+(?:is|was|levels?|readings?|at)\b|my\s+(?:sugar|glucose|bg)\b|\bbg\b|reading\s+of)` +
+		`[^0-9\n.,;!?]{0,25}(\d{1,3}(?:[.,]\d)?)\s*(mmol(?:/l)?|mg/?dl|[a-z%]+)?`)
+	// glucoseUnitPattern finds any sugar or glucose value given in glucose units,
+	// like "glucose 250 mg/dl"
+	glucoseUnitPattern = regexp.MustCompile(`(?i)(sugar|glucose)[^0-9\n.,;!?]{0,25}(\d{1,3}(?:[.,]\d)?)\s*(mmol(?:/l)?|mg/?dl)\b`)
+)
+
+// foodUnits after a number mean an amount of food, not a reading
+var foodUnits = map[string]bool{
+	"g": true, "gr": true, "gram": true, "grams": true, "kg": true, "oz": true, "lb": true, "lbs": true,
+	"kcal": true, "cal": true, "calorie": true, "calories": true, "%": true, "percent": true,
+	"tsp": true, "tbsp": true, "teaspoon": true, "teaspoons": true, "tablespoon": true, "tablespoons": true,
+	"ml": true, "l": true, "cup": true, "cups": true, "cube": true, "cubes": true,
+}
+
+// SafetyScreener checks texts against red-flag rules
+type SafetyScreener struct {
+	rules   []SafetyRule
+	glucose GlucoseThresholds
+}
+
+// NewSafetyScreener compiles the rules of the config
+func NewSafetyScreener(config SafetyConfig) (*SafetyScreener, error) {
+	s := &SafetyScreener{glucose: config.Glucose}
+	for _, rule := range config.Rules {
+		if rule.Scope != ScopeInput && rule.Scope != ScopeOutput {
+			return nil, fmt.Errorf("safety rule %s: unknown scope %q", rule.ID, rule.Scope)
+		}
+		rule.compiled = make([]*regexp.Regexp, 0, len(rule.Patterns))
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(`(?i)` + pattern)
+			if err != nil {
+				return nil, fmt.Errorf("safety rule %s: %w", rule.ID, err)
+			}
+			rule.compiled = append(rule.compiled, re)
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// LoadSafetyScreener reads rules from a JSON file, or uses the defaults if path is empty
+func LoadSafetyScreener(path string) (*SafetyScreener, error) {
+	config := defaultSafetyConfig
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading safety rules %s: %w", path, err)
+		}
+		config = SafetyConfig{Glucose: defaultSafetyConfig.Glucose}
+		if err := json.Unmarshal(content, &config); err != nil {
+			return nil, fmt.Errorf("parsing safety rules %s: %w", path, err)
+		}
+	}
+	return NewSafetyScreener(config)
+}
+
+// Screen returns the first red flag found in the text, or nil
+func (s *SafetyScreener) Screen(text, scope string) *SafetyFinding {
+	if s == nil {
+		return nil
+	}
+
+	for _, rule := range s.rules {
+		if rule.Scope != scope {
+			continue
+		}
+		for _, re := range rule.compiled {
+			if match := re.FindString(text); match != "" {
+				return &SafetyFinding{RuleID: rule.ID, Category: rule.Category, Match: match}
+			}
+		}
+	}
+
+	if scope == ScopeInput {
+		return s.screenGlucose(text)
+	}
+	return nil
+}
+
+// screenGlucose flags blood sugar readings outside the thresholds
+func (s *SafetyScreener) screenGlucose(text string) *SafetyFinding {
+	matches := glucoseReadingPattern.FindAllStringSubmatch(text, -1)
+	matches = append(matches, glucoseUnitPattern.FindAllStringSubmatch(text, -1)...)
+	for _, m := range matches {
+		value, err := strconv.ParseFloat(strings.Replace(m[2], ",", ".", 1), 64)
+		if err != nil || value <= 0 {
+			continue
+		}
+
+		unit := strings.ToLower(m[3])
+		if foodUnits[unit] {
+			continue
+		}
+
+		// Without a unit, values above 35 can only be mg/dL
+		mmol := value
+		if strings.HasPrefix(unit, "mg") || (!strings.HasPrefix(unit, "mmol") && value > 35) {
+			mmol = value / 18
+		}
+
+		switch {
+		case s.glucose.LowMmol > 0 && mmol < s.glucose.LowMmol:
+			return &SafetyFinding{RuleID: "glucose_low", Category: SafetyHypoglycemia, Match: m[0]}
+		case s.glucose.HighMmol > 0 && mmol > s.glucose.HighMmol:
+			return &SafetyFinding{RuleID: "glucose_high", Category: SafetyHyperglycemia, Match: m[0]}
+		}
+	}
+	return nil
+}
+
+// SafetyIncident is a record in the safety incident log
+type SafetyIncident struct {
+	Time     time.Time `json:"time"`
+	UserID   int64     `json:"user_id"`
+	Scope    string    `json:"scope"`
+	RuleID   string    `json:"rule_id"`
+	Category string    `json:"category"`
+	Match    string    `json:"match"`
+}
+
+// IncidentLogger writes safety incidents to an append-only JSON lines file for review
+type IncidentLogger struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewIncidentLogger creates an incident logger writing to the given file
+func NewIncidentLogger(path string) *IncidentLogger {
+	return &IncidentLogger{path: path}
+}
+
+// Record appends an incident to the log
+func (l *IncidentLogger) Record(incident SafetyIncident) {
+	if incident.Time.IsZero() {
+		incident.Time = time.Now()
+	}
+
+	// The matched text is health data, so it only goes to the incident file
+	slog.Warn("Safety incident",
+		"user_id", incident.UserID,
+		"scope", incident.Scope,
+		"rule_id", incident.RuleID,
+		"category", incident.Category)
+	safetyIncidentsTotal.WithLabelValues(incident.Scope, incident.Category).Inc()
+
+	if l == nil || l.path == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := appendJSONLine(l.path, incident); err != nil {
+		slog.Error("Error writing safety incident log", "path", l.path, "error", err)
+	}
+}
+
+// screenInput checks a user's message and answers with an urgent-care
+// message if it contains a red flag. It reports whether the message was handled.
+func (b *Bot) screenInput(chatID, userID int64, text string) bool {
+	finding := b.safety.Screen(text, ScopeInput)
+	if finding == nil {
+		return false
+	}
+
+	b.incidents.Record(SafetyIncident{
+		UserID:   userID,
+		Scope:    ScopeInput,
+		RuleID:   finding.RuleID,
+		Category: finding.Category,
+		Match:    finding.Match,
+	})
+	b.sendText(chatID, finding.Message())
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestSafetyScreenerGlucose(t *testing.T) {
+	screener, err := LoadSafetyScreener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		rule string // Empty if the text must not be flagged
+	}{
+		// Readings outside the thresholds
+		{"My blood sugar is 2.8 and I feel shaky", "glucose_low"},
+		{"my sugar is 3,1 after the run", "glucose_low"},
+		{"Glucose was 55 this morning", "glucose_low"},
+		{"glucose level after lunch 20 mmol/l", "glucose_high"},
+		{"blood glucose 320 mg/dl, can I train?", "glucose_high"},
+		{"The meter gave a reading of 2.5", "glucose_low"},
+		{"BG 18.5 before the workout", "glucose_high"},
+		{"sugar 45 mg/dl", "glucose_low"},
+
+		// Readings within the thresholds
+		{"My blood sugar is 5.6", ""},
+		{"glucose was 110 mg/dl", ""},
+
+		// Food and other numbers are not readings
+		{"How much sugar can I eat per day, 25 g?", ""},
+		{"Is sugar in 2 bananas too much?", ""},
+		{"I was reading 3 articles about protein", ""},
+		{"Is 30 grams of sugar OK after 2 workouts?", ""},
+		{"My sugar intake is 40 g per day", ""},
+		{"My blood sugar is fine, I ate 2 apples", ""},
+		{"glucose is 4% of this drink", ""},
+		{"Does glucose in 1 banana spike insulin?", ""},
+	}
+	for _, tt := range tests {
+		finding := screener.Screen(tt.text, ScopeInput)
+		switch {
+		case tt.rule == "" && finding != nil:
+			t.Errorf("Screen(%q) flagged %s on %q, want no finding", tt.text, finding.RuleID, finding.Match)
+		case tt.rule != "" && finding == nil:
+			t.Errorf("Screen(%q) found nothing, want %s", tt.text, tt.rule)
+		case tt.rule != "" && finding.RuleID != tt.rule:
+			t.Errorf("Screen(%q) = %s, want %s", tt.text, finding.RuleID, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// shutdown.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ErrShuttingDown is returned for work arriving after shutdown started
+var ErrShuttingDown = errors.New("bot is shutting down")
+
+// lifecycle tracks the bot's in-flight work so shutdown can wait for it
+type lifecycle struct {
+	mutex    sync.Mutex
+	stopping bool
+	inflight sync.WaitGroup
+	// Context of all handlers, cancelled when draining runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Cancelled when shutdown starts
+	shutdown      context.Context
+	startShutdown context.CancelFunc
+	// Highest update ID handed to a handler, confirmed to Telegram on shutdown
+	lastUpdateID atomic.Int64
+	polling      atomic.Bool
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown, startShutdown := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel, shutdown: shutdown, startShutdown: startShutdown}
+}
+
+// begin registers work that shutdown waits for until end is called.
+// It reports false once shutdown has started.
+func (l *lifecycle) begin() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.inflight.Add(1)
+	return true
+}
+
+// end marks work registered with begin as finished
+func (l *lifecycle) end() {
+	l.inflight.Done()
+}
+
+// spawn runs f in a goroutine that shutdown waits for. It reports false
+// without running f once shutdown has started.
+func (b *Bot) spawn(name string, f func(ctx context.Context)) bool {
+	if !b.life.begin() {
+		return false
+	}
+
+	go func() {
+		defer b.life.end()
+		runRecovered(name, func() { f(b.life.ctx) })
+	}()
+	return true
+}
+
+// untilShutdown returns a context that is also cancelled when shutdown starts,
+// for long work that stops early instead of holding up draining
+func (b *Bot) untilShutdown(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(b.life.shutdown, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// StopIntake stops receiving updates. Updates arriving afterwards are refused.
+func (b *Bot) StopIntake() {
+	b.life.mutex.Lock()
+	if b.life.stopping {
+		b.life.mutex.Unlock()
+		return
+	}
+	b.life.stopping = true
+	b.life.mutex.Unlock()
+	b.life.startShutdown()
+
+	if !b.life.polling.Load() {
+		return
+	}
+	b.api.StopReceivingUpdates()
+
+	// Telegram marks updates as delivered on the next getUpdates call, so
+	// confirm the handled ones. Anything newer stays queued for the next start.
+	if last := b.life.lastUpdateID.Load(); last > 0 {
+		confirm := tgbotapi.UpdateConfig{Offset: int(last) + 1, Limit: 1}
+		if _, err := b.api.GetUpdates(confirm); err != nil {
+			slog.Error("Error confirming handled updates", "last_update_id", last, "error", err)
+		}
+	}
+}
+
+// Drain waits for in-flight handlers until ctx is done, then cancels the ones left
+func (b *Bot) Drain(ctx context.Context) error {
+	b.StopIntake()
+
+	done := make(chan struct{})
+	go func() {
+		b.life.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("All in-flight work finished")
+		return nil
+	case <-ctx.Done():
+		b.life.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,197 @@
+// speech.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Transcriber turns voice messages into text
+type Transcriber interface {
+	// Transcribe returns the text spoken in the audio
+	Transcribe(ctx context.Context, audio Audio) (string, error)
+}
+
+// Audio is a recording to transcribe
+type Audio struct {
+	Data     []byte
+	FileName string // With an extension telling the format, e.g. voice.ogg
+}
+
+// Supported speech-to-text providers
+const (
+	STTOpenAI     = "openai"     // Whisper API or any OpenAI-compatible transcription server
+	STTWhisperCpp = "whispercpp" // whisper.cpp server, started with --convert for OGG input
+	STTScripted   = "scripted"   // returns the audio bytes as the transcript, for tests
+	STTNone       = "none"       // voice messages are declined
+)
+
+// sttTimeout limits a single transcription request
+const sttTimeout = 60 * time.Second
+
+// STTConfig selects the speech-to-text provider
+type STTConfig struct {
+	Provider string
+	Model    string
+	BaseURL  string
+	APIKey   string
+	Language string // ISO-639-1 hint, detected if empty
+}
+
+// loadSTTConfig reads the STT_* settings. Without STT_PROVIDER, the Whisper
+// API is used if OPENAI_TOKEN is set and voice messages are declined otherwise.
+func loadSTTConfig(src *configSource) (STTConfig, error) {
+	cfg := STTConfig{
+		Provider: strings.ToLower(src.str("STT_PROVIDER")),
+		Model:    src.str("STT_MODEL"),
+		BaseURL:  strings.TrimSuffix(src.str("STT_BASE_URL"), "/"),
+		APIKey:   src.str("STT_API_KEY"),
+		Language: src.str("STT_LANGUAGE"),
+	}
+	if cfg.APIKey == "" {
+		cfg.APIKey = src.str("OPENAI_TOKEN")
+	}
+	if cfg.Provider == "" {
+		cfg.Provider = STTNone
+		if cfg.APIKey != "" {
+			cfg.Provider = STTOpenAI
+		}
+	}
+
+	switch cfg.Provider {
+	case STTOpenAI:
+		if cfg.APIKey == "" && cfg.BaseURL == "" {
+			return cfg, fmt.Errorf("STT_API_KEY or OPENAI_TOKEN required for STT_PROVIDER=%s", STTOpenAI)
+		}
+		if cfg.Model == "" {
+			cfg.Model = openai.Whisper1
+		}
+	case STTWhisperCpp:
+		if cfg.BaseURL == "" {
+			return cfg, fmt.Errorf("STT_BASE_URL required for STT_PROVIDER=%s", STTWhisperCpp)
+		}
+	case STTScripted, STTNone:
+	default:
+		return cfg, fmt.Errorf("unknown STT_PROVIDER %q", cfg.Provider)
+	}
+	return cfg, nil
+}
+
+// NewTranscriber creates the provider described by the config, nil if voice messages are disabled
+func NewTranscriber(cfg STTConfig) Transcriber {
+	switch cfg.Provider {
+	case STTOpenAI:
+		config := openai.DefaultConfig(cfg.APIKey)
+		if cfg.BaseURL != "" {
+			config.BaseURL = cfg.BaseURL
+		}
+		return &WhisperTranscriber{client: openai.NewClientWithConfig(config), model: cfg.Model, language: cfg.Language}
+	case STTWhisperCpp:
+		return &WhisperCppTranscriber{url: cfg.BaseURL + "/inference", language: cfg.Language, client: &http.Client{}}
+	case STTScripted:
+		return ScriptedTranscriber{}
+	default:
+		return nil
+	}
+}
+
+// WhisperTranscriber transcribes with the OpenAI audio API
+type WhisperTranscriber struct {
+	client   *openai.Client
+	model    string
+	language string
+}
+
+func (t *WhisperTranscriber) Transcribe(ctx context.Context, audio Audio) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sttTimeout)
+	defer cancel()
+
+	resp, err := t.client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    t.model,
+		FilePath: audio.FileName,
+		Reader:   bytes.NewReader(audio.Data),
+		Language: t.language,
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// WhisperCppTranscriber transcribes with the /inference endpoint of a whisper.cpp server
+type WhisperCppTranscriber struct {
+	url      string
+	language string
+	client   *http.Client
+}
+
+func (t *WhisperCppTranscriber) Transcribe(ctx context.Context, audio Audio) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sttTimeout)
+	defer cancel()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", audio.FileName)
+	if err != nil {
+		return "", err
+	}
+	part.Write(audio.Data)
+	form.WriteField("response_format", "json")
+	if t.language != "" {
+		form.WriteField("language", t.language)
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("whisper.cpp server returned %s: %s", resp.Status, bytes.TrimSpace(content))
+	}
+
+	var result struct {
+		Text  string `json:"text"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(content, &result); err != nil {
+		return "", fmt.Errorf("parsing whisper.cpp response: %w", err)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("whisper.cpp: %s", result.Error)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// ScriptedTranscriber returns the audio content as the transcript, so tests
+// send the words they want recognized instead of a recording
+type ScriptedTranscriber struct{}
+
+func (ScriptedTranscriber) Transcribe(ctx context.Context, audio Audio) (string, error) {
+	loggerFrom(ctx).Debug("Scripted transcription", "audio_bytes", len(audio.Data))
+	return strings.TrimSpace(string(audio.Data)), nil
+}
@@ -0,0 +1,210 @@
+// store.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store keeps JSON-encoded values grouped into buckets
+type Store interface {
+	// Get decodes the value stored under key into v and reports whether it exists
+	Get(bucket, key string, v any) (bool, error)
+	// Put stores v under key
+	Put(bucket, key string, v any) error
+	// Delete removes the value stored under key
+	Delete(bucket, key string) error
+	// Keys returns all keys of a bucket
+	Keys(bucket string) ([]string, error)
+	// Ping checks that the store is usable
+	Ping() error
+	// Flush writes pending changes to durable storage
+	Flush() error
+	// Close flushes and releases the store
+	Close() error
+}
+
+// FileStore is a Store kept in memory and periodically written to a JSON file
+type FileStore struct {
+	path    string
+	mutex   sync.RWMutex
+	data    map[string]map[string]json.RawMessage
+	dirty   bool
+	writing sync.Mutex // serializes file writes
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// NewFileStore loads the store from path and starts flushing it every interval
+func NewFileStore(path string, interval time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		data: make(map[string]map[string]json.RawMessage),
+		stop: make(chan struct{}),
+	}
+
+	content, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		slog.Info("Store file not found, starting empty", "path", path)
+	case err != nil:
+		return nil, fmt.Errorf("reading store %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(content, &s.data); err != nil {
+			return nil, fmt.Errorf("parsing store %s: %w", path, err)
+		}
+		slog.Info("Store loaded", "path", path, "buckets", len(s.data))
+	}
+
+	if interval > 0 {
+		s.stopped.Add(1)
+		go s.flushLoop(interval)
+	}
+
+	return s, nil
+}
+
+// flushLoop periodically writes changes to disk
+func (s *FileStore) flushLoop(interval time.Duration) {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				slog.Error("Error flushing store", "path", s.path, "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *FileStore) Get(bucket, key string, v any) (bool, error) {
+	s.mutex.RLock()
+	raw, ok := s.data[bucket][key]
+	s.mutex.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, fmt.Errorf("decoding %s/%s: %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+func (s *FileStore) Put(bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s/%s: %w", bucket, key, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data[bucket] == nil {
+		s.data[bucket] = make(map[string]json.RawMessage)
+	}
+	s.data[bucket][key] = raw
+	s.dirty = true
+	return nil
+}
+
+func (s *FileStore) Delete(bucket, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.data[bucket][key]; ok {
+		delete(s.data[bucket], key)
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *FileStore) Keys(bucket string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]string, 0, len(s.data[bucket]))
+	for key := range s.data[bucket] {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Ping checks that the store directory is writable
+func (s *FileStore) Ping() error {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".store-ping-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// Flush atomically writes the store to disk if it has changed
+func (s *FileStore) Flush() error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	content, err := json.Marshal(s.data)
+	s.dirty = false
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial store
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		s.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		s.markDirty()
+		return err
+	}
+	return nil
+}
+
+// markDirty schedules another flush after a failed write
+func (s *FileStore) markDirty() {
+	s.mutex.Lock()
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+// Close stops the flush loop and writes remaining changes
+func (s *FileStore) Close() error {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.stopped.Wait()
+	return s.Flush()
+}
@@ -0,0 +1,54 @@
+// telegram_file.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramFileEndpoint returns the download URL format of the Bot API at
+// apiEndpoint, e.g. https://api.telegram.org/file/bot%s/%s
+func telegramFileEndpoint(apiEndpoint string) string {
+	return strings.Replace(apiEndpoint, "/bot%s/", "/file/bot%s/", 1)
+}
+
+// downloadFile fetches a file the user sent, refusing files over limit bytes.
+// It returns the content and the file's path on the Telegram server.
+func (b *Bot) downloadFile(ctx context.Context, fileID string, limit int) ([]byte, string, error) {
+	file, err := b.api.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, "", err
+	}
+	if file.FileSize > limit {
+		return nil, file.FilePath, fmt.Errorf("file %s has %d bytes, more than %d", file.FilePath, file.FileSize, limit)
+	}
+	link := fmt.Sprintf(telegramFileEndpoint(b.config.TelegramAPIEndpoint), b.api.Token, file.FilePath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, file.FilePath, err
+	}
+	resp, err := b.telegram.Do(req)
+	if err != nil {
+		// The error contains the URL and with it the bot token
+		return nil, file.FilePath, fmt.Errorf("downloading %s failed", file.FilePath)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, file.FilePath, fmt.Errorf("downloading %s: %s", file.FilePath, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, file.FilePath, fmt.Errorf("reading %s: %v", file.FilePath, err)
+	}
+	if len(data) > limit {
+		return nil, file.FilePath, fmt.Errorf("file %s exceeds %d bytes", file.FilePath, limit)
+	}
+	return data, file.FilePath, nil
+}
@@ -0,0 +1,119 @@
+// telegram_webhook.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Ways of receiving Telegram updates
+const (
+	UpdateModePolling = "polling"
+	UpdateModeWebhook = "webhook"
+)
+
+// telegramSecretHeader carries the secret token Telegram sends with every webhook request
+const telegramSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// dispatchWait is how long a webhook request waits for room in a full dispatcher
+const dispatchWait = 5 * time.Second
+
+// telegramSecretPattern lists the characters Telegram allows in a secret token
+var telegramSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// telegramWebhookPath returns the path updates are posted to. It is derived
+// from the bot token, so it can't be guessed but stays the same across restarts.
+func telegramWebhookPath(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "/webhook/telegram/" + hex.EncodeToString(sum[:12])
+}
+
+// SetWebhook asks Telegram to post updates to the webhook path under baseURL
+func (b *Bot) SetWebhook(baseURL, secret string) error {
+	// WebhookConfig has no secret token field, so the request is built by hand
+	params := tgbotapi.Params{
+		"url":             strings.TrimSuffix(baseURL, "/") + telegramWebhookPath(b.api.Token),
+		"secret_token":    secret,
+		"allowed_updates": `["message","callback_query"]`,
+	}
+	resp, err := b.api.MakeRequest("setWebhook", params)
+	if err != nil {
+		return fmt.Errorf("setting Telegram webhook: %w", err)
+	}
+	if !resp.Ok {
+		return fmt.Errorf("setting Telegram webhook: %s", resp.Description)
+	}
+	slog.Info("Bot started listening for messages", "mode", UpdateModeWebhook, "base_url", baseURL)
+	return nil
+}
+
+// TelegramWebhookHandler receives updates posted by Telegram
+type TelegramWebhookHandler struct {
+	bot    *Bot
+	secret string
+}
+
+// NewTelegramWebhookHandler creates a handler accepting requests with the given secret token
+func NewTelegramWebhookHandler(bot *Bot, secret string) *TelegramWebhookHandler {
+	return &TelegramWebhookHandler{bot: bot, secret: secret}
+}
+
+func (h *TelegramWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	defer func() {
+		webhookEventsTotal.WithLabelValues("telegram_update", webhookOutcome(recorder.status)).Inc()
+		webhookDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.Header.Get(telegramSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.secret)) != 1 {
+		slog.Warn("Rejected Telegram webhook request with invalid secret token", "remote_addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const MaxBodyBytes = int64(1 << 20)
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	if err != nil {
+		slog.Error("Error reading Telegram update", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var update tgbotapi.Update
+	if err := json.Unmarshal(payload, &update); err != nil {
+		slog.Error("Error parsing Telegram update", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Telegram waits for the response, so updates are handled asynchronously.
+	// When the queue is full or the bot is shutting down it retries later.
+	ctx, cancel := context.WithTimeout(r.Context(), dispatchWait)
+	defer cancel()
+	if err := h.bot.dispatchUpdate(ctx, update); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
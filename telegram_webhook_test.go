@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestTelegramWebhookHandler(t *testing.T) {
+	h := NewHarness(t)
+
+	tests := []struct {
+		name   string
+		method string
+		secret string
+		body   string
+		status int
+	}{
+		{"valid secret", http.MethodPost, harnessTelegramSecret, "help", http.StatusOK},
+		{"missing secret", http.MethodPost, "", "help", http.StatusUnauthorized},
+		{"wrong secret", http.MethodPost, "tg-other-secret", "help", http.StatusUnauthorized},
+		{"not a POST", http.MethodGet, harnessTelegramSecret, "", http.StatusMethodNotAllowed},
+		{"malformed JSON", http.MethodPost, harnessTelegramSecret, `{"update_id": 1, "message": `, http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := int64(300 + i)
+			body := tt.body
+			if body == "help" {
+				body = recordedUpdate(t, user, "/help")
+			}
+
+			recorder := httptest.NewRecorder()
+			h.telegramWebhook.ServeHTTP(recorder, webhookRequest(tt.method, tt.secret, body))
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+
+			// Only an accepted update reaches the bot
+			if tt.status == http.StatusOK {
+				if _, err := h.Expect(user, "Use /start to begin", e2eWait); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			for _, message := range h.Telegram.Sent() {
+				if message.ChatID == user {
+					t.Fatalf("rejected update was handled, the bot sent %q", message.Text)
+				}
+			}
+		})
+	}
+}
+
+func TestTelegramWebhookHandlerFullQueue(t *testing.T) {
+	h := NewHarness(t)
+
+	// A single slot taken by a job that doesn't finish until the test ends
+	h.Bot.dispatcher = NewDispatcher(1, 1)
+	release := make(chan struct{})
+	defer close(release)
+	if err := h.Bot.dispatcher.Submit(context.Background(), 1, func() { <-release }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Telegram retries the update later, so the handler gives up instead of waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request := webhookRequest(http.MethodPost, harnessTelegramSecret, recordedUpdate(t, 310, "/help")).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+	h.telegramWebhook.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// recordedUpdate returns the JSON Telegram posts for a text message from the user
+func recordedUpdate(t *testing.T, userID int64, text string) string {
+	t.Helper()
+	payload, err := json.Marshal(tgbotapi.Update{
+		UpdateID: int(harnessUpdateID.Add(1)),
+		Message:  textMessage(userID, text),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+// webhookRequest builds a request to the Telegram webhook path
+func webhookRequest(method, secret, body string) *http.Request {
+	request := httptest.NewRequest(method, telegramWebhookPath("e2e-token"), strings.NewReader(body))
+	if secret != "" {
+		request.Header.Set(telegramSecretHeader, secret)
+	}
+	return request
+}
@@ -0,0 +1,259 @@
+// units.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Unit systems supported for height and weight
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+)
+
+// Conversion factors between imperial and metric units
+const (
+	cmPerInch   = 2.54
+	inchPerFoot = 12
+	kgPerPound  = 0.45359237
+	mlPerFlOz   = 29.5735
+)
+
+// Plausible ranges of an adult's height and weight
+const (
+	minHeightCm = 100
+	maxHeightCm = 250
+	minWeightKg = 25
+	maxWeightKg = 350
+)
+
+// ErrImplausibleValue is returned for a height or weight outside the plausible range
+var ErrImplausibleValue = errors.New("value outside the plausible range")
+
+// Regular expressions for imperial height input: 5'10", 5 ft 10 in, 5 10, 70 in
+var (
+	feetInchesPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:'|’|ft|feet|foot)?\s*(?:(\d+(?:\.\d+)?)\s*(?:"|”|''|in|inch|inches)?)?$`)
+	inchesPattern     = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:"|”|in|inch|inches)$`)
+	numberPattern     = regexp.MustCompile(`^(\d+(?:[.,]\d+)?)\s*([a-z]*)$`)
+)
+
+// unitsKeyboard returns a keyboard for choosing the unit system
+func unitsKeyboard() *tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Metric (cm, kg)", CallbackUnits+UnitsMetric),
+			tgbotapi.NewInlineKeyboardButtonData("Imperial (ft/in, lb)", CallbackUnits+UnitsImperial),
+		),
+	)
+	return &keyboard
+}
+
+// parseUnits maps free-text input to a unit system
+func parseUnits(input string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case UnitsMetric, "cm", "kg", "metric (cm, kg)":
+		return UnitsMetric, true
+	case UnitsImperial, "lb", "lbs", "ft", "us", "uk", "imperial (ft/in, lb)":
+		return UnitsImperial, true
+	}
+	return "", false
+}
+
+// IsImperial reports whether the user prefers imperial units
+func (u *UserData) IsImperial() bool {
+	return u.Units == UnitsImperial
+}
+
+// UnitsLabel returns a human-readable name of the user's unit system
+func (u *UserData) UnitsLabel() string {
+	if u.IsImperial() {
+		return "Imperial (ft/in, lb)"
+	}
+	return "Metric (cm, kg)"
+}
+
+// FormatHeight returns the stored height in the user's units
+func (u *UserData) FormatHeight() string {
+	if !u.IsImperial() {
+		return fmt.Sprintf("%d cm", u.Height)
+	}
+	totalInches := int(math.Round(float64(u.Height) / cmPerInch))
+	return fmt.Sprintf("%d ft %d in", totalInches/inchPerFoot, totalInches%inchPerFoot)
+}
+
+// FormatWeight returns the stored weight in the user's units
+func (u *UserData) FormatWeight() string {
+	if !u.IsImperial() {
+		return strconv.FormatFloat(u.Weight, 'f', -1, 64) + " kg"
+	}
+	return fmt.Sprintf("%d lb", kgToPounds(u.Weight))
+}
+
+// FormatVolume returns a liquid volume in the user's units
+func (u *UserData) FormatVolume(ml int) string {
+	if !u.IsImperial() {
+		return fmt.Sprintf("%d ml", ml)
+	}
+	return fmt.Sprintf("%.0f fl oz", float64(ml)/mlPerFlOz)
+}
+
+// HeightQuestion returns the height question for the user's units
+func (u *UserData) HeightQuestion() string {
+	if u.IsImperial() {
+		return "Specify your height in feet and inches (for example, 5'10\" or 5 10):"
+	}
+	return "Specify your height in centimeters (for example, 175):"
+}
+
+// WeightQuestion returns the weight question for the user's units
+func (u *UserData) WeightQuestion() string {
+	if u.IsImperial() {
+		return "Specify your weight in pounds (for example, 165):"
+	}
+	return "Specify your weight in kilograms (for example, 70):"
+}
+
+// HeightRange describes the accepted heights in the user's units
+func (u *UserData) HeightRange() string {
+	if u.IsImperial() {
+		// Whole inches inside the range, so that both ends are accepted
+		low := int(math.Ceil(minHeightCm / cmPerInch))
+		high := int(math.Floor(maxHeightCm / cmPerInch))
+		return fmt.Sprintf("%d ft %d in and %d ft %d in", low/inchPerFoot, low%inchPerFoot, high/inchPerFoot, high%inchPerFoot)
+	}
+	return fmt.Sprintf("%d and %d cm", minHeightCm, maxHeightCm)
+}
+
+// WeightRange describes the accepted weights in the user's units
+func (u *UserData) WeightRange() string {
+	if u.IsImperial() {
+		return fmt.Sprintf("%.0f and %.0f lb", math.Ceil(minWeightKg/kgPerPound), math.Floor(maxWeightKg/kgPerPound))
+	}
+	return fmt.Sprintf("%d and %d kg", minWeightKg, maxWeightKg)
+}
+
+// UnitsInstruction returns a prompt fragment telling GPT which units to use
+func (u *UserData) UnitsInstruction() string {
+	if u.IsImperial() {
+		return "The user prefers imperial units: give all weights in pounds (lb), distances in miles and body measurements in inches."
+	}
+	return "The user prefers metric units: give all weights in kilograms (kg), distances in kilometers and body measurements in centimeters."
+}
+
+// parseHeight converts height input in the given unit system to centimeters
+// and checks that it is plausible
+func parseHeight(input, units string) (int, error) {
+	height, err := convertHeight(strings.ToLower(strings.TrimSpace(input)), units)
+	if err != nil {
+		return 0, err
+	}
+	if height < minHeightCm || height > maxHeightCm {
+		return 0, fmt.Errorf("height of %d cm: %w", height, ErrImplausibleValue)
+	}
+	return height, nil
+}
+
+// convertHeight converts height input in the given unit system to centimeters
+func convertHeight(input, units string) (int, error) {
+	if units != UnitsImperial {
+		value, unit, err := splitNumber(input)
+		if err != nil {
+			return 0, err
+		}
+		switch unit {
+		case "", "cm":
+			return int(math.Round(value)), nil
+		case "m":
+			return int(math.Round(value * 100)), nil
+		}
+		return 0, fmt.Errorf("unsupported height unit: %s", unit)
+	}
+
+	if m := inchesPattern.FindStringSubmatch(input); m != nil {
+		inches, _ := strconv.ParseFloat(m[1], 64)
+		return int(math.Round(inches * cmPerInch)), nil
+	}
+
+	m := feetInchesPattern.FindStringSubmatch(input)
+	if m == nil {
+		return 0, fmt.Errorf("invalid height: %q", input)
+	}
+	feet, _ := strconv.ParseFloat(m[1], 64)
+	var inches float64
+	if m[2] != "" {
+		inches, _ = strconv.ParseFloat(m[2], 64)
+	}
+	// A single large number is most likely total inches (e.g. "70")
+	if m[2] == "" && feet > 8 {
+		inches, feet = feet, 0
+	}
+	if inches >= inchPerFoot && feet > 0 {
+		return 0, fmt.Errorf("invalid inches value: %.0f", inches)
+	}
+	return int(math.Round((feet*inchPerFoot + inches) * cmPerInch)), nil
+}
+
+// parseWeight converts weight input in the given unit system to kilograms,
+// rounded to 0.1 kg so that pounds survive a round trip, and checks that it
+// is plausible
+func parseWeight(input, units string) (float64, error) {
+	weight, err := convertWeight(strings.ToLower(strings.TrimSpace(input)), units)
+	if err != nil {
+		return 0, err
+	}
+	if weight < minWeightKg || weight > maxWeightKg {
+		return 0, fmt.Errorf("weight of %.1f kg: %w", weight, ErrImplausibleValue)
+	}
+	return weight, nil
+}
+
+// convertWeight converts weight input in the given unit system to kilograms
+func convertWeight(input, units string) (float64, error) {
+	value, unit, err := splitNumber(input)
+	if err != nil {
+		return 0, err
+	}
+
+	switch unit {
+	case "kg", "kgs":
+		return roundTenth(value), nil
+	case "lb", "lbs", "pounds", "pound":
+		return roundTenth(value * kgPerPound), nil
+	case "":
+		if units == UnitsImperial {
+			return roundTenth(value * kgPerPound), nil
+		}
+		return roundTenth(value), nil
+	}
+	return 0, fmt.Errorf("unsupported weight unit: %s", unit)
+}
+
+// roundTenth rounds a value to one decimal place
+func roundTenth(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// kgToPounds converts kilograms to whole pounds
+func kgToPounds(kg float64) int {
+	return int(math.Round(kg / kgPerPound))
+}
+
+// splitNumber splits input like "70", "70kg" or "1.75 m" into a value and unit
+func splitNumber(input string) (float64, string, error) {
+	m := numberPattern.FindStringSubmatch(input)
+	if m == nil {
+		return 0, "", fmt.Errorf("invalid number: %q", input)
+	}
+	value, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return value, m[2], nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseHeight(t *testing.T) {
+	tests := []struct {
+		input, units string
+		want         int
+	}{
+		{"175", UnitsMetric, 175},
+		{"175 cm", UnitsMetric, 175},
+		{"1.75 m", UnitsMetric, 175},
+		{"1,75m", UnitsMetric, 175},
+		{"5'10\"", UnitsImperial, 178},
+		{"5’10”", UnitsImperial, 178},
+		{"5 ft 10 in", UnitsImperial, 178},
+		{"5 10", UnitsImperial, 178},
+		{"6'", UnitsImperial, 183},
+		{"70 in", UnitsImperial, 178},
+		{"70", UnitsImperial, 178}, // A single large number is inches
+		{"3 4", UnitsImperial, 102},
+		{"8 2", UnitsImperial, 249},
+	}
+	for _, tt := range tests {
+		if got, err := parseHeight(tt.input, tt.units); err != nil || got != tt.want {
+			t.Errorf("parseHeight(%q, %s) = %d, %v; want %d", tt.input, tt.units, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseHeightErrors(t *testing.T) {
+	tests := []struct {
+		input, units string
+		implausible  bool
+	}{
+		{"510", UnitsImperial, true}, // 5'10" without the separator
+		{"0", UnitsMetric, true},
+		{"99", UnitsMetric, true},
+		{"251", UnitsMetric, true},
+		{"17.5 m", UnitsMetric, true},
+		{"9 ft", UnitsImperial, true},
+		{"5 13", UnitsImperial, false},
+		{"tall", UnitsMetric, false},
+		{"175 in", UnitsMetric, false},
+	}
+	for _, tt := range tests {
+		_, err := parseHeight(tt.input, tt.units)
+		if err == nil || errors.Is(err, ErrImplausibleValue) != tt.implausible {
+			t.Errorf("parseHeight(%q, %s) error %v, implausible %v", tt.input, tt.units, err, tt.implausible)
+		}
+	}
+}
+
+func TestParseWeight(t *testing.T) {
+	tests := []struct {
+		input, units string
+		want         float64
+	}{
+		{"70", UnitsMetric, 70},
+		{"70 kg", UnitsMetric, 70},
+		{"70,5", UnitsMetric, 70.5},
+		{"70.25kg", UnitsMetric, 70.3},
+		{"154 lb", UnitsMetric, 69.9},
+		{"165", UnitsImperial, 74.8},
+		{"165 lbs", UnitsImperial, 74.8},
+		{"70 kg", UnitsImperial, 70},
+		{"56", UnitsImperial, 25.4},
+		{"771", UnitsImperial, 349.7},
+	}
+	for _, tt := range tests {
+		if got, err := parseWeight(tt.input, tt.units); err != nil || got != tt.want {
+			t.Errorf("parseWeight(%q, %s) = %v, %v; want %v", tt.input, tt.units, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseWeightErrors(t *testing.T) {
+	tests := []struct {
+		input, units string
+		implausible  bool
+	}{
+		{"0", UnitsMetric, true},
+		{"9999 lb", UnitsMetric, true},
+		{"9999", UnitsImperial, true},
+		{"20 kg", UnitsImperial, true},
+		{"351", UnitsMetric, true},
+		{"heavy", UnitsMetric, false},
+		{"70 st", UnitsMetric, false},
+	}
+	for _, tt := range tests {
+		_, err := parseWeight(tt.input, tt.units)
+		if err == nil || errors.Is(err, ErrImplausibleValue) != tt.implausible {
+			t.Errorf("parseWeight(%q, %s) error %v, implausible %v", tt.input, tt.units, err, tt.implausible)
+		}
+	}
+}
+
+func TestImplausibleInputIsAskedAgain(t *testing.T) {
+	for _, units := range []string{UnitsMetric, UnitsImperial} {
+		session := NewUserSession(1)
+		session.Data.Units = units
+		session.State = StateAskHeight
+
+		reply, err := session.ProcessInput("510")
+		if err != nil || session.State != StateAskHeight || session.Data.Height != 0 {
+			t.Fatalf("%s: height 510 accepted: state %v, height %d, error %v", units, session.State, session.Data.Height, err)
+		}
+		if !strings.Contains(reply, session.Data.HeightRange()) || !strings.Contains(reply, session.Data.HeightQuestion()) {
+			t.Errorf("%s: reply %q doesn't give the range and ask again", units, reply)
+		}
+
+		session.State = StateAskWeight
+		reply, err = session.ProcessInput("9999")
+		if err != nil || session.State != StateAskWeight || session.Data.Weight != 0 {
+			t.Fatalf("%s: weight 9999 accepted: state %v, weight %v, error %v", units, session.State, session.Data.Weight, err)
+		}
+		if !strings.Contains(reply, session.Data.WeightRange()) {
+			t.Errorf("%s: reply %q doesn't give the range", units, reply)
+		}
+	}
+
+	imperial := &UserData{Units: UnitsImperial}
+	if got := imperial.HeightRange(); got != "3 ft 4 in and 8 ft 2 in" {
+		t.Errorf("imperial HeightRange() = %q", got)
+	}
+	if got := imperial.WeightRange(); got != "56 and 771 lb" {
+		t.Errorf("imperial WeightRange() = %q", got)
+	}
+}
@@ -0,0 +1,345 @@
+// usage.go
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageFeature is the part of the bot a completion was requested for
+type UsageFeature string
+
+const (
+	UsagePlan    UsageFeature = "plan"
+	UsageQA      UsageFeature = "qa"
+	UsagePhoto   UsageFeature = "photo"
+	UsageCheckIn UsageFeature = "checkin" // Next week's plan after a weekly check-in
+)
+
+// llmFeatures are the features with their own language model settings
+var llmFeatures = []UsageFeature{UsagePlan, UsageQA, UsagePhoto, UsageCheckIn}
+
+// usageBucket is the store bucket for monthly usage records
+const usageBucket = "usage"
+
+// usageMonthFormat formats the month a record belongs to
+const usageMonthFormat = "2006-01"
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// defaultModelPrices are used unless overridden by OPENAI_PRICING
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-3.5-turbo":  {Prompt: 0.50, Completion: 1.50},
+	"gpt-4":          {Prompt: 30, Completion: 60},
+	"gpt-4-turbo":    {Prompt: 10, Completion: 30},
+	"gpt-4o":         {Prompt: 2.50, Completion: 10},
+	"gpt-4o-mini":    {Prompt: 0.15, Completion: 0.60},
+	ProviderScripted: {},
+}
+
+// parseModelPrices parses overrides like "gpt-4o=2.5/10,my-model=1/2" on top of the defaults
+func parseModelPrices(value string) (map[string]ModelPrice, error) {
+	prices := make(map[string]ModelPrice, len(defaultModelPrices))
+	for model, price := range defaultModelPrices {
+		prices[model] = price
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		model, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid model price %q, expected model=prompt/completion", item)
+		}
+		promptStr, completionStr, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid model price %q, expected prompt/completion", spec)
+		}
+		prompt, err := strconv.ParseFloat(strings.TrimSpace(promptStr), 64)
+		if err != nil || prompt < 0 {
+			return nil, fmt.Errorf("invalid prompt price %q", promptStr)
+		}
+		completion, err := strconv.ParseFloat(strings.TrimSpace(completionStr), 64)
+		if err != nil || completion < 0 {
+			return nil, fmt.Errorf("invalid completion price %q", completionStr)
+		}
+
+		prices[strings.TrimSpace(model)] = ModelPrice{Prompt: prompt, Completion: completion}
+	}
+
+	return prices, nil
+}
+
+// UsageQuota limits monthly usage per user, zero values mean unlimited
+type UsageQuota struct {
+	Tokens  int
+	CostUSD float64
+}
+
+// UsageTotals sums tokens and cost of completions
+type UsageTotals struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// Tokens returns the total number of tokens
+func (t UsageTotals) Tokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+func (t *UsageTotals) add(usage Usage, cost float64) {
+	t.Requests++
+	t.PromptTokens += usage.PromptTokens
+	t.CompletionTokens += usage.CompletionTokens
+	t.CostUSD += cost
+}
+
+// UsageRecord is one user's usage in one month
+type UsageRecord struct {
+	UserID    int64                   `json:"user_id"`
+	Month     string                  `json:"month"`
+	Total     UsageTotals             `json:"total"`
+	ByModel   map[string]*UsageTotals `json:"by_model"`
+	ByFeature map[string]*UsageTotals `json:"by_feature"`
+}
+
+// UsageTracker records OpenAI usage per user and enforces monthly quotas
+type UsageTracker struct {
+	store  Store
+	prices map[string]ModelPrice
+	quota  UsageQuota
+	mutex  sync.Mutex
+	now    func() time.Time
+}
+
+// NewUsageTracker creates a tracker persisting usage in the store
+func NewUsageTracker(store Store, prices map[string]ModelPrice, quota UsageQuota) *UsageTracker {
+	return &UsageTracker{
+		store:  store,
+		prices: prices,
+		quota:  quota,
+		now:    time.Now,
+	}
+}
+
+// usageKey builds the key of a user's monthly record
+func usageKey(userID int64, month string) string {
+	return fmt.Sprintf("%d:%s", userID, month)
+}
+
+// currentMonth returns the month usage is currently recorded for
+func (t *UsageTracker) currentMonth() string {
+	return t.now().UTC().Format(usageMonthFormat)
+}
+
+// price returns the price of a model
+func (t *UsageTracker) price(model string) (ModelPrice, bool) {
+	if price, ok := t.prices[model]; ok {
+		return price, true
+	}
+
+	// Dated snapshots like gpt-4o-2024-08-06 use the price of the base model
+	best := ""
+	for name := range t.prices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return t.prices[best], true
+}
+
+// Cost estimates the price of a completion in USD
+func (t *UsageTracker) Cost(usage Usage) float64 {
+	price, _ := t.price(usage.Model)
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1_000_000
+}
+
+// Record adds a completion to the user's usage for the current month
+func (t *UsageTracker) Record(userID int64, feature UsageFeature, usage Usage) {
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		return
+	}
+
+	cost := t.Cost(usage)
+	if _, ok := t.price(usage.Model); !ok {
+		slog.Warn("No price configured for model, cost not tracked", "model", usage.Model)
+	}
+	openAICostTotal.WithLabelValues(usage.Model, string(feature)).Add(cost)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	record, err := t.load(userID, t.currentMonth())
+	if err != nil {
+		slog.Error("Error loading usage", "user_id", userID, "error", err)
+		return
+	}
+
+	record.Total.add(usage, cost)
+	if record.ByModel[usage.Model] == nil {
+		record.ByModel[usage.Model] = &UsageTotals{}
+	}
+	record.ByModel[usage.Model].add(usage, cost)
+	if record.ByFeature[string(feature)] == nil {
+		record.ByFeature[string(feature)] = &UsageTotals{}
+	}
+	record.ByFeature[string(feature)].add(usage, cost)
+
+	if err := t.store.Put(usageBucket, usageKey(userID, record.Month), record); err != nil {
+		slog.Error("Error saving usage", "user_id", userID, "error", err)
+	}
+}
+
+// load returns the user's record for the month or an empty one
+func (t *UsageTracker) load(userID int64, month string) (*UsageRecord, error) {
+	record := &UsageRecord{
+		UserID:    userID,
+		Month:     month,
+		ByModel:   make(map[string]*UsageTotals),
+		ByFeature: make(map[string]*UsageTotals),
+	}
+	if _, err := t.store.Get(usageBucket, usageKey(userID, month), record); err != nil {
+		return nil, err
+	}
+	if record.ByModel == nil {
+		record.ByModel = make(map[string]*UsageTotals)
+	}
+	if record.ByFeature == nil {
+		record.ByFeature = make(map[string]*UsageTotals)
+	}
+	return record, nil
+}
+
+// Current returns the user's usage for the current month
+func (t *UsageTracker) Current(userID int64) (*UsageRecord, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.load(userID, t.currentMonth())
+}
+
+// WithinQuota checks whether the user may request another completion this month
+func (t *UsageTracker) WithinQuota(userID int64) bool {
+	if t.quota.Tokens <= 0 && t.quota.CostUSD <= 0 {
+		return true
+	}
+
+	record, err := t.Current(userID)
+	if err != nil {
+		// Don't block users because of a storage problem
+		slog.Error("Error checking usage quota", "user_id", userID, "error", err)
+		return true
+	}
+
+	if t.quota.Tokens > 0 && record.Total.Tokens() >= t.quota.Tokens {
+		return false
+	}
+	if t.quota.CostUSD > 0 && record.Total.CostUSD >= t.quota.CostUSD {
+		return false
+	}
+	return true
+}
+
+// QuotaResetDate returns when the current monthly quota ends
+func (t *UsageTracker) QuotaResetDate() time.Time {
+	now := t.now().UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// TopSpenders returns the users with the highest cost in the month
+func (t *UsageTracker) TopSpenders(month string, limit int) ([]*UsageRecord, error) {
+	keys, err := t.store.Keys(usageBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var records []*UsageRecord
+	for _, key := range keys {
+		idStr, keyMonth, ok := strings.Cut(key, ":")
+		if !ok || keyMonth != month {
+			continue
+		}
+		userID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		record, err := t.load(userID, month)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Total.CostUSD != records[j].Total.CostUSD {
+			return records[i].Total.CostUSD > records[j].Total.CostUSD
+		}
+		return records[i].Total.Tokens() > records[j].Total.Tokens()
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// formatUsageReport returns the top spenders report for admins
+func (b *Bot) formatUsageReport(month string) (string, error) {
+	if month == "" {
+		month = b.usage.currentMonth()
+	} else if _, err := time.Parse(usageMonthFormat, month); err != nil {
+		return "", fmt.Errorf("invalid month %q, expected YYYY-MM", month)
+	}
+
+	records, err := b.usage.TopSpenders(month, 10)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return fmt.Sprintf("💸 No OpenAI usage recorded for %s", month), nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "💸 Top OpenAI spenders for %s\n", month)
+	for i, record := range records {
+		fmt.Fprintf(&sb, "\n%d. User %d: $%.4f, %d tokens, %d requests",
+			i+1, record.UserID, record.Total.CostUSD, record.Total.Tokens(), record.Total.Requests)
+		features := make([]string, 0, len(record.ByFeature))
+		for feature, totals := range record.ByFeature {
+			features = append(features, fmt.Sprintf("%s $%.4f", feature, totals.CostUSD))
+		}
+		sort.Strings(features)
+		if len(features) > 0 {
+			fmt.Fprintf(&sb, " (%s)", strings.Join(features, ", "))
+		}
+	}
+	return sb.String(), nil
+}
+
+// formatUsageLine describes the user's usage this month for admins
+func (b *Bot) formatUsageLine(userID int64) string {
+	record, err := b.usage.Current(userID)
+	if err != nil {
+		return "unavailable"
+	}
+	return fmt.Sprintf("%d tokens, $%.4f in %s", record.Total.Tokens(), record.Total.CostUSD, record.Month)
+}
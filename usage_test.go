@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testUsageTracker returns a tracker on an empty store with the time set by *now
+func testUsageTracker(t *testing.T, quota UsageQuota, now *time.Time) *UsageTracker {
+	t.Helper()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "store.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	tracker := NewUsageTracker(store, defaultModelPrices, quota)
+	tracker.now = func() time.Time { return *now }
+	return tracker
+}
+
+func TestUsagePrice(t *testing.T) {
+	tracker := NewUsageTracker(nil, defaultModelPrices, UsageQuota{})
+	tests := []struct {
+		model string
+		want  ModelPrice
+		ok    bool
+	}{
+		{"gpt-4o", ModelPrice{Prompt: 2.50, Completion: 10}, true},
+		{"gpt-4o-2024-08-06", ModelPrice{Prompt: 2.50, Completion: 10}, true},
+		{"gpt-4o-mini-2024-07-18", ModelPrice{Prompt: 0.15, Completion: 0.60}, true}, // The longest prefix wins
+		{"gpt-4-turbo-2024-04-09", ModelPrice{Prompt: 10, Completion: 30}, true},
+		{"gpt-4-0613", ModelPrice{Prompt: 30, Completion: 60}, true},
+		{"unknown-model", ModelPrice{}, false},
+	}
+	for _, tt := range tests {
+		if got, ok := tracker.price(tt.model); got != tt.want || ok != tt.ok {
+			t.Errorf("price(%q) = %+v, %v, want %+v, %v", tt.model, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUsageCost(t *testing.T) {
+	tracker := NewUsageTracker(nil, defaultModelPrices, UsageQuota{})
+	tests := []struct {
+		usage Usage
+		want  float64
+	}{
+		{Usage{Model: "gpt-4o", PromptTokens: 1_000_000}, 2.50},
+		{Usage{Model: "gpt-4o", PromptTokens: 1000, CompletionTokens: 500}, 0.0025 + 0.005},
+		{Usage{Model: "gpt-4o-mini", PromptTokens: 2000, CompletionTokens: 1000}, 0.0003 + 0.0006},
+		{Usage{Model: "unknown-model", PromptTokens: 1000}, 0},
+	}
+	for _, tt := range tests {
+		if got := tracker.Cost(tt.usage); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("Cost(%+v) = %v, want %v", tt.usage, got, tt.want)
+		}
+	}
+}
+
+func TestUsageRecordAndMonthRollover(t *testing.T) {
+	now := time.Date(2026, 1, 31, 23, 30, 0, 0, time.UTC)
+	tracker := testUsageTracker(t, UsageQuota{}, &now)
+
+	tracker.Record(1, UsageQA, Usage{Model: "gpt-4o", PromptTokens: 1000, CompletionTokens: 500})
+	tracker.Record(1, UsagePlan, Usage{Model: "gpt-4o-mini", PromptTokens: 2000, CompletionTokens: 1000})
+	tracker.Record(1, UsageQA, Usage{Model: "gpt-4o"}) // Nothing to record
+
+	record, err := tracker.Current(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Month != "2026-01" || record.Total.Requests != 2 || record.Total.Tokens() != 4500 {
+		t.Errorf("January totals = %+v", record.Total)
+	}
+	if math.Abs(record.Total.CostUSD-0.0084) > 1e-12 {
+		t.Errorf("January cost = %v, want 0.0084", record.Total.CostUSD)
+	}
+	if qa := record.ByFeature[string(UsageQA)]; qa == nil || qa.Requests != 1 || qa.PromptTokens != 1000 {
+		t.Errorf("Q&A totals = %+v", qa)
+	}
+	if mini := record.ByModel["gpt-4o-mini"]; mini == nil || mini.CompletionTokens != 1000 {
+		t.Errorf("gpt-4o-mini totals = %+v", mini)
+	}
+
+	// A new month starts from zero and keeps the old record
+	now = now.Add(time.Hour)
+	if got := tracker.QuotaResetDate(); !got.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("QuotaResetDate() = %s, want March 1", got)
+	}
+	tracker.Record(1, UsageQA, Usage{Model: "gpt-4o", PromptTokens: 100})
+	if record, err := tracker.Current(1); err != nil || record.Month != "2026-02" || record.Total.Tokens() != 100 {
+		t.Errorf("February record = %+v, error %v", record, err)
+	}
+	if january, err := tracker.load(1, "2026-01"); err != nil || january.Total.Tokens() != 4500 {
+		t.Errorf("January record = %+v, error %v", january, err)
+	}
+}
+
+func TestUsageWithinQuota(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		quota UsageQuota
+		usage Usage
+		want  bool
+	}{
+		{"unlimited", UsageQuota{}, Usage{Model: "gpt-4o", PromptTokens: 10_000_000}, true},
+		{"under the token limit", UsageQuota{Tokens: 1000}, Usage{Model: "gpt-4o", PromptTokens: 999}, true},
+		{"at the token limit", UsageQuota{Tokens: 1000}, Usage{Model: "gpt-4o", PromptTokens: 600, CompletionTokens: 400}, false},
+		{"under the cost limit", UsageQuota{CostUSD: 1}, Usage{Model: "gpt-4o", PromptTokens: 399_999}, true},
+		{"at the cost limit", UsageQuota{CostUSD: 1}, Usage{Model: "gpt-4o", PromptTokens: 400_000}, false},
+		{"cost limit with tokens left", UsageQuota{Tokens: 10_000_000, CostUSD: 1}, Usage{Model: "gpt-4", PromptTokens: 40_000}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := testUsageTracker(t, tt.quota, &now)
+			if !tracker.WithinQuota(1) {
+				t.Fatal("new user is over quota")
+			}
+			tracker.Record(1, UsageQA, tt.usage)
+			if got := tracker.WithinQuota(1); got != tt.want {
+				t.Errorf("WithinQuota() = %v, want %v", got, tt.want)
+			}
+			if !tracker.WithinQuota(2) {
+				t.Error("quota of another user was used")
+			}
+		})
+	}
+
+	// The quota renews with the month
+	tracker := testUsageTracker(t, UsageQuota{Tokens: 1000}, &now)
+	tracker.Record(1, UsageQA, Usage{Model: "gpt-4o", PromptTokens: 5000})
+	now = time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	if !tracker.WithinQuota(1) {
+		t.Error("quota didn't renew in a new month")
+	}
+}
+
+func TestUsageTopSpenders(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	tracker := testUsageTracker(t, UsageQuota{}, &now)
+
+	tracker.Record(1, UsageQA, Usage{Model: "gpt-4o-mini", PromptTokens: 1000})
+	tracker.Record(2, UsageQA, Usage{Model: "gpt-4", PromptTokens: 1000})
+	tracker.Record(3, UsageQA, Usage{Model: "gpt-4o", PromptTokens: 1000})
+	tracker.Record(4, UsageQA, Usage{Model: ProviderScripted, PromptTokens: 500}) // Free, fewer tokens
+	tracker.Record(5, UsageQA, Usage{Model: ProviderScripted, PromptTokens: 900})
+	now = now.AddDate(0, 1, 0)
+	tracker.Record(6, UsageQA, Usage{Model: "gpt-4", PromptTokens: 1_000_000}) // Another month
+
+	records, err := tracker.TopSpenders("2026-05", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []int64
+	for _, record := range records {
+		order = append(order, record.UserID)
+	}
+	// By cost, then by tokens
+	if want := []int64{2, 3, 1, 5, 4}; !slices.Equal(order, want) {
+		t.Errorf("TopSpenders() = %v, want %v", order, want)
+	}
+
+	if records, err := tracker.TopSpenders("2026-05", 2); err != nil || len(records) != 2 || records[0].UserID != 2 {
+		t.Errorf("TopSpenders with limit 2 = %+v, error %v", records, err)
+	}
+	if records, err := tracker.TopSpenders("2026-04", 10); err != nil || len(records) != 0 {
+		t.Errorf("TopSpenders of a month without usage = %+v, error %v", records, err)
+	}
+}
@@ -3,14 +3,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"RestApiServer/Tg-bot/nutrition"
 )
 
 // UserState represents the state of dialog with the user
@@ -20,21 +22,67 @@ const (
 	StateInitial UserState = iota
 	StateAskSex
 	StateAskAge
+	StateAskUnits
 	StateAskHeight
 	StateAskWeight
 	StateAskDiabetes
 	StateAskLevel
+	StateAskActivity
 	StateAskGoal
 	StateAskType
 	StatePayment
 	StateComplete
 )
 
+// stateNames contains readable names of dialog states
+var stateNames = map[UserState]string{
+	StateInitial:     "initial",
+	StateAskSex:      "ask_sex",
+	StateAskAge:      "ask_age",
+	StateAskUnits:    "ask_units",
+	StateAskHeight:   "ask_height",
+	StateAskWeight:   "ask_weight",
+	StateAskDiabetes: "ask_diabetes",
+	StateAskLevel:    "ask_level",
+	StateAskActivity: "ask_activity",
+	StateAskGoal:     "ask_goal",
+	StateAskType:     "ask_type",
+	StatePayment:     "payment",
+	StateComplete:    "complete",
+}
+
+func (s UserState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state_%d", int(s))
+}
+
+// parseUserState returns the state with the given readable name
+func parseUserState(name string) (UserState, bool) {
+	for state, stateName := range stateNames {
+		if stateName == name {
+			return state, true
+		}
+	}
+	return StateInitial, false
+}
+
+// goalValues maps goal callback values to stored goals
+var goalValues = map[string]string{
+	"weight_loss": "weight loss",
+	"muscle_gain": "muscle gain",
+	"maintenance": "maintenance",
+	"endurance":   "endurance improvement",
+}
+
 // CallbackPrefix - prefixes for callback data
 const (
 	CallbackSex      = "sex:"
+	CallbackUnits    = "unt:"
 	CallbackDiabetes = "dia:"
 	CallbackLevel    = "lvl:"
+	CallbackActivity = "act:"
 	CallbackGoal     = "gol:"
 	CallbackType     = "typ:"
 	CallbackAsk      = "ask:"
@@ -45,9 +93,11 @@ type UserData struct {
 	Sex         string    `json:"Sex"`
 	Age         int       `json:"Age"`
 	Height      int       `json:"Height"`
-	Weight      int       `json:"Weight"`
+	Weight      float64   `json:"Weight"`
+	Units       string    `json:"Units,omitempty"`
 	Diabetes    string    `json:"Diabetes"`
 	Level       string    `json:"Level"`
+	Activity    string    `json:"Activity Level"`
 	FitnessGoal string    `json:"Fitness Goal"`
 	FitnessType string    `json:"Fitness Type"`
 	PaymentID   string    `json:"payment_id,omitempty"`
@@ -55,19 +105,18 @@ type UserData struct {
 }
 
 func (u *UserData) String() string {
-	// For internal purposes (logging, webhook) use JSON
-	if os.Getenv("USE_JSON_FORMAT") == "true" {
-		jsonData, err := json.MarshalIndent(u, "", "  ")
-		if err != nil {
-			return "Error formatting data"
-		}
-		return string(jsonData)
-	}
-
-	// For user display use beautiful formatting
 	return u.FormatUserDataBeautifully()
 }
 
+// JSON formats the data for the model when USE_JSON_FORMAT is set
+func (u *UserData) JSON() string {
+	jsonData, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return "Error formatting data"
+	}
+	return string(jsonData)
+}
+
 // UserSession represents a user session
 type UserSession struct {
 	UserID          int64
@@ -75,10 +124,15 @@ type UserSession struct {
 	Data            UserData
 	CreatedAt       time.Time
 	MessageCount    int       // Message counter
+	LastActivity    time.Time // Time of the last message, shown to the user's coach
 	LastCommandTime time.Time // Time of last command to avoid duplication
 	LastCommand     string    // Last command to avoid duplication
 	LastCallback    string    // Last callback to avoid duplication
 	LastMessageID   int       // ID of last message with buttons
+	BlockedBot      bool      // User has blocked the bot, skip in broadcasts
+
+	// Weekly check-in being answered, nil if none
+	CheckIn *CheckInDraft
 }
 
 // NewUserSession creates a new user session
@@ -95,11 +149,10 @@ func NewUserSession(userID int64) *UserSession {
 	}
 }
 
-// IncrementMessageCount increases the message counter
-func (s *UserSession) IncrementMessageCount() bool {
-	const MaxMessages = 10 // Maximum number of messages
+// IncrementMessageCount increases the message counter used in statistics
+func (s *UserSession) IncrementMessageCount() {
 	s.MessageCount++
-	return s.MessageCount <= MaxMessages
+	s.LastActivity = time.Now()
 }
 
 // CheckDuplicateCommand checks if a command is a duplicate
@@ -136,6 +189,9 @@ func (s *UserSession) GetKeyboardForState() *tgbotapi.InlineKeyboardMarkup {
 		)
 		return &keyboard
 
+	case StateAskUnits:
+		return unitsKeyboard()
+
 	case StateAskDiabetes:
 		keyboard := tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
@@ -159,6 +215,26 @@ func (s *UserSession) GetKeyboardForState() *tgbotapi.InlineKeyboardMarkup {
 		)
 		return &keyboard
 
+	case StateAskActivity:
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Sedentary (desk job, little walking)", CallbackActivity+"sedentary"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Lightly active", CallbackActivity+"light"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Moderately active", CallbackActivity+"moderate"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Very active (physical job)", CallbackActivity+"active"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Extremely active", CallbackActivity+"very_active"),
+			),
+		)
+		return &keyboard
+
 	case StateAskGoal:
 		keyboard := tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
@@ -194,23 +270,10 @@ func (s *UserSession) GetKeyboardForState() *tgbotapi.InlineKeyboardMarkup {
 		return &keyboard
 
 	case StatePayment:
-		// Create payment URL in advance
-		paymentURL, err := CreatePayment(s.UserID)
-		if err != nil {
-			log.Printf("Error creating payment link: %v", err)
-			// If failed to create link, use callback button
-			keyboard := tgbotapi.NewInlineKeyboardMarkup(
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("💳 Pay", "pay"),
-				),
-			)
-			return &keyboard
-		}
-
-		// Use URL button with nice emoji and more noticeable text
+		// The bot replaces this with a link to the checkout when it can create one
 		keyboard := tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonURL("💳 Go to Payment", paymentURL),
+				tgbotapi.NewInlineKeyboardButtonData("💳 Pay", "pay"),
 			),
 		)
 		return &keyboard
@@ -240,14 +303,18 @@ func (s *UserSession) GetNextQuestion() string {
 		return "Specify your gender:"
 	case StateAskAge:
 		return "Specify your age (full years):"
+	case StateAskUnits:
+		return "Which units do you prefer for height and weight?"
 	case StateAskHeight:
-		return "Specify your height in centimeters (for example, 175):"
+		return s.Data.HeightQuestion()
 	case StateAskWeight:
-		return "Specify your weight in kilograms (for example, 70):"
+		return s.Data.WeightQuestion()
 	case StateAskDiabetes:
 		return "Do you have diabetes?"
 	case StateAskLevel:
 		return "Rate your current fitness level:"
+	case StateAskActivity:
+		return "How active are you during the day (outside of workouts)?"
 	case StateAskGoal:
 		return "What is your main goal?"
 	case StateAskType:
@@ -268,25 +335,25 @@ func (s *UserSession) GetAskQuestionAnswer(question string) string {
 		// Nutrition recommendations
 		baseText := "🍽️ **NUTRITION RECOMMENDATIONS**\n\n"
 
-		weight := s.Data.Weight
-		height := s.Data.Height
-		goal := s.Data.FitnessGoal
-
-		if goal == "weight loss" {
-			baseText += fmt.Sprintf("To achieve your weight loss goal, considering your weight %d kg and height %d cm, it is recommended to consume approximately %d-%d calories per day, with a deficit of 400-500 calories.\n\n",
-				weight, height, (weight*30)-500, (weight*30)-400)
-		} else if goal == "muscle gain" {
-			baseText += fmt.Sprintf("For muscle mass gain, considering your weight %d kg, it is recommended to consume approximately %d-%d calories per day, with a surplus of 300-400 calories.\n\n",
-				weight, (weight*30)+300, (weight*30)+400)
+		energy, err := nutrition.Calculate(s.Data.NutritionProfile())
+		if err != nil {
+			slog.Warn("Error calculating energy targets", "user_id", s.UserID, "error", err)
+			baseText += "I couldn't calculate exact calorie targets from your data. Please check your age, height and weight using /start.\n\n"
 		} else {
-			baseText += fmt.Sprintf("To maintain your current weight of %d kg, it is recommended to consume approximately %d-%d calories per day.\n\n",
-				weight, weight*28, weight*30)
-		}
+			baseText += fmt.Sprintf("Your body mass index is %.1f (%s).\n\n", energy.BMI, energy.BMICategory)
+			baseText += fmt.Sprintf("Your basal metabolic rate is about %.0f kcal (%s formula), and with your activity level you burn about %.0f kcal per day.\n\n",
+				energy.BMR, energy.BMRFormula, energy.TDEE)
+			baseText += fmt.Sprintf("For your goal (%s) it is recommended to consume approximately %d calories per day (%s).\n\n",
+				s.Data.FitnessGoal, energy.Calories, energy.GoalNote)
+			if energy.CaloriesCapped {
+				baseText += fmt.Sprintf("Your target was raised to the safe minimum of %d calories per day. Do not eat less without medical supervision.\n\n", energy.MinCalories)
+			}
 
-		baseText += "Recommended macronutrient distribution:\n" +
-			"- Protein: 1.6-2.0 g per kg of body weight (approximately " + fmt.Sprintf("%d-%d", int(float64(weight)*1.6), int(float64(weight)*2.0)) + " g per day)\n" +
-			"- Fats: 0.8-1.0 g per kg of body weight (approximately " + fmt.Sprintf("%d-%d", int(float64(weight)*0.8), int(float64(weight)*1.0)) + " g per day)\n" +
-			"- Carbohydrates: the remaining calories\n\n"
+			baseText += "Recommended macronutrient distribution:\n" +
+				fmt.Sprintf("- Protein: %d g per day\n", energy.Macros.ProteinG) +
+				fmt.Sprintf("- Fats: %d g per day\n", energy.Macros.FatG) +
+				fmt.Sprintf("- Carbohydrates: %d g per day\n\n", energy.Macros.CarbsG)
+		}
 
 		baseText += "**Recommended meal schedule:**\n" +
 			"1. Breakfast: protein food + complex carbohydrates (oatmeal, eggs, low-fat cottage cheese)\n" +
@@ -295,8 +362,11 @@ func (s *UserSession) GetAskQuestionAnswer(question string) string {
 			"4. Snack: nuts, yogurt, or cottage cheese\n" +
 			"5. Dinner (at least 2-3 hours before sleep): protein + vegetables (chicken breast/fish, vegetable salad)\n\n"
 
-		baseText += "**Recommendations for fluid intake:**\n" +
-			fmt.Sprintf("- Drink at least %d ml of water per day\n", weight*30) +
+		water := "- Drink 30-35 ml of water per kg of body weight per day\n"
+		if err == nil {
+			water = fmt.Sprintf("- Drink at least %s of water per day\n", s.Data.FormatVolume(energy.WaterMl))
+		}
+		baseText += "**Recommendations for fluid intake:**\n" + water +
 			"- Drink a glass of water 30 minutes before each meal\n" +
 			"- Limit alcohol and sweet drinks consumption\n\n"
 
@@ -472,16 +542,6 @@ func (s *UserSession) ProcessButtonCallback(data string) (string, error) {
 		return "Invalid data", fmt.Errorf("invalid callback data: %s", data)
 	}
 
-	if data == "pay" {
-		// Create payment link
-		paymentURL, err := CreatePayment(s.UserID)
-		if err != nil {
-			return "An error occurred while creating payment. Please try again later.", err
-		}
-		// Return link directly, bot will send it as a message
-		return fmt.Sprintf("To make a payment, follow this link: %s", paymentURL), nil
-	}
-
 	// Process questions about workout program
 	if strings.HasPrefix(data, "ask_") {
 		question := strings.TrimPrefix(data, "ask_")
@@ -494,12 +554,18 @@ func (s *UserSession) ProcessButtonCallback(data string) (string, error) {
 	if strings.HasPrefix(data, CallbackSex) {
 		prefix = CallbackSex
 		value = data[len(CallbackSex):]
+	} else if strings.HasPrefix(data, CallbackUnits) {
+		prefix = CallbackUnits
+		value = data[len(CallbackUnits):]
 	} else if strings.HasPrefix(data, CallbackDiabetes) {
 		prefix = CallbackDiabetes
 		value = data[len(CallbackDiabetes):]
 	} else if strings.HasPrefix(data, CallbackLevel) {
 		prefix = CallbackLevel
 		value = data[len(CallbackLevel):]
+	} else if strings.HasPrefix(data, CallbackActivity) {
+		prefix = CallbackActivity
+		value = data[len(CallbackActivity):]
 	} else if strings.HasPrefix(data, CallbackGoal) {
 		prefix = CallbackGoal
 		value = data[len(CallbackGoal):]
@@ -525,6 +591,19 @@ func (s *UserSession) ProcessButtonCallback(data string) (string, error) {
 		}[value]
 		s.State = StateAskAge
 
+	case CallbackUnits:
+		units, ok := parseUnits(value)
+		if !ok {
+			return "Unknown units", fmt.Errorf("unknown units: %s", value)
+		}
+		s.Data.Units = units
+
+		// The /units command can be used at any stage of the dialog
+		if s.State != StateAskUnits {
+			return s.unitsChangedMessage(), nil
+		}
+		s.State = StateAskHeight
+
 	case CallbackDiabetes:
 		s.Data.Diabetes = map[string]string{
 			"yes": "yes",
@@ -538,15 +617,20 @@ func (s *UserSession) ProcessButtonCallback(data string) (string, error) {
 			"intermediate": "intermediate",
 			"advanced":     "advanced",
 		}[value]
+		s.State = StateAskActivity
+
+	case CallbackActivity:
+		s.Data.Activity = map[string]string{
+			"sedentary":   "sedentary",
+			"light":       "light",
+			"moderate":    "moderate",
+			"active":      "active",
+			"very_active": "very_active",
+		}[value]
 		s.State = StateAskGoal
 
 	case CallbackGoal:
-		s.Data.FitnessGoal = map[string]string{
-			"weight_loss": "weight loss",
-			"muscle_gain": "muscle gain",
-			"maintenance": "maintenance",
-			"endurance":   "endurance improvement",
-		}[value]
+		s.Data.FitnessGoal = goalValues[value]
 		s.State = StateAskType
 
 	case CallbackType:
@@ -565,6 +649,19 @@ func (s *UserSession) ProcessButtonCallback(data string) (string, error) {
 	return s.GetNextQuestion(), nil
 }
 
+// unitsChangedMessage confirms a unit change made outside of the questionnaire
+func (s *UserSession) unitsChangedMessage() string {
+	text := fmt.Sprintf("✅ Units set to %s.", s.Data.UnitsLabel())
+	switch {
+	case s.State == StateInitial:
+		return text + " Use /start to begin."
+	case s.State < StatePayment:
+		return text + "\n\n" + s.GetNextQuestion()
+	default:
+		return text + "\n\n" + s.Data.FormatUserDataBeautifully()
+	}
+}
+
 // FormatUserDataBeautifully returns beautifully formatted user data
 func (u *UserData) FormatUserDataBeautifully() string {
 	// Format readable representation of user data
@@ -572,14 +669,56 @@ func (u *UserData) FormatUserDataBeautifully() string {
 		"👤 *Your data*\n\n"+
 			"• Gender: %s\n"+
 			"• Age: %d years\n"+
-			"• Height: %d cm\n"+
-			"• Weight: %d kg\n"+
+			"• Height: %s\n"+
+			"• Weight: %s\n"+
 			"• Diabetes: %s\n"+
 			"• Fitness level: %s\n"+
+			"• Daily activity: %s\n"+
 			"• Goal: %s\n"+
 			"• Preferred workout type: %s",
-		u.Sex, u.Age, u.Height, u.Weight, u.Diabetes,
-		u.Level, u.FitnessGoal, u.FitnessType,
+		u.Sex, u.Age, u.FormatHeight(), u.FormatWeight(), u.Diabetes,
+		u.Level, u.Activity, u.FitnessGoal, u.FitnessType,
+	)
+}
+
+// NutritionProfile converts user data into a profile for energy calculations
+func (u *UserData) NutritionProfile() nutrition.Profile {
+	sex, _ := nutrition.ParseSex(u.Sex)
+	goal, _ := nutrition.ParseGoal(u.FitnessGoal)
+	activity, err := nutrition.ParseActivity(u.Activity)
+	if err != nil {
+		activity = nutrition.ActivityLight
+	}
+
+	return nutrition.Profile{
+		Sex:      sex,
+		Age:      u.Age,
+		HeightCm: float64(u.Height),
+		WeightKg: u.Weight,
+		Activity: activity,
+		Goal:     goal,
+	}
+}
+
+// EnergySummary returns calculated energy targets for use in GPT prompts
+func (u *UserData) EnergySummary() string {
+	energy, err := nutrition.Calculate(u.NutritionProfile())
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(
+		"Calculated energy targets (use these numbers, do not recalculate):\n"+
+			"- BMI: %.1f (%s)\n"+
+			"- BMR: %.0f kcal (%s)\n"+
+			"- TDEE: %.0f kcal\n"+
+			"- Daily calorie target: %d kcal (%s)\n"+
+			"- Macros: protein %d g, fat %d g, carbohydrates %d g",
+		energy.BMI, energy.BMICategory,
+		energy.BMR, energy.BMRFormula,
+		energy.TDEE,
+		energy.Calories, energy.GoalNote,
+		energy.Macros.ProteinG, energy.Macros.FatG, energy.Macros.CarbsG,
 	)
 }
 
@@ -592,7 +731,11 @@ func (s *UserSession) ProcessInput(input string) (string, error) {
 
 	case StateAskSex:
 		// If input by text, not buttons
-		s.Data.Sex = input
+		sex, err := nutrition.ParseSex(input)
+		if err != nil {
+			return "Please choose your gender using the buttons below:", nil
+		}
+		s.Data.Sex = string(sex)
 		s.State = StateAskAge
 		return "Specify your age (full years):", nil
 
@@ -602,22 +745,44 @@ func (s *UserSession) ProcessInput(input string) (string, error) {
 			return "Please enter age in digits (for example, 25):", nil
 		}
 		s.Data.Age = age
+
+		// Skip the units question if the preference is already known
+		if s.Data.Units != "" {
+			s.State = StateAskHeight
+			return s.Data.HeightQuestion(), nil
+		}
+		s.State = StateAskUnits
+		return "Which units do you prefer for height and weight?", nil
+
+	case StateAskUnits:
+		// If input by text, not buttons
+		units, ok := parseUnits(input)
+		if !ok {
+			return "Please choose metric or imperial units using the buttons below:", nil
+		}
+		s.Data.Units = units
 		s.State = StateAskHeight
-		return "Specify your height in centimeters (for example, 175):", nil
+		return s.Data.HeightQuestion(), nil
 
 	case StateAskHeight:
-		height, err := strconv.Atoi(input)
+		height, err := parseHeight(input, s.Data.Units)
+		if errors.Is(err, ErrImplausibleValue) {
+			return "That height doesn't look right, it should be between " + s.Data.HeightRange() + ". " + s.Data.HeightQuestion(), nil
+		}
 		if err != nil {
-			return "Please enter height in digits in centimeters (for example, 175):", nil
+			return "Please enter your height in the requested format. " + s.Data.HeightQuestion(), nil
 		}
 		s.Data.Height = height
 		s.State = StateAskWeight
-		return "Specify your weight in kilograms (for example, 70):", nil
+		return s.Data.WeightQuestion(), nil
 
 	case StateAskWeight:
-		weight, err := strconv.Atoi(input)
+		weight, err := parseWeight(input, s.Data.Units)
+		if errors.Is(err, ErrImplausibleValue) {
+			return "That weight doesn't look right, it should be between " + s.Data.WeightRange() + ". " + s.Data.WeightQuestion(), nil
+		}
 		if err != nil {
-			return "Please enter weight in digits in kilograms (for example, 70):", nil
+			return "Please enter your weight in digits. " + s.Data.WeightQuestion(), nil
 		}
 		s.Data.Weight = weight
 		s.State = StateAskDiabetes
@@ -632,12 +797,26 @@ func (s *UserSession) ProcessInput(input string) (string, error) {
 	case StateAskLevel:
 		// If input by text, not buttons
 		s.Data.Level = input
+		s.State = StateAskActivity
+		return "How active are you during the day (outside of workouts)?", nil
+
+	case StateAskActivity:
+		// If input by text, not buttons
+		activity, err := nutrition.ParseActivity(input)
+		if err != nil {
+			return "Please choose your daily activity level using the buttons below:", nil
+		}
+		s.Data.Activity = string(activity)
 		s.State = StateAskGoal
 		return "What is your main goal?", nil
 
 	case StateAskGoal:
 		// If input by text, not buttons
-		s.Data.FitnessGoal = input
+		goal, err := nutrition.ParseGoal(input)
+		if err != nil {
+			return "Please choose your main goal using the buttons below:", nil
+		}
+		s.Data.FitnessGoal = string(goal)
 		s.State = StateAskType
 		return "What type of workouts do you prefer?", nil
 
@@ -648,15 +827,6 @@ func (s *UserSession) ProcessInput(input string) (string, error) {
 		return fmt.Sprintf("Thank you! Your information has been collected:\n\n%s\n\nTo receive a personalized workout program, please pay for the service. Enter /pay", s.Data.String()), nil
 
 	case StatePayment:
-		if input == "/pay" {
-			// If user entered /pay command, create link and send it in text
-			paymentLink, err := CreatePayment(s.UserID)
-			if err != nil {
-				return "An error occurred while creating payment. Please try again later.", err
-			}
-			return fmt.Sprintf("To make a payment, follow this link: %s", paymentLink), nil
-		}
-
 		// Use beautiful data formatting instead of JSON
 		return fmt.Sprintf("Thank you! Your information has been collected:\n\n%s\n\nTo receive a personalized workout program, please pay for the service. Click the button or enter /pay",
 			s.Data.FormatUserDataBeautifully()), nil
@@ -669,6 +839,12 @@ func (s *UserSession) ProcessInput(input string) (string, error) {
 	}
 }
 
+// RevokePayment returns the session to the payment stage
+func (s *UserSession) RevokePayment() {
+	s.Data.PaymentID = ""
+	s.State = StatePayment
+}
+
 // SetPaymentCompleted sets payment status as completed
 func (s *UserSession) SetPaymentCompleted(paymentID string) {
 	s.Data.PaymentID = paymentID
@@ -0,0 +1,66 @@
+// voice.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Limits of voice messages sent for transcription
+const (
+	maxVoiceDuration = 2 * time.Minute
+	maxVoiceBytes    = 10 << 20
+)
+
+// transcribeVoice turns a voice message into text and echoes it to the user.
+// It reports false if the message can't be handled and the user was told why.
+func (b *Bot) transcribeVoice(ctx context.Context, message *tgbotapi.Message) (string, bool) {
+	logger := loggerFrom(ctx)
+	chatID := message.Chat.ID
+	voice := message.Voice
+
+	if b.transcriber == nil {
+		voiceTranscriptionsTotal.WithLabelValues("disabled").Inc()
+		b.sendText(chatID, "Sorry, I can't listen to voice messages yet. Please type your message.")
+		return "", false
+	}
+	if duration := time.Duration(voice.Duration) * time.Second; duration > maxVoiceDuration {
+		voiceTranscriptionsTotal.WithLabelValues("too_long").Inc()
+		b.sendText(chatID, fmt.Sprintf("Your voice message is too long. Please keep it under %d minutes.", int(maxVoiceDuration.Minutes())))
+		return "", false
+	}
+
+	if _, err := b.api.Request(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)); err != nil {
+		logger.Error("Error sending 'typing' status", "error", err)
+	}
+
+	data, _, err := b.downloadFile(ctx, voice.FileID, maxVoiceBytes)
+	if err != nil {
+		logger.Error("Error downloading voice message", "error", err)
+		voiceTranscriptionsTotal.WithLabelValues("download_failed").Inc()
+		b.sendText(chatID, "I couldn't load your voice message. Please try sending it again.")
+		return "", false
+	}
+
+	start := time.Now()
+	text, err := b.transcriber.Transcribe(ctx, Audio{Data: data, FileName: "voice.ogg"})
+	if err != nil {
+		logger.Error("Error transcribing voice message", "error", err, "duration", time.Since(start))
+		voiceTranscriptionsTotal.WithLabelValues("failed").Inc()
+		b.sendText(chatID, "I couldn't recognize your voice message right now. Please try again later or type your message.")
+		return "", false
+	}
+	if text == "" {
+		voiceTranscriptionsTotal.WithLabelValues("empty").Inc()
+		b.sendText(chatID, "I couldn't make out any words. Please try again or type your message.")
+		return "", false
+	}
+
+	voiceTranscriptionsTotal.WithLabelValues("transcribed").Inc()
+	logger.Info("Transcribed voice message", "voice_seconds", voice.Duration, "text_length", len(text), "duration", time.Since(start))
+	b.sendText(chatID, fmt.Sprintf("🎙 I heard: \"%s\"", text))
+	return text, true
+}
@@ -0,0 +1,208 @@
+// exercises.go
+package workout
+
+import (
+	_ "embed"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Level is the training experience required for or targeted by a workout
+type Level int
+
+const (
+	LevelBeginner Level = iota + 1
+	LevelIntermediate
+	LevelAdvanced
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelBeginner:
+		return "beginner"
+	case LevelIntermediate:
+		return "intermediate"
+	case LevelAdvanced:
+		return "advanced"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel parses a fitness level as stored in the questionnaire
+func ParseLevel(input string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "beginner":
+		return LevelBeginner, nil
+	case "intermediate":
+		return LevelIntermediate, nil
+	case "advanced":
+		return LevelAdvanced, nil
+	default:
+		return 0, fmt.Errorf("unknown level %q", input)
+	}
+}
+
+// UnmarshalYAML reads a level by name, as in the exercise library
+func (l *Level) UnmarshalYAML(value *yaml.Node) error {
+	level, err := ParseLevel(value.Value)
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// Equipment is what an exercise needs
+type Equipment string
+
+const (
+	EquipmentBodyweight Equipment = "bodyweight"
+	EquipmentDumbbells  Equipment = "dumbbells"
+	EquipmentBand       Equipment = "resistance band"
+	EquipmentGym        Equipment = "gym"
+)
+
+var knownEquipment = map[Equipment]bool{
+	EquipmentBodyweight: true, EquipmentDumbbells: true, EquipmentBand: true, EquipmentGym: true,
+}
+
+// Pattern is the movement pattern an exercise trains
+type Pattern string
+
+const (
+	PatternSquat    Pattern = "squat"
+	PatternHinge    Pattern = "hinge"
+	PatternLunge    Pattern = "lunge"
+	PatternPush     Pattern = "push"
+	PatternPull     Pattern = "pull"
+	PatternShoulder Pattern = "shoulders"
+	PatternArms     Pattern = "arms"
+	PatternCalves   Pattern = "calves"
+	PatternCore     Pattern = "core"
+	PatternCardio   Pattern = "cardio"
+	PatternMobility Pattern = "mobility"
+)
+
+var knownPatterns = map[Pattern]bool{
+	PatternSquat: true, PatternHinge: true, PatternLunge: true, PatternPush: true, PatternPull: true,
+	PatternShoulder: true, PatternArms: true, PatternCalves: true, PatternCore: true, PatternCardio: true,
+	PatternMobility: true,
+}
+
+// Exercise is an entry of the exercise library
+type Exercise struct {
+	ID        string    `yaml:"id"` // Used in /ex_<id> links
+	Name      string    `yaml:"name"`
+	Aliases   []string  `yaml:"aliases"`
+	Pattern   Pattern   `yaml:"pattern"`
+	Muscles   string    `yaml:"muscles"`
+	Equipment Equipment `yaml:"equipment"`
+	MinLevel  Level     `yaml:"level"`
+	// LowImpact exercises avoid jumping and are safe for joints and beginners
+	LowImpact bool `yaml:"low_impact"`
+	// Timed exercises are prescribed in seconds instead of repetitions
+	Timed bool `yaml:"timed"`
+	// Steady cardio can be kept up for a long continuous session
+	Steady bool `yaml:"steady"`
+
+	// Reference shown by /exercise
+	Description       string   `yaml:"description"`
+	Steps             []string `yaml:"steps"`
+	Contraindications []string `yaml:"contraindications"`
+	Media             string   `yaml:"media"` // Optional image file name
+}
+
+//go:embed exercises.yaml
+var libraryData []byte
+
+// Library contains all exercises used to build plans and answer lookups
+var Library = mustLoadLibrary(libraryData)
+
+// exerciseIDPattern limits IDs to what Telegram accepts in a command
+var exerciseIDPattern = regexp.MustCompile(`^[a-z0-9_]{1,28}$`)
+
+// LoadLibrary parses and validates an exercise database in YAML
+func LoadLibrary(data []byte) ([]Exercise, error) {
+	var exercises []Exercise
+	if err := yaml.Unmarshal(data, &exercises); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	names := make(map[string]string) // Normalized name or alias to exercise ID
+	for i, e := range exercises {
+		switch {
+		case !exerciseIDPattern.MatchString(e.ID):
+			return nil, fmt.Errorf("exercise %d: invalid id %q", i+1, e.ID)
+		case ids[e.ID]:
+			return nil, fmt.Errorf("exercise %s: duplicate id", e.ID)
+		case e.Name == "" || e.Muscles == "" || e.Description == "" || len(e.Steps) == 0:
+			return nil, fmt.Errorf("exercise %s: name, muscles, description and steps are required", e.ID)
+		case !knownPatterns[e.Pattern]:
+			return nil, fmt.Errorf("exercise %s: unknown pattern %q", e.ID, e.Pattern)
+		case !knownEquipment[e.Equipment]:
+			return nil, fmt.Errorf("exercise %s: unknown equipment %q", e.ID, e.Equipment)
+		case e.MinLevel == 0:
+			return nil, fmt.Errorf("exercise %s: level is required", e.ID)
+		case e.Media != "" && filepath.Base(e.Media) != e.Media:
+			return nil, fmt.Errorf("exercise %s: media must be a file name, got %q", e.ID, e.Media)
+		}
+		ids[e.ID] = true
+
+		for _, name := range append([]string{e.Name}, e.Aliases...) {
+			key := strings.Join(tokenize(name), " ")
+			if key == "" {
+				return nil, fmt.Errorf("exercise %s: empty name or alias", e.ID)
+			}
+			if other, ok := names[key]; ok {
+				return nil, fmt.Errorf("exercise %s: %q is already a name of %s", e.ID, name, other)
+			}
+			names[key] = e.ID
+		}
+	}
+	return exercises, nil
+}
+
+// mustLoadLibrary loads the built-in database, which is checked at startup
+func mustLoadLibrary(data []byte) []Exercise {
+	exercises, err := LoadLibrary(data)
+	if err != nil {
+		panic(fmt.Sprintf("invalid exercise library: %v", err))
+	}
+	return exercises
+}
+
+// Find returns the library exercise with the ID
+func Find(id string) (Exercise, bool) {
+	for _, e := range Library {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Exercise{}, false
+}
+
+// Filter returns the exercises of a pattern that suit the level and equipment
+func Filter(pattern Pattern, level Level, equipment []Equipment, lowImpact bool) []Exercise {
+	available := map[Equipment]bool{EquipmentBodyweight: true}
+	for _, e := range equipment {
+		available[e] = true
+	}
+
+	var result []Exercise
+	for _, exercise := range Library {
+		if exercise.Pattern != pattern || exercise.MinLevel > level || !available[exercise.Equipment] {
+			continue
+		}
+		if lowImpact && !exercise.LowImpact {
+			continue
+		}
+		result = append(result, exercise)
+	}
+	return result
+}
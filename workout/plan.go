@@ -0,0 +1,370 @@
+// plan.go
+package workout
+
+import (
+	"fmt"
+	"strings"
+
+	"RestApiServer/Tg-bot/nutrition"
+)
+
+// Profile contains the user data that shapes a plan
+type Profile struct {
+	Level     Level
+	Goal      nutrition.Goal
+	Type      string // strength, cardio, mixed, yoga, pilates or other
+	Diabetes  bool
+	Equipment []Equipment
+}
+
+// Prescription is an exercise with its volume
+type Prescription struct {
+	Exercise Exercise
+	Sets     int
+	Dose     string // repetitions, seconds or minutes per set
+}
+
+// Day is one day of the weekly plan
+type Day struct {
+	Name      string
+	Focus     string
+	Minutes   int
+	Exercises []Prescription
+	Note      string
+}
+
+// Rest reports whether the day has no workout
+func (d Day) Rest() bool {
+	return len(d.Exercises) == 0
+}
+
+// Plan is a week of workouts
+type Plan struct {
+	Profile Profile
+	Days    []Day
+	Tips    []string
+}
+
+// Workout focuses
+const (
+	focusFullBody = "Full body strength"
+	focusUpper    = "Upper body strength"
+	focusLower    = "Lower body strength"
+	focusCardio   = "Cardio"
+	focusCore     = "Core and balance"
+	focusMobility = "Mobility and yoga flow"
+	focusPilates  = "Pilates"
+)
+
+var weekDays = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+// trainingDays are the week day indexes with workouts for each level
+var trainingDays = map[Level][]int{
+	LevelBeginner:     {0, 2, 4},
+	LevelIntermediate: {0, 1, 3, 4},
+	LevelAdvanced:     {0, 1, 2, 4, 5},
+}
+
+// focusSlots are the movement patterns of a workout, trimmed by level
+var focusSlots = map[string][]Pattern{
+	focusFullBody: {PatternSquat, PatternPush, PatternHinge, PatternPull, PatternLunge, PatternCore, PatternShoulder},
+	focusUpper:    {PatternPush, PatternPull, PatternShoulder, PatternPush, PatternPull, PatternArms, PatternCore},
+	focusLower:    {PatternSquat, PatternHinge, PatternLunge, PatternCalves, PatternCore, PatternHinge, PatternCore},
+	focusCardio:   {PatternCardio, PatternCardio, PatternCore, PatternCore, PatternMobility, PatternCore, PatternCardio},
+	focusCore:     {PatternCore, PatternCore, PatternCore, PatternMobility, PatternCore, PatternMobility, PatternCore},
+	focusMobility: {PatternMobility, PatternMobility, PatternMobility, PatternCore, PatternMobility, PatternMobility, PatternCore},
+	focusPilates:  {PatternCore, PatternCore, PatternMobility, PatternCore, PatternHinge, PatternCore, PatternMobility},
+}
+
+// slotsPerLevel is the number of exercises per workout
+var slotsPerLevel = map[Level]int{
+	LevelBeginner:     5,
+	LevelIntermediate: 6,
+	LevelAdvanced:     7,
+}
+
+// focusOrder returns the workout focuses of the week for the type and level
+func focusOrder(workoutType string, level Level) []string {
+	switch strings.ToLower(workoutType) {
+	case "strength":
+		switch level {
+		case LevelBeginner:
+			return []string{focusFullBody, focusFullBody, focusFullBody}
+		case LevelIntermediate:
+			return []string{focusUpper, focusLower, focusUpper, focusLower}
+		default:
+			return []string{focusUpper, focusLower, focusFullBody, focusUpper, focusLower}
+		}
+	case "cardio":
+		return []string{focusCardio, focusFullBody, focusCardio, focusCardio, focusCore}
+	case "yoga":
+		return []string{focusMobility, focusCore, focusMobility, focusMobility, focusCore}
+	case "pilates":
+		return []string{focusPilates, focusMobility, focusPilates, focusPilates, focusMobility}
+	default:
+		return []string{focusFullBody, focusCardio, focusFullBody, focusCardio, focusFullBody}
+	}
+}
+
+// Generate builds a weekly plan. The result only depends on the profile.
+func Generate(p Profile) Plan {
+	if p.Level == 0 {
+		p.Level = LevelBeginner
+	}
+	if p.Goal == "" {
+		p.Goal = nutrition.GoalMaintenance
+	}
+
+	days := trainingDays[p.Level]
+	focuses := focusOrder(p.Type, p.Level)
+
+	plan := Plan{Profile: p}
+	workout := 0
+	for i, name := range weekDays {
+		if workout < len(days) && days[workout] == i {
+			plan.Days = append(plan.Days, buildWorkout(p, name, focuses[workout%len(focuses)], workout))
+			workout++
+			continue
+		}
+
+		day := Day{Name: name, Focus: "Rest"}
+		if p.Level > LevelBeginner && i != len(weekDays)-1 {
+			day.Focus = "Active recovery"
+			day.Note = "20-30 minutes of easy walking or cycling and light stretching"
+		}
+		plan.Days = append(plan.Days, day)
+	}
+
+	plan.Tips = tips(p)
+	return plan
+}
+
+// buildWorkout fills the slots of a workout with exercises from the library
+func buildWorkout(p Profile, name, focus string, index int) Day {
+	day := Day{Name: name, Focus: focus}
+	lowImpact := p.Level == LevelBeginner
+
+	slots := focusSlots[focus]
+	if n := slotsPerLevel[p.Level]; n < len(slots) {
+		slots = slots[:n]
+	}
+
+	used := make(map[string]bool)
+	minutes := 10 // Warm-up and cool-down
+	mainCardio := true
+	for slot, pattern := range slots {
+		candidates := Filter(pattern, p.Level, p.Equipment, lowImpact)
+		if pattern == PatternCardio && mainCardio {
+			candidates = steadyOnly(candidates)
+		}
+		exercise, ok := pick(candidates, index+slot, used)
+		if !ok {
+			continue
+		}
+		used[exercise.Name] = true
+
+		prescription := prescribe(p, exercise, mainCardio)
+		if pattern == PatternCardio {
+			mainCardio = false
+		}
+		day.Exercises = append(day.Exercises, prescription)
+		minutes += estimateMinutes(prescription)
+	}
+
+	// Weight loss and endurance goals get extra conditioning after strength work
+	if focus != focusCardio && focus != focusMobility && focus != focusPilates &&
+		(p.Goal == nutrition.GoalWeightLoss || p.Goal == nutrition.GoalEndurance) {
+		finisher := cardioMinutes(p) / 2
+		day.Note = fmt.Sprintf("Finish with %d minutes of low-intensity cardio", finisher)
+		minutes += finisher
+	}
+
+	day.Minutes = minutes
+	return day
+}
+
+// pick deterministically chooses an unused exercise, rotating by seed
+func pick(candidates []Exercise, seed int, used map[string]bool) (Exercise, bool) {
+	for i := range candidates {
+		exercise := candidates[(seed+i)%len(candidates)]
+		if !used[exercise.Name] {
+			return exercise, true
+		}
+	}
+	return Exercise{}, false
+}
+
+// steadyOnly keeps the exercises suitable for a long cardio block
+func steadyOnly(exercises []Exercise) []Exercise {
+	var result []Exercise
+	for _, e := range exercises {
+		if e.Steady {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// prescribe sets the volume of an exercise for the goal and level. The first
+// cardio exercise of a workout is its main block, later ones are short finishers.
+func prescribe(p Profile, e Exercise, mainCardio bool) Prescription {
+	switch e.Pattern {
+	case PatternCardio:
+		if !mainCardio {
+			return Prescription{Exercise: e, Sets: 2 + int(p.Level), Dose: "45 s"}
+		}
+		if p.Level > LevelBeginner && p.Goal != nutrition.GoalEndurance {
+			rounds := 6 + 2*int(p.Level)
+			return Prescription{Exercise: e, Sets: rounds, Dose: "30 s hard / 60 s easy"}
+		}
+		return Prescription{Exercise: e, Sets: 1, Dose: fmt.Sprintf("%d min", cardioMinutes(p))}
+	case PatternMobility:
+		return Prescription{Exercise: e, Sets: 2, Dose: fmt.Sprintf("%d s", 20+10*int(p.Level))}
+	}
+
+	sets := 3
+	reps := "10-12"
+	switch p.Goal {
+	case nutrition.GoalMuscleGain:
+		reps = "8-10"
+		if p.Level > LevelBeginner {
+			sets = 4
+		}
+	case nutrition.GoalWeightLoss:
+		reps = "12-15"
+	case nutrition.GoalEndurance:
+		reps = "15-20"
+		if p.Level == LevelBeginner {
+			sets = 2
+		}
+	}
+	if p.Level == LevelBeginner && sets > 3 {
+		sets = 3
+	}
+
+	if e.Timed {
+		return Prescription{Exercise: e, Sets: sets, Dose: fmt.Sprintf("%d s", 15+15*int(p.Level))}
+	}
+	if e.Pattern == PatternLunge || strings.HasPrefix(e.Name, "Single-leg") || strings.HasPrefix(e.Name, "One-arm") || e.Name == "Bulgarian split squat" {
+		reps += " per side"
+	}
+	return Prescription{Exercise: e, Sets: sets, Dose: reps}
+}
+
+// cardioMinutes is the length of a steady cardio block
+func cardioMinutes(p Profile) int {
+	minutes := 10 + 5*int(p.Level)
+	switch p.Goal {
+	case nutrition.GoalEndurance:
+		minutes += 10
+	case nutrition.GoalWeightLoss:
+		minutes += 5
+	}
+	return minutes
+}
+
+// estimateMinutes roughly estimates the time an exercise takes including rest
+func estimateMinutes(rx Prescription) int {
+	switch {
+	case rx.Exercise.Pattern == PatternCardio && rx.Sets == 1:
+		var minutes int
+		fmt.Sscanf(rx.Dose, "%d", &minutes)
+		return minutes
+	case rx.Exercise.Pattern == PatternCardio && rx.Dose == "45 s":
+		return rx.Sets
+	case rx.Exercise.Pattern == PatternCardio:
+		return (rx.Sets*90 + 59) / 60
+	case rx.Exercise.Pattern == PatternMobility:
+		return 2
+	default:
+		return rx.Sets * 2
+	}
+}
+
+// tips returns advice for the goal and health status
+func tips(p Profile) []string {
+	var result []string
+
+	switch p.Goal {
+	case nutrition.GoalWeightLoss:
+		result = append(result,
+			"Keep rest between sets short (30-45 s) to keep your heart rate up",
+			"Aim for 7,000-10,000 steps on most days, including rest days")
+	case nutrition.GoalMuscleGain:
+		result = append(result,
+			"Rest 60-90 s between sets and finish each set 1-2 reps short of failure",
+			"Eat enough protein and get 7-9 hours of sleep to recover")
+	case nutrition.GoalEndurance:
+		result = append(result,
+			"Keep most cardio at a pace where you can still talk",
+			"Add 5 minutes to your longest cardio session every week")
+	default:
+		result = append(result,
+			"Keep the same schedule and change exercises every 4-6 weeks to stay motivated")
+	}
+
+	switch p.Level {
+	case LevelBeginner:
+		result = append(result, "Focus on technique first: use a mirror or record yourself and stop sets before form breaks down")
+	default:
+		result = append(result, "Progress gradually: add a rep, a set or a little weight each week when all sets feel controlled")
+	}
+
+	if p.Diabetes {
+		result = append(result,
+			"Check your blood sugar before and after workouts and agree your plan with your doctor",
+			"Carry fast carbs (juice, glucose tablets) and stop immediately if you feel shaky, dizzy or sweaty",
+			"Train 1-2 hours after a meal and avoid long workouts on an empty stomach")
+	}
+
+	result = append(result, "Stop any exercise that causes sharp pain and warm up for 5-10 minutes before every workout")
+	return result
+}
+
+// Format returns the plan as a message for the user
+func (p Plan) Format() string {
+	var sb strings.Builder
+
+	sb.WriteString("📋 PERSONALIZED WORKOUT PROGRAM\n\n")
+	fmt.Fprintf(&sb, "Level: %s • Goal: %s", p.Profile.Level, p.Profile.Goal)
+	if p.Profile.Type != "" {
+		fmt.Fprintf(&sb, " • Preferred type: %s", p.Profile.Type)
+	}
+	sb.WriteString("\n\n## WEEKLY PLAN\n\n")
+	for _, day := range p.Days {
+		if day.Rest() {
+			fmt.Fprintf(&sb, "**%s**: %s\n", day.Name, day.Focus)
+			continue
+		}
+		fmt.Fprintf(&sb, "**%s**: %s - about %d minutes\n", day.Name, day.Focus, day.Minutes)
+	}
+
+	sb.WriteString("\n## DETAILED WORKOUTS\n")
+	for _, day := range p.Days {
+		if day.Rest() {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n### %s (%s)\n", strings.ToUpper(day.Name), strings.ToUpper(day.Focus))
+		sb.WriteString("1. Warm-up - 5 minutes\n")
+		for i, rx := range day.Exercises {
+			if rx.Sets == 1 {
+				fmt.Fprintf(&sb, "%d. %s: %s\n", i+2, rx.Exercise.Name, rx.Dose)
+			} else {
+				fmt.Fprintf(&sb, "%d. %s: %d × %s\n", i+2, rx.Exercise.Name, rx.Sets, rx.Dose)
+			}
+		}
+		n := len(day.Exercises) + 2
+		if day.Note != "" {
+			fmt.Fprintf(&sb, "%d. %s\n", n, day.Note)
+			n++
+		}
+		fmt.Fprintf(&sb, "%d. Stretching - 5 minutes\n", n)
+	}
+
+	sb.WriteString("\n## TIPS\n")
+	for _, tip := range p.Tips {
+		fmt.Fprintf(&sb, "- %s\n", tip)
+	}
+
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,200 @@
+package workout
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"RestApiServer/Tg-bot/nutrition"
+)
+
+// homeProfile is a typical profile of the questionnaire
+var homeProfile = Profile{
+	Level:     LevelIntermediate,
+	Goal:      nutrition.GoalMaintenance,
+	Type:      "mixed",
+	Equipment: []Equipment{EquipmentDumbbells, EquipmentBand},
+}
+
+// workouts returns the days of the plan with exercises
+func workouts(p Plan) []Day {
+	var days []Day
+	for _, day := range p.Days {
+		if !day.Rest() {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// doses lists the dose of every exercise of the plan
+func doses(p Plan) string {
+	var all []string
+	for _, day := range workouts(p) {
+		for _, rx := range day.Exercises {
+			all = append(all, rx.Dose)
+		}
+	}
+	return strings.Join(all, "|")
+}
+
+func TestGenerateLevel(t *testing.T) {
+	tests := []struct {
+		level     Level
+		workouts  int
+		exercises int // At most, per workout
+		recovery  bool
+	}{
+		{LevelBeginner, 3, 5, false},
+		{LevelIntermediate, 4, 6, true},
+		{LevelAdvanced, 5, 7, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			p := homeProfile
+			p.Level = tt.level
+			plan := Generate(p)
+			if len(plan.Days) != 7 {
+				t.Fatalf("plan has %d days, want 7", len(plan.Days))
+			}
+			days := workouts(plan)
+			if len(days) != tt.workouts {
+				t.Errorf("%d workouts, want %d", len(days), tt.workouts)
+			}
+			for _, day := range days {
+				if len(day.Exercises) == 0 || len(day.Exercises) > tt.exercises {
+					t.Errorf("%s has %d exercises, want 1-%d", day.Name, len(day.Exercises), tt.exercises)
+				}
+				for _, rx := range day.Exercises {
+					if rx.Exercise.MinLevel > tt.level {
+						t.Errorf("%s is too hard for %s", rx.Exercise.Name, tt.level)
+					}
+					if tt.level == LevelBeginner && !rx.Exercise.LowImpact {
+						t.Errorf("beginner plan has high-impact %s", rx.Exercise.Name)
+					}
+				}
+			}
+			if recovery := strings.Contains(plan.Format(), "Active recovery"); recovery != tt.recovery {
+				t.Errorf("active recovery days: %v, want %v", recovery, tt.recovery)
+			}
+		})
+	}
+}
+
+func TestGenerateGoal(t *testing.T) {
+	tests := []struct {
+		goal     nutrition.Goal
+		reps     string
+		finisher bool
+		tip      string
+	}{
+		{nutrition.GoalMaintenance, "10-12", false, "change exercises every 4-6 weeks"},
+		{nutrition.GoalMuscleGain, "8-10", false, "short of failure"},
+		{nutrition.GoalWeightLoss, "12-15", true, "steps"},
+		{nutrition.GoalEndurance, "15-20", true, "still talk"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.goal), func(t *testing.T) {
+			p := homeProfile
+			p.Goal = tt.goal
+			plan := Generate(p)
+			if !strings.Contains(doses(plan), tt.reps) {
+				t.Errorf("no exercise with %s repetitions: %s", tt.reps, doses(plan))
+			}
+			finisher := false
+			for _, day := range workouts(plan) {
+				finisher = finisher || strings.Contains(day.Note, "low-intensity cardio")
+			}
+			if finisher != tt.finisher {
+				t.Errorf("cardio finisher: %v, want %v", finisher, tt.finisher)
+			}
+			if !strings.Contains(strings.Join(plan.Tips, "\n"), tt.tip) {
+				t.Errorf("tips lack %q: %q", tt.tip, plan.Tips)
+			}
+		})
+	}
+}
+
+func TestGenerateType(t *testing.T) {
+	tests := []struct {
+		workoutType string
+		focus       string
+	}{
+		{"strength", focusUpper},
+		{"cardio", focusCardio},
+		{"yoga", focusMobility},
+		{"pilates", focusPilates},
+		{"Strength", focusUpper}, // As typed by the user
+		{"other", focusFullBody},
+		{"", focusFullBody},
+	}
+	for _, tt := range tests {
+		p := homeProfile
+		p.Type = tt.workoutType
+		days := workouts(Generate(p))
+		if len(days) == 0 || days[0].Focus != tt.focus {
+			t.Errorf("type %q: first workout %+v, want %s", tt.workoutType, days, tt.focus)
+		}
+	}
+
+	// Yoga and strength plans share no workout focus
+	p := homeProfile
+	p.Type = "yoga"
+	for _, day := range workouts(Generate(p)) {
+		if day.Focus == focusUpper || day.Focus == focusLower {
+			t.Errorf("yoga plan has a %s workout", day.Focus)
+		}
+	}
+}
+
+func TestGenerateDiabetes(t *testing.T) {
+	p := homeProfile
+	without := strings.Join(Generate(p).Tips, "\n")
+	p.Diabetes = true
+	with := strings.Join(Generate(p).Tips, "\n")
+	if strings.Contains(without, "blood sugar") || !strings.Contains(with, "blood sugar") || !strings.Contains(with, "fast carbs") {
+		t.Errorf("diabetes tips wrong:\nwithout: %s\nwith: %s", without, with)
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	if a, b := Generate(homeProfile), Generate(homeProfile); !reflect.DeepEqual(a, b) {
+		t.Error("the same profile gave different plans")
+	}
+}
+
+func TestGenerateIncompleteProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+	}{
+		{"empty", Profile{}},
+		{"no equipment", Profile{Level: LevelAdvanced, Goal: nutrition.GoalMuscleGain, Type: "strength"}},
+		{"unknown type", Profile{Type: "crossfit"}},
+		{"only diabetes", Profile{Diabetes: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := Generate(tt.profile)
+			if len(workouts(plan)) == 0 {
+				t.Fatal("plan has no workouts")
+			}
+			for _, day := range workouts(plan) {
+				for _, rx := range day.Exercises {
+					if len(tt.profile.Equipment) == 0 && rx.Exercise.Equipment != EquipmentBodyweight {
+						t.Errorf("%s needs %s", rx.Exercise.Name, rx.Exercise.Equipment)
+					}
+				}
+			}
+			if text := plan.Format(); !strings.Contains(text, "WEEKLY PLAN") {
+				t.Errorf("plan can't be formatted:\n%s", text)
+			}
+			plan.Apply(Progression{Load: 3, Adjustment: AdjustDeload}).Format()
+		})
+	}
+
+	// Unset fields get beginner and maintenance defaults
+	if plan := Generate(Profile{}); plan.Profile.Level != LevelBeginner || plan.Profile.Goal != nutrition.GoalMaintenance {
+		t.Errorf("empty profile planned as %s, %s", plan.Profile.Level, plan.Profile.Goal)
+	}
+}
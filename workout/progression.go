@@ -0,0 +1,245 @@
+// progression.go
+package workout
+
+import (
+	"fmt"
+	"strings"
+
+	"RestApiServer/Tg-bot/nutrition"
+)
+
+// Adherence is the share of planned workouts done
+type Adherence string
+
+const (
+	AdherenceAll  Adherence = "all"
+	AdherenceMost Adherence = "most"
+	AdherenceHalf Adherence = "half"
+	AdherenceLow  Adherence = "low"
+)
+
+// Difficulty is how hard the workouts felt
+type Difficulty string
+
+const (
+	DifficultyEasy    Difficulty = "easy"
+	DifficultyRight   Difficulty = "right"
+	DifficultyHard    Difficulty = "hard"
+	DifficultyTooHard Difficulty = "too_hard"
+)
+
+// Energy is the energy level during the week
+type Energy string
+
+const (
+	EnergyLow    Energy = "low"
+	EnergyNormal Energy = "normal"
+	EnergyHigh   Energy = "high"
+)
+
+// WeightTrend is how body weight changed during the week
+type WeightTrend string
+
+const (
+	WeightDown WeightTrend = "down"
+	WeightSame WeightTrend = "same"
+	WeightUp   WeightTrend = "up"
+)
+
+// Pain is the worst discomfort felt during or after workouts
+type Pain string
+
+const (
+	PainNone  Pain = "none"
+	PainMild  Pain = "mild"  // Muscle soreness
+	PainSharp Pain = "sharp" // Joint or sharp pain
+)
+
+// CheckIn is the user's report on the past week
+type CheckIn struct {
+	Adherence  Adherence   `json:"adherence"`
+	Difficulty Difficulty  `json:"difficulty"`
+	Energy     Energy      `json:"energy"`
+	Weight     WeightTrend `json:"weight"`
+	Pain       Pain        `json:"pain"`
+	// Workouts the user logged during the week
+	LoggedWorkouts int `json:"logged_workouts"`
+}
+
+// Adjustment is how the next week changes from the last one
+type Adjustment string
+
+const (
+	AdjustProgress Adjustment = "progress" // More volume or intensity
+	AdjustRepeat   Adjustment = "repeat"   // Same load again
+	AdjustDeload   Adjustment = "deload"   // About half the volume for recovery
+)
+
+// weeksBeforeDeload is how many weeks of progress are followed by a planned deload
+const weeksBeforeDeload = 3
+
+// maxSets caps the sets of an exercise however far the plan progresses
+const maxSets = 5
+
+// Progression describes a week of the program relative to the first one
+type Progression struct {
+	Week        int        `json:"week"`         // Starting at 1
+	Load        int        `json:"load"`         // Progress steps since the first week
+	SinceDeload int        `json:"since_deload"` // Progress weeks since the last deload
+	Adjustment  Adjustment `json:"adjustment"`
+	Reasons     []string   `json:"reasons"`
+}
+
+// Decide applies the progressive overload and deload rules to the check-in
+// of a user with the goal and returns the progression of the next week
+func Decide(c CheckIn, goal nutrition.Goal, previous Progression) Progression {
+	next := Progression{
+		Week:        previous.Week + 1,
+		Load:        previous.Load,
+		SinceDeload: previous.SinceDeload,
+	}
+	if previous.Week == 0 {
+		next.Week = 2 // The first plan is week 1
+	}
+
+	var deload, repeat []string
+	if c.Pain == PainSharp {
+		deload = append(deload, "sharp or joint pain was reported")
+	}
+	if c.Difficulty == DifficultyTooHard {
+		deload = append(deload, "the workouts felt too hard")
+	}
+	if c.Energy == EnergyLow && c.Difficulty == DifficultyHard {
+		deload = append(deload, "hard workouts together with low energy point to fatigue")
+	}
+	if previous.SinceDeload >= weeksBeforeDeload {
+		deload = append(deload, fmt.Sprintf("%d weeks of progress are followed by a planned recovery week", weeksBeforeDeload))
+	}
+
+	if c.Adherence == AdherenceHalf || c.Adherence == AdherenceLow {
+		repeat = append(repeat, "not all planned workouts were done")
+	}
+	if c.Difficulty == DifficultyHard {
+		repeat = append(repeat, "the workouts felt hard")
+	}
+	if c.Energy == EnergyLow {
+		repeat = append(repeat, "energy was low")
+	}
+	if c.Pain == PainMild {
+		repeat = append(repeat, "there was muscle soreness")
+	}
+	// The answers alone don't show that the workouts were done
+	if c.LoggedWorkouts == 0 {
+		repeat = append(repeat, "no workouts were logged with /log")
+	}
+	if c.Weight == WeightDown && goal == nutrition.GoalMuscleGain {
+		repeat = append(repeat, "weight went down while building muscle, so eating enough comes before more load")
+	}
+
+	switch {
+	case len(deload) > 0:
+		next.Adjustment = AdjustDeload
+		next.Reasons = deload
+		next.SinceDeload = 0
+	case len(repeat) > 0:
+		next.Adjustment = AdjustRepeat
+		next.Reasons = repeat
+	default:
+		next.Adjustment = AdjustProgress
+		next.Load++
+		next.Reasons = []string{"the planned workouts were done without problems"}
+		if c.Difficulty == DifficultyEasy {
+			next.Load++
+			next.Reasons = []string{"the planned workouts were done and felt easy"}
+		}
+		next.SinceDeload++
+	}
+	return next
+}
+
+// Instructions explains the adjustment to a coach or language model
+func (p Progression) Instructions() string {
+	reasons := strings.Join(p.Reasons, "; ")
+	switch p.Adjustment {
+	case AdjustDeload:
+		return fmt.Sprintf("Make week %d a deload week: keep the same exercises, cut the sets by about half, "+
+			"lower the weights by 20-30%% and shorten cardio by about a third. Reason: %s.", p.Week, reasons)
+	case AdjustRepeat:
+		return fmt.Sprintf("Keep the load of week %d the same as the previous week so the user can adapt; "+
+			"you may swap exercises that caused problems for easier variations. Reason: %s.", p.Week, reasons)
+	default:
+		return fmt.Sprintf("Apply progressive overload in week %d: add one set or 1-2 repetitions to the main exercises, "+
+			"or about 5%% more weight, and lengthen cardio by 2-5 minutes. Change only one variable per exercise. Reason: %s.", p.Week, reasons)
+	}
+}
+
+// Apply returns the plan with the progression's load. Every two progress steps
+// add a set, every step lengthens timed exercises and cardio. A deload halves the volume.
+func (p Plan) Apply(pr Progression) Plan {
+	result := Plan{Profile: p.Profile, Tips: p.Tips}
+	for _, day := range p.Days {
+		if day.Rest() {
+			result.Days = append(result.Days, day)
+			continue
+		}
+
+		adjusted := day
+		adjusted.Exercises = make([]Prescription, len(day.Exercises))
+		for i, rx := range day.Exercises {
+			rx = progress(rx, pr.Load)
+			if pr.Adjustment == AdjustDeload {
+				rx = deload(rx)
+			}
+			adjusted.Exercises[i] = rx
+			adjusted.Minutes += estimateMinutes(rx) - estimateMinutes(day.Exercises[i])
+		}
+		result.Days = append(result.Days, adjusted)
+	}
+
+	if pr.Adjustment == AdjustDeload {
+		result.Tips = append([]string{"This is a recovery week: use lighter weights, stop every set well before failure and focus on sleep"}, result.Tips...)
+	}
+	return result
+}
+
+// progress increases the volume of an exercise by the given steps
+func progress(rx Prescription, steps int) Prescription {
+	if steps <= 0 {
+		return rx
+	}
+
+	var amount int
+	switch {
+	case rx.Exercise.Pattern == PatternCardio && rx.Sets == 1:
+		if _, err := fmt.Sscanf(rx.Dose, "%d min", &amount); err == nil {
+			rx.Dose = fmt.Sprintf("%d min", amount+min(2*steps, 20))
+		}
+	case rx.Exercise.Pattern == PatternCardio && rx.Dose != "45 s":
+		rx.Sets += min(steps, 6) // Interval rounds
+	case rx.Exercise.Pattern == PatternMobility:
+		// Mobility work doesn't need overload
+	case rx.Exercise.Timed:
+		if _, err := fmt.Sscanf(rx.Dose, "%d s", &amount); err == nil {
+			rx.Dose = fmt.Sprintf("%d s", amount+min(5*steps, 30))
+		}
+		rx.Sets = min(rx.Sets+steps/2, maxSets)
+	default:
+		rx.Sets = min(rx.Sets+steps/2, maxSets)
+	}
+	return rx
+}
+
+// deload halves the volume of an exercise
+func deload(rx Prescription) Prescription {
+	var minutes int
+	if rx.Exercise.Pattern == PatternCardio && rx.Sets == 1 {
+		if _, err := fmt.Sscanf(rx.Dose, "%d min", &minutes); err == nil {
+			rx.Dose = fmt.Sprintf("%d min", max(minutes*2/3, 5))
+		}
+		return rx
+	}
+	if rx.Exercise.Pattern != PatternMobility {
+		rx.Sets = max(rx.Sets-rx.Sets/2, 1)
+	}
+	return rx
+}
@@ -0,0 +1,163 @@
+package workout
+
+import (
+	"strings"
+	"testing"
+
+	"RestApiServer/Tg-bot/nutrition"
+)
+
+// goodWeek is a check-in without any reason to hold back
+var goodWeek = CheckIn{
+	Adherence:      AdherenceAll,
+	Difficulty:     DifficultyRight,
+	Energy:         EnergyNormal,
+	Weight:         WeightSame,
+	Pain:           PainNone,
+	LoggedWorkouts: 3,
+}
+
+func TestDecideUsesLogsAndWeight(t *testing.T) {
+	previous := Progression{Week: 2, Load: 1, SinceDeload: 1}
+	tests := []struct {
+		name   string
+		change func(*CheckIn)
+		goal   nutrition.Goal
+		want   Adjustment
+		reason string
+	}{
+		{"logged workouts", func(c *CheckIn) {}, nutrition.GoalMaintenance, AdjustProgress, ""},
+		{"nothing logged", func(c *CheckIn) { c.LoggedWorkouts = 0 }, nutrition.GoalMaintenance, AdjustRepeat, "no workouts were logged"},
+		{"nothing logged but easy", func(c *CheckIn) { c.LoggedWorkouts, c.Difficulty = 0, DifficultyEasy }, nutrition.GoalMaintenance, AdjustRepeat, "no workouts were logged"},
+		{"losing weight while building muscle", func(c *CheckIn) { c.Weight = WeightDown }, nutrition.GoalMuscleGain, AdjustRepeat, "weight went down"},
+		{"losing weight to lose weight", func(c *CheckIn) { c.Weight = WeightDown }, nutrition.GoalWeightLoss, AdjustProgress, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := goodWeek
+			tt.change(&c)
+			got := Decide(c, tt.goal, previous)
+			if got.Adjustment != tt.want || !strings.Contains(strings.Join(got.Reasons, "; "), tt.reason) {
+				t.Errorf("Decide() = %s because %q, want %s because %q", got.Adjustment, got.Reasons, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(*CheckIn)
+		previous Progression
+		want     Progression // Reasons are only checked to be given
+	}{
+		{"first check-in", func(c *CheckIn) {}, Progression{}, Progression{Week: 2, Load: 1, SinceDeload: 1, Adjustment: AdjustProgress}},
+		{"good week", func(c *CheckIn) {}, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 2, SinceDeload: 2, Adjustment: AdjustProgress}},
+		{"easy week", func(c *CheckIn) { c.Difficulty = DifficultyEasy }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 3, SinceDeload: 2, Adjustment: AdjustProgress}},
+		{"most workouts done", func(c *CheckIn) { c.Adherence = AdherenceMost }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 2, SinceDeload: 2, Adjustment: AdjustProgress}},
+		{"last week before deload", func(c *CheckIn) {}, Progression{Week: 3, Load: 2, SinceDeload: weeksBeforeDeload - 1}, Progression{Week: 4, Load: 3, SinceDeload: weeksBeforeDeload, Adjustment: AdjustProgress}},
+
+		{"half of the workouts", func(c *CheckIn) { c.Adherence = AdherenceHalf }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 1, SinceDeload: 1, Adjustment: AdjustRepeat}},
+		{"few workouts", func(c *CheckIn) { c.Adherence = AdherenceLow }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 1, SinceDeload: 1, Adjustment: AdjustRepeat}},
+		{"hard", func(c *CheckIn) { c.Difficulty = DifficultyHard }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 1, SinceDeload: 1, Adjustment: AdjustRepeat}},
+		{"low energy", func(c *CheckIn) { c.Energy = EnergyLow }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 1, SinceDeload: 1, Adjustment: AdjustRepeat}},
+		{"soreness", func(c *CheckIn) { c.Pain = PainMild }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 1, SinceDeload: 1, Adjustment: AdjustRepeat}},
+		{"first check-in repeated", func(c *CheckIn) { c.Adherence = AdherenceHalf }, Progression{}, Progression{Week: 2, Adjustment: AdjustRepeat}},
+
+		{"sharp pain", func(c *CheckIn) { c.Pain = PainSharp }, Progression{Week: 3, Load: 2, SinceDeload: 2}, Progression{Week: 4, Load: 2, Adjustment: AdjustDeload}},
+		{"too hard", func(c *CheckIn) { c.Difficulty = DifficultyTooHard }, Progression{Week: 3, Load: 2, SinceDeload: 2}, Progression{Week: 4, Load: 2, Adjustment: AdjustDeload}},
+		{"hard with low energy", func(c *CheckIn) { c.Difficulty, c.Energy = DifficultyHard, EnergyLow }, Progression{Week: 3, Load: 2, SinceDeload: 2}, Progression{Week: 4, Load: 2, Adjustment: AdjustDeload}},
+		{"planned deload", func(c *CheckIn) {}, Progression{Week: 4, Load: 3, SinceDeload: weeksBeforeDeload}, Progression{Week: 5, Load: 3, Adjustment: AdjustDeload}},
+		{"deload over repeat", func(c *CheckIn) { c.Pain, c.Adherence = PainSharp, AdherenceLow }, Progression{Week: 2, Load: 1, SinceDeload: 1}, Progression{Week: 3, Load: 1, Adjustment: AdjustDeload}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := goodWeek
+			tt.change(&c)
+			got := Decide(c, nutrition.GoalMaintenance, tt.previous)
+			if len(got.Reasons) == 0 {
+				t.Errorf("Decide() gives no reasons for %s", got.Adjustment)
+			}
+			got.Reasons = nil
+			if got.Week != tt.want.Week || got.Load != tt.want.Load || got.SinceDeload != tt.want.SinceDeload || got.Adjustment != tt.want.Adjustment {
+				t.Errorf("Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	squat := Exercise{ID: "squat", Pattern: PatternSquat}
+	plank := Exercise{ID: "plank", Pattern: PatternCore, Timed: true}
+	walk := Exercise{ID: "walk", Pattern: PatternCardio, Steady: true}
+	intervals := Exercise{ID: "intervals", Pattern: PatternCardio}
+	stretch := Exercise{ID: "stretch", Pattern: PatternMobility}
+	base := Plan{
+		Days: []Day{
+			{Name: "Monday", Exercises: []Prescription{
+				{Exercise: squat, Sets: 3, Dose: "10"},
+				{Exercise: plank, Sets: 2, Dose: "30 s"},
+				{Exercise: walk, Sets: 1, Dose: "20 min"},
+				{Exercise: intervals, Sets: 6, Dose: "30 s"},
+				{Exercise: stretch, Sets: 1, Dose: "60 s"},
+			}},
+			{Name: "Tuesday", Focus: "Rest"},
+		},
+		Tips: []string{"Drink water"},
+	}
+	base.Days[0].Minutes = 40
+
+	tests := []struct {
+		name        string
+		progression Progression
+		want        []Prescription
+	}{
+		{"first week", Progression{Adjustment: AdjustProgress}, base.Days[0].Exercises},
+		{"one step", Progression{Load: 1, Adjustment: AdjustProgress}, []Prescription{
+			{Exercise: squat, Sets: 3, Dose: "10"}, // A set every two steps
+			{Exercise: plank, Sets: 2, Dose: "35 s"},
+			{Exercise: walk, Sets: 1, Dose: "22 min"},
+			{Exercise: intervals, Sets: 7, Dose: "30 s"},
+			{Exercise: stretch, Sets: 1, Dose: "60 s"},
+		}},
+		{"many steps are capped", Progression{Load: 20, Adjustment: AdjustProgress}, []Prescription{
+			{Exercise: squat, Sets: maxSets, Dose: "10"},
+			{Exercise: plank, Sets: maxSets, Dose: "60 s"},
+			{Exercise: walk, Sets: 1, Dose: "40 min"},
+			{Exercise: intervals, Sets: 12, Dose: "30 s"},
+			{Exercise: stretch, Sets: 1, Dose: "60 s"},
+		}},
+		{"deload", Progression{Load: 2, Adjustment: AdjustDeload}, []Prescription{
+			{Exercise: squat, Sets: 2, Dose: "10"}, // 4 sets halved
+			{Exercise: plank, Sets: 2, Dose: "40 s"},
+			{Exercise: walk, Sets: 1, Dose: "16 min"},
+			{Exercise: intervals, Sets: 4, Dose: "30 s"},
+			{Exercise: stretch, Sets: 1, Dose: "60 s"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := base.Apply(tt.progression)
+			for i, rx := range got.Days[0].Exercises {
+				if rx.Sets != tt.want[i].Sets || rx.Dose != tt.want[i].Dose {
+					t.Errorf("%s: %d x %s, want %d x %s", rx.Exercise.ID, rx.Sets, rx.Dose, tt.want[i].Sets, tt.want[i].Dose)
+				}
+			}
+			if !got.Days[1].Rest() {
+				t.Errorf("rest day got exercises: %+v", got.Days[1])
+			}
+			deloadTip := strings.Contains(got.Tips[0], "recovery week")
+			if deloadTip != (tt.progression.Adjustment == AdjustDeload) || len(got.Tips) < len(base.Tips) {
+				t.Errorf("tips = %q", got.Tips)
+			}
+		})
+	}
+
+	// The base plan is not changed
+	if rx := base.Days[0].Exercises[0]; rx.Sets != 3 || base.Days[0].Minutes != 40 {
+		t.Errorf("Apply changed the base plan: %+v", base.Days[0])
+	}
+	if got := base.Apply(Progression{Load: 4, Adjustment: AdjustProgress}); got.Days[0].Minutes <= base.Days[0].Minutes {
+		t.Errorf("minutes didn't grow with the load: %d", got.Days[0].Minutes)
+	}
+}
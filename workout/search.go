@@ -0,0 +1,218 @@
+// search.go
+package workout
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Match is an exercise found by Search
+type Match struct {
+	Exercise Exercise
+	Score    float64 // 1 for an exact name or alias, lower for partial and misspelled matches
+}
+
+// minMatchScore drops matches that share too little with the query
+const minMatchScore = 0.35
+
+// phrase is a tokenized name or alias of a library exercise
+type phrase struct {
+	tokens   []string
+	exercise int // Index in Library
+}
+
+// phrases holds the names and aliases of the library, longest first
+var phrases = indexPhrases(Library)
+
+func indexPhrases(library []Exercise) []phrase {
+	var result []phrase
+	for i, e := range library {
+		for _, name := range append([]string{e.Name}, e.Aliases...) {
+			result = append(result, phrase{tokens: tokenize(name), exercise: i})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i].tokens) > len(result[j].tokens)
+	})
+	return result
+}
+
+// Search returns up to limit exercises whose name or an alias resembles
+// the query, best first. It tolerates plurals, hyphens and typos.
+func Search(query string, limit int) []Match {
+	words := tokenize(query)
+	if len(words) == 0 {
+		return nil
+	}
+
+	best := make(map[int]float64)
+	for _, p := range phrases {
+		if score := phraseScore(words, p.tokens); score > best[p.exercise] {
+			best[p.exercise] = score
+		}
+	}
+
+	var matches []Match
+	for i, score := range best {
+		if score >= minMatchScore {
+			matches = append(matches, Match{Exercise: Library[i], Score: score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Exercise.Name < matches[j].Exercise.Name
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// Mentions returns the library exercises named in a text such as a plan,
+// in the order of their first mention. Longer names win, so "side plank"
+// isn't also reported as "plank".
+func Mentions(text string) []Exercise {
+	words := tokenize(text)
+	used := make([]bool, len(words))
+	first := make(map[int]int) // Exercise index to position of the first mention
+
+	for _, p := range phrases {
+		for start := 0; start+len(p.tokens) <= len(words); start++ {
+			if !matchesAt(words, used, start, p.tokens) {
+				continue
+			}
+			for i := range p.tokens {
+				used[start+i] = true
+			}
+			if position, ok := first[p.exercise]; !ok || start < position {
+				first[p.exercise] = start
+			}
+		}
+	}
+
+	indexes := make([]int, 0, len(first))
+	for i := range first {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return first[indexes[i]] < first[indexes[j]] })
+
+	result := make([]Exercise, len(indexes))
+	for i, index := range indexes {
+		result[i] = Library[index]
+	}
+	return result
+}
+
+// matchesAt reports whether the unused words at start spell the tokens
+func matchesAt(words []string, used []bool, start int, tokens []string) bool {
+	for i, token := range tokens {
+		if used[start+i] || words[start+i] != token {
+			return false
+		}
+	}
+	return true
+}
+
+// phraseScore compares the query words with a name, from 0 to 1
+func phraseScore(words, tokens []string) float64 {
+	if strings.Join(words, "") == strings.Join(tokens, "") {
+		return 1 // Also matches "pushup" with "push up"
+	}
+
+	taken := make([]bool, len(tokens))
+	var matched float64
+	for _, word := range words {
+		bestIndex, bestScore := -1, 0.0
+		for i, token := range tokens {
+			if taken[i] {
+				continue
+			}
+			if score := wordScore(word, token); score > bestScore {
+				bestIndex, bestScore = i, score
+			}
+		}
+		if bestIndex >= 0 {
+			taken[bestIndex] = true
+			matched += bestScore
+		}
+	}
+	// Short of an exact match, the score stays below 1
+	return 0.95 * 2 * matched / float64(len(words)+len(tokens))
+}
+
+// wordScore compares two words, allowing a typo in longer words
+func wordScore(word, token string) float64 {
+	switch {
+	case word == token:
+		return 1
+	case len(word) >= 3 && strings.HasPrefix(token, word):
+		return 0.9
+	}
+	longest := max(len([]rune(word)), len([]rune(token)))
+	if longest < 5 {
+		return 0
+	}
+	score := 1 - float64(editDistance(word, token))/float64(longest)
+	if score < 0.75 {
+		return 0
+	}
+	return score
+}
+
+// editDistance counts the insertions, deletions, substitutions and
+// transpositions of adjacent letters that turn a into b
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// tokenize splits a text into lowercase singular words,
+// e.g. "Push-ups" into "push" and "up"
+func tokenize(text string) []string {
+	text = strings.NewReplacer("'", "", "’", "").Replace(strings.ToLower(text))
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, field := range fields {
+		fields[i] = singular(field)
+	}
+	return fields
+}
+
+// singular strips common English plural endings
+func singular(word string) string {
+	switch {
+	case len(word) <= 2:
+		return word
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "ches"),
+		strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "xes"):
+		return word[:len(word)-2]
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") &&
+		!strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		return word[:len(word)-1]
+	}
+	return word
+}